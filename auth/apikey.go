@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// HeaderAPIKey carries the API key of a request.
+const HeaderAPIKey = "X-API-Key"
+
+// The scopes of API keys, see MethodScopes.
+const (
+	ScopeCreate = "create"
+	ScopeRead   = "read"
+	ScopeDelete = "delete"
+)
+
+// MethodScopes lists the scopes permitting a tus request method, any of
+// them suffices. HEAD is permitted to create as well so uploads can be
+// resumed.
+var MethodScopes = map[string][]string{
+	http.MethodPost:   {ScopeCreate},
+	http.MethodPatch:  {ScopeCreate},
+	http.MethodHead:   {ScopeCreate, ScopeRead},
+	http.MethodGet:    {ScopeRead},
+	http.MethodDelete: {ScopeDelete},
+}
+
+var (
+	// ErrAPIKeyNotFound is returned by IAPIKeyStore for unknown keys.
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	// ErrForbidden is returned for valid credentials lacking the scope of
+	// the request.
+	ErrForbidden = errors.New("forbidden")
+	// ErrRateLimited is returned for requests exceeding the rate limit of
+	// their credentials.
+	ErrRateLimited = errors.New("rate limit exceeded")
+)
+
+// SAPIKey describes an API key, the key itself is only known to its
+// holder, stores keep its SHA-256 hash.
+type SAPIKey struct {
+	ID string `json:"id"`
+	// Name is the Subject of the identity authenticated by the key.
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// RateLimit is the number of requests per second permitted, bursts of
+	// up to as many requests are allowed. 0 disables the limit.
+	RateLimit float64   `json:"rateLimit,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// IAPIKeyStore looks up API keys.
+type IAPIKeyStore interface {
+	// Lookup returns the API key matching key, ErrAPIKeyNotFound if none.
+	Lookup(ctx context.Context, key string) (SAPIKey, error)
+}
+
+// IAPIKeyManager is a store whose keys can be managed at runtime, e.g. via
+// the admin API.
+type IAPIKeyManager interface {
+	IAPIKeyStore
+	// Create generates a key for apiKey, returned only once.
+	Create(ctx context.Context, apiKey SAPIKey) (string, SAPIKey, error)
+	List(ctx context.Context) ([]SAPIKey, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// HashAPIKey is the hash API keys are stored by.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateAPIKey returns a new random API key.
+func GenerateAPIKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "tusx_" + hex.EncodeToString(b), nil
+}
+
+// SStaticAPIKeys keeps a fixed set of API keys, e.g. from the command line.
+type SStaticAPIKeys struct {
+	keys map[string]SAPIKey
+}
+
+func NewStaticAPIKeys() *SStaticAPIKeys {
+	return &SStaticAPIKeys{keys: make(map[string]SAPIKey)}
+}
+
+func (store *SStaticAPIKeys) Add(key string, apiKey SAPIKey) {
+	store.keys[HashAPIKey(key)] = apiKey
+}
+
+// Parse adds a key given as name:key:scope,...[:rate limit], e.g.
+// ingest:secret:create,read:10.
+func (store *SStaticAPIKeys) Parse(value string) error {
+	parts := strings.Split(value, ":")
+	if len(parts) < 3 || len(parts) > 4 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid API key %q, expected name:key:scope,...[:rate limit]", parts[0])
+	}
+	apiKey := SAPIKey{ID: parts[0], Name: parts[0]}
+	for _, scope := range strings.Split(parts[2], ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			apiKey.Scopes = append(apiKey.Scopes, scope)
+		}
+	}
+	if len(parts) == 4 {
+		rate, err := strconv.ParseFloat(parts[3], 64)
+		if err != nil || rate < 0 {
+			return fmt.Errorf("invalid rate limit of API key %s: %s", parts[0], parts[3])
+		}
+		apiKey.RateLimit = rate
+	}
+	store.Add(parts[1], apiKey)
+	return nil
+}
+
+func (store *SStaticAPIKeys) Lookup(ctx context.Context, key string) (SAPIKey, error) {
+	apiKey, ok := store.keys[HashAPIKey(key)]
+	if !ok {
+		return apiKey, ErrAPIKeyNotFound
+	}
+	return apiKey, nil
+}
+
+// SAPIKeyAuthenticator authenticates requests by the X-API-Key header. The
+// request method has to be permitted by the scopes of the key (see
+// MethodScopes), otherwise ErrForbidden is returned.
+type SAPIKeyAuthenticator struct {
+	stores []IAPIKeyStore
+
+	limitersMu sync.Mutex
+	limiters   map[string]*sLimiter
+}
+
+// NewAPIKeyAuthenticator looks up keys in the stores in order.
+func NewAPIKeyAuthenticator(stores ...IAPIKeyStore) *SAPIKeyAuthenticator {
+	return &SAPIKeyAuthenticator{
+		stores:   stores,
+		limiters: make(map[string]*sLimiter),
+	}
+}
+
+func (authenticator *SAPIKeyAuthenticator) Challenge() string {
+	return "ApiKey"
+}
+
+func (authenticator *SAPIKeyAuthenticator) Authenticate(r *http.Request) (*common.Identity, error) {
+	key := r.Header.Get(HeaderAPIKey)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	apiKey, err := authenticator.lookup(r.Context(), key)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, fmt.Errorf("%w: unknown API key", ErrInvalidCredentials)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &common.Identity{
+		Subject: apiKey.Name,
+		Scopes:  apiKey.Scopes,
+		Claims:  map[string]any{"api_key_id": apiKey.ID},
+	}
+	if !Permitted(identity, RequestMethod(r)) {
+		return nil, fmt.Errorf("%w: API key %s may not %s", ErrForbidden, apiKey.ID, RequestMethod(r))
+	}
+	if !authenticator.allow(apiKey) {
+		return nil, ErrRateLimited
+	}
+	return identity, nil
+}
+
+func (authenticator *SAPIKeyAuthenticator) lookup(ctx context.Context, key string) (SAPIKey, error) {
+	for _, store := range authenticator.stores {
+		apiKey, err := store.Lookup(ctx, key)
+		if !errors.Is(err, ErrAPIKeyNotFound) {
+			return apiKey, err
+		}
+	}
+	return SAPIKey{}, ErrAPIKeyNotFound
+}
+
+// allow 按密钥限流, 修改限额后重新计数
+func (authenticator *SAPIKeyAuthenticator) allow(apiKey SAPIKey) bool {
+	if apiKey.RateLimit <= 0 {
+		return true
+	}
+	authenticator.limitersMu.Lock()
+	limiter, ok := authenticator.limiters[apiKey.ID]
+	if !ok || limiter.rate != apiKey.RateLimit {
+		limiter = newLimiter(apiKey.RateLimit, max(apiKey.RateLimit, 1))
+		authenticator.limiters[apiKey.ID] = limiter
+	}
+	authenticator.limitersMu.Unlock()
+	return limiter.allow()
+}
+
+// Permitted reports whether the scopes of identity permit the request
+// method, see MethodScopes.
+func Permitted(identity *common.Identity, method string) bool {
+	return slices.ContainsFunc(MethodScopes[method], identity.HasScope)
+}
+
+// RequestMethod is the method of r as seen by the tus handler, which
+// honors X-HTTP-Method-Override for POST requests. If the handler ignores
+// the header, IgnoreMethodOverride has to remove it first.
+func RequestMethod(r *http.Request) string {
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && r.Method == http.MethodPost {
+		return strings.ToUpper(override)
+	}
+	return r.Method
+}
+
+// IgnoreMethodOverride removes the X-HTTP-Method-Override header before
+// passing requests to next. It has to wrap the middlewares of this package
+// when the tus handler is configured to ignore the header, otherwise they
+// would check another method than the handler serves.
+func IgnoreMethodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("X-HTTP-Method-Override")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// apiKeyRecord API密钥表的模型, 只保存密钥的哈希
+type apiKeyRecord struct {
+	ID        string  `gorm:"primaryKey;size:64"`
+	Hash      string  `gorm:"size:64;uniqueIndex;comment:密钥的SHA-256"`
+	Name      string  `gorm:"size:255;comment:名称"`
+	Scopes    string  `gorm:"size:255;comment:权限, 空格分隔"`
+	RateLimit float64 `gorm:"comment:每秒请求数"`
+	CreatedAt time.Time
+}
+
+// TableName 指定表名
+func (apiKeyRecord) TableName() string {
+	return "api_keys"
+}
+
+func (record apiKeyRecord) apiKey() SAPIKey {
+	return SAPIKey{
+		ID:        record.ID,
+		Name:      record.Name,
+		Scopes:    strings.Fields(record.Scopes),
+		RateLimit: record.RateLimit,
+		CreatedAt: record.CreatedAt,
+	}
+}
+
+// SGormAPIKeys keeps API keys in the api_keys table of a database, e.g.
+// the metadata database of the file store, so they can be managed at
+// runtime and are shared by all instances of the server.
+type SGormAPIKeys struct {
+	db *gorm.DB
+}
+
+// NewGormAPIKeys creates the table if needed.
+func NewGormAPIKeys(db *gorm.DB) (*SGormAPIKeys, error) {
+	if err := db.AutoMigrate(&apiKeyRecord{}); err != nil {
+		return nil, err
+	}
+	return &SGormAPIKeys{db: db}, nil
+}
+
+func (store *SGormAPIKeys) Lookup(ctx context.Context, key string) (SAPIKey, error) {
+	// 未知的密钥很常见, 不用Take以免记录not found日志
+	var record apiKeyRecord
+	result := store.db.WithContext(ctx).Where("hash = ?", HashAPIKey(key)).Limit(1).Find(&record)
+	if result.Error != nil {
+		return SAPIKey{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return SAPIKey{}, ErrAPIKeyNotFound
+	}
+	return record.apiKey(), nil
+}
+
+func (store *SGormAPIKeys) Create(ctx context.Context, apiKey SAPIKey) (string, SAPIKey, error) {
+	key, err := GenerateAPIKey()
+	if err != nil {
+		return "", apiKey, err
+	}
+	record := apiKeyRecord{
+		ID:        common.Uid(),
+		Hash:      HashAPIKey(key),
+		Name:      apiKey.Name,
+		Scopes:    strings.Join(apiKey.Scopes, " "),
+		RateLimit: apiKey.RateLimit,
+		CreatedAt: time.Now(),
+	}
+	if err = store.db.WithContext(ctx).Create(&record).Error; err != nil {
+		return "", apiKey, err
+	}
+	return key, record.apiKey(), nil
+}
+
+func (store *SGormAPIKeys) List(ctx context.Context) ([]SAPIKey, error) {
+	var records []apiKeyRecord
+	if err := store.db.WithContext(ctx).Order("created_at").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	apiKeys := make([]SAPIKey, 0, len(records))
+	for _, record := range records {
+		apiKeys = append(apiKeys, record.apiKey())
+	}
+	return apiKeys, nil
+}
+
+func (store *SGormAPIKeys) Delete(ctx context.Context, id string) error {
+	result := store.db.WithContext(ctx).Where("id = ?", id).Delete(&apiKeyRecord{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Package auth authenticates the requests to the tus handler and makes the
+// identity of the client available via common.IdentityFromContext.
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+var (
+	// ErrNoCredentials is returned by authenticators for requests without
+	// credentials of their kind, the next authenticator is tried then.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned for credentials which are present
+	// but not valid.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// IAuthenticator authenticates a request by one kind of credentials.
+type IAuthenticator interface {
+	// Authenticate returns the identity of the client, ErrNoCredentials if
+	// the request has none of the credentials handled by the authenticator.
+	Authenticate(r *http.Request) (*common.Identity, error)
+	// Challenge is the value of the WWW-Authenticate header of 401
+	// responses, e.g. Bearer, empty for none.
+	Challenge() string
+}
+
+// Handler authenticates every request before passing it to next, which
+// gets the identity via common.IdentityFromContext. The authenticators are
+// tried in order until one finds its credentials, requests without valid
+// credentials are answered with 401. OPTIONS requests pass without
+// credentials, clients use them to discover the server's capabilities, as
+// do requests authenticated by an outer middleware, e.g. SSignedURLs.
+func Handler(next http.Handler, authenticators ...IAuthenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || common.IdentityFromContext(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		identity, err := Authenticate(r, authenticators...)
+		switch {
+		case errors.Is(err, ErrForbidden):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, ErrRateLimited):
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		case err != nil:
+			for _, authenticator := range authenticators {
+				if challenge := authenticator.Challenge(); challenge != "" {
+					w.Header().Add("WWW-Authenticate", challenge)
+				}
+			}
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(common.WithIdentity(r.Context(), identity)))
+	})
+}
+
+// Authenticate tries the authenticators in order, it returns
+// ErrNoCredentials if none of them found credentials.
+func Authenticate(r *http.Request, authenticators ...IAuthenticator) (*common.Identity, error) {
+	for _, authenticator := range authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// bearerToken 读取Authorization: Bearer <token>
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// SBasicAuthenticator authenticates requests by HTTP Basic credentials, for
+// small deployments without an identity provider. Browsers ask for the
+// credentials themselves and send them with every request of the page,
+// so it can protect the web page as well. The user name becomes the
+// Subject of the identity, users may be assigned roles, see SRBAC.
+type SBasicAuthenticator struct {
+	// Realm is shown by browsers when asking for credentials.
+	Realm string
+
+	mu sync.RWMutex
+	// users 用户名到sha256(明文密码)或bcrypt哈希
+	users map[string]sBasicUser
+	// verified 校验通过的bcrypt凭据的sha256, 避免每个请求都计算bcrypt
+	verified map[[sha256.Size]byte]struct{}
+}
+
+type sBasicUser struct {
+	digest [sha256.Size]byte
+	hash   []byte
+	roles  []string
+}
+
+func NewBasicAuthenticator(realm string) *SBasicAuthenticator {
+	return &SBasicAuthenticator{
+		Realm:    realm,
+		users:    make(map[string]sBasicUser),
+		verified: make(map[[sha256.Size]byte]struct{}),
+	}
+}
+
+// Parse adds a user given as user:password[:role,...], the password can't
+// contain a colon.
+func (authenticator *SBasicAuthenticator) Parse(value string) error {
+	fields := strings.SplitN(value, ":", 3)
+	if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+		return fmt.Errorf("invalid basic auth user %q, expected user:password[:role,...]", fields[0])
+	}
+	user := sBasicUser{digest: sha256.Sum256([]byte(fields[1]))}
+	if len(fields) == 3 {
+		user.roles = splitRoles(fields[2])
+	}
+	authenticator.mu.Lock()
+	defer authenticator.mu.Unlock()
+	authenticator.users[fields[0]] = user
+	return nil
+}
+
+// LoadFile adds the users of an htpasswd file with bcrypt hashes, as
+// created by htpasswd -B, their roles may be appended to the lines as
+// user:hash:role,... Empty lines and lines starting with # are skipped.
+func (authenticator *SBasicAuthenticator) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	authenticator.mu.Lock()
+	defer authenticator.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return fmt.Errorf("%s:%d: expected user:bcrypt hash", path, line)
+		}
+		if _, err = bcrypt.Cost([]byte(fields[1])); err != nil {
+			return fmt.Errorf("%s:%d: expected user:bcrypt hash", path, line)
+		}
+		user := sBasicUser{hash: []byte(fields[1])}
+		if len(fields) == 3 {
+			user.roles = splitRoles(fields[2])
+		}
+		authenticator.users[fields[0]] = user
+	}
+	return scanner.Err()
+}
+
+func (authenticator *SBasicAuthenticator) Challenge() string {
+	realm := authenticator.Realm
+	if realm == "" {
+		realm = "tusx"
+	}
+	return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm)
+}
+
+func (authenticator *SBasicAuthenticator) Authenticate(r *http.Request) (*common.Identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	authenticator.mu.RLock()
+	entry, found := authenticator.users[user]
+	authenticator.mu.RUnlock()
+	if !found {
+		// 未知用户同样计算一次比较, 不泄露用户是否存在
+		entry = sBasicUser{}
+	}
+
+	digest := sha256.Sum256([]byte(password))
+	valid := subtle.ConstantTimeCompare(digest[:], entry.digest[:]) == 1
+	if entry.hash != nil {
+		valid = authenticator.verifyHash(user, password, entry.hash)
+	}
+	if !found || !valid {
+		return nil, fmt.Errorf("%w: wrong user or password", ErrInvalidCredentials)
+	}
+	return &common.Identity{Subject: user, Roles: entry.roles, Claims: map[string]any{"auth": "basic"}}, nil
+}
+
+func splitRoles(value string) []string {
+	var roles []string
+	for _, role := range strings.Split(value, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// verifyHash 校验bcrypt哈希, 结果按用户名和密码缓存
+func (authenticator *SBasicAuthenticator) verifyHash(user, password string, hash []byte) bool {
+	key := sha256.Sum256([]byte(user + ":" + password + ":" + string(hash)))
+	authenticator.mu.RLock()
+	_, ok := authenticator.verified[key]
+	authenticator.mu.RUnlock()
+	if ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	authenticator.mu.Lock()
+	authenticator.verified[key] = struct{}{}
+	authenticator.mu.Unlock()
+	return true
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// ErrInvalidCSRFToken is returned for state-changing requests of browsers
+// without a valid CSRF token.
+var ErrInvalidCSRFToken = errors.New("invalid CSRF token")
+
+// SCSRF protects cookie authenticated browser uploads against cross-site
+// request forgery with signed double-submit tokens: the page gets a token
+// in a cookie readable by its scripts (see Issue), which have to send it
+// back in the CSRF header of POST, PATCH, PUT and DELETE requests.
+//
+// Only requests carrying credentials a browser sends on its own are
+// checked: one of SessionCookies, or Basic credentials of a browser request
+// (one with an Origin or Sec-Fetch-Site header). Clients sending bearer
+// tokens or API keys, and requests authenticated by an outer middleware,
+// e.g. SSignedURLs, pass unchecked.
+type SCSRF struct {
+	// Secret signs the tokens, tokens of other instances are only accepted
+	// if they share it.
+	Secret []byte
+	// SessionCookies names the cookies authenticating requests, e.g. the
+	// session cookie of SOIDC.
+	SessionCookies []string
+	// CookieName of the token, tusx_csrf if empty.
+	CookieName string
+	// HeaderName of the token, X-CSRF-Token if empty.
+	HeaderName string
+}
+
+func (csrf *SCSRF) cookieName() string {
+	if csrf.CookieName != "" {
+		return csrf.CookieName
+	}
+	return "tusx_csrf"
+}
+
+func (csrf *SCSRF) headerName() string {
+	if csrf.HeaderName != "" {
+		return csrf.HeaderName
+	}
+	return "X-CSRF-Token"
+}
+
+// Issue sets the token cookie unless the request already has a valid one,
+// call it when serving the page.
+func (csrf *SCSRF) Issue(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(csrf.cookieName()); err == nil && csrf.valid(cookie.Value) {
+		return
+	}
+	nonce := randomString()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrf.cookieName(),
+		Value:    nonce + "." + csrf.sign(nonce),
+		Path:     "/",
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Handler checks the token of state-changing browser requests before
+// passing them to next, requests without valid token are answered with 403.
+func (csrf *SCSRF) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !csrf.protected(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := r.Cookie(csrf.cookieName())
+		token := r.Header.Get(csrf.headerName())
+		if err != nil || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 || !csrf.valid(token) {
+			http.Error(w, ErrInvalidCSRFToken.Error()+", please reload the page", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// protected 只检查修改状态且带有浏览器自动发送的凭据的请求
+func (csrf *SCSRF) protected(r *http.Request) bool {
+	if !slices.Contains([]string{http.MethodPost, http.MethodPatch, http.MethodPut, http.MethodDelete}, RequestMethod(r)) {
+		return false
+	}
+	if common.IdentityFromContext(r.Context()) != nil {
+		return false
+	}
+	for _, name := range csrf.SessionCookies {
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+			return true
+		}
+	}
+	scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return strings.EqualFold(scheme, "Basic") && (r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != "")
+}
+
+// valid 校验令牌的签名
+func (csrf *SCSRF) valid(token string) bool {
+	nonce, signature, ok := strings.Cut(token, ".")
+	return ok && nonce != "" && hmac.Equal([]byte(signature), []byte(csrf.sign(nonce)))
+}
+
+func (csrf *SCSRF) sign(nonce string) string {
+	mac := hmac.New(sha256.New, csrf.Secret)
+	mac.Write([]byte("csrf:" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewCSRFSecret returns a random secret for SCSRF, for a single instance
+// whose tokens may be invalidated by restarts.
+func NewCSRFSecret() []byte {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return secret
+}
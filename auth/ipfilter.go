@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// SIPFilter admits requests by the IP address of the client. Behind a
+// PROXY protocol listener the address of the request already is the one
+// of the client, behind HTTP proxies it is taken from X-Forwarded-For,
+// but only if the request comes from TrustedProxies, the header is set by
+// clients otherwise.
+type SIPFilter struct {
+	// Allow lists the admitted networks, all if empty.
+	Allow []netip.Prefix
+	// Deny lists the rejected networks, it takes precedence over Allow.
+	Deny           []netip.Prefix
+	TrustedProxies []netip.Prefix
+}
+
+// ParsePrefixes parses CIDRs, e.g. 10.0.0.0/8, or single addresses, each
+// value may contain several separated by commas.
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			if !strings.Contains(field, "/") {
+				addr, err := netip.ParseAddr(field)
+				if err != nil {
+					return nil, fmt.Errorf("invalid address %q: %w", field, err)
+				}
+				addr = addr.Unmap()
+				prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", field, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return prefixes, nil
+}
+
+// ClientIP returns the address of the client, the last one in
+// X-Forwarded-For not belonging to a trusted proxy if the request comes
+// from one.
+func (filter *SIPFilter) ClientIP(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote address %q", r.RemoteAddr)
+	}
+	addr = addr.Unmap()
+	if !contains(filter.TrustedProxies, addr) {
+		return addr, nil
+	}
+
+	// 从右向左跳过可信的代理, 左侧的地址可能由客户端伪造
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid X-Forwarded-For address %q", forwarded[i])
+		}
+		addr = hop.Unmap()
+		if !contains(filter.TrustedProxies, addr) {
+			break
+		}
+	}
+	return addr, nil
+}
+
+// Permitted reports whether addr is allowed and not denied.
+func (filter *SIPFilter) Permitted(addr netip.Addr) bool {
+	if contains(filter.Deny, addr) {
+		return false
+	}
+	return len(filter.Allow) == 0 || contains(filter.Allow, addr)
+}
+
+// Handler answers the requests of clients which aren't permitted with 403
+// before passing the others to next.
+func (filter *SIPFilter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := filter.ClientIP(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !filter.Permitted(addr) {
+			http.Error(w, "Forbidden: address "+addr.String()+" is not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
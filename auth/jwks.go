@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMaxAge 密钥集的缓存时间
+	jwksMaxAge = time.Hour
+	// jwksMinRefresh 遇到未知kid时重新获取的最小间隔, 避免伪造的kid导致频繁请求
+	jwksMinRefresh = time.Minute
+)
+
+// SJWKS fetches the RSA signing keys of a JSON Web Key Set, e.g. published
+// by an OpenID provider. Keys are cached for an hour and fetched again
+// early when a token names an unknown key, at most once a minute.
+type SJWKS struct {
+	URL    string
+	Client *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+func NewJWKS(url string) *SJWKS {
+	return &SJWKS{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Key returns the key with the ID kid, or the only key of the set if kid
+// is empty.
+func (jwks *SJWKS) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	jwks.mu.Lock()
+	defer jwks.mu.Unlock()
+
+	key, ok := jwks.lookup(kid)
+	if (!ok || time.Since(jwks.fetchedAt) > jwksMaxAge) && time.Since(jwks.attemptedAt) > jwksMinRefresh {
+		jwks.attemptedAt = time.Now()
+		if err := jwks.fetch(ctx); err != nil {
+			// 获取失败时继续使用缓存的密钥
+			if !ok {
+				return nil, err
+			}
+		} else {
+			key, ok = jwks.lookup(kid)
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidCredentials, kid)
+	}
+	return key, nil
+}
+
+func (jwks *SJWKS) lookup(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(jwks.keys) == 1 {
+		for _, key := range jwks.keys {
+			return key, true
+		}
+	}
+	key, ok := jwks.keys[kid]
+	return key, ok
+}
+
+func (jwks *SJWKS) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwks.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := jwks.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		// 只支持RSA签名密钥
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return fmt.Errorf("invalid JWKS key %s: %w", jwk.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return fmt.Errorf("invalid JWKS key %s: invalid exponent", jwk.Kid)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	jwks.keys = keys
+	jwks.fetchedAt = time.Now()
+	return nil
+}
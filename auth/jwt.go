@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// ErrTokenExpired is returned for JWTs whose exp claim has passed.
+var ErrTokenExpired = errors.New("token expired")
+
+// SJWTAuthenticator authenticates requests by a JWT in the Authorization:
+// Bearer header, signed with HS256 or RS256. The sub claim becomes the
+// Subject of the identity, the scope (space separated) or scp claims its
+// Scopes.
+type SJWTAuthenticator struct {
+	// Secret verifies HS256 tokens.
+	Secret []byte
+	// PublicKey verifies RS256 tokens.
+	PublicKey *rsa.PublicKey
+	// JWKS verifies RS256 tokens by the key matching their kid header, it
+	// takes precedence over PublicKey.
+	JWKS *SJWKS
+	// Issuer and Audience, if set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// Leeway tolerates clock skew when checking the exp and nbf claims.
+	Leeway time.Duration
+	// ScopeClaim names the claim holding the scopes instead of scope and
+	// scp, e.g. the groups or roles of ID tokens.
+	ScopeClaim string
+}
+
+func (authenticator *SJWTAuthenticator) Challenge() string {
+	return "Bearer"
+}
+
+func (authenticator *SJWTAuthenticator) Authenticate(r *http.Request) (*common.Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	return authenticator.Validate(r.Context(), token)
+}
+
+// Validate verifies the signature and claims of token.
+func (authenticator *SJWTAuthenticator) Validate(ctx context.Context, token string) (*common.Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidCredentials)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed header: %w", ErrInvalidCredentials, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidCredentials)
+	}
+	if err = authenticator.verify(ctx, header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims: %w", ErrInvalidCredentials, err)
+	}
+	return authenticator.identity(claims)
+}
+
+// verify 按alg选择密钥校验签名, 不接受none, HS256只用Secret, 避免以公钥作为HMAC密钥
+func (authenticator *SJWTAuthenticator) verify(ctx context.Context, alg, kid, signed string, signature []byte) error {
+	switch alg {
+	case "HS256":
+		if len(authenticator.Secret) == 0 {
+			return fmt.Errorf("%w: HS256 is not accepted", ErrInvalidCredentials)
+		}
+		mac := hmac.New(sha256.New, authenticator.Secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("%w: signature mismatch", ErrInvalidCredentials)
+		}
+		return nil
+	case "RS256":
+		key := authenticator.PublicKey
+		if authenticator.JWKS != nil {
+			var err error
+			if key, err = authenticator.JWKS.Key(ctx, kid); err != nil {
+				return err
+			}
+		}
+		if key == nil {
+			return fmt.Errorf("%w: RS256 is not accepted", ErrInvalidCredentials)
+		}
+		digest := sha256.Sum256([]byte(signed))
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return fmt.Errorf("%w: signature mismatch", ErrInvalidCredentials)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidCredentials, alg)
+	}
+}
+
+// identity 校验声明并转换为身份
+func (authenticator *SJWTAuthenticator) identity(claims map[string]any) (*common.Identity, error) {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing exp claim", ErrInvalidCredentials)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(authenticator.Leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(authenticator.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("%w: token not valid yet", ErrInvalidCredentials)
+	}
+	if authenticator.Issuer != "" && claims["iss"] != authenticator.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidCredentials)
+	}
+	if authenticator.Audience != "" && !slices.Contains(stringsClaim(claims["aud"]), authenticator.Audience) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidCredentials)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: missing sub claim", ErrInvalidCredentials)
+	}
+
+	identity := &common.Identity{Subject: subject, Claims: claims}
+	if authenticator.ScopeClaim != "" {
+		identity.Scopes = stringsClaim(claims[authenticator.ScopeClaim])
+	} else if scope, ok := claims["scope"].(string); ok {
+		identity.Scopes = strings.Fields(scope)
+	} else {
+		identity.Scopes = stringsClaim(claims["scp"])
+	}
+	return identity, nil
+}
+
+// stringsClaim 声明值可以是字符串或字符串数组, 例如aud
+func stringsClaim(value any) []string {
+	switch value := value.(type) {
+	case string:
+		return strings.Fields(value)
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// LoadRSAPublicKey reads a PEM encoded RSA public key, PKIX or PKCS #1, or
+// the key of a certificate.
+func LoadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	var key any
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key", path)
+	}
+	return rsaKey, nil
+}
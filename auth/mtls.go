@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// The certificate fields SClientCertAuthenticator can take the subject from.
+const (
+	CertSubjectCN    = "cn"
+	CertSubjectDNS   = "dns"
+	CertSubjectEmail = "email"
+	CertSubjectURI   = "uri"
+)
+
+// SClientCertAuthenticator authenticates requests by the client
+// certificate of a mutual TLS connection, verified by the TLS server
+// against the client CAs (see ClientTLSConfig). It has to see the TLS
+// connection itself, certificates verified by a proxy in front of the
+// server aren't supported.
+type SClientCertAuthenticator struct {
+	// SubjectFrom lists the certificate fields the Subject of the identity
+	// is taken from, the first one set is used, by default the common
+	// name and then the DNS names of the subject alternative names.
+	SubjectFrom []string
+}
+
+// Challenge 客户端证书在TLS握手时校验, 没有对应的认证方案
+func (authenticator *SClientCertAuthenticator) Challenge() string {
+	return ""
+}
+
+func (authenticator *SClientCertAuthenticator) Authenticate(r *http.Request) (*common.Identity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, ErrNoCredentials
+	}
+	// 只接受TLS服务器已校验的证书
+	if len(r.TLS.VerifiedChains) == 0 {
+		return nil, fmt.Errorf("%w: client certificate not verified", ErrInvalidCredentials)
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	fields := map[string][]string{
+		CertSubjectCN:    {cert.Subject.CommonName},
+		CertSubjectDNS:   cert.DNSNames,
+		CertSubjectEmail: cert.EmailAddresses,
+	}
+	for _, uri := range cert.URIs {
+		fields[CertSubjectURI] = append(fields[CertSubjectURI], uri.String())
+	}
+
+	subjectFrom := authenticator.SubjectFrom
+	if len(subjectFrom) == 0 {
+		subjectFrom = []string{CertSubjectCN, CertSubjectDNS}
+	}
+	identity := &common.Identity{Claims: map[string]any{
+		"cn":     cert.Subject.CommonName,
+		"dns":    cert.DNSNames,
+		"email":  cert.EmailAddresses,
+		"uri":    fields[CertSubjectURI],
+		"serial": cert.SerialNumber.String(),
+		"issuer": cert.Issuer.String(),
+	}}
+	for _, field := range subjectFrom {
+		if values := fields[field]; len(values) > 0 && values[0] != "" {
+			identity.Subject = values[0]
+			break
+		}
+	}
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("%w: client certificate has no %s", ErrInvalidCredentials, strings.Join(subjectFrom, " or "))
+	}
+	return identity, nil
+}
+
+// ClientTLSConfig returns a TLS server config verifying client
+// certificates against the PEM encoded CAs in caFile. Clients without a
+// certificate are rejected during the handshake if required is set,
+// otherwise they may authenticate by other means.
+func ClientTLSConfig(caFile string, required bool) (*tls.Config, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates", caFile)
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	if required {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
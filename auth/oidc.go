@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+const (
+	// oidcStateCookie 登录过程中保存state, PKCE verifier和nonce
+	oidcStateCookie = "tusx_oidc_state"
+	oidcStateMaxAge = 10 * time.Minute
+)
+
+// SOIDC logs browser users in with the authorization code flow (with PKCE)
+// of an OpenID Connect provider and keeps their ID token in an HttpOnly
+// session cookie, which authenticates their requests until the token
+// expires. Mount HandleLogin, HandleCallback (at RedirectURL) and
+// HandleLogout, and use SOIDC as authenticator.
+type SOIDC struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Scopes requested besides openid.
+	Scopes []string
+	// CookieName of the session, tusx_session if empty.
+	CookieName string
+
+	jwt                   *SJWTAuthenticator
+	authorizationEndpoint string
+	tokenEndpoint         string
+	client                *http.Client
+}
+
+// NewOIDC discovers the endpoints and keys of the provider at issuer.
+// Scopes of users are taken from scopeClaim of their ID token if set, e.g.
+// groups.
+func NewOIDC(ctx context.Context, issuer, clientID, clientSecret, redirectURL, scopeClaim string) (*SOIDC, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %s", resp.Status)
+	}
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("invalid OIDC discovery document: %w", err)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("invalid OIDC discovery document of %s", issuer)
+	}
+
+	jwks := NewJWKS(discovery.JWKSURI)
+	jwks.Client = client
+	return &SOIDC{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"profile", "email"},
+		jwt: &SJWTAuthenticator{
+			JWKS:       jwks,
+			Issuer:     discovery.Issuer,
+			Audience:   clientID,
+			Leeway:     time.Minute,
+			ScopeClaim: scopeClaim,
+		},
+		authorizationEndpoint: discovery.AuthorizationEndpoint,
+		tokenEndpoint:         discovery.TokenEndpoint,
+		client:                client,
+	}, nil
+}
+
+func (oidc *SOIDC) cookieName() string {
+	if oidc.CookieName != "" {
+		return oidc.CookieName
+	}
+	return "tusx_session"
+}
+
+// SessionCookieName returns the name of the session cookie, e.g. for
+// SCSRF.SessionCookies.
+func (oidc *SOIDC) SessionCookieName() string {
+	return oidc.cookieName()
+}
+
+// Challenge 会话Cookie没有对应的认证方案
+func (oidc *SOIDC) Challenge() string {
+	return ""
+}
+
+func (oidc *SOIDC) Authenticate(r *http.Request) (*common.Identity, error) {
+	cookie, err := r.Cookie(oidc.cookieName())
+	if err != nil || cookie.Value == "" {
+		return nil, ErrNoCredentials
+	}
+	return oidc.jwt.Validate(r.Context(), cookie.Value)
+}
+
+// sOIDCState 登录请求的状态, 回调时校验
+type sOIDCState struct {
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect"`
+}
+
+// HandleLogin redirects to the provider, the user returns to the local
+// path in the redirect query parameter after logging in.
+func (oidc *SOIDC) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	state := sOIDCState{
+		State:    randomString(),
+		Verifier: randomString(),
+		Nonce:    randomString(),
+		Redirect: localRedirect(r.URL.Query().Get("redirect")),
+	}
+	data, _ := json.Marshal(state)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(data),
+		Path:     "/",
+		MaxAge:   int(oidcStateMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.ClientID},
+		"redirect_uri":          {oidc.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, oidc.Scopes...), " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(oidc.authorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, oidc.authorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// HandleCallback exchanges the authorization code for the ID token and
+// stores it in the session cookie.
+func (oidc *SOIDC) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	var state sOIDCState
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err == nil {
+		var data []byte
+		if data, err = base64.RawURLEncoding.DecodeString(cookie.Value); err == nil {
+			err = json.Unmarshal(data, &state)
+		}
+	}
+	query := r.URL.Query()
+	if err != nil || state.State == "" || subtle.ConstantTimeCompare([]byte(state.State), []byte(query.Get("state"))) != 1 {
+		http.Error(w, "invalid login state, please log in again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1})
+	if errCode := query.Get("error"); errCode != "" {
+		http.Error(w, "login failed: "+errCode+" "+query.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+
+	token, err := oidc.exchange(r.Context(), query.Get("code"), state.Verifier)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	identity, err := oidc.jwt.Validate(r.Context(), token)
+	if err == nil && identity.Claims["nonce"] != state.Nonce {
+		err = fmt.Errorf("%w: nonce mismatch", ErrInvalidCredentials)
+	}
+	if err != nil {
+		http.Error(w, "login failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	exp, _ := identity.Claims["exp"].(float64)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidc.cookieName(),
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Unix(int64(exp), 0),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, state.Redirect, http.StatusFound)
+}
+
+// exchange 用授权码换取ID Token
+func (oidc *SOIDC) exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidc.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, oidc.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(oidc.ClientID), url.QueryEscape(oidc.ClientSecret))
+	resp, err := oidc.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to exchange authorization code: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("failed to exchange authorization code: %s %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	return body.IDToken, nil
+}
+
+// HandleLogout removes the session cookie and redirects to /.
+func (oidc *SOIDC) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: oidc.cookieName(), Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// localRedirect 只允许跳转到本站的路径, 避免开放重定向
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
+
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// maxLimiterKeys 超过后清理空闲的客户端, 避免大量地址耗尽内存
+const maxLimiterKeys = 10000
+
+// SRateLimiter protects the tus handler from abusive clients. Clients are
+// told apart by the Subject of their identity, or by their IP address if
+// they aren't authenticated, so it has to be placed after the
+// authentication middleware, e.g. Handler. Requests exceeding a limit are
+// answered with 429 and a Retry-After header, the bandwidth of request
+// bodies is throttled instead. Limits of 0 are disabled.
+type SRateLimiter struct {
+	// CreationsPerMinute limits the uploads created by a client, bursts of
+	// that many creations are admitted.
+	CreationsPerMinute float64
+	// MaxConcurrentPatches limits the PATCH requests of a client in
+	// progress at the same time.
+	MaxConcurrentPatches int
+	// BytesPerSecond limits the bandwidth of the request bodies of a
+	// client, all its requests share it.
+	BytesPerSecond int64
+	// TrustedProxies are trusted to set X-Forwarded-For, see SIPFilter.
+	TrustedProxies []netip.Prefix
+
+	mu        sync.Mutex
+	creations map[string]*sLimiter
+	bandwidth map[string]*sLimiter
+	patches   map[string]int
+}
+
+// ClientKey returns the key the limits of r are counted by.
+func (limiter *SRateLimiter) ClientKey(r *http.Request) string {
+	if identity := common.IdentityFromContext(r.Context()); identity != nil && identity.Subject != "" {
+		return "sub:" + identity.Subject
+	}
+	addr, err := (&SIPFilter{TrustedProxies: limiter.TrustedProxies}).ClientIP(r)
+	if err != nil {
+		return "addr:" + r.RemoteAddr
+	}
+	return "ip:" + addr.String()
+}
+
+func (limiter *SRateLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := limiter.ClientKey(r)
+		switch RequestMethod(r) {
+		case http.MethodPost:
+			if limiter.CreationsPerMinute > 0 {
+				bucket := limiter.bucket(&limiter.creations, key, limiter.CreationsPerMinute/60, max(limiter.CreationsPerMinute, 1))
+				if !bucket.allow() {
+					tooManyRequests(w, bucket.wait(), "too many uploads created")
+					return
+				}
+			}
+		case http.MethodPatch:
+			if limiter.MaxConcurrentPatches > 0 {
+				if !limiter.acquirePatch(key) {
+					tooManyRequests(w, time.Second, "too many concurrent PATCH requests")
+					return
+				}
+				defer limiter.releasePatch(key)
+			}
+		}
+		if limiter.BytesPerSecond > 0 && r.Body != nil && r.Body != http.NoBody {
+			bucket := limiter.bucket(&limiter.bandwidth, key, float64(limiter.BytesPerSecond), float64(limiter.BytesPerSecond))
+			r.Body = &sThrottledBody{ReadCloser: r.Body, ctx: r.Context(), bucket: bucket, chunk: int(min(limiter.BytesPerSecond, 64<<10))}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bucket 返回客户端的令牌桶, 客户端过多时清理令牌已满的空闲客户端
+func (limiter *SRateLimiter) bucket(buckets *map[string]*sLimiter, key string, rate, burst float64) *sLimiter {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if *buckets == nil {
+		*buckets = make(map[string]*sLimiter)
+	}
+	bucket, ok := (*buckets)[key]
+	if !ok {
+		if len(*buckets) >= maxLimiterKeys {
+			for k, b := range *buckets {
+				if b.idle() {
+					delete(*buckets, k)
+				}
+			}
+		}
+		bucket = newLimiter(rate, burst)
+		(*buckets)[key] = bucket
+	}
+	return bucket
+}
+
+func (limiter *SRateLimiter) acquirePatch(key string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.patches == nil {
+		limiter.patches = make(map[string]int)
+	}
+	if limiter.patches[key] >= limiter.MaxConcurrentPatches {
+		return false
+	}
+	limiter.patches[key]++
+	return true
+}
+
+func (limiter *SRateLimiter) releasePatch(key string) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.patches[key]--; limiter.patches[key] <= 0 {
+		delete(limiter.patches, key)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, fmt.Sprintf("%v: %s", ErrRateLimited, message), http.StatusTooManyRequests)
+}
+
+// sThrottledBody 按令牌桶限制读取请求体的速度
+type sThrottledBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *sLimiter
+	chunk  int
+}
+
+func (body *sThrottledBody) Read(p []byte) (int, error) {
+	if len(p) > body.chunk {
+		p = p[:body.chunk]
+	}
+	n, err := body.ReadCloser.Read(p)
+	if n > 0 {
+		if wait := body.bucket.take(float64(n)); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-body.ctx.Done():
+				return n, context.Cause(body.ctx)
+			}
+		}
+	}
+	return n, err
+}
+
+// sLimiter 令牌桶, 每秒补充rate个令牌, 最多积累burst个
+type sLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate, burst float64) *sLimiter {
+	return &sLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (limiter *sLimiter) refill() {
+	now := time.Now()
+	limiter.tokens = min(limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate, limiter.burst)
+	limiter.last = now
+}
+
+func (limiter *sLimiter) allow() bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.refill()
+	if limiter.tokens < 1 {
+		return false
+	}
+	limiter.tokens--
+	return true
+}
+
+// wait 返回积累一个令牌需要等待的时间
+func (limiter *sLimiter) wait() time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.refill()
+	return time.Duration(max(1-limiter.tokens, 0) / limiter.rate * float64(time.Second))
+}
+
+// take 取出n个令牌, 令牌不足时允许透支, 返回补足透支需要等待的时间
+func (limiter *sLimiter) take(n float64) time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.refill()
+	limiter.tokens -= n
+	if limiter.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+}
+
+func (limiter *sLimiter) idle() bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.refill()
+	return limiter.tokens >= limiter.burst
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// The roles of SRBAC.
+const (
+	// RoleUploader creates uploads and accesses and terminates its own, if
+	// the handler checks the owner of uploads (SConfig.RequireOwner).
+	RoleUploader = "uploader"
+	// RoleViewer downloads all uploads.
+	RoleViewer = "viewer"
+	// RoleAdmin may do everything, including the admin API.
+	RoleAdmin = "admin"
+)
+
+const (
+	// ScopeAdmin permits the admin API and access to the uploads of all
+	// users, see SConfig.AdminScope of the handler.
+	ScopeAdmin = "admin"
+	// ScopeReadAll permits downloading the uploads of all users, see
+	// SConfig.ReadAllScope of the handler.
+	ScopeReadAll = "read_all"
+)
+
+// RoleScopes lists the scopes granted by every role.
+var RoleScopes = map[string][]string{
+	RoleUploader: {ScopeCreate, ScopeRead, ScopeDelete},
+	RoleViewer:   {ScopeRead, ScopeReadAll},
+	RoleAdmin:    {ScopeCreate, ScopeRead, ScopeDelete, ScopeAdmin},
+}
+
+// SRBAC enforces role-based access control: the request method has to be
+// permitted (see MethodScopes) by the scopes of the identity, which
+// include the scopes of its roles. Roles are assigned by authenticators,
+// e.g. to the users of SBasicAuthenticator, or by RoleClaim of JWTs.
+type SRBAC struct {
+	// RoleClaim names the claim of the identity holding its roles, e.g.
+	// roles or groups, roles are only taken from Identity.Roles if empty.
+	RoleClaim string
+}
+
+// Apply returns a copy of identity with the roles of RoleClaim and the
+// scopes of its roles added.
+func (rbac *SRBAC) Apply(identity *common.Identity) *common.Identity {
+	applied := *identity
+	applied.Roles = slices.Clone(identity.Roles)
+	if rbac.RoleClaim != "" {
+		for _, role := range stringsClaim(identity.Claims[rbac.RoleClaim]) {
+			if !slices.Contains(applied.Roles, role) {
+				applied.Roles = append(applied.Roles, role)
+			}
+		}
+	}
+	applied.Scopes = slices.Clone(identity.Scopes)
+	for _, role := range applied.Roles {
+		for _, scope := range RoleScopes[role] {
+			if !slices.Contains(applied.Scopes, scope) {
+				applied.Scopes = append(applied.Scopes, scope)
+			}
+		}
+	}
+	return &applied
+}
+
+// Handler checks the identity set by an authentication middleware, e.g.
+// Handler, before passing the request to next. Requests without identity
+// are answered with 401, those whose method isn't permitted with 403.
+func (rbac *SRBAC) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		identity := common.IdentityFromContext(r.Context())
+		if identity == nil {
+			http.Error(w, "Unauthorized: "+ErrNoCredentials.Error(), http.StatusUnauthorized)
+			return
+		}
+		identity = rbac.Apply(identity)
+		if method := RequestMethod(r); !Permitted(identity, method) {
+			http.Error(w, fmt.Sprintf("%v: %s may not %s", ErrForbidden, identity.Subject, method), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(common.WithIdentity(r.Context(), identity)))
+	})
+}
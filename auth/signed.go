@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// The query parameters of signed URLs.
+const (
+	ParamSignature = "signature"
+	ParamExpires   = "expires"
+	ParamScope     = "scope"
+	ParamSubject   = "sub"
+	ParamMaxSize   = "max_size"
+	ParamMetadata  = "metadata"
+)
+
+// The scopes of signed URLs.
+const (
+	signedScopeCreate   = "create"
+	signedScopeUpload   = "upload"
+	signedScopeDownload = "download"
+)
+
+// SUploadPolicy restricts the uploads created with a signed URL.
+type SUploadPolicy struct {
+	Expires time.Time
+	// Subject is recorded as owner of the upload, anonymous if empty.
+	Subject string
+	// MaxSize is the maximum Upload-Length, 0 allows any size. Uploads
+	// with a deferred length are rejected if set.
+	MaxSize int64
+	// Metadata lists the Upload-Metadata keys the client may set, with
+	// the value they have to be set to, or an empty value for any value.
+	Metadata map[string]string
+}
+
+// SSignedURLs lets a trusted backend mint time-limited creation URLs, e.g.
+// for browsers without credentials. A signed URL carries its expiry and the
+// restrictions of SUploadPolicy as query parameters, signed with
+// HMAC-SHA256 over the path and the sorted query without the signature:
+//
+//	hex(HMAC(secret, path + "?" + url.Values.Encode()))
+//
+// The Location of uploads created with it is signed as well, valid for
+// UploadExpiry, so the client can upload the data and resume the upload.
+// Signed URLs can't create concatenated uploads. Download URLs minted by
+// SignDownload permit only GET and HEAD requests.
+type SSignedURLs struct {
+	Secret []byte
+	// UploadExpiry is how long the Location of created uploads stays
+	// valid, a day if 0.
+	UploadExpiry time.Duration
+}
+
+// Sign returns rawURL, which has to point at the tus endpoint, as creation
+// URL restricted by policy.
+func (signer *SSignedURLs) Sign(rawURL string, policy SUploadPolicy) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(ParamScope, signedScopeCreate)
+	query.Set(ParamExpires, strconv.FormatInt(policy.Expires.Unix(), 10))
+	if policy.Subject != "" {
+		query.Set(ParamSubject, policy.Subject)
+	}
+	if policy.MaxSize > 0 {
+		query.Set(ParamMaxSize, strconv.FormatInt(policy.MaxSize, 10))
+	}
+	for key, value := range policy.Metadata {
+		if value != "" {
+			key += "=" + value
+		}
+		query.Add(ParamMetadata, key)
+	}
+	signer.sign(u, query)
+	return u.String(), nil
+}
+
+// SignDownload returns rawURL, which has to point at an upload, as download
+// URL valid until expires. The requests are made as subject, which has to
+// be the owner of the upload if SConfig.RequireOwner is set.
+func (signer *SSignedURLs) SignDownload(rawURL, subject string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(ParamScope, signedScopeDownload)
+	query.Set(ParamExpires, strconv.FormatInt(expires.Unix(), 10))
+	if subject != "" {
+		query.Set(ParamSubject, subject)
+	}
+	signer.sign(u, query)
+	return u.String(), nil
+}
+
+// sign 计算签名并设置u的查询参数
+func (signer *SSignedURLs) sign(u *url.URL, query url.Values) {
+	query.Del(ParamSignature)
+	query.Set(ParamSignature, signer.signature(u.Path, query))
+	u.RawQuery = query.Encode()
+}
+
+func (signer *SSignedURLs) signature(path string, query url.Values) string {
+	unsigned := url.Values{}
+	for key, values := range query {
+		if key != ParamSignature {
+			unsigned[key] = values
+		}
+	}
+	mac := hmac.New(sha256.New, signer.Secret)
+	mac.Write([]byte(path + "?" + unsigned.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Handler authenticates the requests with a signed URL before passing them
+// to next, requests without signature are passed unchanged, e.g. to
+// Handler for other credentials.
+func (signer *SSignedURLs) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Method == http.MethodOptions || !query.Has(ParamSignature) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		identity, err := signer.verify(r, query)
+		if err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, ErrForbidden) {
+				status = http.StatusForbidden
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if query.Get(ParamScope) == signedScopeCreate {
+			w = &sSignedLocationWriter{ResponseWriter: w, signer: signer, subject: identity.Subject}
+		}
+		next.ServeHTTP(w, r.WithContext(common.WithIdentity(r.Context(), identity)))
+	})
+}
+
+// verify 校验签名, 有效期和创建上传的限制
+func (signer *SSignedURLs) verify(r *http.Request, query url.Values) (*common.Identity, error) {
+	if !hmac.Equal([]byte(signer.signature(r.URL.Path, query)), []byte(query.Get(ParamSignature))) {
+		return nil, fmt.Errorf("%w: signature mismatch", ErrInvalidCredentials)
+	}
+	expires, err := strconv.ParseInt(query.Get(ParamExpires), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid expiry", ErrInvalidCredentials)
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return nil, ErrTokenExpired
+	}
+
+	identity := &common.Identity{
+		Subject: query.Get(ParamSubject),
+		Claims:  map[string]any{"signed_url": query.Get(ParamScope)},
+	}
+	method := RequestMethod(r)
+	switch query.Get(ParamScope) {
+	case signedScopeCreate:
+		identity.Scopes = []string{ScopeCreate}
+		// 匿名创建的上传以随机的身份作为所有者, 只能通过签名的Location访问
+		if identity.Subject == "" {
+			identity.Subject = "anonymous-" + randomString()[:16]
+		}
+		if method != http.MethodPost {
+			return nil, fmt.Errorf("%w: signed creation URLs only permit POST", ErrForbidden)
+		}
+		if err = checkPolicy(r, query); err != nil {
+			return nil, err
+		}
+	case signedScopeUpload:
+		identity.Scopes = []string{ScopeCreate, ScopeRead}
+		if method != http.MethodHead && method != http.MethodPatch && method != http.MethodGet {
+			return nil, fmt.Errorf("%w: signed upload URLs don't permit %s", ErrForbidden, method)
+		}
+	case signedScopeDownload:
+		identity.Scopes = []string{ScopeRead}
+		if method != http.MethodHead && method != http.MethodGet {
+			return nil, fmt.Errorf("%w: signed download URLs don't permit %s", ErrForbidden, method)
+		}
+	default:
+		return nil, fmt.Errorf("%w: invalid scope", ErrInvalidCredentials)
+	}
+	return identity, nil
+}
+
+// checkPolicy 校验创建请求的大小和元数据
+func checkPolicy(r *http.Request, query url.Values) error {
+	if r.Header.Get(common.HeaderUploadConcat) != "" {
+		return fmt.Errorf("%w: signed URLs can't create concatenated uploads", ErrForbidden)
+	}
+	if query.Has(ParamMaxSize) {
+		maxSize, err := strconv.ParseInt(query.Get(ParamMaxSize), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid max size", ErrInvalidCredentials)
+		}
+		size, err := strconv.ParseInt(r.Header.Get(common.HeaderUploadLength), 10, 64)
+		if err != nil || size > maxSize {
+			return fmt.Errorf("%w: Upload-Length is required and must not exceed %d", ErrForbidden, maxSize)
+		}
+	}
+
+	allowed := make(map[string]string)
+	for _, value := range query[ParamMetadata] {
+		key, value, _ := strings.Cut(value, "=")
+		allowed[key] = value
+	}
+	for _, pair := range strings.Split(r.Header.Get(common.HeaderUploadMetadata), ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		want, ok := allowed[key]
+		if !ok {
+			return fmt.Errorf("%w: metadata %s is not allowed", ErrForbidden, key)
+		}
+		if want == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || string(value) != want {
+			return fmt.Errorf("%w: metadata %s must be %s", ErrForbidden, key, want)
+		}
+	}
+	return nil
+}
+
+// sSignedLocationWriter 为签名URL创建的上传的Location附加签名, 包括草案协议的104响应
+type sSignedLocationWriter struct {
+	http.ResponseWriter
+	signer      *SSignedURLs
+	subject     string
+	wroteHeader bool
+}
+
+func (w *sSignedLocationWriter) WriteHeader(statusCode int) {
+	if statusCode >= http.StatusOK {
+		w.wroteHeader = true
+	}
+	header := w.Header()
+	if location := header.Get(common.HeaderLocation); location != "" {
+		if u, err := url.Parse(location); err == nil && !u.Query().Has(ParamSignature) {
+			expiry := w.signer.UploadExpiry
+			if expiry <= 0 {
+				expiry = 24 * time.Hour
+			}
+			query := u.Query()
+			query.Set(ParamScope, signedScopeUpload)
+			query.Set(ParamExpires, strconv.FormatInt(time.Now().Add(expiry).Unix(), 10))
+			query.Set(ParamSubject, w.subject)
+			w.signer.sign(u, query)
+			header.Set(common.HeaderLocation, u.String())
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *sSignedLocationWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *sSignedLocationWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
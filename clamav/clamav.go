@@ -0,0 +1,164 @@
+package clamav
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrScanFailed is returned when clamd answers with an error, e.g. because
+// the upload exceeds its StreamMaxLength.
+var ErrScanFailed = errors.New("clamd scan failed")
+
+// chunkSize 每个INSTREAM数据块的大小, 需小于clamd的StreamMaxLength
+const chunkSize = 64 << 10
+
+// SClamd scans data with a clamd daemon using its INSTREAM command, the
+// data is streamed over the connection so clamd doesn't need access to the
+// storage. The StreamMaxLength of clamd has to be at least the maximum size
+// of uploads, larger ones can't be scanned.
+type SClamd struct {
+	// Network is "tcp" or "unix".
+	Network string
+	Address string
+	// Timeout limits a scan including the transfer of the data, 0 disables
+	// the timeout.
+	Timeout time.Duration
+}
+
+// New returns a scanner for the clamd at address, a unix socket if it
+// starts with unix: or /, e.g. /run/clamav/clamd.ctl, otherwise host:port,
+// e.g. localhost:3310.
+func New(address string) *SClamd {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return &SClamd{Network: "unix", Address: path}
+	}
+	if strings.HasPrefix(address, "/") {
+		return &SClamd{Network: "unix", Address: address}
+	}
+	return &SClamd{Network: "tcp", Address: strings.TrimPrefix(address, "tcp://")}
+}
+
+// Ping checks that clamd is reachable, e.g. at startup.
+func (clamd *SClamd) Ping(ctx context.Context) error {
+	conn, err := clamd.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("%w: unexpected reply %q", ErrScanFailed, reply)
+	}
+	return nil
+}
+
+// Scan streams data to clamd and returns the name of the virus it found,
+// empty if data is clean.
+func (clamd *SClamd) Scan(ctx context.Context, data io.Reader) (string, error) {
+	conn, err := clamd.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	// 取消时关闭连接, 中断阻塞的读写
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	writer := bufio.NewWriterSize(conn, chunkSize+4)
+	buf := make([]byte, chunkSize+4)
+	for {
+		n, readErr := io.ReadFull(data, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err = writer.Write(buf[:n+4]); err != nil {
+				// clamd超出StreamMaxLength时回复错误并关闭连接
+				if reply, replyErr := readReply(conn); replyErr == nil {
+					return parseReply(reply)
+				}
+				return "", err
+			}
+		}
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+	// 长度为0的块表示数据结束
+	binary.BigEndian.PutUint32(buf, 0)
+	if _, err = writer.Write(buf[:4]); err != nil {
+		return "", err
+	}
+	if err = writer.Flush(); err != nil {
+		if reply, replyErr := readReply(conn); replyErr == nil {
+			return parseReply(reply)
+		}
+		return "", err
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		if ctxErr := context.Cause(ctx); ctxErr != nil {
+			return "", ctxErr
+		}
+		return "", err
+	}
+	return parseReply(reply)
+}
+
+func (clamd *SClamd) dial(ctx context.Context) (net.Conn, error) {
+	if clamd.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, clamd.Timeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, clamd.Network, clamd.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	if clamd.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(clamd.Timeout))
+	}
+	return conn, nil
+}
+
+// readReply 读取以\0结尾的回复
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+// parseReply 解析扫描结果, 例如"stream: OK"或"stream: Eicar-Signature FOUND"
+func parseReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrScanFailed, strings.TrimSuffix(result, " ERROR"))
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/busybox-org/gin-fileuploader/auth"
+	"github.com/busybox-org/gin-fileuploader/common"
+	tusx "github.com/busybox-org/gin-fileuploader/handler"
+)
+
+// maxListLimit 列出上传时每页的最大数量
+const maxListLimit = 1000
+
+// registerAdminRoutes 注册管理接口, 需要Authorization: Bearer <token>, 未配置令牌时不启用
+func registerAdminRoutes(router *gin.Engine, tusxHandler *tusx.SHandler, authn *sAuth, token string) {
+	if token == "" && authn.rbac == nil {
+		return
+	}
+	admin := router.Group("/api/v1/admin", adminAuth(token, authn))
+	admin.POST("/replay", adminReplay(tusxHandler))
+	admin.POST("/jobs", adminStartBulkJob(tusxHandler))
+	admin.GET("/jobs/:id", adminGetBulkJob(tusxHandler))
+	admin.POST("/uploads/*path", adminPauseUpload(tusxHandler))
+	uploads := router.Group("/api/v1/uploads", adminAuth(token, authn))
+	uploads.GET("", adminListUploads(tusxHandler))
+	// ID可以包含/
+	uploads.GET("/*id", adminGetUpload(tusxHandler))
+	uploads.DELETE("/*id", adminDeleteUpload(tusxHandler))
+	if authn.apiKeys != nil {
+		admin.GET("/api-keys", adminListAPIKeys(authn.apiKeys))
+		admin.POST("/api-keys", adminCreateAPIKey(authn.apiKeys))
+		admin.DELETE("/api-keys/:id", adminDeleteAPIKey(authn.apiKeys))
+	}
+	if authn.signer != nil {
+		admin.POST("/signed-urls", adminSignURL(authn.signer))
+		admin.POST("/download-urls", adminSignDownloadURL(tusxHandler, authn.signer))
+	}
+	if quotas {
+		admin.GET("/quotas/:subject", adminGetQuota(tusxHandler))
+		admin.PUT("/quotas/:subject", adminSetQuota(tusxHandler))
+	}
+}
+
+// adminAuth 以常量时间比较Bearer令牌, 启用RBAC时admin角色的用户同样可以使用管理接口
+func adminAuth(token string, authn *sAuth) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if ok && token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			c.Next()
+			return
+		}
+		if authn.rbac != nil {
+			if identity, err := auth.Authenticate(c.Request, authn.authenticators...); err == nil {
+				if !authn.rbac.Apply(identity).HasScope(auth.ScopeAdmin) {
+					c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin role required"})
+					return
+				}
+				c.Next()
+				return
+			}
+		}
+		c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	}
+}
+
+// adminReplay 重新发布上传完成事件, 按id指定单个上传, 或按from/to(RFC3339)指定创建时间范围, e.g.
+//
+//	POST /api/v1/admin/replay?id=<upload id>
+//	POST /api/v1/admin/replay?from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z
+func adminReplay(tusxHandler *tusx.SHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if id := c.Query("id"); id != "" {
+			info, err := tusxHandler.ReplayFinishedUpload(ctx, id)
+			switch {
+			case errors.Is(err, tusx.ErrUploadNotFinished):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			case err != nil && strings.Contains(err.Error(), "not found"):
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			case err != nil:
+				_ = c.Error(err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusOK, gin.H{"replayed": []string{info.ID}})
+			}
+			return
+		}
+
+		var from, to time.Time
+		for name, value := range map[string]*time.Time{"from": &from, "to": &to} {
+			raw := c.Query(name)
+			if raw == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name + ", expected RFC3339"})
+				return
+			}
+			*value = t
+		}
+		if from.IsZero() && to.IsZero() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "id, from or to is required"})
+			return
+		}
+		replayed, err := tusxHandler.ReplayFinishedUploads(ctx, from, to)
+		switch {
+		case errors.Is(err, tusx.ErrListingUnsupported):
+			c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		case err != nil:
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "replayed": replayed})
+		default:
+			c.JSON(http.StatusOK, gin.H{"replayed": replayed})
+		}
+	}
+}
+
+// adminListUploads 分页列出上传, 按state(in-progress或complete), metadata(key=value或key, 可重复),
+// 创建时间from/to(RFC3339)和owner筛选, limit默认100, 下一页以响应中的nextCursor作为cursor, e.g.
+//
+//	GET /api/v1/uploads?state=complete&metadata=filetype=image/png&from=2024-01-01T00:00:00Z&limit=50
+func adminListUploads(tusxHandler *tusx.SHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := tusx.SUploadFilter{
+			State: c.Query("state"),
+			Owner: c.Query("owner"),
+		}
+		for _, pair := range c.QueryArray("metadata") {
+			if filter.MetaData == nil {
+				filter.MetaData = make(map[string]string)
+			}
+			key, value, _ := strings.Cut(pair, "=")
+			filter.MetaData[key] = value
+		}
+		for name, value := range map[string]*time.Time{"from": &filter.CreatedAfter, "to": &filter.CreatedBefore} {
+			raw := c.Query(name)
+			if raw == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name + ", expected RFC3339"})
+				return
+			}
+			*value = t
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil || limit < 1 || limit > maxListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxListLimit)})
+			return
+		}
+
+		page, err := tusxHandler.ListUploads(c.Request.Context(), filter, c.Query("cursor"), limit)
+		switch {
+		case errors.Is(err, tusx.ErrInvalidFilter), errors.Is(err, tusx.ErrInvalidCursor):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, tusx.ErrListingUnsupported):
+			c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		case err != nil:
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusOK, page)
+		}
+	}
+}
+
+// adminGetUpload 以JSON返回上传的完整信息, 与tus的HEAD响应不同, 包括元数据, 创建时间和存储位置, e.g.
+//
+//	GET /api/v1/uploads/<upload id>
+func adminGetUpload(tusxHandler *tusx.SHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		details, err := tusxHandler.UploadDetails(c.Request.Context(), strings.TrimPrefix(c.Param("id"), "/"))
+		switch {
+		case err != nil && strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case err != nil:
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusOK, details)
+		}
+	}
+}
+
+// adminDeleteUpload 删除上传及其合并前的分片, 不受termination扩展是否启用的影响, e.g.
+//
+//	DELETE /api/v1/uploads/<upload id>
+func adminDeleteUpload(tusxHandler *tusx.SHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deleted, err := tusxHandler.DeleteUpload(c.Request.Context(), strings.TrimPrefix(c.Param("id"), "/"))
+		switch {
+		case err != nil && len(deleted) == 0 && strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case err != nil:
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "deleted": deleted})
+		default:
+			c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+		}
+	}
+}
+
+// adminPauseUpload 暂停上传, 暂停期间的PATCH请求返回423, 或恢复暂停的上传, e.g.
+//
+//	POST /api/v1/admin/uploads/<upload id>/pause
+//	POST /api/v1/admin/uploads/<upload id>/resume
+func adminPauseUpload(tusxHandler *tusx.SHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := strings.TrimPrefix(c.Param("path"), "/")
+		var err error
+		if id, ok := strings.CutSuffix(path, "/pause"); ok && id != "" {
+			err = tusxHandler.PauseUpload(c.Request.Context(), id)
+		} else if id, ok = strings.CutSuffix(path, "/resume"); ok && id != "" {
+			err = tusxHandler.ResumeUpload(c.Request.Context(), id)
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"error": "expected /api/v1/admin/uploads/<upload id>/pause or /resume"})
+			return
+		}
+		switch {
+		case err != nil && strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case err != nil:
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+// adminStartBulkJob 在后台删除(delete)或使之过期(expire, 仅未完成的上传)满足条件的上传, 返回任务及其ID,
+// 进度通过GET /api/v1/admin/jobs/<id>查询. olderThan为Go的时长, 至少需要一个条件, e.g.
+//
+//	POST /api/v1/admin/jobs {"action":"expire","olderThan":"168h","metadata":{"tenant":"acme"},"incompleteOnly":true}
+func adminStartBulkJob(tusxHandler *tusx.SHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 不支持列出上传的存储无法执行任务, 不接受请求
+		if !tusxHandler.CanListUploads() {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": tusx.ErrListingUnsupported.Error()})
+			return
+		}
+		var req struct {
+			Action         string            `json:"action" binding:"required"`
+			OlderThan      string            `json:"olderThan"`
+			Metadata       map[string]string `json:"metadata"`
+			IncompleteOnly bool              `json:"incompleteOnly"`
+			Owner          string            `json:"owner"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter := tusx.SUploadFilter{MetaData: req.Metadata, Owner: req.Owner}
+		if req.IncompleteOnly {
+			filter.State = tusx.UploadStateInProgress
+		}
+		if req.OlderThan != "" {
+			olderThan, err := time.ParseDuration(req.OlderThan)
+			if err != nil || olderThan <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid olderThan, expected a positive duration, e.g. 24h"})
+				return
+			}
+			filter.CreatedBefore = time.Now().Add(-olderThan)
+		}
+		// 避免误删所有上传
+		if req.OlderThan == "" && len(req.Metadata) == 0 && !req.IncompleteOnly && req.Owner == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "olderThan, metadata, incompleteOnly or owner is required"})
+			return
+		}
+
+		job, err := tusxHandler.StartBulkJob(c.Request.Context(), req.Action, filter)
+		switch {
+		case errors.Is(err, tusx.ErrListingUnsupported):
+			c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		case err != nil:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusAccepted, job)
+		}
+	}
+}
+
+func adminGetBulkJob(tusxHandler *tusx.SHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, err := tusxHandler.BulkJob(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+func adminListAPIKeys(apiKeys auth.IAPIKeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys, err := apiKeys.List(c.Request.Context())
+		if err != nil {
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"apiKeys": keys})
+	}
+}
+
+// adminCreateAPIKey 创建API密钥, 密钥只在响应中返回一次, e.g.
+//
+//	POST /api/v1/admin/api-keys {"name":"ingest","scopes":["create","read"],"rateLimit":10}
+func adminCreateAPIKey(apiKeys auth.IAPIKeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Name      string   `json:"name" binding:"required"`
+			Scopes    []string `json:"scopes"`
+			RateLimit float64  `json:"rateLimit" binding:"min=0"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		for _, scope := range req.Scopes {
+			if scope != auth.ScopeCreate && scope != auth.ScopeRead && scope != auth.ScopeDelete {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope " + scope})
+				return
+			}
+		}
+		key, apiKey, err := apiKeys.Create(c.Request.Context(), auth.SAPIKey{
+			Name:      req.Name,
+			Scopes:    req.Scopes,
+			RateLimit: req.RateLimit,
+		})
+		if err != nil {
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"key": key, "apiKey": apiKey})
+	}
+}
+
+func adminDeleteAPIKey(apiKeys auth.IAPIKeyManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := apiKeys.Delete(c.Request.Context(), c.Param("id"))
+		switch {
+		case errors.Is(err, auth.ErrAPIKeyNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case err != nil:
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
+
+// adminSignURL 签发创建上传的URL, expiresIn为秒数, 默认1小时, e.g.
+//
+//	POST /api/v1/admin/signed-urls {"subject":"alice","maxSize":10485760,"metadata":{"filename":"","filetype":"image/png"}}
+func adminSignURL(signer *auth.SSignedURLs) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Subject   string            `json:"subject"`
+			MaxSize   int64             `json:"maxSize" binding:"min=0"`
+			Metadata  map[string]string `json:"metadata"`
+			ExpiresIn int64             `json:"expiresIn" binding:"min=0"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.ExpiresIn == 0 {
+			req.ExpiresIn = 3600
+		}
+		expires := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+		signed, err := signer.Sign(requestURL(c, "/api/v1/files/"), auth.SUploadPolicy{
+			Expires:  expires,
+			Subject:  req.Subject,
+			MaxSize:  req.MaxSize,
+			Metadata: req.Metadata,
+		})
+		if err != nil {
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"url": signed, "expires": expires.UTC().Format(time.RFC3339)})
+	}
+}
+
+// adminSignDownloadURL 签发已完成上传的下载URL, expiresIn为秒数, 默认1小时, e.g.
+//
+//	POST /api/v1/admin/download-urls {"id":"<upload id>","expiresIn":86400}
+func adminSignDownloadURL(tusxHandler *tusx.SHandler, signer *auth.SSignedURLs) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			ID        string `json:"id" binding:"required"`
+			ExpiresIn int64  `json:"expiresIn" binding:"min=0"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		info, err := tusxHandler.FinishedUpload(c.Request.Context(), req.ID)
+		switch {
+		case errors.Is(err, tusx.ErrUploadNotFinished):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case err != nil && strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if req.ExpiresIn == 0 {
+			req.ExpiresIn = 3600
+		}
+		expires := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+		// 以上传的所有者签发, 启用-require-owner时同样可以下载
+		signed, err := signer.SignDownload(requestURL(c, "/api/v1/files/"+url.PathEscape(info.ID)), info.MetaData[common.MetaDataOwner], expires)
+		if err != nil {
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"url": signed, "expires": expires.UTC().Format(time.RFC3339)})
+	}
+}
+
+// requestURL 按请求的协议和主机构造path的绝对URL
+func requestURL(c *gin.Context, path string) string {
+	scheme := "http"
+	if c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + path
+}
+
+func adminGetQuota(tusxHandler *tusx.SHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		quota, err := tusxHandler.Quota(c.Request.Context(), c.Param("subject"))
+		if err != nil {
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, quota)
+	}
+}
+
+// adminSetQuota 设置用户的配额(字节), 0恢复默认配额, 负数不限, e.g.
+//
+//	PUT /api/v1/admin/quotas/alice {"quota":1073741824}
+func adminSetQuota(tusxHandler *tusx.SHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Quota *int64 `json:"quota" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := tusxHandler.SetQuota(c.Request.Context(), c.Param("subject"), *req.Quota); err != nil {
+			_ = c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		adminGetQuota(tusxHandler)(c)
+	}
+}
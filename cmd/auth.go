@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/auth"
+)
+
+// sAuth tus接口的认证方式
+type sAuth struct {
+	// authenticators 为空时不做认证
+	authenticators []auth.IAuthenticator
+	// apiKeys 启用-api-keys-db时可通过管理接口维护的密钥
+	apiKeys auth.IAPIKeyManager
+	// oidc 启用时页面需要登录
+	oidc *auth.SOIDC
+	// basic 启用时页面同样需要Basic认证
+	basic *auth.SBasicAuthenticator
+	// tlsConfig 启用-tls-client-ca时校验客户端证书的TLS配置
+	tlsConfig *tls.Config
+	// ipFilter 按客户端地址限制访问, 在认证之前检查
+	ipFilter *auth.SIPFilter
+	// rbac 启用时按角色限制tus接口和管理接口
+	rbac *auth.SRBAC
+	// limiter 按用户或客户端地址限流, 在认证之后检查
+	limiter *auth.SRateLimiter
+	// signer 配置TUSX_URL_SIGNING_SECRET时接受签名的上传URL
+	signer *auth.SSignedURLs
+	// csrf 启用-csrf时校验页面上传的CSRF令牌
+	csrf *auth.SCSRF
+}
+
+// newAuth 按参数创建tus接口的认证方式
+func newAuth() (*sAuth, error) {
+	authn := &sAuth{}
+
+	if len(allowCIDRs) > 0 || len(denyCIDRs) > 0 {
+		filter := &auth.SIPFilter{}
+		var err error
+		if filter.Allow, err = auth.ParsePrefixes(allowCIDRs); err != nil {
+			return nil, err
+		}
+		if filter.Deny, err = auth.ParsePrefixes(denyCIDRs); err != nil {
+			return nil, err
+		}
+		if filter.TrustedProxies, err = auth.ParsePrefixes(trustedProxies); err != nil {
+			return nil, err
+		}
+		authn.ipFilter = filter
+	}
+
+	if tlsClientCA != "" {
+		if tlsCert == "" {
+			return nil, errors.New("-tls-client-ca requires -tls-cert and -tls-key")
+		}
+		config, err := auth.ClientTLSConfig(tlsClientCA, tlsClientRequired)
+		if err != nil {
+			return nil, err
+		}
+		authn.tlsConfig = config
+		authn.authenticators = append(authn.authenticators, &auth.SClientCertAuthenticator{
+			SubjectFrom: strings.Split(tlsClientSubject, ","),
+		})
+	}
+
+	jwt := &auth.SJWTAuthenticator{
+		Secret:   []byte(secretEnv("TUSX_JWT_SECRET")),
+		Issuer:   jwtIssuer,
+		Audience: jwtAudience,
+		Leeway:   time.Minute,
+	}
+	if jwtPublicKey != "" {
+		key, err := auth.LoadRSAPublicKey(jwtPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		jwt.PublicKey = key
+	}
+	if jwtJWKSURL != "" {
+		jwt.JWKS = auth.NewJWKS(jwtJWKSURL)
+	}
+	if len(jwt.Secret) > 0 || jwt.PublicKey != nil || jwt.JWKS != nil {
+		authn.authenticators = append(authn.authenticators, jwt)
+	}
+
+	var apiKeyStores []auth.IAPIKeyStore
+	if len(apiKeys) > 0 {
+		static := auth.NewStaticAPIKeys()
+		for _, value := range apiKeys {
+			if err := static.Parse(value); err != nil {
+				return nil, err
+			}
+		}
+		apiKeyStores = append(apiKeyStores, static)
+	}
+	if apiKeysDB {
+		gdb, err := openDB(uploadDir)
+		if err != nil {
+			return nil, err
+		}
+		store, err := auth.NewGormAPIKeys(gdb)
+		if err != nil {
+			return nil, err
+		}
+		apiKeyStores = append(apiKeyStores, store)
+		authn.apiKeys = store
+	}
+	if len(apiKeyStores) > 0 {
+		authn.authenticators = append(authn.authenticators, auth.NewAPIKeyAuthenticator(apiKeyStores...))
+	}
+
+	if len(basicAuth) > 0 || basicAuthFile != "" {
+		basic := auth.NewBasicAuthenticator("tusx")
+		for _, value := range basicAuth {
+			if err := basic.Parse(value); err != nil {
+				return nil, err
+			}
+		}
+		if basicAuthFile != "" {
+			if err := basic.LoadFile(basicAuthFile); err != nil {
+				return nil, err
+			}
+		}
+		authn.basic = basic
+		authn.authenticators = append(authn.authenticators, basic)
+	}
+
+	if oidcIssuer != "" {
+		if oidcClientID == "" || oidcRedirectURL == "" {
+			return nil, errors.New("-oidc-issuer requires -oidc-client-id and -oidc-redirect-url")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		oidc, err := auth.NewOIDC(ctx, oidcIssuer, oidcClientID, secretEnv("TUSX_OIDC_CLIENT_SECRET"), oidcRedirectURL, oidcScopeClaim)
+		if err != nil {
+			return nil, err
+		}
+		authn.oidc = oidc
+		authn.authenticators = append(authn.authenticators, oidc)
+	}
+
+	if secret := secretEnv("TUSX_URL_SIGNING_SECRET"); secret != "" {
+		authn.signer = &auth.SSignedURLs{Secret: []byte(secret), UploadExpiry: signedUploadExpiry}
+	}
+	if rateCreations > 0 || ratePatches > 0 || rateBytes > 0 {
+		proxies, err := auth.ParsePrefixes(trustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		authn.limiter = &auth.SRateLimiter{
+			CreationsPerMinute:   rateCreations,
+			MaxConcurrentPatches: ratePatches,
+			BytesPerSecond:       rateBytes,
+			TrustedProxies:       proxies,
+		}
+	}
+
+	if csrf {
+		if authn.oidc == nil && authn.basic == nil {
+			return nil, errors.New("-csrf requires -oidc-issuer or -basic-auth")
+		}
+		authn.csrf = &auth.SCSRF{Secret: []byte(secretEnv("TUSX_CSRF_SECRET"))}
+		if len(authn.csrf.Secret) == 0 {
+			authn.csrf.Secret = auth.NewCSRFSecret()
+		}
+		if authn.oidc != nil {
+			authn.csrf.SessionCookies = []string{authn.oidc.SessionCookieName()}
+		}
+	}
+	if rbac {
+		if len(authn.authenticators) == 0 && authn.signer == nil {
+			return nil, errors.New("-rbac requires authentication, e.g. -basic-auth or -jwt-jwks-url")
+		}
+		authn.rbac = &auth.SRBAC{RoleClaim: rbacRoleClaim}
+	}
+	return authn, nil
+}
+
+// handler 为tus接口添加认证, 禁用方法覆盖时先移除X-HTTP-Method-Override, 再检查客户端地址, 签名的URL在其它认证方式之前校验, 认证前检查CSRF令牌, 认证后检查角色和限流
+func (authn *sAuth) handler(next http.Handler) http.Handler {
+	if authn.limiter != nil {
+		next = authn.limiter.Handler(next)
+	}
+	if authn.rbac != nil {
+		next = authn.rbac.Handler(next)
+	}
+	if len(authn.authenticators) > 0 {
+		next = auth.Handler(next, authn.authenticators...)
+	}
+	if authn.csrf != nil {
+		next = authn.csrf.Handler(next)
+	}
+	if authn.signer != nil {
+		next = authn.signer.Handler(next)
+	}
+	if authn.ipFilter != nil {
+		next = authn.ipFilter.Handler(next)
+	}
+	// 认证与tus接口需看到相同的请求方法
+	if noOverride {
+		next = auth.IgnoreMethodOverride(next)
+	}
+	return next
+}
+
+// servePage 页面与tus接口限制相同的客户端地址, 启用OIDC或Basic认证时需要登录, 启用-csrf时下发令牌, 返回false时已写入响应
+func (authn *sAuth) servePage(w http.ResponseWriter, r *http.Request) bool {
+	if authn.ipFilter != nil {
+		addr, err := authn.ipFilter.ClientIP(r)
+		if err != nil || !authn.ipFilter.Permitted(addr) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+	var authenticators []auth.IAuthenticator
+	if authn.basic != nil {
+		authenticators = append(authenticators, authn.basic)
+	}
+	if authn.oidc != nil {
+		authenticators = append(authenticators, authn.oidc)
+	}
+	if len(authenticators) == 0 {
+		return true
+	}
+	if _, err := auth.Authenticate(r, authenticators...); err == nil {
+		if authn.csrf != nil {
+			authn.csrf.Issue(w, r)
+		}
+		return true
+	}
+	if authn.oidc != nil {
+		http.Redirect(w, r, "/auth/login?redirect=/", http.StatusFound)
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", authn.basic.Challenge())
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
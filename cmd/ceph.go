@@ -0,0 +1,40 @@
+//go:build ceph
+
+package main
+
+import (
+	"github.com/ceph/go-ceph/rados"
+
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+	cephstore "github.com/busybox-org/gin-fileuploader/storage/ceph"
+)
+
+func newCephStore(locker locker.ILocker) (storage.IStorage, error) {
+	conn, err := rados.NewConnWithUser(cephUser)
+	if err != nil {
+		return nil, err
+	}
+	if cephConfig != "" {
+		err = conn.ReadConfigFile(cephConfig)
+	} else {
+		err = conn.ReadDefaultConfigFile()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.Connect(); err != nil {
+		return nil, err
+	}
+	ioctx, err := conn.OpenIOContext(cephPool)
+	if err != nil {
+		conn.Shutdown()
+		return nil, err
+	}
+	store, err := cephstore.New(ioctx, locker)
+	if err != nil {
+		return nil, err
+	}
+	store.ObjectPrefix = cephObjectPrefix
+	return store, nil
+}
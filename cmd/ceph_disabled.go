@@ -0,0 +1,14 @@
+//go:build !ceph
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+func newCephStore(_ locker.ILocker) (storage.IStorage, error) {
+	return nil, fmt.Errorf("ceph support is not compiled in, rebuild with -tags ceph")
+}
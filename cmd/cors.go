@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+
+	"github.com/busybox-org/gin-fileuploader/auth"
+	tusx "github.com/busybox-org/gin-fileuploader/handler"
+)
+
+// newCORS 按-cors-*参数创建CORS中间件, 默认允许所有来源发送和读取tus客户端需要的请求头
+func newCORS() (gin.HandlerFunc, error) {
+	config := cors.Config{
+		AllowMethods:     []string{"GET", "HEAD", "POST", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     append(slices.Clone(tusx.CORSAllowHeaders), "Authorization", auth.HeaderAPIKey),
+		ExposeHeaders:    slices.Clone(tusx.CORSExposeHeaders),
+		AllowCredentials: corsCredentials,
+		MaxAge:           corsMaxAge,
+		AllowWildcard:    true,
+	}
+	config.AllowHeaders = append(config.AllowHeaders, corsHeaders...)
+	config.ExposeHeaders = append(config.ExposeHeaders, corsExposeHeaders...)
+	if len(corsOrigins) == 0 || slices.Contains(corsOrigins, "*") {
+		// 允许所有来源时浏览器不会发送凭据
+		if corsCredentials {
+			return nil, errors.New("-cors-credentials requires -cors-origin")
+		}
+		config.AllowAllOrigins = true
+	} else {
+		for _, origin := range corsOrigins {
+			if strings.Count(origin, "*") > 1 {
+				return nil, fmt.Errorf("invalid origin %s, only one * is allowed", origin)
+			}
+		}
+		config.AllowOrigins = corsOrigins
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return cors.New(config), nil
+}
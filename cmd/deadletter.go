@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xmapst/logx"
+
+	"github.com/busybox-org/gin-fileuploader/hooks"
+)
+
+// runDeadLetters lists the hooks which failed all attempts, see
+// -hooks-dead-letter-dir and -hooks-dead-letter-db, and replays them with the
+// configured hook handler, e.g.
+//
+//	uploader hook-dead-letters -hooks-dead-letter-dir ./dead -hooks-http http://... -replay [id...]
+//
+// Without IDs all dead letters are replayed, those succeeding are removed.
+// It exits with status 1 if a replay failed.
+func runDeadLetters(args []string) {
+	var replay bool
+	flag.BoolVar(&replay, "replay", false, "invoke the hook handler again with the dead letters given as arguments, or all, and remove them on success")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s hook-dead-letters [dead letter flags] [hook flags] [-replay [id...]]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	parseFlags(args)
+
+	ctx := context.Background()
+	deadLetters, err := newDeadLetterStore()
+	if err != nil {
+		logx.Fatalln("failed to open hook dead letters", err)
+	}
+	if deadLetters == nil {
+		logx.Fatalln("-hooks-dead-letter-dir or -hooks-dead-letter-db is required")
+	}
+
+	ids := flag.Args()
+	if len(ids) == 0 {
+		letters, err := deadLetters.List(ctx)
+		if err != nil {
+			logx.Fatalln("failed to list hook dead letters", err)
+		}
+		for _, letter := range letters {
+			ids = append(ids, letter.ID)
+			if !replay {
+				logx.Infoln(letter.ID, letter.Event.Type, letter.Event.Upload.ID, letter.FailedAt.Format(time.RFC3339), letter.Attempts, letter.Error)
+			}
+		}
+	}
+	if !replay {
+		if len(flag.Args()) > 0 {
+			logx.Fatalln("dead letter IDs require -replay")
+		}
+		return
+	}
+
+	hookHandler, err := newHookHandler()
+	if err != nil {
+		logx.Fatalln("invalid hooks", err)
+	}
+	if hookHandler == nil {
+		logx.Fatalln("-hooks-dir, -hooks-http or -hooks-plugin is required to replay dead letters")
+	}
+
+	var failed int
+	for _, id := range ids {
+		if err = hooks.Replay(ctx, deadLetters, hookHandler, id); err != nil {
+			failed++
+			logx.Errorln("failed to replay", id, err)
+			continue
+		}
+		logx.Infoln("replayed", id)
+	}
+	if closer, ok := hookHandler.IHookHandler.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	logx.Infoln("replayed dead letters", len(ids)-failed, "failed", failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/xmapst/logx"
+)
+
+// envPrefix 参数对应的环境变量前缀, 例如-db-dsn对应TUSX_DB_DSN
+const envPrefix = "TUSX_"
+
+// parseFlags parses args into the flags of flag.CommandLine, flags missing
+// from args are taken from the environment, e.g. -db-dsn from TUSX_DB_DSN,
+// or from the file named by TUSX_DB_DSN_FILE, e.g. a Docker or Kubernetes
+// secret, so credentials don't have to be passed as arguments visible in
+// ps. Repeatable flags take one value per line.
+func parseFlags(args []string) {
+	_ = flag.CommandLine.Parse(args)
+	if err := flagsFromEnv(flag.CommandLine); err != nil {
+		logx.Fatalln(err)
+	}
+}
+
+// flagsFromEnv 设置命令行未指定的参数
+func flagsFromEnv(flags *flag.FlagSet) error {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var errs []error
+	flags.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok, err := lookupEnv(name)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		if !ok {
+			return
+		}
+		values := []string{value}
+		if _, list := f.Value.(*sFlagList); list {
+			values = strings.FieldsFunc(value, func(r rune) bool {
+				return r == '\n' || r == '\r'
+			})
+		}
+		for _, value = range values {
+			if err = f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value of %s for -%s: %w", name, f.Name, err))
+				return
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// lookupEnv 读取环境变量, 未设置时读取<name>_FILE指向的文件, 去除末尾的换行
+func lookupEnv(name string) (string, bool, error) {
+	value, ok := os.LookupEnv(name)
+	path, fromFile := os.LookupEnv(name + "_FILE")
+	switch {
+	case ok && fromFile:
+		return "", false, fmt.Errorf("%s and %s_FILE cannot both be set", name, name)
+	case fromFile:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read %s_FILE: %w", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+	return value, ok, nil
+}
+
+// secretEnv 读取密钥等环境变量, 同样支持<name>_FILE, 读取失败时退出
+func secretEnv(name string) string {
+	value, _, err := lookupEnv(name)
+	if err != nil {
+		logx.Fatalln(err)
+	}
+	return value
+}
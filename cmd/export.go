@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xmapst/logx"
+	"gorm.io/gorm"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// runExport writes the info of all uploads in the metadata store configured
+// by the usual flags as JSON lines, e.g.
+//
+//	uploader export -upload-dir ./uploads -file uploads.jsonl
+//
+// Only the metadata is exported, the upload data stays in the store.
+func runExport(args []string) {
+	var file string
+	flag.StringVar(&file, "file", "-", "file to write the upload info to, - for stdout")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s export [store flags] [-file uploads.jsonl]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	parseFlags(args)
+
+	ctx := context.Background()
+	meta, closeMeta, err := openMetaStore()
+	if err != nil {
+		logx.Fatalln("failed to open metadata store", err)
+	}
+	defer closeMeta()
+
+	out := io.Writer(os.Stdout)
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			logx.Fatalln("failed to create export file", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		out = f
+	}
+	writer := bufio.NewWriter(out)
+	encoder := json.NewEncoder(writer)
+
+	ids, err := meta.List(ctx, time.Time{})
+	if err != nil {
+		logx.Fatalln("failed to list uploads", err)
+	}
+	var exported int
+	for _, id := range ids {
+		info, err := meta.Get(ctx, id)
+		if err != nil {
+			// 导出期间被删除的上传直接跳过
+			if strings.Contains(err.Error(), "not found") {
+				continue
+			}
+			logx.Fatalln("failed to get upload", id, err)
+		}
+		if err = encoder.Encode(info); err != nil {
+			logx.Fatalln("failed to write upload", id, err)
+		}
+		exported++
+	}
+	if err = writer.Flush(); err != nil {
+		logx.Fatalln("failed to write export", err)
+	}
+	logx.Infoln("exported uploads", exported)
+}
+
+// runImport restores the upload info written by export into the metadata
+// store configured by the usual flags, which may use another database
+// engine than the exported one. Existing uploads with the same ID are
+// overwritten, so an interrupted import can be started again.
+func runImport(args []string) {
+	var file string
+	flag.StringVar(&file, "file", "-", "file to read the upload info from, - for stdin")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s import [store flags] [-file uploads.jsonl]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	parseFlags(args)
+
+	ctx := context.Background()
+	meta, closeMeta, err := openMetaStore()
+	if err != nil {
+		logx.Fatalln("failed to open metadata store", err)
+	}
+	defer closeMeta()
+
+	in := io.Reader(os.Stdin)
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			logx.Fatalln("failed to open import file", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		in = f
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(in))
+	var imported int
+	for {
+		var info common.FileInfo
+		err = decoder.Decode(&info)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			logx.Fatalln("failed to read upload", imported+1, err)
+		}
+		if info.ID == "" {
+			logx.Fatalln("upload without id", imported+1)
+		}
+		if err = meta.Create(ctx, info); err != nil {
+			logx.Fatalln("failed to import upload", info.ID, err)
+		}
+		imported++
+	}
+	logx.Infoln("imported uploads", imported)
+}
+
+// openMetaStore 打开当前参数对应的元数据存储, 返回的函数用于关闭
+func openMetaStore() (storage.IMetaStore, func(), error) {
+	if metadataDB() == "" {
+		return nil, nil, fmt.Errorf("the configured store keeps no upload metadata, use the local file store or -s3-metadata-db")
+	}
+	var gdb *gorm.DB
+	closeMeta := func() {}
+	if metadataRedisURL == "" && metadataBoltFile == "" {
+		var err error
+		gdb, err = openDB(uploadDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		closeMeta = func() {
+			db, err := gdb.DB()
+			if err == nil {
+				_ = db.Close()
+			}
+		}
+	}
+	meta, err := newMetaStore(gdb)
+	if err != nil {
+		closeMeta()
+		return nil, nil, err
+	}
+	if closer, ok := meta.(io.Closer); ok {
+		closeMeta = func() {
+			_ = closer.Close()
+		}
+	}
+	return meta, closeMeta, nil
+}
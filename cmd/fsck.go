@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/xmapst/logx"
+
+	filestore "github.com/busybox-org/gin-fileuploader/storage/file"
+)
+
+// runFsck cross-checks the upload metadata against the files in the upload
+// dir of the local file store and reports orphaned files, missing blobs and
+// offset mismatches, e.g.
+//
+//	uploader fsck -upload-dir ./uploads -repair
+//
+// It exits with status 1 if problems remain after the check.
+func runFsck(args []string) {
+	var repair bool
+	flag.BoolVar(&repair, "repair", false, "remove orphaned files and metadata of missing blobs, and correct offset mismatches")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s fsck [store flags] [-repair]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	parseFlags(args)
+	if !usesFileStore() {
+		logx.Fatalln("fsck only supports the local file store")
+	}
+
+	ctx := context.Background()
+	locker, err := newLocker()
+	if err != nil {
+		logx.Fatalln("failed to create locker", err)
+	}
+	store, closeStore, err := newMigrateStore(ctx, locker)
+	if err != nil {
+		logx.Fatalln("failed to create store", err)
+	}
+	defer closeStore()
+	fileStore, ok := store.(*filestore.SFileStore)
+	if !ok {
+		logx.Fatalln("fsck only supports the local file store")
+	}
+
+	problems, err := fileStore.Fsck(ctx, repair)
+	var remaining int
+	for _, problem := range problems {
+		status := "found"
+		if problem.Repaired {
+			status = "repaired"
+		} else {
+			remaining++
+		}
+		logx.Infoln(status, problem.Kind, problem.ID, problem.Path, problem.Detail)
+	}
+	if err != nil {
+		logx.Fatalln("failed to check uploads", err)
+	}
+	logx.Infoln("checked upload dir", uploadDir, "problems", len(problems), "remaining", remaining)
+	if remaining > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xmapst/logx"
+	"gorm.io/gorm"
+
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// sFlagList 可重复指定的参数
+type sFlagList []string
+
+func (l *sFlagList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *sFlagList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runMigrate copies all uploads from the store configured by the usual flags
+// to the store configured by the -to flags, e.g.
+//
+//	uploader migrate -upload-dir ./uploads -to s3-bucket=uploads -to s3-object-prefix=tus/
+//
+// Uploads already present in the target with the same offset are skipped,
+// partially copied uploads are resumed, so an interrupted migration can
+// simply be started again. The data is copied as stored, wrappers like
+// encryption or compression are not applied.
+func runMigrate(args []string) {
+	var (
+		targetFlags sFlagList
+		dryRun      bool
+	)
+	flag.Var(&targetFlags, "to", "flag of the target store as name=value, e.g. -to s3-bucket=uploads, can be repeated")
+	flag.BoolVar(&dryRun, "dry-run", false, "only print what would be migrated")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s migrate [source flags] -to name=value... [-dry-run]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	parseFlags(args)
+	if len(targetFlags) == 0 {
+		logx.Fatalln("no target store given, use -to to configure it")
+	}
+
+	ctx := context.Background()
+	locker, err := newLocker()
+	if err != nil {
+		logx.Fatalln("failed to create locker", err)
+	}
+	sourceIsFile, sourceDir, sourceDB := usesFileStore(), uploadDir, metadataDB()
+	source, closeSource, err := newMigrateStore(ctx, locker)
+	if err != nil {
+		logx.Fatalln("failed to create source store", err)
+	}
+	defer closeSource()
+	if !storage.CanListUploads(source) {
+		logx.Fatalln("source store does not support listing uploads")
+	}
+
+	// 重置为默认值后应用目标存储的参数
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "to" && f.Name != "dry-run" {
+			_ = f.Value.Set(f.DefValue)
+		}
+	})
+	for _, targetFlag := range targetFlags {
+		name, value, _ := strings.Cut(targetFlag, "=")
+		if err = flag.Set(strings.TrimLeft(name, "-"), value); err != nil {
+			logx.Fatalln("invalid target flag", targetFlag, err)
+		}
+	}
+	// 共用元数据数据库的两个存储同样视为相同
+	sameDB := sourceDB != "" && sourceDB == metadataDB()
+	if (sourceIsFile && usesFileStore() && filepath.Clean(uploadDir) == filepath.Clean(sourceDir)) || sameDB {
+		logx.Fatalln("source and target store are the same")
+	}
+	target, closeTarget, err := newMigrateStore(ctx, locker)
+	if err != nil {
+		logx.Fatalln("failed to create target store", err)
+	}
+	defer closeTarget()
+
+	ids, err := storage.ListUploads(ctx, source)
+	if err != nil {
+		logx.Fatalln("failed to list uploads", err)
+	}
+	var failed int
+	for _, id := range ids {
+		action, size, err := migrateUpload(ctx, source, target, id, dryRun)
+		if err != nil {
+			failed++
+			logx.Errorln("failed to migrate upload", id, err)
+			continue
+		}
+		logx.Infoln(action, id, size)
+	}
+	logx.Infoln("migrated uploads", len(ids)-failed, "failed", failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// newMigrateStore 创建当前参数对应的存储, 仅在元数据保存在数据库中时打开数据库
+func newMigrateStore(ctx context.Context, locker locker.ILocker) (storage.IStorage, func(), error) {
+	var gdb *gorm.DB
+	closeDB := func() {}
+	if metadataDB() != "" && metadataRedisURL == "" && metadataBoltFile == "" {
+		var err error
+		gdb, err = openDB(uploadDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		closeDB = func() {
+			db, err := gdb.DB()
+			if err == nil {
+				_ = db.Close()
+			}
+		}
+	}
+	store, err := newBackendStore(ctx, gdb, locker)
+	if err != nil {
+		closeDB()
+		return nil, nil, err
+	}
+	return store, closeDB, nil
+}
+
+// migrateUpload 将单个上传复制到目标存储, 返回执行的操作及复制的字节数
+func migrateUpload(ctx context.Context, source, target storage.IStorage, id string, dryRun bool) (string, int64, error) {
+	sourceUpload, err := source.GetUpload(ctx, id)
+	if err != nil {
+		return "", 0, err
+	}
+	info, err := sourceUpload.GetInfo(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+
+	action := "copy"
+	var offset int64
+	targetUpload, err := target.GetUpload(ctx, id)
+	if err == nil {
+		targetInfo, err := targetUpload.GetInfo(ctx)
+		if err != nil {
+			return "", 0, err
+		}
+		switch {
+		case targetInfo.Size == info.Size && targetInfo.Offset == info.Offset:
+			return "skip", 0, nil
+		case targetInfo.Size == info.Size && targetInfo.Offset < info.Offset:
+			action = "resume"
+			offset = targetInfo.Offset
+		default:
+			// 目标中的数据与源不一致, 重新复制
+			action = "replace"
+			if !dryRun {
+				if err = targetUpload.Terminate(ctx); err != nil {
+					return "", 0, err
+				}
+			}
+			targetUpload = nil
+		}
+	} else if !strings.Contains(err.Error(), "not found") {
+		return "", 0, err
+	}
+	if dryRun {
+		return action, info.Offset - offset, nil
+	}
+
+	if targetUpload == nil {
+		targetInfo := info
+		targetInfo.Offset = 0
+		targetInfo.Storage = nil
+		targetUpload, err = target.NewUpload(ctx, targetInfo)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	if info.Offset <= offset {
+		return action, 0, nil
+	}
+
+	reader, err := sourceUpload.GetReader(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	if _, err = io.CopyN(io.Discard, reader, offset); err != nil {
+		return "", 0, err
+	}
+	n, err := targetUpload.WriteChunk(ctx, offset, io.LimitReader(reader, info.Offset-offset))
+	if err != nil {
+		return "", n, err
+	}
+	if n != info.Offset-offset {
+		return "", n, fmt.Errorf("copied %d of %d bytes", n, info.Offset-offset)
+	}
+	return action, n, nil
+}
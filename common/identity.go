@@ -0,0 +1,52 @@
+package common
+
+import (
+	"context"
+	"slices"
+)
+
+const (
+	// MetaDataOwner is the upload metadata key the handler stores the
+	// Subject of the identity creating an upload under.
+	MetaDataOwner = "owner"
+	// MetaDataOwnerScopes stores the space separated Scopes of that
+	// identity.
+	MetaDataOwnerScopes = "owner_scopes"
+)
+
+// Identity is the authenticated client of a request, e.g. the claims of a
+// JWT.
+type Identity struct {
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes,omitempty"`
+	// Roles are the roles assigned to the client, they grant scopes, see
+	// auth.RoleScopes.
+	Roles []string `json:"roles,omitempty"`
+	// Claims are the raw claims of the credential, if any.
+	Claims map[string]any `json:"claims,omitempty"`
+}
+
+func (identity *Identity) HasScope(scope string) bool {
+	return identity != nil && slices.Contains(identity.Scopes, scope)
+}
+
+func (identity *Identity) HasRole(role string) bool {
+	return identity != nil && slices.Contains(identity.Roles, role)
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying identity.
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity set by WithIdentity, nil for
+// unauthenticated requests.
+func IdentityFromContext(ctx context.Context) *Identity {
+	if ctx == nil {
+		return nil
+	}
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
@@ -24,6 +24,16 @@ const (
 	HeaderMaxSize            = "Tus-Max-Size"
 	HeaderExtension          = "Tus-Extension"
 	HeaderChecksumAlgorithm  = "Tus-Checksum-Algorithm"
+	HeaderUploadPresignedURL = "Upload-Presigned-Url"
+	HeaderUploadExpires      = "Upload-Expires"
+	HeaderUploadCreated      = "Upload-Created"
+	// HeaderUploadEncryptionKey carries the base64 encoded key of uploads
+	// encrypted with a client's key.
+	HeaderUploadEncryptionKey = "Upload-Encryption-Key"
+
+	// IETF draft resumable uploads
+	HeaderUploadComplete            = "Upload-Complete"
+	HeaderUploadDraftInteropVersion = "Upload-Draft-Interop-Version"
 )
 
 type FileInfoChanges struct {
@@ -41,12 +51,28 @@ type FileInfo struct {
 	IsFinal        bool              `json:"isFinal"`
 	PartialIDs     []string          `json:"partialIDs,omitempty"`
 	CreateTime     time.Time         `json:"createTime"`
+	// Storage 存储后端相关的信息, 例如文件所在路径
+	Storage map[string]string `json:"storage,omitempty"`
 }
 
 type HookEvent struct {
 	Context     context.Context
 	Upload      FileInfo
 	HTTPRequest *http.Request
+	// Scan is the result of the virus scan, only for upload.scanned events.
+	Scan *ScanResult
+}
+
+// ScanResult is the outcome of scanning a finished upload for viruses.
+type ScanResult struct {
+	Infected bool `json:"infected"`
+	// Signature names the virus found in infected uploads.
+	Signature string `json:"signature,omitempty"`
+	// Action is what was done with an infected upload, "quarantine" or
+	// "delete", empty if it was kept.
+	Action string `json:"action,omitempty"`
+	// Error is set if the upload couldn't be scanned or the action failed.
+	Error string `json:"error,omitempty"`
 }
 
 type HTTPResponse struct {
@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// The actions of bulk jobs, see StartBulkJob.
+const (
+	// BulkActionDelete deletes the matching uploads like DeleteUpload.
+	BulkActionDelete = "delete"
+	// BulkActionExpire deletes the matching uploads which are still in
+	// progress, as if they had expired.
+	BulkActionExpire = "expire"
+)
+
+// The states of SBulkJob.
+const (
+	BulkJobRunning = "running"
+	BulkJobDone    = "done"
+	BulkJobFailed  = "failed"
+)
+
+// ErrBulkJobNotFound is returned by BulkJob for unknown jobs.
+var ErrBulkJobNotFound = errors.New("bulk job not found")
+
+// maxBulkJobs 保留的已结束任务数量, 超过后删除最早的
+const maxBulkJobs = 100
+
+// SBulkJob is the progress of a job started by StartBulkJob.
+type SBulkJob struct {
+	ID     string        `json:"id"`
+	Action string        `json:"action"`
+	Filter SUploadFilter `json:"filter"`
+	State  string        `json:"state"`
+	// Total is the number of matching uploads, known once they have been
+	// listed.
+	Total int `json:"total"`
+	// Processed counts the matching uploads handled so far, Deleted those
+	// removed (partial uploads removed with their final upload aren't
+	// counted) and Failed those which couldn't be removed.
+	Processed int `json:"processed"`
+	Deleted   int `json:"deleted"`
+	Failed    int `json:"failed"`
+	// Error is the last error of the job.
+	Error     string     `json:"error,omitempty"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+}
+
+// sBulkJobs 本实例的任务, 重启后丢失
+type sBulkJobs struct {
+	mu    sync.Mutex
+	jobs  map[string]*SBulkJob
+	order []string
+}
+
+// update 修改任务并返回副本
+func (jobs *sBulkJobs) update(id string, fn func(job *SBulkJob)) SBulkJob {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	job := jobs.jobs[id]
+	fn(job)
+	return *job
+}
+
+// StartBulkJob deletes or expires (see BulkActionDelete and
+// BulkActionExpire) the uploads matching filter in the background and
+// returns the job, whose progress is reported by BulkJob. Jobs are kept in
+// memory of this instance only, the last 100 finished ones are retained.
+// The store has to be able to list its uploads, see storage.CanListUploads,
+// otherwise ErrListingUnsupported is returned.
+func (s *SHandler) StartBulkJob(ctx context.Context, action string, filter SUploadFilter) (SBulkJob, error) {
+	switch action {
+	case BulkActionDelete:
+	case BulkActionExpire:
+		if filter.State == UploadStateComplete {
+			return SBulkJob{}, fmt.Errorf("%w: finished uploads don't expire", ErrInvalidFilter)
+		}
+		filter.State = UploadStateInProgress
+	default:
+		return SBulkJob{}, fmt.Errorf("unknown bulk action %s", action)
+	}
+	if err := filter.validate(); err != nil {
+		return SBulkJob{}, err
+	}
+	if !s.CanListUploads() {
+		return SBulkJob{}, ErrListingUnsupported
+	}
+
+	job := &SBulkJob{
+		ID:        common.Uid(),
+		Action:    action,
+		Filter:    filter,
+		State:     BulkJobRunning,
+		StartTime: time.Now(),
+	}
+	s.bulkJobs.mu.Lock()
+	s.bulkJobs.jobs[job.ID] = job
+	s.bulkJobs.order = append(s.bulkJobs.order, job.ID)
+	s.pruneBulkJobs()
+	started := *job
+	s.bulkJobs.mu.Unlock()
+
+	go s.runBulkJob(context.WithoutCancel(ctx), job.ID, filter)
+	return started, nil
+}
+
+// BulkJob returns the progress of the job with id.
+func (s *SHandler) BulkJob(id string) (SBulkJob, error) {
+	s.bulkJobs.mu.Lock()
+	defer s.bulkJobs.mu.Unlock()
+	job, ok := s.bulkJobs.jobs[id]
+	if !ok {
+		return SBulkJob{}, fmt.Errorf("%w: %s", ErrBulkJobNotFound, id)
+	}
+	return *job, nil
+}
+
+// pruneBulkJobs 删除最早结束的任务, 调用时需持有锁
+func (s *SHandler) pruneBulkJobs() {
+	for i := 0; len(s.bulkJobs.jobs) > maxBulkJobs && i < len(s.bulkJobs.order); {
+		id := s.bulkJobs.order[i]
+		if s.bulkJobs.jobs[id].State == BulkJobRunning {
+			i++
+			continue
+		}
+		delete(s.bulkJobs.jobs, id)
+		s.bulkJobs.order = append(s.bulkJobs.order[:i], s.bulkJobs.order[i+1:]...)
+	}
+}
+
+// runBulkJob 先列出满足条件的上传再逐个删除, 单个上传失败时继续处理其余上传
+func (s *SHandler) runBulkJob(ctx context.Context, id string, filter SUploadFilter) {
+	var uploads []storage.IUpload
+	var infos []common.FileInfo
+	err := s.walkUploads(ctx, filter, func(upload storage.IUpload, info common.FileInfo) error {
+		uploads = append(uploads, upload)
+		infos = append(infos, info)
+		return nil
+	})
+	if err != nil {
+		s.logger.Errorf("Error listing uploads of bulk job %s: %v", id, err)
+		s.finishBulkJob(id, err)
+		return
+	}
+	s.bulkJobs.update(id, func(job *SBulkJob) {
+		job.Total = len(uploads)
+	})
+
+	for i, upload := range uploads {
+		_, err = s.deleteUpload(ctx, upload, infos[i])
+		// 已作为其他最终上传的分片被删除
+		if err != nil && strings.Contains(err.Error(), "not found") {
+			s.bulkJobs.update(id, func(job *SBulkJob) {
+				job.Processed++
+			})
+			continue
+		}
+		if err != nil {
+			s.logger.Errorf("Error deleting upload %s of bulk job %s: %v", infos[i].ID, id, err)
+		}
+		s.bulkJobs.update(id, func(job *SBulkJob) {
+			job.Processed++
+			if err != nil {
+				job.Failed++
+				job.Error = err.Error()
+			} else {
+				job.Deleted++
+			}
+		})
+	}
+	s.finishBulkJob(id, nil)
+}
+
+func (s *SHandler) finishBulkJob(id string, err error) {
+	job := s.bulkJobs.update(id, func(job *SBulkJob) {
+		now := time.Now()
+		job.EndTime = &now
+		job.State = BulkJobDone
+		if err != nil {
+			job.State = BulkJobFailed
+			job.Error = err.Error()
+		}
+	})
+	s.logger.Infof("Bulk job %s %s: %d of %d uploads deleted, %d failed", job.ID, job.State, job.Deleted, job.Total, job.Failed)
+}
@@ -7,8 +7,10 @@ import (
 	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"io"
 	"strings"
 
@@ -16,6 +18,19 @@ import (
 	"golang.org/x/crypto/sha3"
 )
 
+// StatusChecksumMismatch is the status of a request whose body doesn't match
+// the Upload-Checksum header, as defined by the tus checksum extension.
+const StatusChecksumMismatch = 460
+
+var (
+	// ErrChecksumMismatch is returned when the checksum of a chunk differs
+	// from the Upload-Checksum header, the chunk is discarded.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrInvalidChecksum is returned for a malformed Upload-Checksum header
+	// or an unsupported algorithm.
+	ErrInvalidChecksum = errors.New("invalid checksum")
+)
+
 type HashProvider struct {
 	hasher hash.Hash
 }
@@ -50,6 +65,8 @@ func NewHash(algorithm string) (hash.Hash, error) {
 		return sha3.New256(), nil
 	case "sm3":
 		return sm3.New(), nil
+	case "crc32":
+		return crc32.NewIEEE(), nil
 	default:
 		return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
 	}
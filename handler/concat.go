@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+var (
+	// ErrPartialUploadNotFound is returned when a final upload references a
+	// partial upload that doesn't exist.
+	ErrPartialUploadNotFound = errors.New("partial upload not found")
+	// ErrNotPartialUpload is returned when a final upload references an
+	// upload that wasn't created with Upload-Concat: partial.
+	ErrNotPartialUpload = errors.New("upload is not a partial upload")
+	// ErrPartialUploadNotFinished is returned when a final upload references
+	// a partial upload that hasn't received all of its data yet.
+	ErrPartialUploadNotFinished = errors.New("partial upload is not finished")
+	// ErrPartialUploadTooLarge is returned when a partial upload exceeds
+	// SConfig.MaxPartialSize.
+	ErrPartialUploadTooLarge = errors.New("partial upload too large")
+)
+
+// getPartialUploads 获取最终上传引用的分片并校验均已完成, 返回分片及其总大小.
+// 分片各自拥有独立的锁, 客户端可通过多个连接并行上传, 合并前需全部上传完毕
+func (s *SHandler) getPartialUploads(ctx context.Context, partialIDs []string) ([]storage.IUpload, int64, error) {
+	var size int64
+	partialUploads := make([]storage.IUpload, 0, len(partialIDs))
+	for _, partialID := range partialIDs {
+		partialUpload, err := s.storage.GetUpload(ctx, partialID)
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				return nil, 0, fmt.Errorf("%w: %s", ErrPartialUploadNotFound, partialID)
+			}
+			return nil, 0, err
+		}
+		info, err := partialUpload.GetInfo(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !info.IsPartial {
+			return nil, 0, fmt.Errorf("%w: %s", ErrNotPartialUpload, partialID)
+		}
+		if !s.isOwner(ctx, info) {
+			return nil, 0, fmt.Errorf("%w: %s", ErrNotOwner, partialID)
+		}
+		// 过期的分片随时可能被清理
+		if s.expired(info) {
+			return nil, 0, fmt.Errorf("%w: %s has expired", ErrPartialUploadNotFound, partialID)
+		}
+		if info.SizeIsDeferred || info.Offset != info.Size {
+			return nil, 0, fmt.Errorf("%w: %s", ErrPartialUploadNotFinished, partialID)
+		}
+		// 延迟声明长度的分片可能写入超过限制的数据
+		if err = s.checkPartialSize(info.Size); err != nil {
+			return nil, 0, fmt.Errorf("%w: %s", err, partialID)
+		}
+		size += info.Size
+		partialUploads = append(partialUploads, partialUpload)
+	}
+	return partialUploads, size, nil
+}
+
+// checkPartialSize 校验分片大小不超过MaxPartialSize
+func (s *SHandler) checkPartialSize(size int64) error {
+	if s.config.MaxPartialSize > 0 && size > s.config.MaxPartialSize {
+		return fmt.Errorf("%w: exceeds %d bytes", ErrPartialUploadTooLarge, s.config.MaxPartialSize)
+	}
+	return nil
+}
@@ -3,26 +3,233 @@ package handler
 import (
 	"fmt"
 	"net/url"
+	"slices"
+	"time"
 
 	"github.com/busybox-org/gin-fileuploader/common"
 	"github.com/busybox-org/gin-fileuploader/storage"
 )
 
 type SConfig struct {
-	MaxSize                    int64
-	BasePath                   string
-	isAbs                      bool
-	Store                      storage.IStorage
-	Logger                     common.ILogger
-	PreUploadCreateCallback    func(hook common.HookEvent) (common.HTTPResponse, common.FileInfoChanges, error)
+	// MaxSize is the maximum size of an upload in bytes, advertised in the
+	// Tus-Max-Size header. Larger uploads, and uploads with a deferred
+	// length growing past it, are rejected with 413. 0 disables the limit.
+	MaxSize int64
+	// BasePath is the path the handler is mounted at, or an absolute URL
+	// used as is in the Location header. Otherwise the Location header is
+	// built from the request, honoring X-Forwarded-Proto, X-Forwarded-Host,
+	// X-Forwarded-Prefix and Forwarded set by reverse proxies.
+	BasePath string
+	isAbs    bool
+	Store    storage.IStorage
+	Logger   common.ILogger
+	// PreUploadCreateCallback is called before an upload is created, after
+	// its size and metadata have been validated. Returning an error rejects
+	// the creation (see ErrUploadRejected), the returned FileInfoChanges can
+	// override the ID and metadata of the upload.
+	PreUploadCreateCallback func(hook common.HookEvent) (common.HTTPResponse, common.FileInfoChanges, error)
+	// PreFinishResponseCallback is called once after the last byte of an
+	// upload has been written, before the response is sent and the
+	// upload.finished event is published. The returned HTTPResponse is
+	// merged into the response, e.g. to return a JSON body, returning an
+	// error fails the request like PreUploadCreateCallback.
 	PreFinishResponseCallback  func(hook common.HookEvent) (common.HTTPResponse, error)
 	PreUploadTerminateCallback func(hook common.HookEvent) (common.HTTPResponse, error)
+
+	// ProgressInterval and ProgressBytes enable progress reports while the
+	// body of a PATCH request is received, whenever the interval has passed
+	// or the number of bytes has been received since the last report.
+	// Reports are published to SubscribeProgressUploads.
+	ProgressInterval time.Duration
+	ProgressBytes    int64
+	// ProgressCallback is called with each progress report before it is
+	// published, blocking the upload. Returning an error aborts the PATCH
+	// request like PreUploadCreateCallback, the data received until then is
+	// kept and the client can resume the upload.
+	ProgressCallback func(hook common.HookEvent) error
+	// EnableEventStream serves the offset of an upload as Server-Sent
+	// Events at GET <BasePath><id>/events, e.g. for a second browser tab
+	// or a dashboard watching the upload. A "progress" event is sent with
+	// the current state and then with every progress report, the stream
+	// ends with a "finished" or "terminated" event. Only the requests
+	// served by this instance are reported.
+	EnableEventStream bool
+
+	// RelativeLocation returns the Location header of new uploads as a path
+	// without scheme and host.
+	RelativeLocation bool
+
+	// IDGenerator generates the IDs of new uploads, e.g. SUUIDv7Generator or
+	// SULIDGenerator for IDs sorting by creation time. The store generates
+	// random IDs if nil.
+	IDGenerator IIDGenerator
+
+	// PresignedPartExpiry enables direct uploads to the storage backend if
+	// the store supports it (see storage.IPresignedUpload). The handler then
+	// returns a presigned URL for the next part in the Upload-Presigned-Url
+	// header, and a PATCH without body and Upload-Length syncs the offset
+	// from the backend. Its Upload-Offset must include the uploaded parts.
+	PresignedPartExpiry time.Duration
+	// PresignedDownloadExpiry adds a presigned download URL valid this long
+	// as "DownloadURL" to FileInfo.Storage of the pre-finish hook and the
+	// upload.finished event, if the store supports it (see
+	// storage.IPresignedDownload). 0 disables it.
+	PresignedDownloadExpiry time.Duration
+
+	// UploadExpiry enables the expiration extension: uploads expire this
+	// long after their creation, requests for them are answered with 410
+	// Gone until the store's Cleanup removes them. 0 disables expiration.
+	UploadExpiry time.Duration
+
+	// RequireOwner permits the requests for an upload only to the identity
+	// which created it (see common.MetaDataOwner) and to identities with
+	// AdminScope, others are answered with 403. The identity is set by an
+	// authentication middleware, e.g. auth.Handler, requests without one
+	// are rejected.
+	RequireOwner bool
+	AdminScope   string
+	// ReadAllScope permits identities to read, but not modify, the uploads
+	// of others with RequireOwner, i.e. HEAD and GET requests.
+	ReadAllScope string
+
+	// PauseStore keeps the uploads paused by PauseUpload, an in-memory
+	// store if nil.
+	PauseStore IPauseStore
+	// PauseRetryAfter is sent in the Retry-After header of PATCH requests
+	// to paused uploads, one minute if 0.
+	PauseRetryAfter time.Duration
+
+	// EnableClientKeys lets clients encrypt uploads with their
+	// own key, sent base64 encoded in the Upload-Encryption-Key header when
+	// creating the upload and with every request reading or writing its
+	// data. The key is passed to the store with storage.WithEncryptionKey,
+	// which has to support it, e.g. encrypted.SEncryptedStore, and is never
+	// persisted. Requests without the key are answered with 400, with
+	// another key with 403. Chunks with an Upload-Checksum header are
+	// buffered unencrypted in TemporaryDirectory until verified.
+	EnableClientKeys bool
+
+	// AllowedContentTypes and DeniedContentTypes restrict the content of
+	// uploads, as detected from their first 512 bytes by
+	// DetectContentType regardless of the declared metadata, e.g. image/*
+	// or application/x-executable. Uploads of other types are rejected
+	// with 415 when their first chunk is received, which has to contain
+	// 512 bytes or the whole upload. Denied types take precedence, all
+	// types are allowed if AllowedContentTypes is empty.
+	AllowedContentTypes []string
+	DeniedContentTypes  []string
+
+	// Scanner scans every finished upload, except partial uploads, for
+	// viruses in the background after the upload.finished event, the
+	// result is published to SubscribeScannedUploads. Uploads can be
+	// downloaded until their scan has finished.
+	Scanner IVirusScanner
+	// ScanAction is taken for infected uploads, ScanActionQuarantine or
+	// ScanActionDelete, they are kept if empty.
+	ScanAction string
+	// QuarantineStore receives the infected uploads with
+	// ScanActionQuarantine, under their ID and with their info.
+	QuarantineStore storage.IStorage
+
+	// QuotaStore enables per owner storage quotas (see
+	// common.MetaDataOwner): creating an upload which doesn't fit into the
+	// quota of its owner is answered with 413. The size of an upload is
+	// counted once known, at creation or when its length is declared, and
+	// released when it is terminated. Uploads without owner are unlimited.
+	QuotaStore IQuotaStore
+	// DefaultQuota is the quota in bytes of owners without their own, see
+	// SHandler.SetQuota, 0 is unlimited.
+	DefaultQuota int64
+
+	// DisabledExtensions turns off tus extensions, they are then neither
+	// advertised in Tus-Extension nor accepted. Valid are
+	// creation-with-upload, creation-defer-length, checksum,
+	// checksum-trailer, termination, concatenation and expiration.
+	// Disabling checksum disables checksum-trailer as well.
+	DisabledExtensions []string
+
+	// DisableCORS stops the handler from setting Access-Control-* headers,
+	// which allow every origin, so a CORS middleware can apply its policy,
+	// see CORSAllowHeaders and CORSExposeHeaders.
+	DisableCORS bool
+
+	// DisableMethodOverride ignores the X-HTTP-Method-Override header. By
+	// default the method of a POST request is replaced by the header's, so
+	// clients behind proxies blocking PATCH and DELETE can tunnel them.
+	DisableMethodOverride bool
+
+	// EnableDraftProtocol serves requests with an Upload-Draft-Interop-Version
+	// header according to the IETF resumable uploads draft (see
+	// DraftInteropVersion) next to tus 1.0, both share the same uploads.
+	EnableDraftProtocol bool
+
+	// MaxConcatPartials, if > 0, is the maximum number of partial uploads a
+	// final upload may reference.
+	MaxConcatPartials int
+	// MaxPartialSize, if > 0, is the maximum size of a partial upload in
+	// bytes. Partial uploads exceeding it are rejected when they are created
+	// or their length is declared, and cannot be concatenated.
+	MaxPartialSize int64
+
+	// ContentDisposition overrides the Content-Disposition type of GET
+	// requests, "attachment" or "inline". By default only allowlisted media
+	// types are served inline. "inline" serves every upload inline, including
+	// HTML and scripts, and should only be used if uploads are served from a
+	// separate origin.
+	ContentDisposition string
+
+	// MetadataRules constrain the Upload-Metadata of new uploads, POST
+	// requests violating them are rejected with 400 before the upload is
+	// created in the store.
+	MetadataRules []SMetadataRule
+	// MaxMetadataSize, if > 0, is the maximum length of the Upload-Metadata
+	// header in bytes, larger headers are rejected with 413.
+	MaxMetadataSize int
+	// MaxMetadataKeys, if > 0, is the maximum number of Upload-Metadata keys,
+	// uploads with more keys are rejected with 400.
+	MaxMetadataKeys int
+
+	// TemporaryDirectory is where chunks with an Upload-Checksum header are
+	// buffered until their checksum is verified, the default directory for
+	// temporary files if empty.
+	TemporaryDirectory string
 }
 
 func (config *SConfig) validate() error {
 	if config.Logger == nil {
 		return fmt.Errorf("logger is required")
 	}
+	for _, extension := range config.DisabledExtensions {
+		if !slices.Contains(optionalExtensions, extension) {
+			return fmt.Errorf("unknown or required extension %s", extension)
+		}
+	}
+	if config.ContentDisposition != "" && config.ContentDisposition != "attachment" && config.ContentDisposition != "inline" {
+		return fmt.Errorf("invalid content disposition %s", config.ContentDisposition)
+	}
+	if config.ProgressInterval < 0 || config.ProgressBytes < 0 {
+		return fmt.Errorf("progress interval and bytes cannot be negative")
+	}
+	if config.MaxConcatPartials < 0 || config.MaxPartialSize < 0 {
+		return fmt.Errorf("concatenation limits cannot be negative")
+	}
+	if config.MaxMetadataSize < 0 || config.MaxMetadataKeys < 0 {
+		return fmt.Errorf("metadata limits cannot be negative")
+	}
+	switch config.ScanAction {
+	case "", ScanActionDelete:
+	case ScanActionQuarantine:
+		if config.QuarantineStore == nil {
+			return fmt.Errorf("scan action %s requires a quarantine store", config.ScanAction)
+		}
+	default:
+		return fmt.Errorf("invalid scan action %s", config.ScanAction)
+	}
+	for _, rule := range config.MetadataRules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
 
 	base := config.BasePath
 	uri, err := url.Parse(base)
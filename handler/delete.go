@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// DeleteUpload removes the upload with id from the store, including its
+// info in the metadata database, and for a final upload the partial uploads
+// it was concatenated from, even if other final uploads were concatenated
+// from them as well. It works whether or not the termination extension is
+// enabled, the pre-terminate callback isn't run, but upload.terminated is
+// published for every removed upload (see SubscribeTerminatedUploads). It
+// returns the IDs of the removed uploads, an error containing "not found"
+// if there is no upload with id.
+func (s *SHandler) DeleteUpload(ctx context.Context, id string) ([]string, error) {
+	upload, err := s.storage.GetUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.deleteUpload(ctx, upload, info)
+}
+
+// deleteUpload 删除上传, 最终上传同时删除其分片, 返回已删除的ID
+func (s *SHandler) deleteUpload(ctx context.Context, upload storage.IUpload, info common.FileInfo) ([]string, error) {
+	if err := s.terminate(ctx, nil, upload, info); err != nil {
+		return nil, err
+	}
+	deleted := []string{info.ID}
+	if !info.IsFinal {
+		return deleted, nil
+	}
+
+	for _, partialID := range info.PartialIDs {
+		partial, err := s.storage.GetUpload(ctx, partialID)
+		if err != nil {
+			// 分片可能已被删除或过期清理
+			if strings.Contains(err.Error(), "not found") {
+				continue
+			}
+			return deleted, fmt.Errorf("failed to delete partial upload %s: %w", partialID, err)
+		}
+		partialInfo, err := partial.GetInfo(ctx)
+		if err == nil {
+			err = s.terminate(ctx, nil, partial, partialInfo)
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete partial upload %s: %w", partialID, err)
+		}
+		deleted = append(deleted, partialID)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,385 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// DraftInteropVersion is the Upload-Draft-Interop-Version of the IETF
+// resumable uploads draft (draft-ietf-httpbis-resumable-upload-05) that is
+// implemented next to tus 1.0.
+const DraftInteropVersion = "6"
+
+// StatusUploadResumptionSupported is the informational response sent with
+// the Location of a new upload before its body is read, so clients can
+// resume the upload if the connection breaks during the creation request.
+const StatusUploadResumptionSupported = 104
+
+// draftContentType 追加数据请求的Content-Type
+const draftContentType = "application/partial-upload"
+
+// serveDraft 处理IETF草案协议的请求, 创建/追加/查询偏移量, 删除与tus共用
+func (s *SHandler) serveDraft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(common.HeaderUploadDraftInteropVersion, DraftInteropVersion)
+	if version := r.Header.Get(common.HeaderUploadDraftInteropVersion); version != DraftInteropVersion {
+		s.logger.Errorf("Unsupported Upload-Draft-Interop-Version: %v", version)
+		http.Error(w, "Unsupported Upload-Draft-Interop-Version", http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Path == s.basePath {
+		if r.Method == http.MethodPost {
+			s.handleDraftCreate(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	} else if strings.HasPrefix(r.URL.Path, s.basePath) {
+		uploadID := strings.TrimPrefix(r.URL.Path, s.basePath)
+		switch r.Method {
+		case http.MethodHead:
+			s.handleDraftHead(w, r, uploadID)
+		case http.MethodPatch:
+			s.handleDraftAppend(w, r, uploadID)
+		case http.MethodDelete:
+			s.handleDelete(w, r, uploadID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	} else {
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (s *SHandler) handleDraftCreate(w http.ResponseWriter, r *http.Request) {
+	complete, err := parseDraftComplete(r)
+	if err != nil {
+		s.logger.Errorf("Error parsing upload info: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info := common.FileInfo{SizeIsDeferred: true}
+	if lengthHeader := r.Header.Get(common.HeaderUploadLength); lengthHeader != "" {
+		info.Size, err = strconv.ParseInt(lengthHeader, 10, 64)
+		if err != nil || info.Size < 0 {
+			s.logger.Errorf("Invalid Upload-Length header: %v", lengthHeader)
+			http.Error(w, "Invalid Upload-Length header", http.StatusBadRequest)
+			return
+		}
+		info.SizeIsDeferred = false
+	}
+	// 请求体即为完整的上传时, 其长度就是上传大小
+	if complete && r.ContentLength >= 0 {
+		if !info.SizeIsDeferred && info.Size != r.ContentLength {
+			s.logger.Errorf("Upload-Length doesn't match the complete body: %d != %d", info.Size, r.ContentLength)
+			http.Error(w, "Upload-Length doesn't match the request body", http.StatusBadRequest)
+			return
+		}
+		info.Size = r.ContentLength
+		info.SizeIsDeferred = false
+	}
+	if s.config.MaxSize > 0 && info.Size > s.config.MaxSize {
+		s.logger.Errorf("Upload size exceeds maximum allowed: %v", s.config.MaxSize)
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !info.SizeIsDeferred && r.ContentLength > info.Size {
+		s.logger.Errorf("Request body exceeds Upload-Length: %d > %d", r.ContentLength, info.Size)
+		http.Error(w, "Request body exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !s.limitBody(w, r, info, 0) || !s.checkContent(w, r, info, 0) {
+		return
+	}
+	if err = s.validateMetadata(info.MetaData); err != nil {
+		s.logger.Errorf("Error validating metadata: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, info, ok := s.preUploadCreate(w, r, info)
+	if !ok || !s.checkQuota(w, r, info, info.Size) {
+		return
+	}
+	upload, err := s.storage.NewUpload(r.Context(), info)
+	if err != nil {
+		s.logger.Errorf("Error creating upload: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info, err = upload.GetInfo(r.Context())
+	if err != nil {
+		s.logger.Errorf("Error getting upload info: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !info.SizeIsDeferred {
+		s.chargeQuota(r.Context(), info, info.Size)
+	}
+
+	// 读取请求体前告知上传地址, 连接中断后客户端可据此恢复上传
+	w.Header().Set(common.HeaderLocation, s.absFileURL(r, info.ID))
+	writeInformational(w, StatusUploadResumptionSupported)
+	s.publishEvent("upload.created", common.HookEvent{
+		Context:     r.Context(),
+		HTTPRequest: r,
+		Upload:      info,
+	})
+
+	info, ok = s.writeDraftBody(w, r, upload, info, complete)
+	if !ok {
+		return
+	}
+	resp = common.HTTPResponse{StatusCode: http.StatusCreated}.MergeWith(resp)
+	if !info.SizeIsDeferred && info.Offset >= info.Size {
+		if resp, ok = s.finishUpload(w, r, upload, resp); !ok {
+			return
+		}
+	}
+	setDraftHeaders(w, info)
+	resp.WriteTo(w)
+}
+
+func (s *SHandler) handleDraftHead(w http.ResponseWriter, r *http.Request, uploadID string) {
+	upload, err := s.storage.GetUpload(r.Context(), uploadID)
+	if err != nil {
+		s.logger.Errorf("Error getting upload: %v", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	info, err := upload.GetInfo(r.Context())
+	if err != nil {
+		s.logger.Errorf("Error getting upload info: %v", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if s.expired(info) {
+		s.logger.Errorf("Upload expired: %v", uploadID)
+		http.Error(w, "Upload expired", http.StatusGone)
+		return
+	}
+	if !s.checkOwner(w, r, info) {
+		return
+	}
+	setDraftHeaders(w, info)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *SHandler) handleDraftAppend(w http.ResponseWriter, r *http.Request, uploadID string) {
+	if contentType := r.Header.Get(common.HeaderContent); contentType != draftContentType {
+		s.logger.Errorf("UnsupportedMedia Type: %v", contentType)
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	complete, err := parseDraftComplete(r)
+	if err != nil {
+		s.logger.Errorf("Error parsing upload info: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(common.HeaderUploadOffset), 10, 64)
+	if err != nil || offset < 0 {
+		s.logger.Errorf("Invalid Upload-Offset header: %v", r.Header.Get(common.HeaderUploadOffset))
+		http.Error(w, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := s.storage.GetUpload(r.Context(), uploadID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			s.logger.Errorf("Error getting upload: %v", err)
+			http.Error(w, "Not found", http.StatusNotFound)
+		} else {
+			s.logger.Errorf("Error getting upload: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	info, err := upload.GetInfo(r.Context())
+	if err != nil {
+		s.logger.Errorf("Error getting upload info: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.expired(info) {
+		s.logger.Errorf("Upload expired: %v", uploadID)
+		http.Error(w, "Upload expired", http.StatusGone)
+		return
+	}
+	if !s.checkOwner(w, r, info) {
+		return
+	}
+	if info.IsFinal {
+		s.logger.Errorf("Cannot patch final upload: %v", uploadID)
+		http.Error(w, "Cannot patch final upload", http.StatusForbidden)
+		return
+	}
+	if !s.checkPaused(w, r, uploadID) {
+		return
+	}
+	if offset != info.Offset {
+		s.logger.Errorf("Offset mismatch: %v != %v", offset, info.Offset)
+		w.Header().Set(common.HeaderUploadOffset, strconv.FormatInt(info.Offset, 10))
+		http.Error(w, "Offset mismatch", http.StatusConflict)
+		return
+	}
+	if !info.SizeIsDeferred && info.Offset >= info.Size && (r.ContentLength != 0 || !complete) {
+		s.logger.Errorf("Upload already completed: %v", uploadID)
+		http.Error(w, "Upload already completed", http.StatusBadRequest)
+		return
+	}
+
+	// 请求体长度已知时, 完成上传的请求在写入前声明上传大小
+	if complete && r.ContentLength >= 0 {
+		length := offset + r.ContentLength
+		if !info.SizeIsDeferred && length != info.Size {
+			s.logger.Errorf("Request body doesn't complete the upload: %d != %d", length, info.Size)
+			http.Error(w, "Request body doesn't match Upload-Length", http.StatusBadRequest)
+			return
+		}
+		if info.SizeIsDeferred {
+			if s.config.MaxSize > 0 && length > s.config.MaxSize {
+				s.logger.Errorf("Upload size exceeds maximum allowed: %v", s.config.MaxSize)
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if !s.checkQuota(w, r, info, length) {
+				return
+			}
+			if err = storage.DeclareLength(r.Context(), upload, length); err != nil {
+				s.logger.Errorf("Error declaring upload length: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			s.chargeQuota(r.Context(), info, length)
+			info.Size = length
+			info.SizeIsDeferred = false
+		}
+	}
+	if !s.limitBody(w, r, info, offset) || !s.checkContent(w, r, info, offset) {
+		return
+	}
+
+	info, ok := s.writeDraftBody(w, r, upload, info, complete)
+	if !ok {
+		return
+	}
+	resp := common.HTTPResponse{StatusCode: http.StatusNoContent}
+	if !info.SizeIsDeferred && info.Offset >= info.Size {
+		if resp, ok = s.finishUpload(w, r, upload, resp); !ok {
+			return
+		}
+	} else {
+		s.publishEvent("upload.progress", common.HookEvent{
+			Context:     r.Context(),
+			HTTPRequest: r,
+			Upload:      info,
+		})
+	}
+	setDraftHeaders(w, info)
+	resp.WriteTo(w)
+}
+
+// writeDraftBody 写入请求体, 完成上传的请求体长度未知时在写入后声明上传大小, 返回false时已写入错误响应
+func (s *SHandler) writeDraftBody(w http.ResponseWriter, r *http.Request, upload storage.IUpload, info common.FileInfo, complete bool) (common.FileInfo, bool) {
+	ctx, cancel := s.interruptible(w, r)
+	defer cancel(nil)
+	defer s.trackPatch(info.ID, cancel)()
+	s.trackProgress(r, info, cancel)
+
+	written, err := upload.WriteChunk(ctx, info.Offset, r.Body)
+	if errors.Is(err, storage.ErrUploadCompleted) {
+		written, err = s.completedOffset(r.Context(), upload, info.Offset)
+	}
+	if err != nil {
+		s.logger.Errorf("Error writing chunk: %v", err)
+		if errors.Is(context.Cause(ctx), ErrUploadPaused) {
+			s.writePaused(w)
+			return info, false
+		}
+		if errors.Is(context.Cause(ctx), ErrUploadAborted) {
+			s.writeHookError(w, common.HTTPResponse{}, context.Cause(ctx))
+			return info, false
+		}
+		if errors.Is(context.Cause(ctx), ErrUploadInterrupted) {
+			http.Error(w, ErrUploadInterrupted.Error(), http.StatusBadRequest)
+			return info, false
+		}
+		if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return info, false
+		}
+		if s.writeEncryptionKeyError(w, err) {
+			return info, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return info, false
+	}
+	info.Offset += written
+
+	if complete && info.SizeIsDeferred {
+		if err = storage.DeclareLength(ctx, upload, info.Offset); err != nil {
+			s.logger.Errorf("Error declaring upload length: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return info, false
+		}
+		// 数据已写入, 只计入配额不再拒绝
+		s.chargeQuota(ctx, info, info.Offset)
+		info.Size = info.Offset
+		info.SizeIsDeferred = false
+		// 声明长度后写入空数据, 由存储完成上传
+		if _, err = upload.WriteChunk(ctx, info.Offset, http.NoBody); err != nil && !errors.Is(err, storage.ErrUploadCompleted) {
+			s.logger.Errorf("Error completing upload: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return info, false
+		}
+	}
+	return info, true
+}
+
+// setDraftHeaders 设置上传的偏移量与完成状态
+func setDraftHeaders(w http.ResponseWriter, info common.FileInfo) {
+	complete := !info.SizeIsDeferred && info.Offset >= info.Size
+	w.Header().Set(common.HeaderUploadOffset, strconv.FormatInt(info.Offset, 10))
+	w.Header().Set(common.HeaderUploadComplete, formatDraftBool(complete))
+	if !info.SizeIsDeferred {
+		w.Header().Set(common.HeaderUploadLength, strconv.FormatInt(info.Size, 10))
+	}
+}
+
+// parseDraftComplete 解析结构化字段布尔值形式的Upload-Complete头
+func parseDraftComplete(r *http.Request) (bool, error) {
+	switch value := r.Header.Get(common.HeaderUploadComplete); value {
+	case "?1":
+		return true, nil
+	case "?0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid Upload-Complete header %q", value)
+	}
+}
+
+func formatDraftBool(value bool) string {
+	if value {
+		return "?1"
+	}
+	return "?0"
+}
+
+// writeInformational 发送1xx响应. gin等包装的ResponseWriter会将其当作最终状态码, 需直接写入底层的ResponseWriter
+func writeInformational(w http.ResponseWriter, code int) {
+	for {
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = unwrapper.Unwrap()
+	}
+	w.WriteHeader(code)
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// ErrClientKeysDisabled is returned for requests with an
+// Upload-Encryption-Key header if SConfig.EnableClientKeys is off.
+var ErrClientKeysDisabled = errors.New("client encryption keys are not supported")
+
+// withEncryptionKey 将Upload-Encryption-Key中的密钥放入请求上下文并从请求头中删除,
+// 避免传给钩子或被记录, 返回false时已写入响应
+func (s *SHandler) withEncryptionKey(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	value := r.Header.Get(common.HeaderUploadEncryptionKey)
+	if value == "" {
+		return r, true
+	}
+	r.Header.Del(common.HeaderUploadEncryptionKey)
+	if !s.config.EnableClientKeys {
+		http.Error(w, ErrClientKeysDisabled.Error(), http.StatusBadRequest)
+		return r, false
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		http.Error(w, "Upload-Encryption-Key must be a base64 encoded 32 byte key", http.StatusBadRequest)
+		return r, false
+	}
+	return r.WithContext(storage.WithEncryptionKey(r.Context(), key)), true
+}
+
+// writeEncryptionKeyError 缺少客户端密钥时响应400, 密钥错误时响应403, 其他错误返回false
+func (s *SHandler) writeEncryptionKeyError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, storage.ErrEncryptionKeyRequired):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrEncryptionKeyMismatch):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		return false
+	}
+	return true
+}
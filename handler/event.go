@@ -104,6 +104,10 @@ func newMemoryBroker(logger common.ILogger) *sMemoryBroker {
 }
 
 func (b *sMemoryBroker) PublishEvent(prefix string, event common.HookEvent) {
+	// 订阅者异步处理事件, 此时请求可能已结束, 保留请求上下文的值但不随其取消
+	if event.Context != nil {
+		event.Context = context.WithoutCancel(event.Context)
+	}
 	b.topics.Range(func(key, value any) bool {
 		if strings.HasPrefix(key.(string), prefix) {
 			value.(*topic).publish(event)
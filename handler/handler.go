@@ -1,16 +1,25 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"mime"
 	"net/http"
+	"os"
+	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
 	"github.com/busybox-org/gin-fileuploader/storage"
 )
 
@@ -20,6 +29,13 @@ var (
 	reValidUploadId  = regexp.MustCompile(`^[A-Za-z0-9\-._~%!$'()*+,;=/:@]*$`)
 )
 
+// optionalExtensions 可通过SConfig.DisabledExtensions关闭的扩展
+var optionalExtensions = []string{"creation-with-upload", "creation-defer-length", "checksum", "checksum-trailer", "termination", "concatenation", "expiration"}
+
+// ErrUploadInterrupted is the cause of a PATCH request being stopped because
+// another request for the same upload is waiting for its lock.
+var ErrUploadInterrupted = errors.New("upload has been interrupted by another request for this upload resource")
+
 type SHandler struct {
 	config        *SConfig
 	basePath      string
@@ -29,12 +45,35 @@ type SHandler struct {
 	events        *sMemoryBroker
 	extensions    []string
 	algorithms    []string
+	pauses        IPauseStore
+	// inflight 本实例中各上传进行中的PATCH
+	inflightMu sync.Mutex
+	inflight   map[string]map[*sInflightPatch]struct{}
+	// watchers 本实例中各上传的进度流
+	watchersMu sync.Mutex
+	watchers   map[string]map[*sStreamWatcher]struct{}
+	// bulkJobs 本实例中批量删除的任务
+	bulkJobs sBulkJobs
 }
 
 func New(config *SConfig) (*SHandler, error) {
 	if err := config.validate(); err != nil {
 		return nil, err
 	}
+	extensions := []string{"creation"}
+	for _, extension := range optionalExtensions {
+		switch {
+		case slices.Contains(config.DisabledExtensions, extension):
+		case extension == "checksum-trailer" && slices.Contains(config.DisabledExtensions, "checksum"):
+		case extension == "expiration" && config.UploadExpiry <= 0:
+		default:
+			extensions = append(extensions, extension)
+		}
+	}
+	pauses := config.PauseStore
+	if pauses == nil {
+		pauses = NewMemoryPauseStore()
+	}
 	return &SHandler{
 		config:        config,
 		basePath:      config.BasePath,
@@ -42,38 +81,63 @@ func New(config *SConfig) (*SHandler, error) {
 		storage:       config.Store,
 		logger:        config.Logger,
 		events:        newMemoryBroker(config.Logger),
-		extensions:    []string{"creation", "creation-with-upload", "checksum", "expiration", "termination", "concatenation"},
-		algorithms:    []string{"sha1", "sha256", "sha512", "md5"},
+		extensions:    extensions,
+		algorithms:    []string{"sha1", "sha256", "sha512", "md5", "crc32"},
+		pauses:        pauses,
+		inflight:      make(map[string]map[*sInflightPatch]struct{}),
+		watchers:      make(map[string]map[*sStreamWatcher]struct{}),
+		bulkJobs:      sBulkJobs{jobs: make(map[string]*SBulkJob)},
 	}, nil
 }
 
+// hasExtension 扩展是否启用, 与OPTIONS中声明的一致
+func (s *SHandler) hasExtension(extension string) bool {
+	return slices.Contains(s.extensions, extension)
+}
+
 func (s *SHandler) Close(ctx context.Context) error {
 	s.events.Shutdown(ctx)
 	return nil
 }
 
+// SubscribeCompleteUploads calls callback after an upload has received all
+// of its data and PreFinishResponseCallback has succeeded. Callbacks run
+// asynchronously until ctx is done, the event's Context carries the values
+// of the request but is not canceled when the request ends.
 func (s *SHandler) SubscribeCompleteUploads(ctx context.Context, callback func(hook common.HookEvent) error) {
 	s.events.SubscribeEvent(ctx, "upload.finished", callback)
 }
 
+// SubscribeTerminatedUploads calls callback after an upload has been
+// deleted by a DELETE request, e.g. to clean up external state.
 func (s *SHandler) SubscribeTerminatedUploads(ctx context.Context, callback func(hook common.HookEvent) error) {
 	s.events.SubscribeEvent(ctx, "upload.terminated", callback)
 }
 
+// SubscribeCreatedUploads calls callback after an upload has been created,
+// before the data of a creation-with-upload request is written.
 func (s *SHandler) SubscribeCreatedUploads(ctx context.Context, callback func(hook common.HookEvent) error) {
 	s.events.SubscribeEvent(ctx, "upload.created", callback)
 }
 
 func (s *SHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.setCommonHeaders(w, r)
-	if r.Header.Get("X-HTTP-Method-Override") != "" {
-		r.Method = r.Header.Get("X-HTTP-Method-Override")
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && r.Method == http.MethodPost && !s.config.DisableMethodOverride {
+		r.Method = strings.ToUpper(override)
 	}
 
 	if r.Method == http.MethodOptions {
 		s.handleOptions(w, r)
 		return
 	}
+	r, ok := s.withEncryptionKey(w, r)
+	if !ok {
+		return
+	}
+	if s.config.EnableDraftProtocol && r.Header.Get(common.HeaderUploadDraftInteropVersion) != "" {
+		s.serveDraft(w, r)
+		return
+	}
 	tusResumable := r.Header.Get(common.HeaderResumable)
 	if tusResumable != common.Version && r.Method != http.MethodGet {
 		w.Header().Set(common.HeaderVersion, common.Version)
@@ -97,7 +161,11 @@ func (s *SHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case http.MethodDelete:
 			s.handleDelete(w, r, uploadID)
 		case http.MethodGet:
-			s.handleGet(w, r, uploadID)
+			if streamID, ok := strings.CutSuffix(uploadID, eventStreamSuffix); ok && s.config.EnableEventStream {
+				s.handleEventStream(w, r, streamID)
+			} else {
+				s.handleGet(w, r, uploadID)
+			}
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -110,6 +178,16 @@ func (s *SHandler) handlePost(w http.ResponseWriter, r *http.Request) {
 	info, err := s.parseUploadInfo(r)
 	if err != nil {
 		s.logger.Errorf("Error parsing upload info: %v", err)
+		if errors.Is(err, ErrMetadataTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	if err = s.validateMetadata(info.MetaData); err != nil {
+		s.logger.Errorf("Error validating metadata: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -120,47 +198,75 @@ func (s *SHandler) handlePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// concatenation: 创建最终上传前校验所有分片均已完成, 最终大小为分片大小之和
+	var partialUploads []storage.IUpload
+	if info.IsFinal {
+		partialUploads, info.Size, err = s.getPartialUploads(r.Context(), info.PartialIDs)
+		if err != nil {
+			s.logger.Errorf("Error getting partial uploads: %v", err)
+			switch {
+			case errors.Is(err, ErrPartialUploadNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errors.Is(err, ErrNotOwner):
+				http.Error(w, err.Error(), http.StatusForbidden)
+			case errors.Is(err, ErrNotPartialUpload), errors.Is(err, ErrPartialUploadNotFinished), errors.Is(err, ErrPartialUploadTooLarge):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
 	if s.config.MaxSize > 0 && info.Size > s.config.MaxSize {
 		s.logger.Errorf("Upload size exceeds maximum allowed: %v", s.config.MaxSize)
 		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	resp := common.HTTPResponse{
-		StatusCode: http.StatusCreated,
-		Headers:    make(map[string]string),
-	}
-	if s.config.PreUploadCreateCallback != nil {
-		var resp2 common.HTTPResponse
-		var changes common.FileInfoChanges
-		resp2, changes, err = s.config.PreUploadCreateCallback(common.HookEvent{
-			Context:     r.Context(),
-			HTTPRequest: r,
-			Upload:      info,
-		})
-		if err != nil {
-			s.logger.Errorf("failed to run PreUploadCreateCallback: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	// creation-with-upload: 在分配存储前校验请求体, 避免留下无效的上传
+	contentType := r.Header.Get(common.HeaderContent)
+	hasBody := r.ContentLength > 0 || (r.ContentLength < 0 && contentType == "application/offset+octet-stream")
+	if hasBody {
+		if !s.hasExtension("creation-with-upload") {
+			s.logger.Errorf("Creation with upload is disabled")
+			http.Error(w, "creation-with-upload extension is disabled", http.StatusBadRequest)
 			return
 		}
-		resp = resp.MergeWith(resp2)
-		if changes.ID != "" {
-			if err = s.validateUploadId(changes.ID); err != nil {
-				s.logger.Errorf("failed to validate upload ID: %v", err)
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-
-			info.ID = changes.ID
+		if contentType != "application/offset+octet-stream" {
+			s.logger.Errorf("Unsupported Media Type: %v", contentType)
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if !info.SizeIsDeferred && r.ContentLength > info.Size {
+			s.logger.Errorf("Request body exceeds Upload-Length: %d > %d", r.ContentLength, info.Size)
+			http.Error(w, "Request body exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !s.limitBody(w, r, info, 0) || !s.checkContent(w, r, info, 0) {
+			return
 		}
+	}
 
-		info.MetaData = s.mergeMetadata(info.MetaData, changes.MetaData)
+	resp := common.HTTPResponse{
+		StatusCode: http.StatusCreated,
+		Headers:    make(map[string]string),
+	}
+	resp2, info, ok := s.preUploadCreate(w, r, info)
+	if !ok {
+		return
+	}
+	resp = resp.MergeWith(resp2)
+	if !s.checkQuota(w, r, info, info.Size) {
+		return
 	}
 
 	upload, err := s.storage.NewUpload(r.Context(), info)
 	if err != nil {
 		s.logger.Errorf("Error creating upload: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !s.writeEncryptionKeyError(w, err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 	info, err = upload.GetInfo(r.Context())
@@ -169,85 +275,164 @@ func (s *SHandler) handlePost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !info.SizeIsDeferred {
+		s.chargeQuota(r.Context(), info, info.Size)
+	}
 
 	w.Header().Set(common.HeaderLocation, s.absFileURL(r, info.ID))
-	s.events.PublishEvent("upload.created", common.HookEvent{
+	s.setExpires(w, info)
+	s.setPresignedURL(w, r, upload, info)
+	s.publishEvent("upload.created", common.HookEvent{
 		Context:     r.Context(),
 		HTTPRequest: r,
 		Upload:      info,
 	})
 
 	// 处理Creation With Upload
-	if r.ContentLength > 0 {
-		contentType := r.Header.Get(common.HeaderContent)
-		if contentType != "application/offset+octet-stream" {
-			s.logger.Errorf("Unsupported Media Type: %v", contentType)
-			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
-			return
-		}
+	if hasBody {
 		var written int64
-		written, err = s.wrapWithChecksum(r, upload, 0)
+		written, err = s.wrapWithChecksum(r.Context(), r, upload, 0)
 		if err != nil {
-			s.logger.Errorf("Error parsing upload info: %v", err)
+			s.logger.Errorf("Error writing chunk: %v", err)
+			if errors.Is(err, ErrChecksumMismatch) {
+				http.Error(w, err.Error(), StatusChecksumMismatch)
+				return
+			}
+			if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		info.Offset = written
 		w.Header().Set(common.HeaderUploadOffset, strconv.FormatInt(written, 10))
+		s.setExpires(w, info)
 	}
 
-	if info.IsFinal {
-		var partialUploads []storage.IUpload
-		for _, partialID := range info.PartialIDs {
-			var partialUpload storage.IUpload
-			partialUpload, err = s.storage.GetUpload(r.Context(), partialID)
-			if err != nil {
-				s.logger.Errorf("Error getting partial upload: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			partialUploads = append(partialUploads, partialUpload)
+	// 零字节的上传无需PATCH, 写入空数据使存储完成上传, 部分存储创建时即已完成
+	if !hasBody && !info.IsFinal && !info.SizeIsDeferred && info.Size == 0 {
+		_, err = upload.WriteChunk(r.Context(), 0, http.NoBody)
+		if err != nil && !errors.Is(err, storage.ErrUploadCompleted) {
+			s.logger.Errorf("Error writing chunk: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		w.Header().Set(common.HeaderUploadOffset, "0")
+	}
+
+	if info.IsFinal {
 		err = upload.ConcatUploads(r.Context(), partialUploads)
 		if err != nil {
 			s.logger.Errorf("Error concatenating uploads: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			if !s.writeEncryptionKeyError(w, err) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
 			return
 		}
-		if s.config.PreFinishResponseCallback != nil {
-			var resp2 common.HTTPResponse
-			resp2, err = s.config.PreFinishResponseCallback(common.HookEvent{
-				Context:     r.Context(),
-				HTTPRequest: r,
-				Upload:      info,
-			})
-			resp = resp.MergeWith(resp2)
+		info.Offset = info.Size
+	}
+
+	// 合并完成, 请求体已包含全部数据或零字节的上传即完成
+	if info.IsFinal || (!info.SizeIsDeferred && info.Offset >= info.Size) {
+		if resp, ok = s.finishUpload(w, r, upload, resp); !ok {
+			return
 		}
-		s.events.PublishEvent("upload.finished", common.HookEvent{
+	}
+	resp.WriteTo(w)
+}
+
+// finishUpload 在写入最后的数据后运行PreFinishResponseCallback并发布上传完成事件,
+// 返回合并后的响应. 钩子返回错误时不发布事件, 返回false时已写入错误响应
+func (s *SHandler) finishUpload(w http.ResponseWriter, r *http.Request, upload storage.IUpload, resp common.HTTPResponse) (common.HTTPResponse, bool) {
+	// 存储完成上传时可能修改了上传信息, 例如去重后的Storage路径, 重新读取
+	info, err := upload.GetInfo(r.Context())
+	if err != nil {
+		s.logger.Errorf("Error getting upload info: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return resp, false
+	}
+	info = s.withDownloadURL(r.Context(), upload, info)
+	if s.config.PreFinishResponseCallback != nil {
+		resp2, err := s.config.PreFinishResponseCallback(common.HookEvent{
 			Context:     r.Context(),
 			HTTPRequest: r,
 			Upload:      info,
 		})
-		resp.WriteTo(w)
+		if err != nil {
+			s.logger.Errorf("failed to run PreFinishResponseCallback: %v", err)
+			s.writeHookError(w, resp2, err)
+			return resp, false
+		}
+		resp = resp.MergeWith(resp2)
+	}
+	s.publishEvent("upload.finished", common.HookEvent{
+		Context:     r.Context(),
+		HTTPRequest: r,
+		Upload:      info,
+	})
+	if s.config.Scanner != nil && !info.IsPartial {
+		go s.scanUpload(context.WithoutCancel(r.Context()), r, info)
 	}
+	return resp, true
+}
+
+// withDownloadURL 存储支持时将预签名下载地址加入info.Storage, 失败时只记录日志
+func (s *SHandler) withDownloadURL(ctx context.Context, upload storage.IUpload, info common.FileInfo) common.FileInfo {
+	presigned, ok := upload.(storage.IPresignedDownload)
+	if !ok || s.config.PresignedDownloadExpiry <= 0 {
+		return info
+	}
+	url, err := presigned.PresignDownload(ctx, s.config.PresignedDownloadExpiry)
+	if err != nil {
+		s.logger.Warnf("failed to presign download of upload %s: %v", info.ID, err)
+		return info
+	}
+	// 复制map, 避免修改存储缓存的info
+	location := make(map[string]string, len(info.Storage)+1)
+	for key, value := range info.Storage {
+		location[key] = value
+	}
+	location["DownloadURL"] = url
+	info.Storage = location
+	return info
 }
 
 func (s *SHandler) handleHead(w http.ResponseWriter, r *http.Request, uploadID string) {
-	upload, err := s.storage.GetUpload(r.Context(), uploadID)
+	ctx := storage.WithStaleReads(r.Context())
+	upload, err := s.storage.GetUpload(ctx, uploadID)
 	if err != nil {
 		s.logger.Errorf("Error getting upload: %v", err)
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	info, err := upload.GetInfo(r.Context())
+	info, err := upload.GetInfo(ctx)
 	if err != nil {
 		s.logger.Errorf("Error getting upload info: %v", err)
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if s.expired(info) {
+		s.logger.Errorf("Upload expired: %v", uploadID)
+		http.Error(w, "Upload expired", http.StatusGone)
+		return
+	}
+	if !s.checkOwner(w, r, info) {
+		return
+	}
 
 	w.Header().Set(common.HeaderUploadOffset, strconv.FormatInt(info.Offset, 10))
-	w.Header().Set(common.HeaderUploadLength, strconv.FormatInt(info.Size, 10))
+	if info.SizeIsDeferred {
+		w.Header().Set(common.HeaderUploadDeferLength, "1")
+	} else {
+		w.Header().Set(common.HeaderUploadLength, strconv.FormatInt(info.Size, 10))
+	}
+	s.setExpires(w, info)
+	// 客户端刷新页面后可据此恢复上传列表
+	if !info.CreateTime.IsZero() {
+		w.Header().Set(common.HeaderUploadCreated, info.CreateTime.UTC().Format(http.TimeFormat))
+	}
 
 	if len(info.MetaData) > 0 {
 		metadata := s.encodeMetadata(info.MetaData)
@@ -264,6 +449,7 @@ func (s *SHandler) handleHead(w http.ResponseWriter, r *http.Request, uploadID s
 		w.Header().Set(common.HeaderUploadConcat, concat)
 	}
 
+	s.setPresignedURL(w, r, upload, info)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -293,11 +479,25 @@ func (s *SHandler) handlePatch(w http.ResponseWriter, r *http.Request, uploadID
 		return
 	}
 
+	if s.expired(info) {
+		s.logger.Errorf("Upload expired: %v", uploadID)
+		http.Error(w, "Upload expired", http.StatusGone)
+		return
+	}
+	if !s.checkOwner(w, r, info) {
+		return
+	}
+
 	if info.IsFinal {
 		s.logger.Errorf("Cannot patch final upload: %v", uploadID)
 		http.Error(w, "Cannot patch final upload", http.StatusForbidden)
 		return
 	}
+	if !s.checkPaused(w, r, uploadID) {
+		return
+	}
+	// 只有完成上传的PATCH运行PreFinishResponseCallback, 已完成上传的重复PATCH不再触发
+	wasFinished := !info.SizeIsDeferred && info.Offset >= info.Size
 
 	offsetHeader := r.Header.Get(common.HeaderUploadOffset)
 	offset, err := strconv.ParseInt(offsetHeader, 10, 64)
@@ -313,10 +513,123 @@ func (s *SHandler) handlePatch(w http.ResponseWriter, r *http.Request, uploadID
 		return
 	}
 
+	// 客户端已通过预签名地址直接上传分片, 只需同步偏移量, 偏移量已包含这些分片
+	if presigned, ok := upload.(storage.IPresignedUpload); ok && s.config.PresignedPartExpiry > 0 && r.ContentLength == 0 && r.Header.Get(common.HeaderUploadLength) == "" {
+		info.Offset, err = presigned.SyncPresignedParts(r.Context())
+		if err != nil {
+			s.logger.Errorf("Error syncing presigned parts: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(common.HeaderUploadOffset, strconv.FormatInt(info.Offset, 10))
+		s.setPresignedURL(w, r, upload, info)
+		resp := common.HTTPResponse{StatusCode: http.StatusNoContent}
+		if !wasFinished && !info.SizeIsDeferred && info.Offset >= info.Size {
+			if resp, ok = s.finishUpload(w, r, upload, resp); !ok {
+				return
+			}
+		}
+		resp.WriteTo(w)
+		return
+	}
+
+	// 延迟声明长度的上传在PATCH中声明最终长度
+	if lengthHeader := r.Header.Get(common.HeaderUploadLength); lengthHeader != "" {
+		length, err := strconv.ParseInt(lengthHeader, 10, 64)
+		if err != nil || length < 0 {
+			s.logger.Errorf("Invalid Upload-Length header: %v", lengthHeader)
+			http.Error(w, "Invalid Upload-Length header", http.StatusBadRequest)
+			return
+		}
+		if !info.SizeIsDeferred {
+			if length != info.Size {
+				s.logger.Errorf("Upload-Length cannot be changed: %d != %d", length, info.Size)
+				http.Error(w, "Upload-Length cannot be changed", http.StatusBadRequest)
+				return
+			}
+		} else {
+			if length < info.Offset {
+				s.logger.Errorf("Upload-Length is smaller than the offset: %d < %d", length, info.Offset)
+				http.Error(w, "Upload-Length is smaller than the current offset", http.StatusBadRequest)
+				return
+			}
+			if s.config.MaxSize > 0 && length > s.config.MaxSize {
+				s.logger.Errorf("Upload size exceeds maximum allowed: %v", s.config.MaxSize)
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if info.IsPartial {
+				if err = s.checkPartialSize(length); err != nil {
+					s.logger.Errorf("Error declaring upload length: %v", err)
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if r.ContentLength > 0 && offset+r.ContentLength > length {
+				s.logger.Errorf("Request body exceeds Upload-Length: %d > %d", offset+r.ContentLength, length)
+				http.Error(w, "Request body exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if !s.checkQuota(w, r, info, length) {
+				return
+			}
+			if err = storage.DeclareLength(r.Context(), upload, length); err != nil {
+				s.logger.Errorf("Error declaring upload length: %v", err)
+				if errors.Is(err, storage.ErrLengthNotDeclarable) {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			s.chargeQuota(r.Context(), info, length)
+			info.Size = length
+			info.SizeIsDeferred = false
+		}
+	}
+	if !s.limitBody(w, r, info, offset) || !s.checkContent(w, r, info, offset) {
+		return
+	}
+
+	ctx, cancel := s.interruptible(w, r)
+	defer cancel(nil)
+	defer s.trackPatch(uploadID, cancel)()
+	s.trackProgress(r, info, cancel)
+
 	var written int64
-	written, err = s.wrapWithChecksum(r, upload, offset)
+	written, err = s.wrapWithChecksum(ctx, r, upload, offset)
+	if errors.Is(err, storage.ErrUploadCompleted) {
+		written, err = s.completedOffset(r.Context(), upload, offset)
+	}
 	if err != nil {
 		s.logger.Errorf("Error writing chunk: %v", err)
+		if errors.Is(context.Cause(ctx), ErrUploadPaused) {
+			s.writePaused(w)
+			return
+		}
+		if errors.Is(context.Cause(ctx), ErrUploadAborted) {
+			s.writeHookError(w, common.HTTPResponse{}, context.Cause(ctx))
+			return
+		}
+		if errors.Is(context.Cause(ctx), ErrUploadInterrupted) {
+			http.Error(w, ErrUploadInterrupted.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			http.Error(w, err.Error(), StatusChecksumMismatch)
+			return
+		}
+		if errors.Is(err, ErrInvalidChecksum) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if s.writeEncryptionKeyError(w, err) {
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -327,17 +640,16 @@ func (s *SHandler) handlePatch(w http.ResponseWriter, r *http.Request, uploadID
 			common.HeaderUploadOffset: strconv.FormatInt(newOffset, 10),
 		},
 	}
+	info.Offset = newOffset
+	s.setExpires(w, info)
 
-	if s.config.PreFinishResponseCallback != nil {
-		var resp2 common.HTTPResponse
-		resp2, err = s.config.PreFinishResponseCallback(common.HookEvent{
-			Context:     r.Context(),
-			HTTPRequest: r,
-			Upload:      info,
-		})
-		resp = resp.MergeWith(resp2)
+	if !wasFinished && !info.SizeIsDeferred && info.Offset >= info.Size {
+		var ok bool
+		if resp, ok = s.finishUpload(w, r, upload, resp); !ok {
+			return
+		}
 	}
-	s.events.PublishEvent("upload.progress", common.HookEvent{
+	s.publishEvent("upload.progress", common.HookEvent{
 		Context:     r.Context(),
 		HTTPRequest: r,
 		Upload:      info,
@@ -345,7 +657,79 @@ func (s *SHandler) handlePatch(w http.ResponseWriter, r *http.Request, uploadID
 	resp.WriteTo(w)
 }
 
+// completedOffset 存储拒绝写入已完成的上传时(例如重复的PATCH)不视为错误, 返回相对offset已写入的字节数
+func (s *SHandler) completedOffset(ctx context.Context, upload storage.IUpload, offset int64) (int64, error) {
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return max(info.Offset-offset, 0), nil
+}
+
+// preUploadCreate 运行PreUploadCreateCallback并应用其对上传的修改, 返回false时已写入错误响应
+func (s *SHandler) preUploadCreate(w http.ResponseWriter, r *http.Request, info common.FileInfo) (common.HTTPResponse, common.FileInfo, bool) {
+	// 记录创建者, 覆盖客户端提供的同名元数据
+	if identity := common.IdentityFromContext(r.Context()); identity != nil {
+		info.MetaData = s.mergeMetadata(info.MetaData, map[string]string{
+			common.MetaDataOwner:       identity.Subject,
+			common.MetaDataOwnerScopes: strings.Join(identity.Scopes, " "),
+		})
+	}
+	if s.config.IDGenerator != nil {
+		id, err := s.config.IDGenerator.NewID(r.Context(), info)
+		if err == nil {
+			err = s.validateUploadId(id)
+		}
+		if err != nil {
+			s.logger.Errorf("failed to generate upload ID: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return common.HTTPResponse{}, info, false
+		}
+		info.ID = id
+	}
+	if s.config.PreUploadCreateCallback == nil {
+		return common.HTTPResponse{}, info, true
+	}
+	resp, changes, err := s.config.PreUploadCreateCallback(common.HookEvent{
+		Context:     r.Context(),
+		HTTPRequest: r,
+		Upload:      info,
+	})
+	if err != nil {
+		s.logger.Errorf("failed to run PreUploadCreateCallback: %v", err)
+		s.writeHookError(w, resp, err)
+		return resp, info, false
+	}
+	if changes.ID != "" {
+		if err = s.validateUploadId(changes.ID); err != nil {
+			s.logger.Errorf("failed to validate upload ID: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return resp, info, false
+		}
+
+		info.ID = changes.ID
+	}
+
+	info.MetaData = s.mergeMetadata(info.MetaData, changes.MetaData)
+	return resp, info, true
+}
+
+// interruptible 其他请求等待该上传的锁时中断本次写入, 避免客户端重连后被失效的连接阻塞
+func (s *SHandler) interruptible(w http.ResponseWriter, r *http.Request) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	controller := http.NewResponseController(w)
+	ctx = locker.WithReleaseRequest(ctx, func() {
+		cancel(ErrUploadInterrupted)
+		_ = controller.SetReadDeadline(time.Now())
+	})
+	return ctx, cancel
+}
+
 func (s *SHandler) handleDelete(w http.ResponseWriter, r *http.Request, uploadID string) {
+	if !s.hasExtension("termination") {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	upload, err := s.storage.GetUpload(r.Context(), uploadID)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
@@ -363,6 +747,9 @@ func (s *SHandler) handleDelete(w http.ResponseWriter, r *http.Request, uploadID
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !s.checkOwner(w, r, info) {
+		return
+	}
 	resp := common.HTTPResponse{
 		StatusCode: http.StatusNoContent,
 	}
@@ -375,109 +762,309 @@ func (s *SHandler) handleDelete(w http.ResponseWriter, r *http.Request, uploadID
 			Upload:      info,
 		})
 		if err != nil {
-			s.logger.Errorf("failed to emit finish events: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			s.logger.Errorf("failed to run PreUploadTerminateCallback: %v", err)
+			s.writeHookError(w, resp2, err)
 			return
 		}
 		resp = resp.MergeWith(resp2)
 	}
 
-	err = upload.Terminate(r.Context())
-	if err != nil {
+	if err = s.terminate(r.Context(), r, upload, info); err != nil {
 		s.logger.Errorf("Error terminating upload: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	s.events.PublishEvent("upload.terminated", common.HookEvent{
-		Context:     r.Context(),
+	resp.WriteTo(w)
+}
+
+// terminate 删除上传, 释放配额并发布upload.terminated事件, r可以为nil
+func (s *SHandler) terminate(ctx context.Context, r *http.Request, upload storage.IUpload, info common.FileInfo) error {
+	if err := upload.Terminate(ctx); err != nil {
+		return err
+	}
+	if err := s.pauses.Resume(ctx, info.ID); err != nil {
+		s.logger.Errorf("Error resuming terminated upload: %v", err)
+	}
+	if !info.SizeIsDeferred {
+		s.chargeQuota(ctx, info, -info.Size)
+	}
+	s.publishEvent("upload.terminated", common.HookEvent{
+		Context:     ctx,
 		HTTPRequest: r,
 		Upload:      info,
 	})
-	resp.WriteTo(w)
+	return nil
 }
 
 func (s *SHandler) handleGet(w http.ResponseWriter, r *http.Request, uploadID string) {
-	upload, err := s.storage.GetUpload(r.Context(), uploadID)
+	ctx := storage.WithStaleReads(r.Context())
+	upload, err := s.storage.GetUpload(ctx, uploadID)
 	if err != nil {
 		s.logger.Errorf("Error getting upload: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
-	info, err := upload.GetInfo(r.Context())
+	info, err := upload.GetInfo(ctx)
 	if err != nil {
 		s.logger.Errorf("Error getting upload info: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if s.expired(info) {
+		s.logger.Errorf("Upload expired: %v", uploadID)
+		http.Error(w, "Upload expired", http.StatusGone)
+		return
+	}
+	if !s.checkOwner(w, r, info) {
+		return
+	}
 	contentType, contentDisposition := s.filterContentType(info)
 	w.Header().Set(common.HeaderContent, contentType)
 	w.Header().Set(common.HeaderContentDisposition, contentDisposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set(common.HeaderUploadLength, strconv.FormatInt(info.Size, 10))
-	err = upload.ServeContent(r.Context(), w, r)
+	// 后端未提供ETag时以偏移量区分内容, If-Range/If-None-Match据此判断
+	w.Header().Set("ETag", fmt.Sprintf("%q", info.ID+"-"+strconv.FormatInt(info.Offset, 10)))
+	if err = upload.ServeContent(ctx, w, r); err != nil {
+		s.logger.Errorf("Error serving upload: %v", err)
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Not found", http.StatusNotFound)
+		} else if !s.writeEncryptionKeyError(w, err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// setPresignedURL 为支持预签名的上传设置下一个分片的上传地址
+func (s *SHandler) setPresignedURL(w http.ResponseWriter, r *http.Request, upload storage.IUpload, info common.FileInfo) {
+	presigned, ok := upload.(storage.IPresignedUpload)
+	if !ok || s.config.PresignedPartExpiry <= 0 {
+		return
+	}
+	if !info.SizeIsDeferred && info.Offset >= info.Size {
+		return
+	}
+	url, err := presigned.PresignNextPart(r.Context(), s.config.PresignedPartExpiry)
+	if err != nil {
+		s.logger.Errorf("Error presigning part: %v", err)
+		return
+	}
+	w.Header().Set(common.HeaderUploadPresignedURL, url)
+}
+
+// limitBody 限制请求体不超过上传的剩余长度, 长度未声明的上传不超过MaxSize和所有者的剩余配额.
+// 请求体长度已知时直接拒绝, 否则(例如chunked请求体)在读取超出限制时中断, 返回false时已写入响应
+func (s *SHandler) limitBody(w http.ResponseWriter, r *http.Request, info common.FileInfo, offset int64) bool {
+	limit := info.Size
+	if info.SizeIsDeferred {
+		limit = s.config.MaxSize
+		// 长度声明后才计入配额, 此前写入的数据同样不能超出剩余配额
+		remaining, err := s.remainingQuota(r.Context(), info)
+		if err != nil {
+			s.logger.Errorf("Error getting quota: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		if remaining >= 0 && (limit <= 0 || remaining < limit) {
+			limit = remaining
+		}
+		if limit <= 0 && remaining < 0 {
+			return true
+		}
+	}
+	if r.ContentLength > 0 && offset+r.ContentLength > limit {
+		if info.SizeIsDeferred {
+			s.logger.Errorf("Upload size exceeds maximum allowed: %v", limit)
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		} else {
+			s.logger.Errorf("Request body exceeds Upload-Length: %d > %d", offset+r.ContentLength, info.Size)
+			http.Error(w, "Request body exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		}
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, max(limit-offset, 0))
+	return true
+}
+
+// expiresAt 返回上传的过期时间, 未启用过期时为零值
+func (s *SHandler) expiresAt(info common.FileInfo) time.Time {
+	if !s.hasExtension("expiration") || info.CreateTime.IsZero() {
+		return time.Time{}
+	}
+	return info.CreateTime.Add(s.config.UploadExpiry)
+}
+
+func (s *SHandler) expired(info common.FileInfo) bool {
+	expiresAt := s.expiresAt(info)
+	return !expiresAt.IsZero() && time.Now().After(expiresAt)
+}
+
+// setExpires 为未完成的上传设置过期时间
+func (s *SHandler) setExpires(w http.ResponseWriter, info common.FileInfo) {
+	expiresAt := s.expiresAt(info)
+	if expiresAt.IsZero() || info.IsFinal || (!info.SizeIsDeferred && info.Offset >= info.Size) {
+		return
+	}
+	w.Header().Set(common.HeaderUploadExpires, expiresAt.UTC().Format(http.TimeFormat))
+}
+
+// CORSAllowHeaders lists the request headers of tus clients, browsers have
+// to be allowed to send them cross-origin.
+var CORSAllowHeaders = []string{
+	"Origin", "X-Requested-With", "Content-Type", "Upload-Length", "Upload-Offset", "Tus-Resumable",
+	"Upload-Metadata", "Upload-Defer-Length", "Upload-Concat", "Upload-Checksum", "Upload-Complete",
+	"Upload-Draft-Interop-Version", "Upload-Encryption-Key", "X-HTTP-Method-Override", "Range", "If-Range",
+}
+
+// CORSExposeHeaders lists the response headers tus clients read, browsers
+// hide them from cross-origin scripts unless they are exposed.
+var CORSExposeHeaders = []string{
+	"Upload-Offset", "Location", "Upload-Length", "Tus-Version", "Tus-Resumable", "Tus-Max-Size",
+	"Tus-Extension", "Upload-Metadata", "Upload-Defer-Length", "Upload-Concat", "Upload-Checksum",
+	"Tus-Checksum-Algorithm", "Upload-Presigned-Url", "Upload-Expires", "Upload-Created", "Upload-Complete",
+	"Upload-Draft-Interop-Version", "Retry-After", "ETag", "Content-Range", "Accept-Ranges",
 }
 
 func (s *SHandler) setCommonHeaders(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(common.HeaderResumable, common.Version)
 	w.Header().Set(common.HeaderCacheControl, "no-store")
+	if s.config.DisableCORS {
+		return
+	}
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, HEAD, PATCH, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Upload-Length, Upload-Offset, Tus-Resumable, Upload-Metadata, Upload-Defer-Length, Upload-Concat, Upload-Checksum")
-	w.Header().Set("Access-Control-Expose-Headers", "Upload-Offset, Location, Upload-Length, Tus-Version, Tus-Resumable, Tus-Max-Size, Tus-Extension, Upload-Metadata, Upload-Defer-Length, Upload-Concat, Upload-Checksum, Tus-Checksum-Algorithm")
+	if s.hasExtension("termination") {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, HEAD, PATCH, DELETE, OPTIONS")
+	} else {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, HEAD, PATCH, OPTIONS")
+	}
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(CORSAllowHeaders, ", "))
+	w.Header().Set("Access-Control-Expose-Headers", strings.Join(CORSExposeHeaders, ", "))
 }
 
 func (s *SHandler) handleOptions(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(common.HeaderVersion, common.Version)
-	w.Header().Set(common.HeaderMaxSize, strconv.FormatInt(s.config.MaxSize, 10))
+	if s.config.MaxSize > 0 {
+		w.Header().Set(common.HeaderMaxSize, strconv.FormatInt(s.config.MaxSize, 10))
+	}
 	w.Header().Set(common.HeaderExtension, strings.Join(s.extensions, ","))
-	w.Header().Set(common.HeaderChecksumAlgorithm, strings.Join(s.algorithms, ","))
+	if s.hasExtension("checksum") || s.hasExtension("checksum-trailer") {
+		w.Header().Set(common.HeaderChecksumAlgorithm, strings.Join(s.algorithms, ","))
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *SHandler) wrapWithChecksum(r *http.Request, upload storage.IUpload, offset int64) (written int64, err error) {
+// wrapWithChecksum writes the body of r to the upload at offset. With an
+// Upload-Checksum header the body is buffered in a temporary file and only
+// written once its checksum has been verified, so a corrupted chunk never
+// becomes part of the upload. Clients streaming data of unknown content may
+// declare Upload-Checksum as trailer instead, the buffered body is then
+// hashed once the trailer has been received.
+func (s *SHandler) wrapWithChecksum(ctx context.Context, r *http.Request, upload storage.IUpload, offset int64) (written int64, err error) {
 	checksumHeader := r.Header.Get(common.HeaderUploadChecksum)
-	if checksumHeader == "" {
-		return upload.WriteChunk(r.Context(), offset, r.Body)
+	_, checksumTrailer := r.Trailer[common.HeaderUploadChecksum]
+	if checksumHeader == "" && !checksumTrailer {
+		return upload.WriteChunk(ctx, offset, r.Body)
+	}
+	if (checksumHeader != "" && !s.hasExtension("checksum")) || (checksumHeader == "" && !s.hasExtension("checksum-trailer")) {
+		s.logger.Errorf("Checksum extension is disabled")
+		return 0, fmt.Errorf("%w: checksum extension is disabled", ErrInvalidChecksum)
 	}
 
-	parts := strings.SplitN(checksumHeader, " ", 2)
-	if len(parts) != 2 {
-		s.logger.Errorf("Invalid checksum header format: %v", checksumHeader)
-		return 0, fmt.Errorf("invalid checksum header format")
+	var (
+		algorithm        string
+		expectedChecksum []byte
+		sumReader        *ShaSumReader
+	)
+	body := io.Reader(r.Body)
+	if checksumHeader != "" {
+		algorithm, expectedChecksum, err = s.parseChecksum(checksumHeader)
+		if err != nil {
+			return 0, err
+		}
+		sumReader, err = NewShaSumReader(algorithm, r.Body)
+		if err != nil {
+			return 0, err
+		}
+		body = sumReader
 	}
 
-	algorithm := parts[0]
-	expectedChecksum := parts[1]
+	// 校验通过前数据只写入临时文件
+	file, err := os.CreateTemp(s.config.TemporaryDirectory, "tus-checksum-*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}()
+	if _, err = io.Copy(file, body); err != nil {
+		return 0, err
+	}
 
-	// 检查算法支持
-	supported := false
-	for _, alg := range s.algorithms {
-		if alg == algorithm {
-			supported = true
-			break
+	// Trailer在读完请求体后才可用, 需重新读取临时文件计算校验和
+	if sumReader == nil {
+		checksumHeader = r.Trailer.Get(common.HeaderUploadChecksum)
+		if checksumHeader == "" {
+			s.logger.Errorf("Missing Upload-Checksum trailer")
+			return 0, fmt.Errorf("%w: missing Upload-Checksum trailer", ErrInvalidChecksum)
+		}
+		algorithm, expectedChecksum, err = s.parseChecksum(checksumHeader)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		sumReader, err = NewShaSumReader(algorithm, file)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = io.Copy(io.Discard, sumReader); err != nil {
+			return 0, err
 		}
 	}
-	if !supported {
-		s.logger.Errorf("Algorithm not supported: %v", algorithm)
-		return 0, fmt.Errorf("algorithm not supported %s", algorithm)
+
+	if !bytes.Equal(sumReader.Checksum(), expectedChecksum) {
+		s.logger.Errorf("checksum mismatch: %v", checksumHeader)
+		return 0, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, base64.StdEncoding.EncodeToString(expectedChecksum), sumReader.ChecksumBase64())
 	}
-	sumReader, err := NewShaSumReader(algorithm, r.Body)
-	if err != nil {
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
 		return 0, err
 	}
+	return upload.WriteChunk(ctx, offset, file)
+}
 
-	defer func() {
-		calculatedSum := sumReader.ChecksumBase64()
-		if calculatedSum != expectedChecksum {
-			s.logger.Errorf("checksum mismatch: %v", expectedChecksum)
-			err = fmt.Errorf("checksum verification failed: expected %s, got %s",
-				expectedChecksum, calculatedSum)
-		}
-	}()
+// parseChecksum 解析"算法 base64校验和"格式的Upload-Checksum
+func (s *SHandler) parseChecksum(value string) (string, []byte, error) {
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 {
+		s.logger.Errorf("Invalid checksum header format: %v", value)
+		return "", nil, fmt.Errorf("%w: invalid checksum header format", ErrInvalidChecksum)
+	}
+
+	algorithm := parts[0]
+	checksum, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		s.logger.Errorf("Invalid checksum: %v", parts[1])
+		return "", nil, fmt.Errorf("%w: checksum is not base64 encoded", ErrInvalidChecksum)
+	}
 
-	return upload.WriteChunk(r.Context(), 0, r.Body)
+	// 检查算法支持
+	if !slices.Contains(s.algorithms, algorithm) {
+		s.logger.Errorf("Algorithm not supported: %v", algorithm)
+		return "", nil, fmt.Errorf("%w: algorithm not supported %s", ErrInvalidChecksum, algorithm)
+	}
+	return algorithm, checksum, nil
 }
 
 func (s *SHandler) parseUploadInfo(r *http.Request) (info common.FileInfo, err error) {
+	if r.Header.Get(common.HeaderUploadConcat) != "" && !s.hasExtension("concatenation") {
+		return info, fmt.Errorf("concatenation extension is disabled")
+	}
 	info.IsPartial, info.IsFinal, info.PartialIDs, err = s.parseConcat(r.Header.Get("Upload-Concat"))
 	if err != nil {
 		s.logger.Errorf("Error parsing upload info: %v", err)
@@ -487,11 +1074,22 @@ func (s *SHandler) parseUploadInfo(r *http.Request) (info common.FileInfo, err e
 	lengthHeader := r.Header.Get(common.HeaderUploadLength)
 	deferLengthHeader := r.Header.Get(common.HeaderUploadDeferLength)
 	if !info.IsFinal {
-		if deferLengthHeader == "1" {
+		if deferLengthHeader != "" && lengthHeader != "" {
+			s.logger.Errorf("Both Upload-Length and Upload-Defer-Length headers given")
+			return info, fmt.Errorf("Upload-Length and Upload-Defer-Length headers are mutually exclusive")
+		}
+		if deferLengthHeader != "" {
+			if !s.hasExtension("creation-defer-length") {
+				return info, fmt.Errorf("creation-defer-length extension is disabled")
+			}
+			if deferLengthHeader != "1" {
+				s.logger.Errorf("Invalid Upload-Defer-Length header: %v", deferLengthHeader)
+				return info, fmt.Errorf("invalid Upload-Defer-Length header")
+			}
 			info.SizeIsDeferred = true
 		} else if lengthHeader != "" {
 			info.Size, err = strconv.ParseInt(lengthHeader, 10, 64)
-			if err != nil {
+			if err != nil || info.Size < 0 {
 				s.logger.Errorf("Invalid Upload-Length header: %v", lengthHeader)
 				return info, fmt.Errorf("invalid Upload-Length header")
 			}
@@ -500,14 +1098,28 @@ func (s *SHandler) parseUploadInfo(r *http.Request) (info common.FileInfo, err e
 			return info, fmt.Errorf("missing Upload-Length or Upload-Defer-Length header")
 		}
 	}
+	if info.IsPartial {
+		if err = s.checkPartialSize(info.Size); err != nil {
+			return info, err
+		}
+	}
 
 	metadataHeader := r.Header.Get(common.HeaderUploadMetadata)
 	if metadataHeader != "" {
+		if err = s.checkMetadataSize(metadataHeader); err != nil {
+			return info, err
+		}
 		info.MetaData, err = s.parseMetadata(metadataHeader)
 		if err != nil {
 			s.logger.Errorf("Error parsing upload info: %v", err)
 			return info, err
 		}
+		if err = sanitizeMetadata(info.MetaData); err != nil {
+			return info, err
+		}
+		if err = s.checkMetadataKeys(info.MetaData); err != nil {
+			return info, err
+		}
 	}
 
 	return info, nil
@@ -545,8 +1157,16 @@ func (s *SHandler) parseMetadata(header string) (map[string]string, error) {
 }
 
 func (s *SHandler) encodeMetadata(metadata map[string]string) string {
+	// 按键排序, 同一上传的响应保持一致
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
 	var pairs []string
-	for key, value := range metadata {
+	for _, key := range keys {
+		value := metadata[key]
 		if value == "" {
 			pairs = append(pairs, key)
 		} else {
@@ -558,6 +1178,9 @@ func (s *SHandler) encodeMetadata(metadata map[string]string) string {
 }
 
 func (s *SHandler) mergeMetadata(old, new map[string]string) map[string]string {
+	if old == nil && len(new) > 0 {
+		old = make(map[string]string, len(new))
+	}
 	for key, value := range new {
 		old[key] = value
 	}
@@ -590,6 +1213,14 @@ func (s *SHandler) parseConcat(header string) (isPartial bool, isFinal bool, par
 				err = extractErr
 				return
 			}
+			if slices.Contains(partialUploads, id) {
+				err = fmt.Errorf("partial upload %s is referenced more than once", id)
+				return
+			}
+			if s.config.MaxConcatPartials > 0 && len(partialUploads) >= s.config.MaxConcatPartials {
+				err = fmt.Errorf("final upload references more than %d partial uploads", s.config.MaxConcatPartials)
+				return
+			}
 
 			partialUploads = append(partialUploads, id)
 		}
@@ -652,10 +1283,11 @@ var mimeInlineBrowserWhitelist = map[string]struct{}{
 func (s *SHandler) filterContentType(info common.FileInfo) (contentType string, contentDisposition string) {
 	filetype := info.MetaData["filetype"]
 
-	if ft, _, err := mime.ParseMediaType(filetype); err == nil {
+	if ft, params, err := mime.ParseMediaType(filetype); err == nil {
 		// If the filetype from metadata is well-formed, we forward use this for the Content-Type header.
 		// However, only allowlisted mime types	will be allowed to be shown inline in the browser
-		contentType = filetype
+		// 重新格式化, 避免转发原值中的多余字符
+		contentType = mime.FormatMediaType(ft, params)
 		if _, isWhitelisted := mimeInlineBrowserWhitelist[ft]; isWhitelisted {
 			contentDisposition = "inline"
 		} else {
@@ -667,13 +1299,55 @@ func (s *SHandler) filterContentType(info common.FileInfo) (contentType string,
 		contentType = "application/octet-stream"
 		contentDisposition = "attachment"
 	}
+	if s.config.ContentDisposition != "" {
+		contentDisposition = s.config.ContentDisposition
+	}
 
 	// Add a filename to Content-Disposition if one is available in the metadata
-	if filename, ok := info.MetaData["filename"]; ok {
-		contentDisposition += ";filename=" + strconv.Quote(filename)
+	filename, ok := info.MetaData["filename"]
+	if !ok {
+		filename = info.MetaData["name"]
+	}
+	return contentType, formatDisposition(contentDisposition, filename)
+}
+
+// formatDisposition 生成Content-Disposition, 文件名去除控制字符和路径, 非ASCII文件名按
+// RFC 5987编码为filename*, 并附带ASCII的filename供旧客户端使用
+func formatDisposition(disposition, filename string) string {
+	// 之前保存的元数据可能未经清理
+	filename = path.Base(strings.ReplaceAll(sanitizeMetadataValue(filename), "\\", "/"))
+	if filename == "." || filename == "/" {
+		return disposition
 	}
 
-	return contentType, contentDisposition
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, filename)
+	value := mime.FormatMediaType(disposition, map[string]string{"filename": fallback})
+	if value == "" {
+		return disposition
+	}
+	if fallback != filename {
+		value += "; filename*=UTF-8''" + encodeExtValue(filename)
+	}
+	return value
+}
+
+// encodeExtValue 按RFC 5987的attr-char对值进行百分号编码
+func encodeExtValue(value string) string {
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			builder.WriteByte(c)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		}
+	}
+	return builder.String()
 }
 
 func (s *SHandler) absFileURL(r *http.Request, id string) string {
@@ -681,14 +1355,40 @@ func (s *SHandler) absFileURL(r *http.Request, id string) string {
 		return s.basePath + id
 	}
 
+	// 反向代理去掉的路径前缀需要加回, 否则客户端无法访问
+	location := forwardedPrefix(r) + s.basePath + id
+	if s.config.RelativeLocation {
+		return location
+	}
+
 	// Read origin and protocol from request
 	host, proto := s.getHostAndProtocol(r)
 
-	url := proto + "://" + host + s.basePath + id
+	url := proto + "://" + host + location
 
 	return url
 }
 
+// forwardedPrefix 返回X-Forwarded-Prefix中的路径前缀, 不以/结尾
+func forwardedPrefix(r *http.Request) string {
+	prefix := firstForwarded(r.Header.Get("X-Forwarded-Prefix"))
+	if prefix == "" {
+		return ""
+	}
+	// 清理后的前缀不会以//开头, 避免相对地址被解析为其他主机
+	prefix = path.Clean("/" + prefix)
+	if prefix == "/" {
+		return ""
+	}
+	return prefix
+}
+
+// firstForwarded 返回多级代理以逗号追加的转发头中的第一个值, 即最外层代理收到的值
+func firstForwarded(value string) string {
+	value, _, _ = strings.Cut(value, ",")
+	return strings.TrimSpace(value)
+}
+
 func (s *SHandler) getHostAndProtocol(r *http.Request) (host, proto string) {
 	if r.TLS != nil {
 		proto = "https"
@@ -697,11 +1397,11 @@ func (s *SHandler) getHostAndProtocol(r *http.Request) (host, proto string) {
 	}
 
 	host = r.Host
-	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+	if h := firstForwarded(r.Header.Get("X-Forwarded-Host")); h != "" {
 		host = h
 	}
 
-	if h := r.Header.Get("X-Forwarded-Proto"); h == "http" || h == "https" {
+	if h := strings.ToLower(firstForwarded(r.Header.Get("X-Forwarded-Proto"))); h == "http" || h == "https" {
 		proto = h
 	}
 
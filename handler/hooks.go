@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// ErrUploadRejected can be returned, also wrapped, by a blocking hook such as
+// PreUploadCreateCallback to reject the request with 400 and the error
+// message. A hook returning an error together with an HTTPResponse with a
+// status code is answered with that response instead, e.g. 403 and a body
+// explaining why.
+var ErrUploadRejected = errors.New("upload rejected")
+
+// writeHookError 响应阻塞钩子返回的错误, 钩子给出状态码时按其响应拒绝请求
+func (s *SHandler) writeHookError(w http.ResponseWriter, resp common.HTTPResponse, err error) {
+	switch {
+	case resp.StatusCode != 0:
+		resp.WriteTo(w)
+	case errors.Is(err, ErrUploadRejected):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/google/uuid"
+)
+
+// IIDGenerator generates the IDs of new uploads, which become the last
+// segment of their URLs. IDs must be unique and only contain URL-safe
+// characters. PreUploadCreateCallback can still replace the generated ID.
+type IIDGenerator interface {
+	NewID(ctx context.Context, info common.FileInfo) (string, error)
+}
+
+// IDGeneratorFunc adapts a function to IIDGenerator.
+type IDGeneratorFunc func(ctx context.Context, info common.FileInfo) (string, error)
+
+func (f IDGeneratorFunc) NewID(ctx context.Context, info common.FileInfo) (string, error) {
+	return f(ctx, info)
+}
+
+// SRandomIDGenerator generates 128 random bits in hex after Prefix, the same
+// IDs the stores generate by default.
+type SRandomIDGenerator struct {
+	Prefix string
+}
+
+func (generator SRandomIDGenerator) NewID(ctx context.Context, info common.FileInfo) (string, error) {
+	return generator.Prefix + common.Uid(), nil
+}
+
+// SUUIDv7Generator generates UUIDv7 IDs, which sort by creation time.
+type SUUIDv7Generator struct{}
+
+func (SUUIDv7Generator) NewID(ctx context.Context, info common.FileInfo) (string, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// crockford ULID使用的Crockford Base32字母表
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// SULIDGenerator generates ULIDs, 26 characters that sort by creation time
+// in milliseconds.
+type SULIDGenerator struct{}
+
+func (SULIDGenerator) NewID(ctx context.Context, info common.FileInfo) (string, error) {
+	// 前48位为毫秒时间戳, 其后80位随机
+	var id [16]byte
+	ms := uint64(time.Now().UnixMilli())
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+
+	// 128位每5位编码为一个字符, 首字符只有高位补零后的3位
+	var encoded [26]byte
+	for i := range encoded {
+		var value byte
+		for b := 0; b < 5; b++ {
+			bit := i*5 + b - 2
+			if bit >= 0 && id[bit/8]&(0x80>>(bit%8)) != 0 {
+				value |= 0x10 >> b
+			}
+		}
+		encoded[i] = crockford[value]
+	}
+	return string(encoded[:]), nil
+}
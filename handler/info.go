@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// SUploadDetails is the info of an upload as returned by UploadDetails,
+// e.g. for dashboards. The Storage of finished uploads contains a
+// DownloadURL if the store presigns downloads (see
+// SConfig.PresignedDownloadExpiry).
+type SUploadDetails struct {
+	common.FileInfo
+	// State is UploadStateInProgress or UploadStateComplete.
+	State string `json:"state"`
+	// ExpiresAt is when an unfinished upload expires, nil if it doesn't.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// UploadDetails returns the full info of the upload with id, an error
+// containing "not found" if there is none. The info may come from a read
+// replica, see storage.WithStaleReads.
+func (s *SHandler) UploadDetails(ctx context.Context, id string) (SUploadDetails, error) {
+	ctx = storage.WithStaleReads(ctx)
+	upload, err := s.storage.GetUpload(ctx, id)
+	if err != nil {
+		return SUploadDetails{}, err
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return SUploadDetails{}, err
+	}
+	details := SUploadDetails{FileInfo: info, State: UploadStateInProgress}
+	if uploadFinished(info) {
+		details.State = UploadStateComplete
+		details.FileInfo = s.withDownloadURL(ctx, upload, info)
+	} else if expiresAt := s.expiresAt(info); !expiresAt.IsZero() {
+		details.ExpiresAt = &expiresAt
+	}
+	return details, nil
+}
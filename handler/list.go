@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// The states of SUploadFilter.
+const (
+	// UploadStateInProgress matches uploads which haven't received all
+	// their data yet.
+	UploadStateInProgress = "in-progress"
+	// UploadStateComplete matches finished uploads.
+	UploadStateComplete = "complete"
+)
+
+var (
+	// ErrInvalidFilter is returned by ListUploads for an SUploadFilter with
+	// an unknown State.
+	ErrInvalidFilter = errors.New("invalid filter")
+	// ErrInvalidCursor is returned by ListUploads for a cursor it didn't
+	// issue.
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// SUploadFilter selects the uploads returned by ListUploads, its zero value
+// matches all uploads.
+type SUploadFilter struct {
+	// State is UploadStateInProgress or UploadStateComplete, empty for
+	// both.
+	State string `json:"state,omitempty"`
+	// MetaData lists keys the uploads must have with the given value, or
+	// with any value if it is empty.
+	MetaData map[string]string `json:"metaData,omitempty"`
+	// CreatedAfter and CreatedBefore limit the creation time to
+	// [CreatedAfter, CreatedBefore), a zero time leaves the range open at
+	// that side.
+	CreatedAfter  time.Time `json:"createdAfter,omitzero"`
+	CreatedBefore time.Time `json:"createdBefore,omitzero"`
+	// Owner matches the uploads created by this subject, see
+	// common.MetaDataOwner.
+	Owner string `json:"owner,omitempty"`
+}
+
+func (filter SUploadFilter) validate() error {
+	if filter.State != "" && filter.State != UploadStateInProgress && filter.State != UploadStateComplete {
+		return fmt.Errorf("%w: unknown upload state %s", ErrInvalidFilter, filter.State)
+	}
+	return nil
+}
+
+// match 判断上传是否满足所有条件
+func (filter SUploadFilter) match(info common.FileInfo) bool {
+	switch filter.State {
+	case UploadStateInProgress:
+		if uploadFinished(info) {
+			return false
+		}
+	case UploadStateComplete:
+		if !uploadFinished(info) {
+			return false
+		}
+	}
+	for key, value := range filter.MetaData {
+		if actual, ok := info.MetaData[key]; !ok || (value != "" && actual != value) {
+			return false
+		}
+	}
+	if !filter.CreatedAfter.IsZero() && info.CreateTime.Before(filter.CreatedAfter) {
+		return false
+	}
+	if !filter.CreatedBefore.IsZero() && !info.CreateTime.Before(filter.CreatedBefore) {
+		return false
+	}
+	return filter.Owner == "" || info.MetaData[common.MetaDataOwner] == filter.Owner
+}
+
+// SUploadPage is a page of the uploads returned by ListUploads.
+type SUploadPage struct {
+	Uploads []common.FileInfo `json:"uploads"`
+	// NextCursor fetches the next page, empty on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// CanListUploads reports whether the store can list its uploads, which
+// ListUploads, StartBulkJob and ReplayFinishedUploads require.
+func (s *SHandler) CanListUploads() bool {
+	return storage.CanListUploads(s.storage)
+}
+
+// ListUploads returns up to limit uploads matching filter, ordered by their
+// creation time. The page following a page is fetched by passing its
+// NextCursor, an empty cursor starts at the oldest upload. Every call reads
+// the info of all uploads of the store, which has to be able to list them
+// (see storage.CanListUploads), otherwise ErrListingUnsupported is returned. The
+// info may come from a read replica, see storage.WithStaleReads.
+func (s *SHandler) ListUploads(ctx context.Context, filter SUploadFilter, cursor string, limit int) (SUploadPage, error) {
+	ctx = storage.WithStaleReads(ctx)
+	page := SUploadPage{Uploads: []common.FileInfo{}}
+	if err := filter.validate(); err != nil {
+		return page, err
+	}
+	afterTime, afterID, err := parseCursor(cursor)
+	if err != nil {
+		return page, err
+	}
+	var infos []common.FileInfo
+	err = s.walkUploads(ctx, filter, func(_ storage.IUpload, info common.FileInfo) error {
+		if cursor == "" || compareUploads(info.CreateTime, info.ID, afterTime, afterID) > 0 {
+			infos = append(infos, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return page, err
+	}
+	slices.SortFunc(infos, func(a, b common.FileInfo) int {
+		return compareUploads(a.CreateTime, a.ID, b.CreateTime, b.ID)
+	})
+	if limit > 0 && len(infos) > limit {
+		infos = infos[:limit]
+		last := infos[limit-1]
+		page.NextCursor = formatCursor(last.CreateTime, last.ID)
+	}
+	page.Uploads = append(page.Uploads, infos...)
+	return page, nil
+}
+
+// walkUploads 对存储中满足条件的上传依次调用fn
+func (s *SHandler) walkUploads(ctx context.Context, filter SUploadFilter, fn func(upload storage.IUpload, info common.FileInfo) error) error {
+	ids, err := storage.ListUploads(ctx, s.storage)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		upload, err := s.storage.GetUpload(ctx, id)
+		if err != nil {
+			// 列出后已被删除
+			if strings.Contains(err.Error(), "not found") {
+				continue
+			}
+			return err
+		}
+		info, err := upload.GetInfo(ctx)
+		if err != nil {
+			return err
+		}
+		if !filter.match(info) {
+			continue
+		}
+		if err = fn(upload, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFinished 上传已接收全部数据
+func uploadFinished(info common.FileInfo) bool {
+	return info.IsFinal || (!info.SizeIsDeferred && info.Offset >= info.Size)
+}
+
+func compareUploads(aTime time.Time, aID string, bTime time.Time, bID string) int {
+	if c := aTime.Compare(bTime); c != 0 {
+		return c
+	}
+	return cmp.Compare(aID, bID)
+}
+
+// formatCursor 游标记录上一页最后一个上传的创建时间和ID
+func formatCursor(createTime time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createTime.Format(time.RFC3339Nano) + " " + id))
+}
+
+func parseCursor(cursor string) (time.Time, string, error) {
+	if cursor == "" {
+		return time.Time{}, "", nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	raw, id, ok := strings.Cut(string(data), " ")
+	createTime, err := time.Parse(time.RFC3339Nano, raw)
+	if !ok || err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return createTime, id, nil
+}
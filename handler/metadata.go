@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// ErrInvalidMetadata is returned when the Upload-Metadata of a new upload
+// doesn't conform to the configured metadata rules, or one of its keys
+// contains characters other than ASCII letters, digits, '.', '_' and '-' or
+// starts with one of storage.ReservedMetaDataPrefixes.
+var ErrInvalidMetadata = errors.New("invalid metadata")
+
+// ErrMetadataTooLarge is returned when the Upload-Metadata header of a new
+// upload exceeds SConfig.MaxMetadataSize.
+var ErrMetadataTooLarge = errors.New("metadata too large")
+
+// SMetadataRule constrains a single Upload-Metadata key of new uploads.
+type SMetadataRule struct {
+	Key string
+	// Required rejects uploads without the key.
+	Required bool
+	// Forbidden rejects uploads with the key.
+	Forbidden bool
+	// Pattern, if set, must match the decoded value.
+	Pattern *regexp.Regexp
+	// MaxLength, if > 0, is the maximum length of the decoded value in bytes.
+	MaxLength int
+}
+
+func (rule SMetadataRule) validate() error {
+	if rule.Key == "" {
+		return fmt.Errorf("metadata rule without key")
+	}
+	if rule.Required && rule.Forbidden {
+		return fmt.Errorf("metadata key %s cannot be required and forbidden", rule.Key)
+	}
+	return nil
+}
+
+// check 校验单个键, 未提供的可选键不做限制
+func (rule SMetadataRule) check(metadata map[string]string) error {
+	value, ok := metadata[rule.Key]
+	if !ok {
+		if rule.Required {
+			return fmt.Errorf("%w: %s is required", ErrInvalidMetadata, rule.Key)
+		}
+		return nil
+	}
+	if rule.Forbidden {
+		return fmt.Errorf("%w: %s is not allowed", ErrInvalidMetadata, rule.Key)
+	}
+	if rule.MaxLength > 0 && len(value) > rule.MaxLength {
+		return fmt.Errorf("%w: %s exceeds %d bytes", ErrInvalidMetadata, rule.Key, rule.MaxLength)
+	}
+	if rule.Pattern != nil && !rule.Pattern.MatchString(value) {
+		return fmt.Errorf("%w: %s does not match %s", ErrInvalidMetadata, rule.Key, rule.Pattern)
+	}
+	return nil
+}
+
+// checkMetadataSize 解码前校验Upload-Metadata头的长度, 避免解析过大的头
+func (s *SHandler) checkMetadataSize(header string) error {
+	if s.config.MaxMetadataSize > 0 && len(header) > s.config.MaxMetadataSize {
+		return fmt.Errorf("%w: Upload-Metadata exceeds %d bytes", ErrMetadataTooLarge, s.config.MaxMetadataSize)
+	}
+	return nil
+}
+
+// checkMetadataKeys 校验元数据键的数量
+func (s *SHandler) checkMetadataKeys(metadata map[string]string) error {
+	if s.config.MaxMetadataKeys > 0 && len(metadata) > s.config.MaxMetadataKeys {
+		return fmt.Errorf("%w: more than %d keys", ErrInvalidMetadata, s.config.MaxMetadataKeys)
+	}
+	return nil
+}
+
+// validateMetadata 按配置的规则校验新上传的元数据
+func (s *SHandler) validateMetadata(metadata map[string]string) error {
+	for _, rule := range s.config.MetadataRules {
+		if err := rule.check(metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sanitizeMetadata 校验客户端提供的元数据键并清理其值, 保存前调用
+func sanitizeMetadata(metadata map[string]string) error {
+	for key, value := range metadata {
+		if !validMetadataKey(key) {
+			return fmt.Errorf("%w: key %q contains invalid characters", ErrInvalidMetadata, key)
+		}
+		for _, prefix := range storage.ReservedMetaDataPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				return fmt.Errorf("%w: key %q is reserved", ErrInvalidMetadata, key)
+			}
+		}
+		metadata[key] = sanitizeMetadataValue(value)
+	}
+	return nil
+}
+
+// validMetadataKey 键只允许ASCII字母, 数字和._-
+func validMetadataKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeMetadataValue 替换无效的UTF-8, 去除控制字符和可伪装文件名的双向文本控制字符, 并规范化为NFC
+func sanitizeMetadataValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(value, "\uFFFD"))
+	return norm.NFC.String(value)
+}
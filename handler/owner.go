@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// ErrNotOwner is returned for requests to the upload of another identity
+// if SConfig.RequireOwner is set.
+var ErrNotOwner = errors.New("upload belongs to another user")
+
+// isOwner 是否允许请求的身份访问该上传, 管理员可以访问所有上传
+func (s *SHandler) isOwner(ctx context.Context, info common.FileInfo) bool {
+	if !s.config.RequireOwner {
+		return true
+	}
+	identity := common.IdentityFromContext(ctx)
+	if identity == nil {
+		return false
+	}
+	if s.config.AdminScope != "" && identity.HasScope(s.config.AdminScope) {
+		return true
+	}
+	return identity.Subject != "" && info.MetaData[common.MetaDataOwner] == identity.Subject
+}
+
+// checkOwner 不是上传的所有者时写入403响应并返回false
+func (s *SHandler) checkOwner(w http.ResponseWriter, r *http.Request, info common.FileInfo) bool {
+	if s.isOwner(r.Context(), info) {
+		return true
+	}
+	// ReadAllScope只允许读取其他用户的上传
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && s.config.ReadAllScope != "" &&
+		common.IdentityFromContext(r.Context()).HasScope(s.config.ReadAllScope) {
+		return true
+	}
+	s.logger.Errorf("Upload of another user: %v", info.ID)
+	http.Error(w, ErrNotOwner.Error(), http.StatusForbidden)
+	return false
+}
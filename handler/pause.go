@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrUploadPaused is returned for PATCH requests to a paused upload and is
+// the cause of a PATCH being stopped because its upload has been paused.
+var ErrUploadPaused = errors.New("upload is paused")
+
+// IPauseStore keeps the set of paused uploads. Deployments with multiple
+// instances need an implementation shared by all of them.
+type IPauseStore interface {
+	Pause(ctx context.Context, id string) error
+	Resume(ctx context.Context, id string) error
+	IsPaused(ctx context.Context, id string) (bool, error)
+}
+
+// SMemoryPauseStore keeps the paused uploads in memory, for single instance
+// deployments. Pauses are lifted by a restart.
+type SMemoryPauseStore struct {
+	mu     sync.RWMutex
+	paused map[string]struct{}
+}
+
+func NewMemoryPauseStore() *SMemoryPauseStore {
+	return &SMemoryPauseStore{paused: make(map[string]struct{})}
+}
+
+func (store *SMemoryPauseStore) Pause(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.paused[id] = struct{}{}
+	return nil
+}
+
+func (store *SMemoryPauseStore) Resume(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.paused, id)
+	return nil
+}
+
+func (store *SMemoryPauseStore) IsPaused(ctx context.Context, id string) (bool, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	_, ok := store.paused[id]
+	return ok, nil
+}
+
+// sInflightPatch 进行中的PATCH, 暂停上传时用于中断写入
+type sInflightPatch struct {
+	cancel context.CancelCauseFunc
+}
+
+// PauseUpload pauses an upload without discarding its data, e.g. for abuse
+// handling. PATCH requests are answered with 423 Locked and a Retry-After
+// header until ResumeUpload is called, PATCH requests for the upload in
+// progress on this instance are stopped.
+func (s *SHandler) PauseUpload(ctx context.Context, id string) error {
+	if _, err := s.storage.GetUpload(ctx, id); err != nil {
+		return err
+	}
+	if err := s.pauses.Pause(ctx, id); err != nil {
+		return err
+	}
+
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	for patch := range s.inflight[id] {
+		patch.cancel(ErrUploadPaused)
+	}
+	return nil
+}
+
+// ResumeUpload lifts the pause of an upload, clients can continue it with
+// the next PATCH request.
+func (s *SHandler) ResumeUpload(ctx context.Context, id string) error {
+	return s.pauses.Resume(ctx, id)
+}
+
+// trackPatch 登记进行中的PATCH, 返回的函数在写入结束后注销
+func (s *SHandler) trackPatch(id string, cancel context.CancelCauseFunc) func() {
+	patch := &sInflightPatch{cancel: cancel}
+	s.inflightMu.Lock()
+	if s.inflight[id] == nil {
+		s.inflight[id] = make(map[*sInflightPatch]struct{})
+	}
+	s.inflight[id][patch] = struct{}{}
+	s.inflightMu.Unlock()
+
+	return func() {
+		s.inflightMu.Lock()
+		defer s.inflightMu.Unlock()
+		delete(s.inflight[id], patch)
+		if len(s.inflight[id]) == 0 {
+			delete(s.inflight, id)
+		}
+	}
+}
+
+// checkPaused 上传暂停时写入423响应并返回false
+func (s *SHandler) checkPaused(w http.ResponseWriter, r *http.Request, id string) bool {
+	paused, err := s.pauses.IsPaused(r.Context(), id)
+	if err != nil {
+		s.logger.Errorf("Error checking pause of upload: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if paused {
+		s.logger.Errorf("Upload paused: %v", id)
+		s.writePaused(w)
+		return false
+	}
+	return true
+}
+
+// writePaused 响应暂停的上传, 客户端应在Retry-After后重试
+func (s *SHandler) writePaused(w http.ResponseWriter) {
+	retryAfter := s.config.PauseRetryAfter
+	if retryAfter <= 0 {
+		retryAfter = time.Minute
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	http.Error(w, ErrUploadPaused.Error(), http.StatusLocked)
+}
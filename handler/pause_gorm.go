@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// pauseRecord 暂停上传表的模型
+type pauseRecord struct {
+	FileID    string `gorm:"primaryKey;size:255;comment:文件ID"`
+	CreatedAt time.Time
+}
+
+// TableName 指定表名
+func (pauseRecord) TableName() string {
+	return "paused_uploads"
+}
+
+// SGormPauseStore keeps the paused uploads in the paused_uploads table of a
+// database, e.g. the metadata database of the file store, so pauses are
+// shared by all instances of the server and survive restarts.
+type SGormPauseStore struct {
+	db *gorm.DB
+}
+
+// NewGormPauseStore creates the table if needed.
+func NewGormPauseStore(db *gorm.DB) (*SGormPauseStore, error) {
+	if err := db.AutoMigrate(&pauseRecord{}); err != nil {
+		return nil, err
+	}
+	return &SGormPauseStore{db: db}, nil
+}
+
+func (store *SGormPauseStore) Pause(ctx context.Context, id string) error {
+	return store.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&pauseRecord{FileID: id}).Error
+}
+
+func (store *SGormPauseStore) Resume(ctx context.Context, id string) error {
+	return store.db.WithContext(ctx).Where("file_id = ?", id).Delete(&pauseRecord{}).Error
+}
+
+func (store *SGormPauseStore) IsPaused(ctx context.Context, id string) (bool, error) {
+	var count int64
+	err := store.db.WithContext(ctx).Model(&pauseRecord{}).Where("file_id = ?", id).Count(&count).Error
+	return count > 0, err
+}
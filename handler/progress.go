@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// ErrUploadAborted is the cause of a PATCH request stopped because
+// ProgressCallback returned an error, which it wraps.
+var ErrUploadAborted = errors.New("upload aborted")
+
+// SubscribeProgressUploads calls callback with the progress reports of PATCH
+// requests (see SConfig.ProgressInterval) and after each PATCH request.
+func (s *SHandler) SubscribeProgressUploads(ctx context.Context, callback func(hook common.HookEvent) error) {
+	s.events.SubscribeEvent(ctx, "upload.progress", callback)
+}
+
+// sProgressReader 读取请求体时按间隔或字节数报告上传进度
+type sProgressReader struct {
+	handler *SHandler
+	reader  io.ReadCloser
+	request *http.Request
+	info    common.FileInfo
+	cancel  context.CancelCauseFunc
+
+	read       int64
+	reported   int64
+	reportedAt time.Time
+}
+
+// trackProgress 配置了进度报告时包装请求体, 回调返回错误时以ErrUploadAborted中断写入
+func (s *SHandler) trackProgress(r *http.Request, info common.FileInfo, cancel context.CancelCauseFunc) {
+	if s.config.ProgressInterval <= 0 && s.config.ProgressBytes <= 0 {
+		return
+	}
+	r.Body = &sProgressReader{
+		handler:    s,
+		reader:     r.Body,
+		request:    r,
+		info:       info,
+		cancel:     cancel,
+		reportedAt: time.Now(),
+	}
+}
+
+func (reader *sProgressReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.read += int64(n)
+	if n > 0 && reader.due() {
+		if hookErr := reader.report(); hookErr != nil {
+			return n, hookErr
+		}
+	}
+	return n, err
+}
+
+func (reader *sProgressReader) Close() error {
+	return reader.reader.Close()
+}
+
+func (reader *sProgressReader) due() bool {
+	config := reader.handler.config
+	if config.ProgressBytes > 0 && reader.read-reader.reported >= config.ProgressBytes {
+		return true
+	}
+	return config.ProgressInterval > 0 && time.Since(reader.reportedAt) >= config.ProgressInterval
+}
+
+func (reader *sProgressReader) report() error {
+	reader.reported = reader.read
+	reader.reportedAt = time.Now()
+
+	info := reader.info
+	info.Offset += reader.read
+	event := common.HookEvent{
+		Context:     reader.request.Context(),
+		HTTPRequest: reader.request,
+		Upload:      info,
+	}
+	if callback := reader.handler.config.ProgressCallback; callback != nil {
+		if err := callback(event); err != nil {
+			err = fmt.Errorf("%w: %w", ErrUploadAborted, err)
+			reader.cancel(err)
+			return err
+		}
+	}
+	reader.handler.publishEvent("upload.progress", event)
+	return nil
+}
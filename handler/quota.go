@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// ErrQuotaExceeded is returned for uploads which don't fit into the quota
+// of their owner.
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// IQuotaStore keeps the bytes stored by every owner and their quota.
+// Deployments with multiple instances need an implementation shared by all
+// of them.
+type IQuotaStore interface {
+	// Usage returns the bytes stored by subject and its own quota, 0 if
+	// it has none and SConfig.DefaultQuota applies.
+	Usage(ctx context.Context, subject string) (used, quota int64, err error)
+	// AddUsage adds delta, which is negative for removed uploads, to the
+	// bytes stored by subject.
+	AddUsage(ctx context.Context, subject string, delta int64) error
+	// SetQuota sets the quota of subject, 0 reverts to the default and a
+	// negative quota is unlimited.
+	SetQuota(ctx context.Context, subject string, quota int64) error
+}
+
+// SQuota is the storage usage of an owner.
+type SQuota struct {
+	Subject string `json:"subject"`
+	Used    int64  `json:"used"`
+	// Quota is the quota in effect, -1 if unlimited.
+	Quota int64 `json:"quota"`
+	// Default is set if the owner has no quota of its own.
+	Default bool `json:"default"`
+}
+
+// SMemoryQuotaStore keeps the usage in memory, for single instance
+// deployments. It is reset by a restart.
+type SMemoryQuotaStore struct {
+	mu     sync.Mutex
+	used   map[string]int64
+	quotas map[string]int64
+}
+
+func NewMemoryQuotaStore() *SMemoryQuotaStore {
+	return &SMemoryQuotaStore{used: make(map[string]int64), quotas: make(map[string]int64)}
+}
+
+func (store *SMemoryQuotaStore) Usage(ctx context.Context, subject string) (int64, int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.used[subject], store.quotas[subject], nil
+}
+
+func (store *SMemoryQuotaStore) AddUsage(ctx context.Context, subject string, delta int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.used[subject] = max(store.used[subject]+delta, 0)
+	return nil
+}
+
+func (store *SMemoryQuotaStore) SetQuota(ctx context.Context, subject string, quota int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if quota == 0 {
+		delete(store.quotas, subject)
+	} else {
+		store.quotas[subject] = quota
+	}
+	return nil
+}
+
+// Quota returns the storage usage and quota of subject, it fails if
+// SConfig.QuotaStore isn't set.
+func (s *SHandler) Quota(ctx context.Context, subject string) (SQuota, error) {
+	if s.config.QuotaStore == nil {
+		return SQuota{}, errors.New("quotas are not enabled")
+	}
+	used, quota, err := s.config.QuotaStore.Usage(ctx, subject)
+	if err != nil {
+		return SQuota{}, err
+	}
+	usage := SQuota{Subject: subject, Used: used, Quota: quota}
+	if quota == 0 {
+		usage.Quota = s.config.DefaultQuota
+		usage.Default = true
+	}
+	if usage.Quota <= 0 {
+		usage.Quota = -1
+	}
+	return usage, nil
+}
+
+// SetQuota sets the quota of subject in bytes, 0 reverts to
+// SConfig.DefaultQuota and a negative quota is unlimited. Uploads already
+// stored are kept if they exceed it.
+func (s *SHandler) SetQuota(ctx context.Context, subject string, quota int64) error {
+	if s.config.QuotaStore == nil {
+		return errors.New("quotas are not enabled")
+	}
+	return s.config.QuotaStore.SetQuota(ctx, subject, quota)
+}
+
+// checkQuota 上传超出所有者的剩余配额时写入413响应并返回false, 大小未知的上传只要求配额未用尽
+func (s *SHandler) checkQuota(w http.ResponseWriter, r *http.Request, info common.FileInfo, size int64) bool {
+	owner := info.MetaData[common.MetaDataOwner]
+	if s.config.QuotaStore == nil || owner == "" {
+		return true
+	}
+	usage, err := s.Quota(r.Context(), owner)
+	if err != nil {
+		s.logger.Errorf("Error getting quota: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if usage.Quota < 0 || (usage.Used+size <= usage.Quota && usage.Used < usage.Quota) {
+		return true
+	}
+	s.logger.Errorf("Upload of %v exceeds its quota: %d + %d > %d", owner, usage.Used, size, usage.Quota)
+	http.Error(w, fmt.Sprintf("%v: %d of %d bytes used", ErrQuotaExceeded, usage.Used, usage.Quota), http.StatusRequestEntityTooLarge)
+	return false
+}
+
+// remainingQuota 返回上传所有者剩余的配额, 不限制时返回-1
+func (s *SHandler) remainingQuota(ctx context.Context, info common.FileInfo) (int64, error) {
+	owner := info.MetaData[common.MetaDataOwner]
+	if s.config.QuotaStore == nil || owner == "" {
+		return -1, nil
+	}
+	usage, err := s.Quota(ctx, owner)
+	if err != nil {
+		return 0, err
+	}
+	if usage.Quota < 0 {
+		return -1, nil
+	}
+	return max(usage.Quota-usage.Used, 0), nil
+}
+
+// chargeQuota 记录所有者存储的字节数, 上传大小确定时计入, 终止时扣除, 失败只记录日志
+func (s *SHandler) chargeQuota(ctx context.Context, info common.FileInfo, delta int64) {
+	owner := info.MetaData[common.MetaDataOwner]
+	if s.config.QuotaStore == nil || owner == "" || delta == 0 {
+		return
+	}
+	if err := s.config.QuotaStore.AddUsage(ctx, owner, delta); err != nil {
+		s.logger.Errorf("Error updating quota usage of %v: %v", owner, err)
+	}
+}
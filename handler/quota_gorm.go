@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// quotaRecord 配额表的模型
+type quotaRecord struct {
+	Subject   string `gorm:"primaryKey;size:255;comment:上传的所有者"`
+	Used      int64  `gorm:"not null;default:0;comment:已使用的字节数"`
+	Quota     int64  `gorm:"not null;default:0;comment:配额, 0为默认, 负数不限"`
+	UpdatedAt time.Time
+}
+
+// TableName 指定表名
+func (quotaRecord) TableName() string {
+	return "upload_quotas"
+}
+
+// SGormQuotaStore keeps the usage in the upload_quotas table of a database,
+// e.g. the metadata database of the file store, so all instances of the
+// server share it.
+type SGormQuotaStore struct {
+	db *gorm.DB
+}
+
+// NewGormQuotaStore creates the table if needed.
+func NewGormQuotaStore(db *gorm.DB) (*SGormQuotaStore, error) {
+	if err := db.AutoMigrate(&quotaRecord{}); err != nil {
+		return nil, err
+	}
+	return &SGormQuotaStore{db: db}, nil
+}
+
+func (store *SGormQuotaStore) Usage(ctx context.Context, subject string) (int64, int64, error) {
+	// 没有记录的所有者尚未上传, 不用Take以免记录not found日志
+	var record quotaRecord
+	if err := store.db.WithContext(ctx).Where("subject = ?", subject).Limit(1).Find(&record).Error; err != nil {
+		return 0, 0, err
+	}
+	return record.Used, record.Quota, nil
+}
+
+func (store *SGormQuotaStore) AddUsage(ctx context.Context, subject string, delta int64) error {
+	// 在数据库中累加, 多个实例并发更新时不丢失
+	return store.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "subject"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"used":       gorm.Expr("CASE WHEN upload_quotas.used + ? > 0 THEN upload_quotas.used + ? ELSE 0 END", delta, delta),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&quotaRecord{Subject: subject, Used: max(delta, 0)}).Error
+}
+
+func (store *SGormQuotaStore) SetQuota(ctx context.Context, subject string, quota int64) error {
+	return store.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "subject"}},
+		DoUpdates: clause.AssignmentColumns([]string{"quota", "updated_at"}),
+	}).Create(&quotaRecord{Subject: subject, Quota: quota}).Error
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+var (
+	// ErrUploadNotFinished is returned when replaying an upload which is
+	// still in progress.
+	ErrUploadNotFinished = errors.New("upload not finished")
+	// ErrListingUnsupported is returned when replaying a time range with a
+	// store which can't list its uploads, see storage.CanListUploads.
+	ErrListingUnsupported = storage.ErrListingUnsupported
+)
+
+// ReplayFinishedUpload publishes the upload.finished event of a finished
+// upload again, e.g. after a downstream consumer was down, so the
+// subscribers (see SubscribeCompleteUploads) process it once more. The
+// pre-finish hook is not run again and the event has no HTTPRequest.
+func (s *SHandler) ReplayFinishedUpload(ctx context.Context, id string) (common.FileInfo, error) {
+	upload, err := s.storage.GetUpload(ctx, id)
+	if err != nil {
+		return common.FileInfo{}, err
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return common.FileInfo{}, err
+	}
+	return s.replayFinished(ctx, upload, info)
+}
+
+// FinishedUpload returns the info of a finished upload, ErrUploadNotFinished
+// while it is in progress.
+func (s *SHandler) FinishedUpload(ctx context.Context, id string) (common.FileInfo, error) {
+	upload, err := s.storage.GetUpload(ctx, id)
+	if err != nil {
+		return common.FileInfo{}, err
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return common.FileInfo{}, err
+	}
+	if !uploadFinished(info) {
+		return info, fmt.Errorf("%w: %s", ErrUploadNotFinished, info.ID)
+	}
+	return info, nil
+}
+
+// replayFinished 重新发布已完成上传的完成事件
+func (s *SHandler) replayFinished(ctx context.Context, upload storage.IUpload, info common.FileInfo) (common.FileInfo, error) {
+	if !uploadFinished(info) {
+		return info, fmt.Errorf("%w: %s", ErrUploadNotFinished, info.ID)
+	}
+	info = s.withDownloadURL(ctx, upload, info)
+	s.publishEvent("upload.finished", common.HookEvent{
+		Context: ctx,
+		Upload:  info,
+	})
+	return info, nil
+}
+
+// ReplayFinishedUploads replays the finished uploads created in [from, to),
+// a zero time leaves the range open at that side. Uploads in progress are
+// skipped. It returns the IDs of the replayed uploads.
+func (s *SHandler) ReplayFinishedUploads(ctx context.Context, from, to time.Time) ([]string, error) {
+	ids, err := storage.ListUploads(ctx, s.storage)
+	if err != nil {
+		return nil, err
+	}
+
+	var replayed []string
+	for _, id := range ids {
+		if err = ctx.Err(); err != nil {
+			return replayed, err
+		}
+		upload, err := s.storage.GetUpload(ctx, id)
+		if err != nil {
+			// 列出后已被删除
+			if strings.Contains(err.Error(), "not found") {
+				continue
+			}
+			return replayed, err
+		}
+		info, err := upload.GetInfo(ctx)
+		if err != nil {
+			return replayed, err
+		}
+		if (!from.IsZero() && info.CreateTime.Before(from)) || (!to.IsZero() && !info.CreateTime.Before(to)) {
+			continue
+		}
+		if _, err = s.replayFinished(ctx, upload, info); errors.Is(err, ErrUploadNotFinished) {
+			continue
+		} else if err != nil {
+			return replayed, err
+		}
+		replayed = append(replayed, id)
+	}
+	return replayed, nil
+}
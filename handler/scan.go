@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// The actions taken for infected uploads, see SConfig.ScanAction.
+const (
+	// ScanActionQuarantine moves infected uploads to
+	// SConfig.QuarantineStore, where they can be inspected.
+	ScanActionQuarantine = "quarantine"
+	// ScanActionDelete terminates infected uploads.
+	ScanActionDelete = "delete"
+)
+
+// IVirusScanner scans the data of finished uploads, e.g. clamav.SClamd.
+type IVirusScanner interface {
+	// Scan reads data to its end and returns the name of the virus found
+	// in it, empty if it is clean.
+	Scan(ctx context.Context, data io.Reader) (string, error)
+}
+
+// SubscribeScannedUploads calls callback after a finished upload has been
+// scanned (see SConfig.Scanner), the result is passed in the event's Scan.
+// Infected uploads have already been quarantined or deleted by then.
+func (s *SHandler) SubscribeScannedUploads(ctx context.Context, callback func(hook common.HookEvent) error) {
+	s.events.SubscribeEvent(ctx, "upload.scanned", callback)
+}
+
+// scanUpload 扫描完成的上传并发布upload.scanned事件, 在请求结束后异步执行
+func (s *SHandler) scanUpload(ctx context.Context, r *http.Request, info common.FileInfo) {
+	result := s.scan(ctx, info)
+	if result.Infected {
+		s.logger.Warnf("Upload infected: %v %v, action: %v", info.ID, result.Signature, result.Action)
+	}
+	s.publishEvent("upload.scanned", common.HookEvent{
+		Context:     ctx,
+		HTTPRequest: r,
+		Upload:      info,
+		Scan:        &result,
+	})
+}
+
+// scan 扫描上传的数据, 感染时按ScanAction隔离或删除, 失败时记录在结果的Error中
+func (s *SHandler) scan(ctx context.Context, info common.FileInfo) common.ScanResult {
+	var result common.ScanResult
+	upload, err := s.storage.GetUpload(ctx, info.ID)
+	if err != nil {
+		s.logger.Errorf("Error getting upload: %v", err)
+		result.Error = err.Error()
+		return result
+	}
+	reader, err := upload.GetReader(ctx)
+	if err != nil {
+		s.logger.Errorf("Error reading upload: %v", err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Signature, err = s.config.Scanner.Scan(ctx, reader)
+	_ = reader.Close()
+	if err != nil {
+		s.logger.Errorf("Error scanning upload %v: %v", info.ID, err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Infected = result.Signature != ""
+	if !result.Infected {
+		return result
+	}
+
+	switch s.config.ScanAction {
+	case ScanActionQuarantine:
+		err = s.quarantine(ctx, upload, info)
+	case ScanActionDelete:
+		err = upload.Terminate(ctx)
+	default:
+		return result
+	}
+	if err != nil {
+		s.logger.Errorf("Error handling infected upload %v: %v", info.ID, err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Action = s.config.ScanAction
+	if err = s.pauses.Resume(ctx, info.ID); err != nil {
+		s.logger.Errorf("Error resuming removed upload: %v", err)
+	}
+	s.chargeQuota(ctx, info, -info.Size)
+	return result
+}
+
+// quarantine 将上传复制到隔离存储后删除原上传
+func (s *SHandler) quarantine(ctx context.Context, upload storage.IUpload, info common.FileInfo) error {
+	// 清理之前失败时留下的数据
+	if stale, err := s.config.QuarantineStore.GetUpload(ctx, info.ID); err == nil {
+		if err = stale.Terminate(ctx); err != nil {
+			return err
+		}
+	} else if !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+
+	quarantinedInfo := info
+	quarantinedInfo.Offset = 0
+	quarantinedInfo.Storage = nil
+	quarantined, err := s.config.QuarantineStore.NewUpload(ctx, quarantinedInfo)
+	if err != nil {
+		return err
+	}
+	reader, err := upload.GetReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	n, err := quarantined.WriteChunk(ctx, 0, reader)
+	if err != nil && !errors.Is(err, storage.ErrUploadCompleted) {
+		return err
+	}
+	if n != info.Offset {
+		return fmt.Errorf("quarantined %d of %d bytes", n, info.Offset)
+	}
+	return upload.Terminate(ctx)
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// ErrContentTypeNotAllowed is returned for uploads whose content, as
+// detected by DetectContentType, isn't allowed by
+// SConfig.AllowedContentTypes or DeniedContentTypes.
+var ErrContentTypeNotAllowed = errors.New("content type not allowed")
+
+// sniffLen 判断类型读取的字节数, 与http.DetectContentType一致
+const sniffLen = 512
+
+// executableSignatures 补充http.DetectContentType不识别的可执行文件
+var executableSignatures = []struct {
+	prefix      string
+	contentType string
+}{
+	{"\x7fELF", "application/x-executable"},
+	{"MZ", "application/vnd.microsoft.portable-executable"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xca\xfe\xba\xbe", "application/x-mach-binary"},
+	{"#!", "text/x-shellscript"},
+}
+
+// DetectContentType returns the media type of data, the first 512 bytes of
+// a file, without parameters. Besides the types of http.DetectContentType
+// it recognizes executables: ELF (application/x-executable), PE
+// (application/vnd.microsoft.portable-executable), Mach-O
+// (application/x-mach-binary) and scripts with a shebang
+// (text/x-shellscript).
+func DetectContentType(data []byte) string {
+	for _, signature := range executableSignatures {
+		if bytes.HasPrefix(data, []byte(signature.prefix)) {
+			return signature.contentType
+		}
+	}
+	contentType, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	return contentType
+}
+
+// contentTypeAllowed 按拒绝和允许列表判断, 支持image/*形式的通配
+func (s *SHandler) contentTypeAllowed(contentType string) bool {
+	for _, pattern := range s.config.DeniedContentTypes {
+		if matchContentType(pattern, contentType) {
+			return false
+		}
+	}
+	if len(s.config.AllowedContentTypes) == 0 {
+		return true
+	}
+	for _, pattern := range s.config.AllowedContentTypes {
+		if matchContentType(pattern, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchContentType(pattern, contentType string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(contentType, prefix+"/")
+	}
+	return pattern == "*" || strings.EqualFold(pattern, contentType)
+}
+
+// checkContent 读取上传开头的数据校验类型, 之后的写入从头读取请求体, 返回false时已写入响应.
+// 第一块数据不足512字节且不是完整的上传时无法判断类型, 为防止分多次发送绕过检查而拒绝
+func (s *SHandler) checkContent(w http.ResponseWriter, r *http.Request, info common.FileInfo, offset int64) bool {
+	if offset != 0 || (len(s.config.AllowedContentTypes) == 0 && len(s.config.DeniedContentTypes) == 0) {
+		return true
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r.Body, head)
+	head = head[:n]
+	r.Body = &sReplayBody{Reader: io.MultiReader(bytes.NewReader(head), r.Body), Closer: r.Body}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		s.logger.Errorf("Error reading chunk: %v", err)
+		if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return false
+	}
+	if n == 0 {
+		return true
+	}
+	if n < sniffLen && (info.SizeIsDeferred || int64(n) < info.Size) {
+		s.logger.Errorf("First chunk too short for content type validation: %v", info.ID)
+		http.Error(w, "the first chunk must contain at least 512 bytes for content type validation", http.StatusBadRequest)
+		return false
+	}
+	if contentType := DetectContentType(head); !s.contentTypeAllowed(contentType) {
+		s.logger.Errorf("Content type not allowed: %v %v", info.ID, contentType)
+		http.Error(w, ErrContentTypeNotAllowed.Error()+": "+contentType, http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
+}
+
+// sReplayBody 重新读取已读出的开头数据, 关闭原始的请求体
+type sReplayBody struct {
+	io.Reader
+	io.Closer
+}
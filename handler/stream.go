@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// eventStreamSuffix 进度流的路径后缀, GET <basePath><id>/events
+const eventStreamSuffix = "/events"
+
+// eventStreamKeepAlive 空闲时发送注释行的间隔, 避免代理关闭连接
+const eventStreamKeepAlive = 15 * time.Second
+
+// sStreamEvent 进度流中的一条事件
+type sStreamEvent struct {
+	Type           string `json:"-"`
+	ID             string `json:"id"`
+	Offset         int64  `json:"offset"`
+	Size           int64  `json:"size"`
+	SizeIsDeferred bool   `json:"sizeIsDeferred"`
+}
+
+func newStreamEvent(typ string, info common.FileInfo) sStreamEvent {
+	return sStreamEvent{
+		Type:           typ,
+		ID:             info.ID,
+		Offset:         info.Offset,
+		Size:           info.Size,
+		SizeIsDeferred: info.SizeIsDeferred,
+	}
+}
+
+// final 完成或删除后不会再有事件
+func (event sStreamEvent) final() bool {
+	return event.Type != "progress"
+}
+
+// sStreamWatcher 一个进度流连接, 只保留最新的事件, 慢速客户端跳过中间的进度
+type sStreamWatcher struct {
+	mu      sync.Mutex
+	event   sStreamEvent
+	pending bool
+	notify  chan struct{}
+}
+
+func (watcher *sStreamWatcher) set(event sStreamEvent) {
+	watcher.mu.Lock()
+	// 完成事件不被随后的进度覆盖
+	if !watcher.pending || !watcher.event.final() || event.final() {
+		watcher.event = event
+		watcher.pending = true
+	}
+	watcher.mu.Unlock()
+	select {
+	case watcher.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (watcher *sStreamWatcher) take() (sStreamEvent, bool) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	event, ok := watcher.event, watcher.pending
+	watcher.pending = false
+	return event, ok
+}
+
+// publishEvent 发布事件并通知该上传的进度流
+func (s *SHandler) publishEvent(name string, event common.HookEvent) {
+	s.events.PublishEvent(name, event)
+
+	var typ string
+	switch name {
+	case "upload.progress":
+		typ = "progress"
+	case "upload.finished":
+		typ = "finished"
+	case "upload.terminated":
+		typ = "terminated"
+	default:
+		return
+	}
+	s.watchersMu.Lock()
+	defer s.watchersMu.Unlock()
+	for watcher := range s.watchers[event.Upload.ID] {
+		watcher.set(newStreamEvent(typ, event.Upload))
+	}
+}
+
+// watchUpload 登记进度流, 返回的函数在连接结束后注销
+func (s *SHandler) watchUpload(id string) (*sStreamWatcher, func()) {
+	watcher := &sStreamWatcher{notify: make(chan struct{}, 1)}
+	s.watchersMu.Lock()
+	if s.watchers[id] == nil {
+		s.watchers[id] = make(map[*sStreamWatcher]struct{})
+	}
+	s.watchers[id][watcher] = struct{}{}
+	s.watchersMu.Unlock()
+
+	return watcher, func() {
+		s.watchersMu.Lock()
+		defer s.watchersMu.Unlock()
+		delete(s.watchers[id], watcher)
+		if len(s.watchers[id]) == 0 {
+			delete(s.watchers, id)
+		}
+	}
+}
+
+// handleEventStream 以Server-Sent Events推送上传的偏移量, 供其他页面或监控面板实时查看进度.
+// 先发送当前状态, 之后每次进度报告发送progress, 上传完成或删除时发送finished/terminated并结束
+func (s *SHandler) handleEventStream(w http.ResponseWriter, r *http.Request, uploadID string) {
+	// 先登记再读取状态, 避免遗漏其间的事件
+	watcher, unwatch := s.watchUpload(uploadID)
+	defer unwatch()
+
+	upload, err := s.storage.GetUpload(r.Context(), uploadID)
+	if err != nil {
+		s.logger.Errorf("Error getting upload: %v", err)
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	info, err := upload.GetInfo(r.Context())
+	if err != nil {
+		s.logger.Errorf("Error getting upload info: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.expired(info) {
+		s.logger.Errorf("Upload expired: %v", uploadID)
+		http.Error(w, "Upload expired", http.StatusGone)
+		return
+	}
+	if !s.checkOwner(w, r, info) {
+		return
+	}
+
+	flusher := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// 关闭nginx的响应缓冲
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	event := newStreamEvent("progress", info)
+	if !info.SizeIsDeferred && info.Offset >= info.Size {
+		event.Type = "finished"
+	}
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		data, _ := json.Marshal(event)
+		if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err == nil {
+			err = flusher.Flush()
+		}
+		if err != nil || event.final() {
+			return
+		}
+
+		var ok bool
+		for !ok {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err == nil {
+					err = flusher.Flush()
+				}
+				if err != nil {
+					return
+				}
+			case <-watcher.notify:
+				event, ok = watcher.take()
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"github.com/busybox-org/gin-fileuploader/hooks"
+)
+
+// SNSHook publishes hook events as JSON to an SNS topic. The message
+// attributes type, id and, for uploads stored in S3, bucket and key allow
+// subscriptions to filter the events with a filter policy, e.g. to trigger a
+// Lambda function only for finished uploads.
+//
+// FIFO topics (ending with .fifo) receive the upload ID as message group, so
+// the events of an upload are delivered in order. It only publishes and never
+// rejects, so it is meant to be used with hooks.Subscribe for the post hooks.
+type SNSHook struct {
+	TopicARN string
+
+	client *sns.Client
+}
+
+// NewSNSHook creates a hook publishing to the topic with client.
+func NewSNSHook(client *sns.Client, topicARN string) *SNSHook {
+	return &SNSHook{TopicARN: topicARN, client: client}
+}
+
+func (hook *SNSHook) InvokeHook(ctx context.Context, event hooks.SEvent) (hooks.SResponse, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return hooks.SResponse{}, err
+	}
+	input := &sns.PublishInput{
+		TopicArn:          aws.String(hook.TopicARN),
+		Message:           aws.String(string(payload)),
+		MessageAttributes: make(map[string]snstypes.MessageAttributeValue),
+	}
+	for name, value := range attributes(event) {
+		input.MessageAttributes[name] = snstypes.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+	if strings.HasSuffix(hook.TopicARN, ".fifo") {
+		input.MessageGroupId = aws.String(event.Upload.ID)
+		input.MessageDeduplicationId = aws.String(deduplicationID(event))
+	}
+	_, err = hook.client.Publish(ctx, input)
+	return hooks.SResponse{}, err
+}
+
+// SQSHook sends hook events as JSON to an SQS queue, with the same message
+// attributes and FIFO handling as SNSHook.
+type SQSHook struct {
+	QueueURL string
+
+	client *sqs.Client
+}
+
+// NewSQSHook creates a hook sending to the queue with client.
+func NewSQSHook(client *sqs.Client, queueURL string) *SQSHook {
+	return &SQSHook{QueueURL: queueURL, client: client}
+}
+
+func (hook *SQSHook) InvokeHook(ctx context.Context, event hooks.SEvent) (hooks.SResponse, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return hooks.SResponse{}, err
+	}
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(hook.QueueURL),
+		MessageBody:       aws.String(string(payload)),
+		MessageAttributes: make(map[string]sqstypes.MessageAttributeValue),
+	}
+	for name, value := range attributes(event) {
+		input.MessageAttributes[name] = sqstypes.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+	if strings.HasSuffix(hook.QueueURL, ".fifo") {
+		input.MessageGroupId = aws.String(event.Upload.ID)
+		input.MessageDeduplicationId = aws.String(deduplicationID(event))
+	}
+	_, err = hook.client.SendMessage(ctx, input)
+	return hooks.SResponse{}, err
+}
+
+// attributes 返回消息属性, SNS/SQS不允许空值因此跳过缺失的存储位置
+func attributes(event hooks.SEvent) map[string]string {
+	attrs := map[string]string{
+		"type": string(event.Type),
+		"id":   event.Upload.ID,
+	}
+	for name, key := range map[string]string{"bucket": "Bucket", "key": "Key"} {
+		if value := event.Upload.Storage[key]; value != "" {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
+
+// deduplicationID FIFO去重ID, 同一上传的进度事件按偏移量区分
+func deduplicationID(event hooks.SEvent) string {
+	id := event.Upload.ID + ":" + string(event.Type)
+	if event.Type == hooks.HookPostReceive {
+		id += ":" + strconv.FormatInt(event.Upload.Offset, 10)
+	}
+	return id
+}
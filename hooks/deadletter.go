@@ -0,0 +1,202 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// ErrDeadLetterNotFound is returned for unknown dead letter IDs.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// SDeadLetter is a hook event whose delivery failed after all attempts.
+type SDeadLetter struct {
+	ID       string    `json:"id"`
+	Event    SEvent    `json:"event"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// IDeadLetterStore persists dead letters until they are replayed.
+type IDeadLetterStore interface {
+	Add(ctx context.Context, letter SDeadLetter) error
+	// List returns the dead letters ordered by the time they failed.
+	List(ctx context.Context) ([]SDeadLetter, error)
+	Get(ctx context.Context, id string) (SDeadLetter, error)
+	Remove(ctx context.Context, id string) error
+}
+
+// Retry invokes hookHandler up to attempts times while it fails, waiting
+// backoff before the second attempt and twice as long before every further
+// one. Rejections are responses, not failures, and are not retried. Events
+// still failing are added to deadLetters, if not nil, so they can be
+// replayed with Replay.
+//
+// Retrying delays the request, so it is meant for asynchronous hooks.
+func Retry(hookHandler IHookHandler, attempts int, backoff time.Duration, deadLetters IDeadLetterStore) IHookHandler {
+	return &sRetryHook{
+		hookHandler: hookHandler,
+		attempts:    max(attempts, 1),
+		backoff:     backoff,
+		deadLetters: deadLetters,
+	}
+}
+
+// sRetryHook 失败时重试钩子, 最终失败的事件写入死信存储
+type sRetryHook struct {
+	hookHandler IHookHandler
+	attempts    int
+	backoff     time.Duration
+	deadLetters IDeadLetterStore
+}
+
+func (hook *sRetryHook) InvokeHook(ctx context.Context, event SEvent) (SResponse, error) {
+	var (
+		resp SResponse
+		err  error
+	)
+	wait := hook.backoff
+	for attempt := 1; attempt <= hook.attempts; attempt++ {
+		if resp, err = hook.hookHandler.InvokeHook(ctx, event); err == nil {
+			return resp, nil
+		}
+		if attempt == hook.attempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return resp, err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+	if hook.deadLetters == nil {
+		return resp, err
+	}
+
+	letter := SDeadLetter{
+		ID:       common.Uid(),
+		Event:    event,
+		Error:    err.Error(),
+		Attempts: hook.attempts,
+		FailedAt: time.Now(),
+	}
+	if dlErr := hook.deadLetters.Add(context.WithoutCancel(ctx), letter); dlErr != nil {
+		return resp, fmt.Errorf("%w, failed to persist dead letter: %w", err, dlErr)
+	}
+	return resp, fmt.Errorf("%w, saved as dead letter %s", err, letter.ID)
+}
+
+// Replay invokes hookHandler with the event of the dead letter and removes
+// the dead letter once the hook succeeded.
+func Replay(ctx context.Context, deadLetters IDeadLetterStore, hookHandler IHookHandler, id string) error {
+	letter, err := deadLetters.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if _, err = hookHandler.InvokeHook(ctx, letter.Event); err != nil {
+		return err
+	}
+	return deadLetters.Remove(ctx, id)
+}
+
+// SDirDeadLetterStore keeps every dead letter as a JSON file named after its
+// ID in Dir.
+type SDirDeadLetterStore struct {
+	Dir string
+}
+
+// NewDirDeadLetterStore creates the directory if needed.
+func NewDirDeadLetterStore(dir string) (*SDirDeadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &SDirDeadLetterStore{Dir: dir}, nil
+}
+
+func (store *SDirDeadLetterStore) path(id string) (string, error) {
+	// ID来自命令行参数, 不允许包含路径
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+	return filepath.Join(store.Dir, id+".json"), nil
+}
+
+func (store *SDirDeadLetterStore) Add(ctx context.Context, letter SDeadLetter) error {
+	path, err := store.path(letter.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	// 先写入临时文件再重命名, 避免读取到写了一半的文件
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (store *SDirDeadLetterStore) List(ctx context.Context) ([]SDeadLetter, error) {
+	names, err := filepath.Glob(filepath.Join(store.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]SDeadLetter, 0, len(names))
+	for _, name := range names {
+		letter, err := store.Get(ctx, strings.TrimSuffix(filepath.Base(name), ".json"))
+		if errors.Is(err, ErrDeadLetterNotFound) {
+			// 列出期间已被重放
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	slices.SortFunc(letters, func(a, b SDeadLetter) int {
+		return a.FailedAt.Compare(b.FailedAt)
+	})
+	return letters, nil
+}
+
+func (store *SDirDeadLetterStore) Get(ctx context.Context, id string) (SDeadLetter, error) {
+	var letter SDeadLetter
+	path, err := store.path(id)
+	if err != nil {
+		return letter, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return letter, fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+	if err != nil {
+		return letter, err
+	}
+	if err = json.Unmarshal(data, &letter); err != nil {
+		return letter, fmt.Errorf("invalid dead letter %s: %w", id, err)
+	}
+	return letter, nil
+}
+
+func (store *SDirDeadLetterStore) Remove(ctx context.Context, id string) error {
+	path, err := store.path(id)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+	return err
+}
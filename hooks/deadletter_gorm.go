@@ -0,0 +1,111 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// deadLetterRecord 死信表的模型
+type deadLetterRecord struct {
+	ID       string         `gorm:"primaryKey;size:64"`
+	Type     string         `gorm:"size:32;comment:钩子类型"`
+	UploadID string         `gorm:"size:255;index;comment:上传ID"`
+	Event    datatypes.JSON `gorm:"type:json;comment:钩子事件"`
+	Error    string         `gorm:"type:text;comment:错误信息"`
+	Attempts int
+	FailedAt time.Time `gorm:"index"`
+}
+
+// TableName 指定表名
+func (deadLetterRecord) TableName() string {
+	return "hook_dead_letters"
+}
+
+// SGormDeadLetterStore keeps the dead letters in the hook_dead_letters table
+// of a database, e.g. the metadata database of the file store, so all
+// instances of the server share them.
+type SGormDeadLetterStore struct {
+	db *gorm.DB
+}
+
+// NewGormDeadLetterStore creates the table if needed.
+func NewGormDeadLetterStore(db *gorm.DB) (*SGormDeadLetterStore, error) {
+	if err := db.AutoMigrate(&deadLetterRecord{}); err != nil {
+		return nil, err
+	}
+	return &SGormDeadLetterStore{db: db}, nil
+}
+
+func (store *SGormDeadLetterStore) Add(ctx context.Context, letter SDeadLetter) error {
+	event, err := json.Marshal(letter.Event)
+	if err != nil {
+		return err
+	}
+	return store.db.WithContext(ctx).Create(&deadLetterRecord{
+		ID:       letter.ID,
+		Type:     string(letter.Event.Type),
+		UploadID: letter.Event.Upload.ID,
+		Event:    event,
+		Error:    letter.Error,
+		Attempts: letter.Attempts,
+		FailedAt: letter.FailedAt,
+	}).Error
+}
+
+func (store *SGormDeadLetterStore) List(ctx context.Context) ([]SDeadLetter, error) {
+	var records []deadLetterRecord
+	if err := store.db.WithContext(ctx).Order("failed_at").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	letters := make([]SDeadLetter, 0, len(records))
+	for _, record := range records {
+		letter, err := record.letter()
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+func (store *SGormDeadLetterStore) Get(ctx context.Context, id string) (SDeadLetter, error) {
+	var record deadLetterRecord
+	err := store.db.WithContext(ctx).Where("id = ?", id).Take(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return SDeadLetter{}, fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+	if err != nil {
+		return SDeadLetter{}, err
+	}
+	return record.letter()
+}
+
+func (store *SGormDeadLetterStore) Remove(ctx context.Context, id string) error {
+	result := store.db.WithContext(ctx).Where("id = ?", id).Delete(&deadLetterRecord{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+	return nil
+}
+
+func (record deadLetterRecord) letter() (SDeadLetter, error) {
+	letter := SDeadLetter{
+		ID:       record.ID,
+		Error:    record.Error,
+		Attempts: record.Attempts,
+		FailedAt: record.FailedAt,
+	}
+	if err := json.Unmarshal(record.Event, &letter.Event); err != nil {
+		return letter, fmt.Errorf("invalid dead letter %s: %w", record.ID, err)
+	}
+	return letter, nil
+}
@@ -0,0 +1,87 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SExecHook invokes hooks by executing the program named after the hook
+// type in Directory, e.g. hooks/pre-create, hook types without a program are
+// skipped. The program receives the SEvent as JSON on stdin and the
+// TUS_HOOK, TUS_ID, TUS_SIZE and TUS_OFFSET environment variables.
+//
+// Exiting with 0 accepts the request, any other exit code rejects it with
+// stderr as error message. The program can print an SResponse as JSON to
+// stdout to change the response or the new upload.
+type SExecHook struct {
+	Directory string
+	// Timeout kills programs running longer, 0 disables the timeout.
+	Timeout time.Duration
+}
+
+func (hook *SExecHook) InvokeHook(ctx context.Context, event SEvent) (SResponse, error) {
+	var resp SResponse
+	name := filepath.Join(hook.Directory, string(event.Type))
+	if _, err := os.Stat(name); err != nil {
+		if os.IsNotExist(err) {
+			return resp, nil
+		}
+		return resp, err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return resp, err
+	}
+	if hook.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hook.Timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(),
+		"TUS_HOOK="+string(event.Type),
+		"TUS_ID="+event.Upload.ID,
+		"TUS_SIZE="+strconv.FormatInt(event.Upload.Size, 10),
+		"TUS_OFFSET="+strconv.FormatInt(event.Upload.Offset, 10),
+	)
+	err = cmd.Run()
+
+	// 非零退出码表示拒绝, 其余错误为钩子执行失败
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return resp, err
+	}
+	if err != nil && ctx.Err() != nil {
+		return resp, fmt.Errorf("%s: %w", name, ctx.Err())
+	}
+	if output := bytes.TrimSpace(stdout.Bytes()); len(output) > 0 {
+		if err := json.Unmarshal(output, &resp); err != nil {
+			return resp, fmt.Errorf("invalid output of %s: %w", name, err)
+		}
+	}
+	if exitErr != nil {
+		resp.RejectUpload = true
+		if resp.HTTPResponse.StatusCode == 0 {
+			if message := strings.TrimSpace(stderr.String()); message != "" {
+				resp.HTTPResponse.StatusCode = 400
+				resp.HTTPResponse.Body = message + "\n"
+			}
+		}
+	}
+	return resp, nil
+}
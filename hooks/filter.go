@@ -0,0 +1,74 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SMetadataFilter matches uploads by their metadata. Every key has to be
+// present and its value has to match one of the patterns of the key, see
+// path.Match, e.g. {"type": {"video"}, "filetype": {"video/*", "image/*"}}.
+type SMetadataFilter map[string][]string
+
+// ParseMetadataFilter parses rules like type=video, repeating a key allows
+// several values.
+func ParseMetadataFilter(rules []string) (SMetadataFilter, error) {
+	filter := make(SMetadataFilter, len(rules))
+	for _, rule := range rules {
+		key, pattern, ok := strings.Cut(rule, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid metadata filter %s, expected key=pattern", rule)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid metadata filter %s: %w", rule, err)
+		}
+		filter[key] = append(filter[key], pattern)
+	}
+	return filter, nil
+}
+
+// Match reports whether metadata satisfies the filter, an empty filter
+// matches everything.
+func (filter SMetadataFilter) Match(metadata map[string]string) bool {
+	for key, patterns := range filter {
+		value, ok := metadata[key]
+		if !ok || !matchAny(patterns, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter invokes hookHandler only for uploads matching filter, others are
+// accepted without invoking it. This allows several hook handlers, e.g. one
+// per downstream system, to receive only the uploads they are interested in.
+func Filter(hookHandler IHookHandler, filter SMetadataFilter) IHookHandler {
+	if len(filter) == 0 {
+		return hookHandler
+	}
+	return &sFilterHook{hookHandler: hookHandler, filter: filter}
+}
+
+// sFilterHook 只对元数据匹配的上传调用钩子
+type sFilterHook struct {
+	hookHandler IHookHandler
+	filter      SMetadataFilter
+}
+
+func (hook *sFilterHook) InvokeHook(ctx context.Context, event SEvent) (SResponse, error) {
+	if !hook.filter.Match(event.Upload.MetaData) {
+		return SResponse{}, nil
+	}
+	return hook.hookHandler.InvokeHook(ctx, event)
+}
@@ -0,0 +1,162 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/handler"
+)
+
+// HookType names the point in the lifecycle of an upload a hook is invoked
+// at. The pre hooks block the request and can reject it, the post hooks are
+// invoked asynchronously after the request.
+type HookType string
+
+const (
+	HookPreCreate     HookType = "pre-create"
+	HookPostCreate    HookType = "post-create"
+	HookPostReceive   HookType = "post-receive"
+	HookPreFinish     HookType = "pre-finish"
+	HookPostFinish    HookType = "post-finish"
+	HookPreTerminate  HookType = "pre-terminate"
+	HookPostTerminate HookType = "post-terminate"
+	// HookPostScan is invoked with the result of the virus scan of a
+	// finished upload, see handler.SConfig.Scanner.
+	HookPostScan HookType = "post-scan"
+)
+
+// AllHooks lists every hook type.
+var AllHooks = []HookType{
+	HookPreCreate,
+	HookPostCreate,
+	HookPostReceive,
+	HookPreFinish,
+	HookPostFinish,
+	HookPreTerminate,
+	HookPostTerminate,
+	HookPostScan,
+}
+
+// SEvent is passed to hook handlers, external ones receive it as JSON.
+type SEvent struct {
+	Type        HookType        `json:"type"`
+	Upload      common.FileInfo `json:"upload"`
+	HTTPRequest SHTTPRequest    `json:"httpRequest"`
+	// Identity is the authenticated client of the request, if any.
+	Identity *common.Identity `json:"identity,omitempty"`
+	// Scan is the result of the virus scan, only for post-scan hooks.
+	Scan *common.ScanResult `json:"scan,omitempty"`
+}
+
+// SHTTPRequest describes the request which triggered a hook.
+type SHTTPRequest struct {
+	Method     string      `json:"method"`
+	URI        string      `json:"uri"`
+	RemoteAddr string      `json:"remoteAddr"`
+	Header     http.Header `json:"header"`
+}
+
+// SResponse is returned by hook handlers, it is only applied for pre hooks.
+type SResponse struct {
+	// HTTPResponse is merged into the response, or replaces it if the
+	// request is rejected.
+	HTTPResponse common.HTTPResponse `json:"httpResponse"`
+	// RejectUpload rejects the request, with 400 unless HTTPResponse has a
+	// status code.
+	RejectUpload bool `json:"rejectUpload"`
+	// ChangeFileInfo overrides the ID and metadata of new uploads, only for
+	// pre-create hooks.
+	ChangeFileInfo common.FileInfoChanges `json:"changeFileInfo"`
+}
+
+// IHookHandler invokes hooks, e.g. by executing a program.
+type IHookHandler interface {
+	InvokeHook(ctx context.Context, event SEvent) (SResponse, error)
+}
+
+// NewEvent converts a handler event to the payload of a hook.
+func NewEvent(typ HookType, hook common.HookEvent) SEvent {
+	event := SEvent{Type: typ, Upload: hook.Upload, Identity: common.IdentityFromContext(hook.Context), Scan: hook.Scan}
+	if r := hook.HTTPRequest; r != nil {
+		event.HTTPRequest = SHTTPRequest{
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			RemoteAddr: r.RemoteAddr,
+			Header:     r.Header,
+		}
+	}
+	return event
+}
+
+// Configure sets the callbacks of config for the enabled pre hooks, it has
+// to be called before handler.New.
+func Configure(config *handler.SConfig, hookHandler IHookHandler, enabled []HookType) {
+	if slices.Contains(enabled, HookPreCreate) {
+		config.PreUploadCreateCallback = func(hook common.HookEvent) (common.HTTPResponse, common.FileInfoChanges, error) {
+			resp, err := invokeBlocking(hookHandler, HookPreCreate, hook)
+			return resp.HTTPResponse, resp.ChangeFileInfo, err
+		}
+	}
+	if slices.Contains(enabled, HookPreFinish) {
+		config.PreFinishResponseCallback = func(hook common.HookEvent) (common.HTTPResponse, error) {
+			resp, err := invokeBlocking(hookHandler, HookPreFinish, hook)
+			return resp.HTTPResponse, err
+		}
+	}
+	if slices.Contains(enabled, HookPreTerminate) {
+		config.PreUploadTerminateCallback = func(hook common.HookEvent) (common.HTTPResponse, error) {
+			resp, err := invokeBlocking(hookHandler, HookPreTerminate, hook)
+			return resp.HTTPResponse, err
+		}
+	}
+}
+
+// Subscribe invokes the enabled post hooks for the events of h until ctx is
+// done. Failed hooks are logged by the handler.
+func Subscribe(ctx context.Context, h *handler.SHandler, hookHandler IHookHandler, enabled []HookType) {
+	subscriptions := map[HookType]func(context.Context, func(common.HookEvent) error){
+		HookPostCreate:    h.SubscribeCreatedUploads,
+		HookPostReceive:   h.SubscribeProgressUploads,
+		HookPostFinish:    h.SubscribeCompleteUploads,
+		HookPostTerminate: h.SubscribeTerminatedUploads,
+		HookPostScan:      h.SubscribeScannedUploads,
+	}
+	for _, typ := range AllHooks {
+		subscribe, ok := subscriptions[typ]
+		if !ok || !slices.Contains(enabled, typ) {
+			continue
+		}
+		subscribe(ctx, func(hook common.HookEvent) error {
+			_, err := hookHandler.InvokeHook(hook.Context, NewEvent(typ, hook))
+			return err
+		})
+	}
+}
+
+// ParseHookTypes converts hook names like pre-create to hook types.
+func ParseHookTypes(names []string) ([]HookType, error) {
+	types := make([]HookType, 0, len(names))
+	for _, name := range names {
+		typ := HookType(name)
+		if !slices.Contains(AllHooks, typ) {
+			return nil, fmt.Errorf("unknown hook %s", name)
+		}
+		types = append(types, typ)
+	}
+	return types, nil
+}
+
+// invokeBlocking 调用阻塞钩子, 钩子拒绝时返回包装handler.ErrUploadRejected的错误
+func invokeBlocking(hookHandler IHookHandler, typ HookType, hook common.HookEvent) (SResponse, error) {
+	resp, err := hookHandler.InvokeHook(hook.Context, NewEvent(typ, hook))
+	if err != nil {
+		return resp, fmt.Errorf("%s hook failed: %w", typ, err)
+	}
+	if resp.RejectUpload {
+		return resp, fmt.Errorf("%w by %s hook", handler.ErrUploadRejected, typ)
+	}
+	return resp, nil
+}
@@ -0,0 +1,152 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderSignature carries the HMAC of a webhook, sha256=<hex>.
+	HeaderSignature = "X-Signature"
+	// HeaderTimestamp carries the Unix time a webhook was signed at.
+	HeaderTimestamp = "X-Timestamp"
+)
+
+var (
+	// ErrInvalidSignature is returned by VerifySignature for a missing or
+	// wrong signature.
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrSignatureExpired is returned by VerifySignature for a timestamp
+	// outside the tolerance, e.g. a replayed request.
+	ErrSignatureExpired = errors.New("webhook signature expired")
+)
+
+// SHTTPHook invokes hooks by POSTing the SEvent as JSON to Endpoint, the hook
+// type is sent in the Hook-Name header as well.
+//
+// A 2xx response accepts the request and can contain an SResponse as JSON, a
+// 4xx response rejects it with the body as error message, anything else is an
+// error of the hook.
+type SHTTPHook struct {
+	Endpoint string
+	// Timeout cancels requests running longer, 0 disables the timeout.
+	Timeout time.Duration
+	// Secret signs the requests, see Sign. Empty disables signing.
+	Secret []byte
+	// Header is sent with every request, e.g. for authorization.
+	Header http.Header
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+func (hook *SHTTPHook) InvokeHook(ctx context.Context, event SEvent) (SResponse, error) {
+	var resp SResponse
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return resp, err
+	}
+	if hook.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hook.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return resp, err
+	}
+	for key, values := range hook.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Hook-Name", string(event.Type))
+	if len(hook.Secret) > 0 {
+		Sign(req.Header, hook.Secret, payload, time.Now())
+	}
+
+	client := hook.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return resp, err
+	}
+	defer res.Body.Close()
+	// 限制读取大小, 避免异常的接收方占用内存
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return resp, err
+	}
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		if body = bytes.TrimSpace(body); len(body) > 0 {
+			if err = json.Unmarshal(body, &resp); err != nil {
+				return resp, fmt.Errorf("invalid response of %s: %w", hook.Endpoint, err)
+			}
+		}
+		return resp, nil
+	case res.StatusCode >= 400 && res.StatusCode < 500:
+		resp.RejectUpload = true
+		if message := strings.TrimSpace(string(body)); message != "" {
+			resp.HTTPResponse.StatusCode = http.StatusBadRequest
+			resp.HTTPResponse.Body = message + "\n"
+		}
+		return resp, nil
+	default:
+		return resp, fmt.Errorf("%s responded with %s", hook.Endpoint, res.Status)
+	}
+}
+
+// Sign sets the X-Timestamp header to the Unix time of now and the
+// X-Signature header to sha256=<hex>, the HMAC-SHA256 with secret of the
+// timestamp, a dot and the body. Signing the timestamp lets receivers reject
+// replayed requests.
+func Sign(header http.Header, secret, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	header.Set(HeaderTimestamp, timestamp)
+	header.Set(HeaderSignature, "sha256="+hex.EncodeToString(signature(secret, timestamp, body)))
+}
+
+// VerifySignature checks the signature of a webhook received with header and
+// body, see Sign. Requests signed more than tolerance ago or ahead are
+// rejected with ErrSignatureExpired, 0 disables this check.
+func VerifySignature(header http.Header, secret, body []byte, tolerance time.Duration) error {
+	timestamp := header.Get(HeaderTimestamp)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	got, ok := strings.CutPrefix(header.Get(HeaderSignature), "sha256=")
+	if !ok {
+		return ErrInvalidSignature
+	}
+	mac, err := hex.DecodeString(got)
+	if err != nil || !hmac.Equal(mac, signature(secret, timestamp, body)) {
+		return ErrInvalidSignature
+	}
+	if age := time.Since(time.Unix(unix, 0)); tolerance > 0 && (age > tolerance || age < -tolerance) {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func signature(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
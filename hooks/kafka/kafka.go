@@ -0,0 +1,54 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+
+	kafka "github.com/segmentio/kafka-go"
+
+	"github.com/busybox-org/gin-fileuploader/hooks"
+)
+
+// KafkaHook publishes hook events as JSON messages to a Kafka topic, keyed by
+// the upload ID so the events of an upload stay ordered within a partition.
+// Each message has a "type" header with the hook type.
+//
+// It only publishes and never rejects, so it is meant to be used with
+// hooks.Subscribe for the post hooks.
+type KafkaHook struct {
+	writer *kafka.Writer
+}
+
+// New creates a hook publishing to topic on the brokers (host:port).
+func New(brokers []string, topic string) *KafkaHook {
+	return NewFromWriter(&kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	})
+}
+
+// NewFromWriter creates a hook publishing with writer, which must have a topic.
+func NewFromWriter(writer *kafka.Writer) *KafkaHook {
+	return &KafkaHook{writer: writer}
+}
+
+func (hook *KafkaHook) InvokeHook(ctx context.Context, event hooks.SEvent) (hooks.SResponse, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return hooks.SResponse{}, err
+	}
+	return hooks.SResponse{}, hook.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(event.Upload.ID),
+		Value: payload,
+		Headers: []kafka.Header{
+			{Key: "type", Value: []byte(event.Type)},
+		},
+	})
+}
+
+// Close flushes pending messages and closes the connections to the brokers.
+func (hook *KafkaHook) Close() error {
+	return hook.writer.Close()
+}
@@ -0,0 +1,72 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/busybox-org/gin-fileuploader/hooks"
+)
+
+// NatsHook publishes hook events as JSON to the subject <prefix>.<hook type>,
+// e.g. tusx.events.post-finish, so subscribers can pick the events they need
+// with subject wildcards. The upload ID is sent in the Tus-Upload-Id header.
+//
+// With JetStream each message is acknowledged by the stream capturing the
+// subject, which has to exist, so events are persisted for consumers which
+// are offline. It only publishes and never rejects, so it is meant to be used
+// with hooks.Subscribe for the post hooks.
+type NatsHook struct {
+	conn    *nats.Conn
+	js      jetstream.JetStream
+	subject string
+}
+
+// New connects to the NATS servers at url, comma separated for a cluster.
+func New(url, subject string, useJetStream bool) (*NatsHook, error) {
+	conn, err := nats.Connect(url, nats.Name("tusx"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	hook, err := NewFromConn(conn, subject, useJetStream)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return hook, nil
+}
+
+// NewFromConn creates a hook publishing with an existing connection.
+func NewFromConn(conn *nats.Conn, subject string, useJetStream bool) (*NatsHook, error) {
+	hook := &NatsHook{conn: conn, subject: subject}
+	if useJetStream {
+		js, err := jetstream.New(conn)
+		if err != nil {
+			return nil, err
+		}
+		hook.js = js
+	}
+	return hook, nil
+}
+
+func (hook *NatsHook) InvokeHook(ctx context.Context, event hooks.SEvent) (hooks.SResponse, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return hooks.SResponse{}, err
+	}
+	msg := nats.NewMsg(hook.subject + "." + string(event.Type))
+	msg.Header.Set("Tus-Upload-Id", event.Upload.ID)
+	msg.Data = payload
+	if hook.js != nil {
+		_, err = hook.js.PublishMsg(ctx, msg)
+		return hooks.SResponse{}, err
+	}
+	return hooks.SResponse{}, hook.conn.PublishMsg(msg)
+}
+
+// Close publishes pending messages and closes the connection.
+func (hook *NatsHook) Close() error {
+	return hook.conn.Drain()
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/rpc"
+	"os/exec"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+
+	"github.com/busybox-org/gin-fileuploader/hooks"
+)
+
+// Handshake is shared by the server and the plugins, it keeps the plugins
+// from being executed directly and rejects plugins built for an incompatible
+// protocol version.
+var Handshake = plugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "TUSX_PLUGIN_MAGIC_COOKIE",
+	MagicCookieValue: "4b1c8a1e-tusx-hook-handler",
+}
+
+// pluginName 插件中钩子处理器的名称
+const pluginName = "hookHandler"
+
+// PluginHook invokes hooks by calling a hook handler in an external plugin
+// binary over go-plugin, so hooks written in Go can be added without
+// recompiling the server. The binary is started by New and runs until Close.
+type PluginHook struct {
+	client  *plugin.Client
+	handler hooks.IHookHandler
+}
+
+// New starts the plugin binary at path, which has to call Serve.
+func New(path string) (*PluginHook, error) {
+	client := plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig: Handshake,
+		Plugins:         map[string]plugin.Plugin{pluginName: &HookHandlerPlugin{}},
+		Cmd:             exec.Command(path),
+		Logger:          hclog.New(&hclog.LoggerOptions{Name: "hook-plugin", Level: hclog.Warn}),
+	})
+	rpcClient, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return nil, err
+	}
+	raw, err := rpcClient.Dispense(pluginName)
+	if err != nil {
+		client.Kill()
+		return nil, err
+	}
+	handler, ok := raw.(hooks.IHookHandler)
+	if !ok {
+		client.Kill()
+		return nil, fmt.Errorf("plugin %s does not serve a hook handler", path)
+	}
+	return &PluginHook{client: client, handler: handler}, nil
+}
+
+func (hook *PluginHook) InvokeHook(ctx context.Context, event hooks.SEvent) (hooks.SResponse, error) {
+	return hook.handler.InvokeHook(ctx, event)
+}
+
+// Close stops the plugin binary.
+func (hook *PluginHook) Close() error {
+	hook.client.Kill()
+	return nil
+}
+
+// Serve serves impl to the server, it is called from the main function of a
+// plugin binary and blocks until the server stops the plugin.
+func Serve(impl hooks.IHookHandler) {
+	plugin.Serve(&plugin.ServeConfig{
+		HandshakeConfig: Handshake,
+		Plugins:         map[string]plugin.Plugin{pluginName: &HookHandlerPlugin{Impl: impl}},
+	})
+}
+
+// HookHandlerPlugin implements plugin.Plugin for hook handlers over net/rpc.
+type HookHandlerPlugin struct {
+	// Impl is the hook handler served by the plugin binary.
+	Impl hooks.IHookHandler
+}
+
+func (p *HookHandlerPlugin) Server(*plugin.MuxBroker) (any, error) {
+	return &RPCServer{Impl: p.Impl}, nil
+}
+
+func (p *HookHandlerPlugin) Client(_ *plugin.MuxBroker, client *rpc.Client) (any, error) {
+	return &RPCClient{client: client}, nil
+}
+
+// RPCClient is the hook handler dispensed to the server.
+type RPCClient struct {
+	client *rpc.Client
+}
+
+// InvokeHook calls the plugin, net/rpc does not propagate ctx, the call is
+// abandoned when ctx is done.
+func (c *RPCClient) InvokeHook(ctx context.Context, event hooks.SEvent) (hooks.SResponse, error) {
+	var resp hooks.SResponse
+	call := c.client.Go("Plugin.InvokeHook", event, &resp, make(chan *rpc.Call, 1))
+	select {
+	case <-ctx.Done():
+		return resp, ctx.Err()
+	case <-call.Done:
+		return resp, call.Error
+	}
+}
+
+// RPCServer serves the hook handler inside the plugin binary.
+type RPCServer struct {
+	Impl hooks.IHookHandler
+}
+
+func (s *RPCServer) InvokeHook(event hooks.SEvent, resp *hooks.SResponse) error {
+	var err error
+	*resp, err = s.Impl.InvokeHook(context.Background(), event)
+	return err
+}
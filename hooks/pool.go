@@ -0,0 +1,158 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrQueueFull is reported for hooks dropped because the queue of the
+	// pool was full.
+	ErrQueueFull = errors.New("hook queue full")
+	// ErrPoolClosed is reported for hooks submitted after SPool.Close.
+	ErrPoolClosed = errors.New("hook pool closed")
+)
+
+// SPool invokes asynchronous hooks with a fixed number of workers. Hooks are
+// queued up to the queue size, further hooks are dropped instead of blocking
+// the requests, so slow hook handlers can't stall uploads.
+type SPool struct {
+	// OnError is called with hooks which failed or were dropped, e.g. to log
+	// them. It is called by the workers, or by the submitting goroutine for
+	// dropped hooks.
+	OnError func(event SEvent, err error)
+
+	queue   chan func()
+	workers int
+	wg      sync.WaitGroup
+	mu      sync.RWMutex
+	closed  bool
+
+	running   atomic.Int64
+	completed atomic.Int64
+	failed    atomic.Int64
+	dropped   atomic.Int64
+}
+
+// SPoolStats is a snapshot of the counters of an SPool.
+type SPoolStats struct {
+	Workers    int   `json:"workers"`
+	QueueSize  int   `json:"queueSize"`
+	QueueDepth int   `json:"queueDepth"`
+	Running    int64 `json:"running"`
+	Completed  int64 `json:"completed"`
+	Failed     int64 `json:"failed"`
+	Dropped    int64 `json:"dropped"`
+}
+
+// NewPool starts workers goroutines invoking the hooks from a queue holding up
+// to queueSize hooks.
+func NewPool(workers, queueSize int) *SPool {
+	workers = max(workers, 1)
+	pool := &SPool{
+		queue:   make(chan func(), queueSize),
+		workers: workers,
+	}
+	pool.wg.Add(workers)
+	for range workers {
+		go func() {
+			defer pool.wg.Done()
+			for task := range pool.queue {
+				pool.running.Add(1)
+				task()
+				pool.running.Add(-1)
+			}
+		}()
+	}
+	return pool
+}
+
+// Stats returns the current counters, e.g. to export them as metrics.
+func (pool *SPool) Stats() SPoolStats {
+	return SPoolStats{
+		Workers:    pool.workers,
+		QueueSize:  cap(pool.queue),
+		QueueDepth: len(pool.queue),
+		Running:    pool.running.Load(),
+		Completed:  pool.completed.Load(),
+		Failed:     pool.failed.Load(),
+		Dropped:    pool.dropped.Load(),
+	}
+}
+
+// Close stops accepting hooks and waits until the queued hooks are invoked
+// or ctx is done.
+func (pool *SPool) Close(ctx context.Context) error {
+	pool.mu.Lock()
+	if !pool.closed {
+		pool.closed = true
+		close(pool.queue)
+	}
+	pool.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		pool.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+// submit 将钩子加入队列, 队列已满或已关闭时丢弃
+func (pool *SPool) submit(hookHandler IHookHandler, ctx context.Context, event SEvent) {
+	task := func() {
+		if _, err := hookHandler.InvokeHook(ctx, event); err != nil {
+			pool.failed.Add(1)
+			pool.reportError(event, err)
+			return
+		}
+		pool.completed.Add(1)
+	}
+
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	err := ErrPoolClosed
+	if !pool.closed {
+		select {
+		case pool.queue <- task:
+			return
+		default:
+			err = ErrQueueFull
+		}
+	}
+	pool.dropped.Add(1)
+	pool.reportError(event, err)
+}
+
+func (pool *SPool) reportError(event SEvent, err error) {
+	if pool.OnError != nil {
+		pool.OnError(event, err)
+	}
+}
+
+// Async queues the hooks to pool instead of invoking hookHandler directly.
+// The hooks are accepted right away and their responses are discarded, so
+// pre hooks invoked this way can't reject requests. Errors are reported to
+// SPool.OnError.
+func Async(hookHandler IHookHandler, pool *SPool) IHookHandler {
+	return &sAsyncHook{hookHandler: hookHandler, pool: pool}
+}
+
+// sAsyncHook 通过工作池异步调用钩子
+type sAsyncHook struct {
+	hookHandler IHookHandler
+	pool        *SPool
+}
+
+func (hook *sAsyncHook) InvokeHook(ctx context.Context, event SEvent) (SResponse, error) {
+	// 钩子在请求结束后执行, 不随请求取消
+	hook.pool.submit(hook.hookHandler, context.WithoutCancel(ctx), event)
+	return SResponse{}, nil
+}
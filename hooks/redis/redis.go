@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/busybox-org/gin-fileuploader/hooks"
+)
+
+// RedisHook publishes hook events as JSON to Redis pub/sub channels and, if
+// Stream is set, appends them to a stream. Pub/sub only reaches connected
+// subscribers, e.g. a web UI waiting for its upload, while a stream keeps the
+// events for consumer groups which process them later.
+//
+// It only publishes and never rejects, so it is meant to be used with
+// hooks.Subscribe for the post hooks.
+type RedisHook struct {
+	// Channel is the prefix of the channels, events are published to
+	// <Channel><hook type>, e.g. tusx:events:post-finish. Empty disables
+	// pub/sub.
+	Channel string
+	// Stream is the key of the stream events are appended to with the fields
+	// type, id and event. Empty disables the stream.
+	Stream string
+	// StreamMaxLen approximately caps the stream length, 0 keeps all events.
+	StreamMaxLen int64
+
+	client redis.UniversalClient
+}
+
+// New connects to the Redis server at the given URI, e.g.
+// redis://localhost:6379/0.
+func New(uri string) (*RedisHook, error) {
+	options, err := redis.ParseURL(uri)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err = client.Ping(context.Background()).Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return NewFromClient(client), nil
+}
+
+// NewFromClient creates a hook publishing with an existing Redis client.
+func NewFromClient(client redis.UniversalClient) *RedisHook {
+	return &RedisHook{
+		Channel: "tusx:events:",
+		client:  client,
+	}
+}
+
+func (hook *RedisHook) InvokeHook(ctx context.Context, event hooks.SEvent) (hooks.SResponse, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return hooks.SResponse{}, err
+	}
+	_, err = hook.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if hook.Channel != "" {
+			pipe.Publish(ctx, hook.Channel+string(event.Type), payload)
+		}
+		if hook.Stream != "" {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: hook.Stream,
+				MaxLen: hook.StreamMaxLen,
+				Approx: hook.StreamMaxLen > 0,
+				Values: []any{"type", string(event.Type), "id", event.Upload.ID, "event", payload},
+			})
+		}
+		return nil
+	})
+	return hooks.SResponse{}, err
+}
+
+// Close closes the Redis client.
+func (hook *RedisHook) Close() error {
+	return hook.client.Close()
+}
@@ -0,0 +1,103 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/busybox-org/gin-fileuploader/locker"
+)
+
+func init() {
+	// consul://localhost:8500, 地址为空时从环境变量读取
+	locker.Register("consul", func(uri *url.URL) (locker.ILocker, error) {
+		return New(uri.Host)
+	})
+}
+
+// ConsulLocker uses Consul sessions to share locks between multiple
+// instances. Every lock holds its own session which is renewed in the
+// background, locks of a crashed instance are released once the session TTL
+// has passed.
+type ConsulLocker struct {
+	// Prefix is prepended to the KV keys of the locks.
+	Prefix string
+	// SessionTTL is the TTL of the sessions, e.g. "15s".
+	SessionTTL string
+
+	client *api.Client
+}
+
+// New connects to the Consul agent at the given address, the address and
+// the ACL token are read from the CONSUL_HTTP_* environment variables if
+// empty.
+func New(address string) (*ConsulLocker, error) {
+	config := api.DefaultConfig()
+	if address != "" {
+		config.Address = address
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromClient(client)
+}
+
+// NewFromClient creates a locker using an existing Consul client.
+func NewFromClient(client *api.Client) (*ConsulLocker, error) {
+	if _, err := client.Agent().Self(); err != nil {
+		return nil, err
+	}
+	return &ConsulLocker{
+		Prefix:     "tusd/locks/",
+		SessionTTL: "15s",
+		client:     client,
+	}, nil
+}
+
+func (locker *ConsulLocker) NewLock(id string) (locker.ILock, error) {
+	return &consulLock{
+		locker: locker,
+		id:     id,
+	}, nil
+}
+
+type consulLock struct {
+	locker *ConsulLocker
+	id     string
+	lock   *api.Lock
+}
+
+// Lock tries to obtain the exclusive lock.
+func (lock *consulLock) Lock(ctx context.Context) error {
+	l, err := lock.locker.client.LockOpts(&api.LockOptions{
+		Key:         lock.locker.Prefix + lock.id,
+		SessionName: "tusd lock " + lock.id,
+		SessionTTL:  lock.locker.SessionTTL,
+	})
+	if err != nil {
+		return err
+	}
+	lostCh, err := l.Lock(ctx.Done())
+	if err != nil {
+		return err
+	}
+	// 等待期间ctx结束时返回nil
+	if lostCh == nil {
+		return errors.New("lock request timed out")
+	}
+	lock.lock = l
+	return nil
+}
+
+// Unlock releases the lock and removes its key if no one else is waiting.
+func (lock *consulLock) Unlock() {
+	if lock.lock == nil {
+		return
+	}
+	_ = lock.lock.Unlock()
+	_ = lock.lock.Destroy()
+	lock.lock = nil
+}
@@ -0,0 +1,164 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+)
+
+func init() {
+	// dynamodb://table, 凭证从环境变量读取
+	locker.Register("dynamodb", func(uri *url.URL) (locker.ILocker, error) {
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return New(uri.Host, dynamodb.NewFromConfig(cfg))
+	})
+}
+
+// DynamoDBLocker uses conditional writes to a DynamoDB table to share locks
+// between multiple instances. The table needs a string partition key named
+// "LockID"; enable DynamoDB TTL on the "ExpiresAt" attribute to have stale
+// items removed. A held lock is renewed in the background, locks of a
+// crashed instance can be taken over once TTL has passed.
+type DynamoDBLocker struct {
+	// Table is the name of the DynamoDB table.
+	Table string
+	// TTL is the time after which a lock which is not renewed expires.
+	TTL time.Duration
+	// PollInterval is the interval to retry obtaining a held lock.
+	PollInterval time.Duration
+
+	client *dynamodb.Client
+}
+
+// New creates a locker storing its locks in the given table.
+func New(table string, client *dynamodb.Client) (*DynamoDBLocker, error) {
+	if table == "" {
+		return nil, errors.New("table is required")
+	}
+	return &DynamoDBLocker{
+		Table:        table,
+		TTL:          15 * time.Second,
+		PollInterval: 200 * time.Millisecond,
+		client:       client,
+	}, nil
+}
+
+func (locker *DynamoDBLocker) NewLock(id string) (locker.ILock, error) {
+	return &dynamoDBLock{
+		locker: locker,
+		id:     id,
+	}, nil
+}
+
+type dynamoDBLock struct {
+	locker *DynamoDBLocker
+	id     string
+	owner  string
+	cancel func()
+}
+
+// Lock tries to obtain the exclusive lock.
+func (lock *dynamoDBLock) Lock(ctx context.Context) error {
+	owner := common.Uid()
+	for {
+		ok, err := lock.put(ctx, owner, false)
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("lock request timed out")
+		case <-time.After(lock.locker.PollInterval):
+		}
+	}
+
+	lock.owner = owner
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	lock.cancel = cancel
+	go lock.keepAlive(keepAliveCtx, owner)
+	return nil
+}
+
+// put 写入锁记录, 锁不存在、已过期或由owner持有(续期)时成功
+func (lock *dynamoDBLock) put(ctx context.Context, owner string, renew bool) (bool, error) {
+	now := time.Now()
+	condition := "attribute_not_exists(LockID) OR ExpiresAt < :now"
+	values := map[string]types.AttributeValue{
+		":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+	}
+	if renew {
+		condition = "Owner = :owner"
+		values = map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: owner},
+		}
+	}
+	_, err := lock.locker.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(lock.locker.Table),
+		Item: map[string]types.AttributeValue{
+			"LockID":    &types.AttributeValueMemberS{Value: lock.id},
+			"Owner":     &types.AttributeValueMemberS{Value: owner},
+			"ExpiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(lock.locker.TTL).Unix(), 10)},
+		},
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (lock *dynamoDBLock) keepAlive(ctx context.Context, owner string) {
+	ticker := time.NewTicker(lock.locker.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// 续期失败说明锁已被接管, 无法通知持有者, 只能停止续期
+			if ok, err := lock.put(ctx, owner, true); !ok && err == nil {
+				return
+			}
+		}
+	}
+}
+
+// Unlock releases the lock.
+func (lock *dynamoDBLock) Unlock() {
+	if lock.cancel == nil {
+		return
+	}
+	lock.cancel()
+	lock.cancel = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = lock.locker.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(lock.locker.Table),
+		Key: map[string]types.AttributeValue{
+			"LockID": &types.AttributeValueMemberS{Value: lock.id},
+		},
+		ConditionExpression: aws.String("Owner = :owner"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: lock.owner},
+		},
+	})
+}
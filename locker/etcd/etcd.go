@@ -0,0 +1,119 @@
+package etcd
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/busybox-org/gin-fileuploader/locker"
+)
+
+func init() {
+	// etcd://host1:2379,host2:2379
+	locker.Register("etcd", func(uri *url.URL) (locker.ILocker, error) {
+		return New(strings.Split(uri.Host, ","))
+	})
+}
+
+// EtcdLocker uses etcd to share locks between multiple instances. All locks
+// are bound to a lease which is kept alive by the session as long as the
+// process is running, so locks of a crashed instance are released once the
+// lease expires after TTL seconds.
+type EtcdLocker struct {
+	// Prefix is prepended to the keys of the locks.
+	Prefix string
+	// TTL is the time to live of the session lease in seconds.
+	TTL int
+
+	client  *clientv3.Client
+	session *concurrency.Session
+	mutex   sync.Mutex
+}
+
+// New connects to the given etcd endpoints and creates a locker.
+func New(endpoints []string) (*EtcdLocker, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewFromClient(client)
+}
+
+// NewFromClient creates a locker using an existing etcd client.
+func NewFromClient(client *clientv3.Client) (*EtcdLocker, error) {
+	_locker := &EtcdLocker{
+		Prefix: "/tusd/locks/",
+		TTL:    10,
+		client: client,
+	}
+	// 提前建立会话, 以便尽早发现连接问题
+	if _, err := _locker.getSession(); err != nil {
+		return nil, err
+	}
+	return _locker, nil
+}
+
+// getSession 返回共享的会话, 租约过期后重新创建
+func (locker *EtcdLocker) getSession() (*concurrency.Session, error) {
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+	if locker.session != nil {
+		select {
+		case <-locker.session.Done():
+		default:
+			return locker.session, nil
+		}
+	}
+	session, err := concurrency.NewSession(locker.client, concurrency.WithTTL(locker.TTL))
+	if err != nil {
+		return nil, err
+	}
+	locker.session = session
+	return session, nil
+}
+
+func (locker *EtcdLocker) NewLock(id string) (locker.ILock, error) {
+	return &etcdLock{
+		locker: locker,
+		id:     id,
+	}, nil
+}
+
+type etcdLock struct {
+	locker *EtcdLocker
+	id     string
+	mutex  *concurrency.Mutex
+}
+
+// Lock tries to obtain the exclusive lock.
+func (lock *etcdLock) Lock(ctx context.Context) error {
+	session, err := lock.locker.getSession()
+	if err != nil {
+		return err
+	}
+	mutex := concurrency.NewMutex(session, lock.locker.Prefix+lock.id)
+	if err = mutex.Lock(ctx); err != nil {
+		return err
+	}
+	lock.mutex = mutex
+	return nil
+}
+
+// Unlock releases the lock.
+func (lock *etcdLock) Unlock() {
+	if lock.mutex == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = lock.mutex.Unlock(ctx)
+	lock.mutex = nil
+}
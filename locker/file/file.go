@@ -0,0 +1,94 @@
+package file
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/locker"
+)
+
+func init() {
+	// file:///var/lock/uploader 或 file://./locks
+	locker.Register("file", func(uri *url.URL) (locker.ILocker, error) {
+		return New(filepath.FromSlash(uri.Host + uri.Path))
+	})
+}
+
+// FileLocker uses flock on per-upload lock files in Dir, so multiple
+// processes on the same host, or on hosts sharing Dir via NFS, can share
+// locks. Locks are released by the kernel if a process exits. The lock
+// files are kept after unlocking, removing them would race with processes
+// waiting for the lock.
+type FileLocker struct {
+	// Dir contains the lock files.
+	Dir string
+	// PollInterval is the interval to retry obtaining a held lock.
+	PollInterval time.Duration
+}
+
+// New creates a locker keeping its lock files in dir.
+func New(dir string) (*FileLocker, error) {
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+	return &FileLocker{
+		Dir:          dir,
+		PollInterval: 50 * time.Millisecond,
+	}, nil
+}
+
+func (locker *FileLocker) NewLock(id string) (locker.ILock, error) {
+	// ID中可能含有目录分隔符, 使用哈希值作为文件名
+	sum := sha256.Sum256([]byte(id))
+	return &fileLock{
+		locker: locker,
+		path:   filepath.Join(locker.Dir, hex.EncodeToString(sum[:])+".lock"),
+	}, nil
+}
+
+type fileLock struct {
+	locker *FileLocker
+	path   string
+	file   *os.File
+}
+
+// Lock tries to obtain the exclusive lock.
+func (lock *fileLock) Lock(ctx context.Context) error {
+	file, err := os.OpenFile(lock.path, os.O_CREATE|os.O_RDWR, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	for {
+		ok, err := tryLockFile(file)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		if ok {
+			lock.file = file
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			_ = file.Close()
+			return errors.New("lock request timed out")
+		case <-time.After(lock.locker.PollInterval):
+		}
+	}
+}
+
+// Unlock releases the lock.
+func (lock *fileLock) Unlock() {
+	if lock.file == nil {
+		return
+	}
+	_ = unlockFile(lock.file)
+	_ = lock.file.Close()
+	lock.file = nil
+}
@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package file
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLockFile(file *os.File) (bool, error) {
+	return false, errors.New("flock is not supported on this platform")
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -11,3 +11,29 @@ type ILock interface {
 	Lock(ctx context.Context) error
 	Unlock()
 }
+
+// ILeaseLock is implemented by locks which are held as a lease. The lease is
+// renewed in the background while the context passed to Lock is alive, so a
+// lock whose holder died expires and can be taken over by others.
+type ILeaseLock interface {
+	ILock
+	// Renew extends the lease, it fails if the lease has already expired and
+	// the lock might have been taken over.
+	Renew() error
+}
+
+type releaseRequestKey struct{}
+
+// WithReleaseRequest returns a context carrying a callback which is invoked
+// when another request waits for a lock obtained with this context, so the
+// holder can stop early instead of blocking it until its connection times
+// out. Lockers which cannot signal other holders ignore the callback.
+func WithReleaseRequest(ctx context.Context, requestRelease func()) context.Context {
+	return context.WithValue(ctx, releaseRequestKey{}, requestRelease)
+}
+
+// ReleaseRequest returns the callback set by WithReleaseRequest or nil.
+func ReleaseRequest(ctx context.Context) func() {
+	requestRelease, _ := ctx.Value(releaseRequestKey{}).(func())
+	return requestRelease
+}
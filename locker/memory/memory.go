@@ -3,81 +3,182 @@ package memory
 import (
 	"context"
 	"errors"
+	"net/url"
 	"sync"
+	"time"
 
 	"github.com/busybox-org/gin-fileuploader/locker"
 )
 
+func init() {
+	locker.Register("memory", func(*url.URL) (locker.ILocker, error) {
+		return New(), nil
+	})
+}
+
 // MemoryLocker persists locks using memory and therefore allowing a simple and
 // cheap mechanism. Locks will only exist as long as this object is kept in
 // reference and will be erased if the program exits.
+//
+// Locks are held as leases of LeaseTTL which are renewed in the background
+// until the lock is released or the context passed to Lock is done. A lock
+// whose lease has expired is reclaimed by the next waiter after GracePeriod.
 type MemoryLocker struct {
-	locks map[string]lockEntry
+	// LeaseTTL is the duration of a lease, 0 disables expiry.
+	LeaseTTL time.Duration
+	// GracePeriod is the time after the expiry of a lease until it can be
+	// taken over.
+	GracePeriod time.Duration
+
+	locks map[string]*lockEntry
 	mutex sync.RWMutex
 }
 
 type lockEntry struct {
 	lockReleased chan struct{}
+	// expiresAt 租约到期时间, 未启用租约时为零值
+	expiresAt time.Time
+	// requestRelease 请求持有者释放锁, 只调用一次
+	requestRelease func()
 }
 
 // New creates a new in-memory locker.
 func New() *MemoryLocker {
 	return &MemoryLocker{
-		locks: make(map[string]lockEntry),
+		LeaseTTL:    30 * time.Second,
+		GracePeriod: 5 * time.Second,
+		locks:       make(map[string]*lockEntry),
 	}
 }
 
 func (locker *MemoryLocker) NewLock(id string) (locker.ILock, error) {
-	return memoryLock{locker, id}, nil
+	return &memoryLock{locker: locker, id: id}, nil
+}
+
+// reclaimable 租约过期且超过宽限期后可被接管
+func (locker *MemoryLocker) reclaimable(entry *lockEntry, now time.Time) bool {
+	return !entry.expiresAt.IsZero() && now.After(entry.expiresAt.Add(locker.GracePeriod))
 }
 
 type memoryLock struct {
 	locker *MemoryLocker
 	id     string
+	// entry 持有锁时对应的记录
+	entry *lockEntry
+	stop  chan struct{}
 }
 
 // Lock tries to obtain the exclusive lock.
-func (lock memoryLock) Lock(ctx context.Context) error {
-	lock.locker.mutex.RLock()
-	entry, ok := lock.locker.locks[lock.id]
-	lock.locker.mutex.RUnlock()
+func (lock *memoryLock) Lock(ctx context.Context) error {
+	var err error
+	for {
+		lock.locker.mutex.Lock()
+		now := time.Now()
+		entry, ok := lock.locker.locks[lock.id]
+		if ok && lock.locker.reclaimable(entry, now) {
+			delete(lock.locker.locks, lock.id)
+			close(entry.lockReleased)
+			ok = false
+		}
+		if !ok {
+			// No lock exists, so we can create it
+			entry = &lockEntry{
+				lockReleased:   make(chan struct{}),
+				requestRelease: locker.ReleaseRequest(ctx),
+			}
+			if lock.locker.LeaseTTL > 0 {
+				entry.expiresAt = now.Add(lock.locker.LeaseTTL)
+			}
+			lock.locker.locks[lock.id] = entry
+			lock.entry = entry
+			lock.stop = nil
+			if lock.locker.LeaseTTL > 0 {
+				lock.stop = make(chan struct{})
+				go lock.keepAlive(ctx, lock.stop)
+			}
+			lock.locker.mutex.Unlock()
+			return nil
+		}
+		expiresAt := entry.expiresAt
+		requestRelease := entry.requestRelease
+		entry.requestRelease = nil
+		lock.locker.mutex.Unlock()
+
+		if requestRelease != nil {
+			requestRelease()
+		}
 
-requestRelease:
-	if ok {
+		// Wait until the lock is released or its lease can be reclaimed
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !expiresAt.IsZero() {
+			timer = time.NewTimer(time.Until(expiresAt.Add(lock.locker.GracePeriod)) + time.Millisecond)
+			expired = timer.C
+		}
 		select {
 		case <-ctx.Done():
-			return errors.New("lock request timed out")
+			err = errors.New("lock request timed out")
 		case <-entry.lockReleased:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
 		}
 	}
+}
 
-	lock.locker.mutex.Lock()
-	// Check that the lock has not already been created in the meantime
-	entry, ok = lock.locker.locks[lock.id]
-	if ok {
-		// Lock has been created in the meantime, so we must wait again until it is free
-		lock.locker.mutex.Unlock()
-		goto requestRelease
+// keepAlive 在释放锁或持有者的ctx结束前定期续约
+func (lock *memoryLock) keepAlive(ctx context.Context, stop chan struct{}) {
+	ticker := time.NewTicker(lock.locker.LeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := lock.Renew(); err != nil {
+				return
+			}
+		}
 	}
+}
 
-	// No lock exists, so we can create it
-	entry = lockEntry{
-		lockReleased: make(chan struct{}),
+// Renew extends the lease of the held lock.
+func (lock *memoryLock) Renew() error {
+	lock.locker.mutex.Lock()
+	defer lock.locker.mutex.Unlock()
+	entry, ok := lock.locker.locks[lock.id]
+	if !ok || lock.entry == nil || entry != lock.entry {
+		return errors.New("lock lease expired")
+	}
+	if lock.locker.LeaseTTL > 0 {
+		entry.expiresAt = time.Now().Add(lock.locker.LeaseTTL)
 	}
-
-	lock.locker.locks[lock.id] = entry
-	lock.locker.mutex.Unlock()
-
 	return nil
 }
 
 // Unlock releases a lock. If no such lock exists, no error will be returned.
-func (lock memoryLock) Unlock() {
+func (lock *memoryLock) Unlock() {
 	lock.locker.mutex.Lock()
-	lockReleased := lock.locker.locks[lock.id].lockReleased
+	if lock.stop != nil {
+		close(lock.stop)
+		lock.stop = nil
+	}
+	entry, ok := lock.locker.locks[lock.id]
+	held := lock.entry
+	lock.entry = nil
+	// 锁可能已过期并被其他持有者接管
+	if !ok || (held != nil && entry != held) {
+		lock.locker.mutex.Unlock()
+		return
+	}
 	// Delete the lock entry entirely
 	delete(lock.locker.locks, lock.id)
 	lock.locker.mutex.Unlock()
-	close(lockReleased)
-	return
+	close(entry.lockReleased)
 }
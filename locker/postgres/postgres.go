@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"hash/fnv"
+	"net/url"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+
+	"github.com/busybox-org/gin-fileuploader/locker"
+)
+
+func init() {
+	factory := func(uri *url.URL) (locker.ILocker, error) {
+		db, err := sql.Open("pgx", uri.String())
+		if err != nil {
+			return nil, err
+		}
+		if err = db.Ping(); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+		return New(db), nil
+	}
+	locker.Register("postgres", factory)
+	locker.Register("postgresql", factory)
+}
+
+// PostgresLocker uses PostgreSQL advisory locks to share locks between
+// multiple instances, so no lock infrastructure besides the database is
+// needed. Advisory locks belong to a database session, every held lock
+// therefore keeps its own connection from the pool until it is released.
+// Locks of a crashed instance are released when its connections are closed.
+type PostgresLocker struct {
+	db *sql.DB
+}
+
+// New creates a locker using the given PostgreSQL database.
+func New(db *sql.DB) *PostgresLocker {
+	return &PostgresLocker{
+		db: db,
+	}
+}
+
+func (locker *PostgresLocker) NewLock(id string) (locker.ILock, error) {
+	return &postgresLock{
+		locker: locker,
+		key:    lockKey(id),
+	}, nil
+}
+
+// lockKey 咨询锁以bigint为键, 使用ID的哈希值
+func lockKey(id string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(id))
+	return int64(h.Sum64())
+}
+
+type postgresLock struct {
+	locker *PostgresLocker
+	key    int64
+	conn   *sql.Conn
+}
+
+// Lock tries to obtain the exclusive lock, it waits until the lock is
+// released or ctx is done.
+func (lock *postgresLock) Lock(ctx context.Context) error {
+	conn, err := lock.locker.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lock.key); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	lock.conn = conn
+	return nil
+}
+
+// Unlock releases the lock and returns the connection to the pool.
+func (lock *postgresLock) Unlock() {
+	if lock.conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := lock.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", lock.key); err != nil {
+		// 无法确认是否已释放时丢弃连接, 会话结束后锁会被自动释放
+		_ = lock.conn.Raw(func(any) error {
+			return driver.ErrBadConn
+		})
+	}
+	_ = lock.conn.Close()
+	lock.conn = nil
+}
@@ -2,6 +2,8 @@ package redis
 
 import (
 	"context"
+	"errors"
+	"net/url"
 	"time"
 
 	"github.com/go-redsync/redsync/v4"
@@ -11,6 +13,14 @@ import (
 	"github.com/busybox-org/gin-fileuploader/locker"
 )
 
+func init() {
+	factory := func(uri *url.URL) (locker.ILocker, error) {
+		return New(uri.String())
+	}
+	locker.Register("redis", factory)
+	locker.Register("rediss", factory)
+}
+
 var (
 	LockExchangeChannel = "tusd_lock_release_request_"
 	LockReleaseChannel  = "tusd_lock_released_"
@@ -62,7 +72,14 @@ func (l *redisLock) Lock(ctx context.Context) error {
 	if err := l.requestLock(ctx); err != nil {
 		return err
 	}
-	go l.exchange.Listen(l.ctx, l.id)
+	requestRelease := locker.ReleaseRequest(ctx)
+	go func() {
+		l.exchange.Listen(l.ctx, l.id)
+		// 释放锁后Listen同样会返回, 仅在仍持有锁时转发释放请求
+		if requestRelease != nil && l.ctx.Err() == nil {
+			requestRelease()
+		}
+	}()
 	go func() {
 		if err := l.keepAlive(l.ctx); err != nil {
 			l.cancel()
@@ -86,14 +103,21 @@ func (l *redisLock) aquireLock(ctx context.Context) error {
 }
 
 func (l *redisLock) requestLock(ctx context.Context) error {
-	err := l.aquireLock(ctx)
-	if err == nil {
-		return nil
-	}
-	if err = l.exchange.Request(ctx, l.id); err != nil {
-		return err
+	for {
+		if err := l.aquireLock(ctx); err == nil {
+			return nil
+		}
+		// 等待持有者释放锁, 持有者异常退出时锁最迟在LockExpiry后过期
+		waitCtx, cancel := context.WithTimeout(ctx, LockExpiry)
+		err := l.exchange.Request(waitCtx, l.id)
+		cancel()
+		if ctx.Err() != nil {
+			return errors.New("lock request timed out")
+		}
+		if err != nil && waitCtx.Err() == nil {
+			return err
+		}
 	}
-	return l.aquireLock(ctx)
 }
 
 func (l *redisLock) keepAlive(ctx context.Context) error {
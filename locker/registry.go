@@ -0,0 +1,59 @@
+package locker
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// Factory creates a locker from a URI whose scheme it was registered for.
+type Factory func(uri *url.URL) (ILocker, error)
+
+var (
+	factories   = make(map[string]Factory)
+	factoriesMu sync.RWMutex
+)
+
+// Register makes a locker available to Open under the given URI scheme, e.g.
+// "redis". The lockers of this module register themselves when their package
+// is imported, applications embedding the handler can add their own.
+func Register(scheme string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("locker: Register factory is nil")
+	}
+	if _, ok := factories[scheme]; ok {
+		panic("locker: Register called twice for scheme " + scheme)
+	}
+	factories[scheme] = factory
+}
+
+// Open creates the locker registered for the scheme of the URI, e.g.
+// redis://localhost:6379/0 or etcd://host1:2379,host2:2379.
+func Open(uri string) (ILocker, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	factoriesMu.RLock()
+	factory, ok := factories[u.Scheme]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown locker %q, supported are %v", u.Scheme, Schemes())
+	}
+	return factory(u)
+}
+
+// Schemes returns the sorted URI schemes of the registered lockers.
+func Schemes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	schemes := make([]string, 0, len(factories))
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
@@ -0,0 +1,121 @@
+package zookeeper
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+
+	"github.com/busybox-org/gin-fileuploader/locker"
+)
+
+func init() {
+	// zookeeper://host1:2181,host2:2181
+	locker.Register("zookeeper", func(uri *url.URL) (locker.ILocker, error) {
+		return New(strings.Split(uri.Host, ","))
+	})
+}
+
+// ZooKeeperLocker uses ephemeral znodes to share locks between multiple
+// instances. A lock is held as long as its znode exists, locks of a crashed
+// instance are released by ZooKeeper once its session has expired.
+type ZooKeeperLocker struct {
+	// Prefix is the path of the parent znode of the locks.
+	Prefix string
+
+	conn *zk.Conn
+}
+
+// New connects to the given ZooKeeper servers, e.g. "localhost:2181".
+func New(servers []string) (*ZooKeeperLocker, error) {
+	conn, _, err := zk.Connect(servers, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromConn(conn)
+}
+
+// NewFromConn creates a locker using an existing ZooKeeper connection.
+func NewFromConn(conn *zk.Conn) (*ZooKeeperLocker, error) {
+	locker := &ZooKeeperLocker{
+		Prefix: "/tusd/locks",
+		conn:   conn,
+	}
+	if err := locker.ensurePath(locker.Prefix); err != nil {
+		return nil, err
+	}
+	return locker, nil
+}
+
+// ensurePath 逐级创建持久节点
+func (locker *ZooKeeperLocker) ensurePath(path string) error {
+	var current string
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		current += "/" + part
+		_, err := locker.conn.Create(current, nil, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && !errors.Is(err, zk.ErrNodeExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (locker *ZooKeeperLocker) NewLock(id string) (locker.ILock, error) {
+	return &zooKeeperLock{
+		locker: locker,
+		path:   strings.TrimRight(locker.Prefix, "/") + "/" + id,
+	}, nil
+}
+
+type zooKeeperLock struct {
+	locker *ZooKeeperLocker
+	path   string
+	held   bool
+}
+
+// Lock tries to obtain the exclusive lock.
+func (lock *zooKeeperLock) Lock(ctx context.Context) error {
+	conn := lock.locker.conn
+	for {
+		_, err := conn.Create(lock.path, nil, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+		if err == nil {
+			lock.held = true
+			return nil
+		}
+		if !errors.Is(err, zk.ErrNodeExists) {
+			return err
+		}
+
+		// 等待持有者删除节点后重试
+		exists, _, events, err := conn.ExistsW(lock.path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("lock request timed out")
+		case <-events:
+		}
+	}
+}
+
+// Unlock releases the lock.
+func (lock *zooKeeperLock) Unlock() {
+	if !lock.held {
+		return
+	}
+	lock.held = false
+	conn := lock.locker.conn
+	// 会话过期后节点可能已被其他实例重新创建
+	exists, stat, err := conn.Exists(lock.path)
+	if err != nil || !exists || stat.EphemeralOwner != conn.SessionID() {
+		return
+	}
+	_ = conn.Delete(lock.path, stat.Version)
+}
@@ -0,0 +1,578 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// MaxBlockSize Azure单个block最大4000MiB
+const MaxBlockSize = 4000 * 1024 * 1024
+
+// SAzureStore stores uploads as Azure Block Blobs. Every tus PATCH is staged
+// as one or more uncommitted blocks and the block list is committed once the
+// upload is complete.
+//
+// The upload info is kept in a "<id>.info" blob, no database is required.
+// Note that Azure discards uncommitted blocks after seven days.
+type SAzureStore struct {
+	// ObjectPrefix is prepended to every blob name, e.g. "uploads/".
+	ObjectPrefix string
+	// BlockSize is the maximum size of a staged block. Larger chunks are
+	// split into several blocks.
+	BlockSize int64
+	// TemporaryDirectory is used to buffer blocks before staging them.
+	// The system's temporary directory is used if empty.
+	TemporaryDirectory string
+
+	client *container.Client
+	locker locker.ILocker
+}
+
+// New creates a new store for the container the client points to.
+func New(client *container.Client, locker locker.ILocker) (*SAzureStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("container client is required")
+	}
+	return &SAzureStore{
+		BlockSize: 100 * 1024 * 1024,
+		client:    client,
+		locker:    locker,
+	}, nil
+}
+
+func (store *SAzureStore) blobName(name string) string {
+	return path.Join(store.ObjectPrefix, name)
+}
+
+func (store *SAzureStore) binBlob(id string) *blockblob.Client {
+	return store.client.NewBlockBlobClient(store.blobName(id))
+}
+
+func (store *SAzureStore) infoBlob(id string) *blockblob.Client {
+	return store.client.NewBlockBlobClient(store.blobName(id + ".info"))
+}
+
+func (store *SAzureStore) newLock(id string) (locker.ILock, error) {
+	return store.locker.NewLock("azure:" + strings.ReplaceAll(store.binBlob(id).URL(), "/", ":"))
+}
+
+func (store *SAzureStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	// 去掉URL中可能包含的SAS令牌
+	blobURL, _, _ := strings.Cut(store.binBlob(info.ID).URL(), "?")
+	info.Storage = map[string]string{
+		"Type": "azure",
+		"Blob": store.blobName(info.ID),
+		"URL":  blobURL,
+	}
+
+	upload := &sAzureUpload{
+		info:  info,
+		store: store,
+	}
+	binLock, err := store.newLock(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer upload.binLock.Unlock()
+
+	if err = upload.writeInfo(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SAzureStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	upload := &sAzureUpload{
+		info:  common.FileInfo{ID: id},
+		store: store,
+	}
+	binLock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.readInfo(ctx); err != nil {
+		return nil, err
+	}
+	if err = upload.readOffset(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SAzureStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(ctx, expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SAzureStore) cleanup(ctx context.Context, expiredBefore time.Duration) {
+	lock, err := store.locker.NewLock("azure:" + strings.ReplaceAll(store.client.URL(), "/", ":") + ":cleanup")
+	if err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	if err = lock.Lock(ctx); err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
+	expiredTime := time.Now().Add(-expiredBefore)
+	prefix := store.ObjectPrefix
+	pager := store.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			fmt.Printf("failed to list expired uploads: %v\n", err)
+			return
+		}
+		for _, item := range page.Segment.BlobItems {
+			name := *item.Name
+			if !strings.HasSuffix(name, ".info") || item.Properties == nil || item.Properties.CreationTime == nil ||
+				item.Properties.CreationTime.After(expiredTime) {
+				continue
+			}
+			id := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(name, store.ObjectPrefix), "/"), ".info")
+			upload, err := store.GetUpload(ctx, id)
+			if err != nil {
+				fmt.Printf("failed to get expired upload: %v\n", err)
+				continue
+			}
+			if err = upload.Terminate(ctx); err != nil {
+				fmt.Printf("failed to remove expired upload: %v\n", err)
+			}
+		}
+	}
+}
+
+func (store *SAzureStore) ListUploads(ctx context.Context) ([]string, error) {
+	var ids []string
+	prefix := store.ObjectPrefix
+	pager := store.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			name := *item.Name
+			if strings.HasSuffix(name, ".info") {
+				ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(name, store.ObjectPrefix), "/"), ".info"))
+			}
+		}
+	}
+	return ids, nil
+}
+
+type sAzureUpload struct {
+	binLock locker.ILock
+	info    common.FileInfo
+	store   *SAzureStore
+}
+
+func (upload *sAzureUpload) writeInfo(ctx context.Context) error {
+	data, err := json.Marshal(upload.info)
+	if err != nil {
+		return err
+	}
+	contentType := "application/json"
+	_, err = upload.store.infoBlob(upload.info.ID).Upload(ctx, streaming.NopCloser(bytes.NewReader(data)), &blockblob.UploadOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+	})
+	return err
+}
+
+func (upload *sAzureUpload) readInfo(ctx context.Context) error {
+	res, err := upload.store.infoBlob(upload.info.ID).DownloadStream(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	return json.NewDecoder(res.Body).Decode(&upload.info)
+}
+
+// blockID 生成定长的block ID, Azure要求同一blob的所有block ID长度一致
+func blockID(index int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", index)))
+}
+
+func blockIndex(id string) (int, error) {
+	name, err := base64.StdEncoding.DecodeString(id)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimPrefix(string(name), "block-"))
+}
+
+type azureBlock struct {
+	id    string
+	index int
+	size  int64
+}
+
+// listBlocks 按序号返回所有block, committed表示block列表是否已提交
+func (upload *sAzureUpload) listBlocks(ctx context.Context) (blocks []azureBlock, committed bool, err error) {
+	res, err := upload.store.binBlob(upload.info.ID).GetBlockList(ctx, blockblob.BlockListTypeAll, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	list := res.UncommittedBlocks
+	if len(res.CommittedBlocks) > 0 {
+		list = res.CommittedBlocks
+		committed = true
+	}
+	for _, block := range list {
+		index, err := blockIndex(*block.Name)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid block id %s: %w", *block.Name, err)
+		}
+		blocks = append(blocks, azureBlock{id: *block.Name, index: index, size: *block.Size})
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].index < blocks[j].index
+	})
+	return blocks, committed, nil
+}
+
+func (upload *sAzureUpload) readOffset(ctx context.Context) error {
+	blocks, committed, err := upload.listBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	if committed {
+		upload.info.Offset = upload.info.Size
+		return nil
+	}
+
+	var offset int64
+	for _, block := range blocks {
+		offset += block.size
+	}
+	upload.info.Offset = offset
+	return nil
+}
+
+func (upload *sAzureUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	if err := upload.readInfo(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	if err := upload.readOffset(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	return upload.info, nil
+}
+
+func (upload *sAzureUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	res, err := upload.store.binBlob(upload.info.ID).DownloadStream(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, fmt.Errorf("upload not found")
+		}
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (upload *sAzureUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	blocks, committed, err := upload.listBlocks(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if committed {
+		return 0, storage.ErrUploadCompleted
+	}
+	index := 0
+	if len(blocks) > 0 {
+		index = blocks[len(blocks)-1].index + 1
+	}
+
+	written, _, err := upload.stageBlocks(ctx, index, src)
+	if err != nil {
+		return written, err
+	}
+
+	upload.info.Offset = offset + written
+	if !upload.info.SizeIsDeferred && upload.info.Offset >= upload.info.Size {
+		if err = upload.commit(ctx); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// stageBlocks 将数据按BlockSize切分并逐个stage, 返回写入的字节数和下一个block序号
+func (upload *sAzureUpload) stageBlocks(ctx context.Context, index int, src io.Reader) (int64, int, error) {
+	blockSize := upload.store.BlockSize
+	if blockSize <= 0 || blockSize > MaxBlockSize {
+		blockSize = MaxBlockSize
+	}
+
+	var written int64
+	for {
+		file, err := os.CreateTemp(upload.store.TemporaryDirectory, "azure-block-")
+		if err != nil {
+			return written, index, err
+		}
+		n, err := io.CopyN(file, src, blockSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			cleanupTempFile(file)
+			return written, index, err
+		}
+		if n == 0 {
+			cleanupTempFile(file)
+			return written, index, nil
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			cleanupTempFile(file)
+			return written, index, err
+		}
+
+		_, err = upload.store.binBlob(upload.info.ID).StageBlock(ctx, blockID(index), file, nil)
+		cleanupTempFile(file)
+		if err != nil {
+			return written, index, fmt.Errorf("failed to stage block: %w", err)
+		}
+		written += n
+		index++
+	}
+}
+
+// commit 按序提交所有未提交的block
+func (upload *sAzureUpload) commit(ctx context.Context) error {
+	blocks, _, err := upload.listBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		ids = append(ids, block.id)
+	}
+
+	options := &blockblob.CommitBlockListOptions{}
+	if filetype, ok := upload.info.MetaData["filetype"]; ok {
+		options.HTTPHeaders = &blob.HTTPHeaders{BlobContentType: &filetype}
+	}
+	if _, err = upload.store.binBlob(upload.info.ID).CommitBlockList(ctx, ids, options); err != nil {
+		return fmt.Errorf("failed to commit block list: %w", err)
+	}
+
+	upload.info.Offset = upload.info.Size
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sAzureUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	var (
+		index int
+		size  int64
+	)
+	for _, partialUpload := range uploads {
+		_partialUpload := partialUpload.(*sAzureUpload)
+		reader, err := _partialUpload.GetReader(ctx)
+		if err != nil {
+			return err
+		}
+		var n int64
+		n, index, err = upload.stageBlocks(ctx, index, reader)
+		_ = reader.Close()
+		if err != nil {
+			return err
+		}
+		size += n
+	}
+
+	upload.info.Size = size
+	if err := upload.commit(ctx); err != nil {
+		return err
+	}
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (upload *sAzureUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	client := upload.store.binBlob(upload.info.ID)
+	props, err := client.GetProperties(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	if props.ETag != nil {
+		w.Header().Set("ETag", string(*props.ETag))
+	}
+	var modtime time.Time
+	if props.LastModified != nil {
+		modtime = *props.LastModified
+	}
+
+	rs := &sRangeReadSeeker{ctx: ctx, client: client, size: *props.ContentLength}
+	defer rs.Close()
+	http.ServeContent(w, r, "", modtime, rs)
+	return nil
+}
+
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sAzureUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.readInfo(ctx); err != nil {
+		return err
+	}
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sAzureUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	// 未提交的block会随blob一起删除, 若blob不存在则在7天后自动过期
+	for _, client := range []*blockblob.Client{
+		upload.store.binBlob(upload.info.ID),
+		upload.store.infoBlob(upload.info.ID),
+	} {
+		if _, err := client.Delete(ctx, nil); err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sRangeReadSeeker 基于range读取实现io.ReadSeeker, 供http.ServeContent使用
+type sRangeReadSeeker struct {
+	ctx    context.Context
+	client *blockblob.Client
+	size   int64
+	pos    int64
+	reader io.ReadCloser
+}
+
+func (rs *sRangeReadSeeker) Read(p []byte) (int, error) {
+	if rs.pos >= rs.size {
+		return 0, io.EOF
+	}
+	if rs.reader == nil {
+		res, err := rs.client.DownloadStream(rs.ctx, &blob.DownloadStreamOptions{
+			Range: blob.HTTPRange{Offset: rs.pos},
+		})
+		if err != nil {
+			return 0, err
+		}
+		rs.reader = res.Body
+	}
+	n, err := rs.reader.Read(p)
+	rs.pos += int64(n)
+	return n, err
+}
+
+func (rs *sRangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = rs.pos + offset
+	case io.SeekEnd:
+		pos = rs.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position: %d", pos)
+	}
+	if pos != rs.pos {
+		rs.Close()
+		rs.pos = pos
+	}
+	return pos, nil
+}
+
+func (rs *sRangeReadSeeker) Close() {
+	if rs.reader != nil {
+		_ = rs.reader.Close()
+		rs.reader = nil
+	}
+}
+
+func cleanupTempFile(file *os.File) {
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+}
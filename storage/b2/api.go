@@ -0,0 +1,369 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const authorizeURL = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+
+var errNotFound = errors.New("not found")
+
+// sClient is a minimal client for the native B2 API, covering the calls
+// needed for large file uploads.
+type sClient struct {
+	keyID          string
+	applicationKey string
+	bucketName     string
+	httpClient     *http.Client
+
+	mu       sync.Mutex
+	auth     *authorizeResponse
+	bucketID string
+}
+
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("b2: %s (%d): %s", e.Code, e.Status, e.Message)
+}
+
+type authorizeResponse struct {
+	AccountID          string `json:"accountId"`
+	AuthorizationToken string `json:"authorizationToken"`
+	APIURL             string `json:"apiUrl"`
+	DownloadURL        string `json:"downloadUrl"`
+}
+
+type b2File struct {
+	FileID          string            `json:"fileId"`
+	FileName        string            `json:"fileName"`
+	ContentLength   int64             `json:"contentLength"`
+	ContentType     string            `json:"contentType"`
+	FileInfo        map[string]string `json:"fileInfo"`
+	Action          string            `json:"action"`
+	UploadTimestamp int64             `json:"uploadTimestamp"`
+}
+
+type b2Part struct {
+	FileID        string `json:"fileId"`
+	PartNumber    int    `json:"partNumber"`
+	ContentLength int64  `json:"contentLength"`
+	ContentSha1   string `json:"contentSha1"`
+}
+
+type uploadURLResponse struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+func (c *sClient) authorize(ctx context.Context) (*authorizeResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth != nil {
+		return c.auth, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, authorizeURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.keyID, c.applicationKey)
+	var auth authorizeResponse
+	if err = c.do(req, &auth); err != nil {
+		return nil, err
+	}
+	c.auth = &auth
+
+	if c.bucketID == "" {
+		var buckets struct {
+			Buckets []struct {
+				BucketID   string `json:"bucketId"`
+				BucketName string `json:"bucketName"`
+			} `json:"buckets"`
+		}
+		err = c.post(ctx, &auth, "b2_list_buckets", map[string]string{
+			"accountId":  auth.AccountID,
+			"bucketName": c.bucketName,
+		}, &buckets)
+		if err != nil {
+			c.auth = nil
+			return nil, err
+		}
+		if len(buckets.Buckets) == 0 {
+			c.auth = nil
+			return nil, fmt.Errorf("b2: bucket %s not found", c.bucketName)
+		}
+		c.bucketID = buckets.Buckets[0].BucketID
+	}
+	return c.auth, nil
+}
+
+// call invokes an API operation, the authorization is renewed once if the
+// token expired.
+func (c *sClient) call(ctx context.Context, op string, body, res any) error {
+	for attempt := 0; ; attempt++ {
+		auth, err := c.authorize(ctx)
+		if err != nil {
+			return err
+		}
+		err = c.post(ctx, auth, op, body, res)
+		var apiErr *apiError
+		if attempt == 0 && errors.As(err, &apiErr) && apiErr.Status == http.StatusUnauthorized {
+			c.mu.Lock()
+			c.auth = nil
+			c.mu.Unlock()
+			continue
+		}
+		return err
+	}
+}
+
+func (c *sClient) post(ctx context.Context, auth *authorizeResponse, op string, body, res any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, auth.APIURL+"/b2api/v2/"+op, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	return c.do(req, res)
+}
+
+func (c *sClient) do(req *http.Request, res any) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &apiError{Status: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(apiErr)
+		if resp.StatusCode == http.StatusNotFound || apiErr.Code == "file_not_present" || apiErr.Code == "no_such_file" {
+			return fmt.Errorf("%w: %v", errNotFound, apiErr)
+		}
+		return apiErr
+	}
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+func (c *sClient) startLargeFile(ctx context.Context, name, contentType string, info map[string]string) (string, error) {
+	if contentType == "" {
+		contentType = "b2/x-auto"
+	}
+	var res b2File
+	err := c.call(ctx, "b2_start_large_file", map[string]any{
+		"bucketId":    c.bucketID,
+		"fileName":    name,
+		"contentType": contentType,
+		"fileInfo":    info,
+	}, &res)
+	return res.FileID, err
+}
+
+func (c *sClient) listParts(ctx context.Context, fileID string) ([]b2Part, error) {
+	var (
+		parts []b2Part
+		start = 1
+	)
+	for {
+		var res struct {
+			Parts          []b2Part `json:"parts"`
+			NextPartNumber *int     `json:"nextPartNumber"`
+		}
+		err := c.call(ctx, "b2_list_parts", map[string]any{
+			"fileId":          fileID,
+			"startPartNumber": start,
+			"maxPartCount":    1000,
+		}, &res)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, res.Parts...)
+		if res.NextPartNumber == nil {
+			return parts, nil
+		}
+		start = *res.NextPartNumber
+	}
+}
+
+// uploadPart 上传一个分片, body必须可重复读取以便计算长度
+func (c *sClient) uploadPart(ctx context.Context, fileID string, partNumber int, body io.Reader, size int64, sha1 string) error {
+	var target uploadURLResponse
+	if err := c.call(ctx, "b2_get_upload_part_url", map[string]string{"fileId": fileID}, &target); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.UploadURL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Authorization", target.AuthorizationToken)
+	req.Header.Set("X-Bz-Part-Number", strconv.Itoa(partNumber))
+	req.Header.Set("X-Bz-Content-Sha1", sha1)
+	return c.do(req, nil)
+}
+
+func (c *sClient) copyPart(ctx context.Context, sourceFileID, largeFileID string, partNumber int) error {
+	return c.call(ctx, "b2_copy_part", map[string]any{
+		"sourceFileId": sourceFileID,
+		"largeFileId":  largeFileID,
+		"partNumber":   partNumber,
+	}, nil)
+}
+
+func (c *sClient) finishLargeFile(ctx context.Context, fileID string, sha1s []string) error {
+	return c.call(ctx, "b2_finish_large_file", map[string]any{
+		"fileId":        fileID,
+		"partSha1Array": sha1s,
+	}, nil)
+}
+
+func (c *sClient) cancelLargeFile(ctx context.Context, fileID string) error {
+	return c.call(ctx, "b2_cancel_large_file", map[string]string{"fileId": fileID}, nil)
+}
+
+func (c *sClient) uploadFile(ctx context.Context, name, contentType string, body io.Reader, size int64, sha1 string) error {
+	var target uploadURLResponse
+	if err := c.call(ctx, "b2_get_upload_url", map[string]string{"bucketId": c.bucketID}, &target); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.UploadURL, body)
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = "b2/x-auto"
+	}
+	req.ContentLength = size
+	req.Header.Set("Authorization", target.AuthorizationToken)
+	req.Header.Set("X-Bz-File-Name", escapeFileName(name))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Bz-Content-Sha1", sha1)
+	return c.do(req, nil)
+}
+
+// listFileVersions 返回名称以prefix开头的所有文件版本
+func (c *sClient) listFileVersions(ctx context.Context, prefix string) ([]b2File, error) {
+	var (
+		files     []b2File
+		startName *string
+		startID   *string
+	)
+	for {
+		var res struct {
+			Files        []b2File `json:"files"`
+			NextFileName *string  `json:"nextFileName"`
+			NextFileID   *string  `json:"nextFileId"`
+		}
+		body := map[string]any{
+			"bucketId":     c.bucketID,
+			"prefix":       prefix,
+			"maxFileCount": 1000,
+		}
+		if startName != nil {
+			body["startFileName"] = *startName
+		}
+		if startID != nil {
+			body["startFileId"] = *startID
+		}
+		if err := c.call(ctx, "b2_list_file_versions", body, &res); err != nil {
+			return nil, err
+		}
+		files = append(files, res.Files...)
+		if res.NextFileName == nil {
+			return files, nil
+		}
+		startName, startID = res.NextFileName, res.NextFileID
+	}
+}
+
+// getFile 返回指定名称的最新版本
+func (c *sClient) getFile(ctx context.Context, name string) (*b2File, error) {
+	files, err := c.listFileVersions(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		// 同名版本按时间倒序排列, 第一个即最新版本
+		if file.FileName == name {
+			if file.Action != "upload" {
+				return nil, errNotFound
+			}
+			return &file, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (c *sClient) deleteFileVersion(ctx context.Context, name, fileID string) error {
+	err := c.call(ctx, "b2_delete_file_version", map[string]string{
+		"fileName": name,
+		"fileId":   fileID,
+	}, nil)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	return err
+}
+
+// download 按名称下载文件, header中的Range等条件请求头会被透传
+func (c *sClient) download(ctx context.Context, name string, header http.Header) (*http.Response, error) {
+	auth, err := c.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, auth.DownloadURL+"/file/"+c.bucketName+"/"+escapeFileName(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		apiErr := &apiError{Status: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(apiErr)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %v", errNotFound, apiErr)
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// escapeFileName B2要求文件名按URL编码, 但保留路径分隔符
+func escapeFileName(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
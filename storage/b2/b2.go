@@ -0,0 +1,670 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+const (
+	// MinPartSize B2要求除最后一个分片外每个分片至少5MB
+	MinPartSize = 5 * 1024 * 1024
+	// MaxPartNumber B2单个大文件最多10000个分片
+	MaxPartNumber = 10000
+)
+
+// SB2Store stores uploads in a Backblaze B2 bucket using the native large
+// file API (b2_start_large_file, b2_upload_part, b2_finish_large_file).
+// Data which is too small to be uploaded as a part is kept in a separate
+// "<id>.part" file until the next chunk arrives.
+//
+// The upload info is kept in a "<id>.info" file, no database is required.
+type SB2Store struct {
+	Bucket string
+	// ObjectPrefix is prepended to every file name, e.g. "uploads/".
+	ObjectPrefix string
+	// PreferredPartSize is the size of the parts uploaded to B2. It must be
+	// at least MinPartSize.
+	PreferredPartSize int64
+	// TemporaryDirectory is used to buffer parts before uploading them.
+	// The system's temporary directory is used if empty.
+	TemporaryDirectory string
+
+	client *sClient
+	locker locker.ILocker
+}
+
+// New creates a new store authenticating with an application key.
+func New(bucket, keyID, applicationKey string, locker locker.ILocker) (*SB2Store, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	store := &SB2Store{
+		Bucket:            bucket,
+		PreferredPartSize: 100 * 1024 * 1024,
+		client: &sClient{
+			keyID:          keyID,
+			applicationKey: applicationKey,
+			bucketName:     bucket,
+			httpClient:     &http.Client{},
+		},
+		locker: locker,
+	}
+	if _, err := store.client.authorize(context.Background()); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *SB2Store) fileName(name string) string {
+	return path.Join(store.ObjectPrefix, name)
+}
+
+func (store *SB2Store) binName(id string) string {
+	return store.fileName(id)
+}
+
+func (store *SB2Store) infoName(id string) string {
+	return store.fileName(id + ".info")
+}
+
+func (store *SB2Store) partName(id string) string {
+	return store.fileName(id + ".part")
+}
+
+func (store *SB2Store) newLock(id string) (locker.ILock, error) {
+	return store.locker.NewLock("b2:" + store.Bucket + ":" + strings.ReplaceAll(store.binName(id), "/", ":"))
+}
+
+func (store *SB2Store) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	info.Storage = map[string]string{
+		"Type":   "b2",
+		"Bucket": store.Bucket,
+		"Key":    store.binName(info.ID),
+	}
+
+	upload := &sB2Upload{
+		info:  info,
+		store: store,
+	}
+	binLock, err := store.newLock(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer upload.binLock.Unlock()
+
+	upload.fileID, err = store.client.startLargeFile(ctx, store.binName(info.ID), info.MetaData["filetype"], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start large file: %w", err)
+	}
+
+	if err = upload.writeInfo(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SB2Store) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	upload := &sB2Upload{
+		info:  common.FileInfo{ID: id},
+		store: store,
+	}
+	binLock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if _, err = upload.GetInfo(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SB2Store) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(ctx, expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SB2Store) cleanup(ctx context.Context, expiredBefore time.Duration) {
+	lock, err := store.locker.NewLock("b2:" + store.Bucket + ":cleanup")
+	if err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	if err = lock.Lock(ctx); err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
+	files, err := store.client.listFileVersions(ctx, store.ObjectPrefix)
+	if err != nil {
+		fmt.Printf("failed to list expired uploads: %v\n", err)
+		return
+	}
+	expiredTime := time.Now().Add(-expiredBefore)
+	for _, file := range files {
+		if !strings.HasSuffix(file.FileName, ".info") || file.Action != "upload" ||
+			time.UnixMilli(file.UploadTimestamp).After(expiredTime) {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(file.FileName, store.ObjectPrefix), "/"), ".info")
+		upload, err := store.GetUpload(ctx, id)
+		if err != nil {
+			fmt.Printf("failed to get expired upload: %v\n", err)
+			continue
+		}
+		if err = upload.Terminate(ctx); err != nil {
+			fmt.Printf("failed to remove expired upload: %v\n", err)
+		}
+	}
+}
+
+// b2Info is the content of the "<id>.info" file.
+type b2Info struct {
+	common.FileInfo
+	LargeFileID string `json:"largeFileID"`
+	Completed   bool   `json:"completed"`
+}
+
+type sB2Upload struct {
+	binLock   locker.ILock
+	info      common.FileInfo
+	fileID    string
+	completed bool
+	store     *SB2Store
+}
+
+func (upload *sB2Upload) writeInfo(ctx context.Context) error {
+	data, err := json.Marshal(b2Info{
+		FileInfo:    upload.info,
+		LargeFileID: upload.fileID,
+		Completed:   upload.completed,
+	})
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum(data)
+	return upload.store.client.uploadFile(ctx, upload.store.infoName(upload.info.ID), "application/json",
+		bytes.NewReader(data), int64(len(data)), hex.EncodeToString(sum[:]))
+}
+
+func (upload *sB2Upload) readInfo(ctx context.Context) error {
+	resp, err := upload.store.client.download(ctx, upload.store.infoName(upload.info.ID), nil)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var info b2Info
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return err
+	}
+	upload.info = info.FileInfo
+	upload.fileID = info.LargeFileID
+	upload.completed = info.Completed
+	return nil
+}
+
+func (upload *sB2Upload) readOffset(ctx context.Context) error {
+	if upload.completed {
+		upload.info.Offset = upload.info.Size
+		return nil
+	}
+	parts, err := upload.store.client.listParts(ctx, upload.fileID)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	for _, part := range parts {
+		offset += part.ContentLength
+	}
+	part, err := upload.store.client.getFile(ctx, upload.store.partName(upload.info.ID))
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	if part != nil {
+		offset += part.ContentLength
+	}
+	upload.info.Offset = offset
+	return nil
+}
+
+func (upload *sB2Upload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	if err := upload.readInfo(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	if err := upload.readOffset(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	return upload.info, nil
+}
+
+func (upload *sB2Upload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	resp, err := upload.store.client.download(ctx, upload.store.binName(upload.info.ID), nil)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil, fmt.Errorf("upload not found")
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (upload *sB2Upload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	if upload.completed {
+		return 0, storage.ErrUploadCompleted
+	}
+
+	parts, err := upload.store.client.listParts(ctx, upload.fileID)
+	if err != nil {
+		return 0, err
+	}
+	var uploaded int64
+	for _, part := range parts {
+		uploaded += part.ContentLength
+	}
+	partNumber := len(parts) + 1
+
+	// 上次遗留的未完成分片需要与本次数据合并后再上传
+	incomplete, incompleteSize, err := upload.takeIncompletePart(ctx)
+	if err != nil {
+		return 0, err
+	}
+	reader := src
+	if incomplete != nil {
+		defer func() {
+			_ = incomplete.Close()
+		}()
+		reader = io.MultiReader(incomplete, src)
+	}
+
+	var written int64
+	for {
+		file, n, sum, err := upload.bufferPart(reader)
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			break
+		}
+
+		total := uploaded + n
+		isLast := !upload.info.SizeIsDeferred && total >= upload.info.Size
+		if n < MinPartSize && !isLast {
+			// 数据不足一个分片, 暂存为未完成分片
+			err = upload.store.client.uploadFile(ctx, upload.store.partName(upload.info.ID), "application/octet-stream", file, n, sum)
+			cleanupTempFile(file)
+			if err != nil {
+				return written, err
+			}
+			written += n
+			break
+		}
+		if isLast && partNumber == 1 {
+			// 大文件至少需要两个分片, 单个分片时直接上传为普通文件
+			err = upload.uploadDirect(ctx, file, n, sum)
+			cleanupTempFile(file)
+			if err != nil {
+				return written, err
+			}
+			written += n
+			break
+		}
+		if partNumber > MaxPartNumber {
+			cleanupTempFile(file)
+			return written, fmt.Errorf("too many parts for upload %s", upload.info.ID)
+		}
+
+		err = upload.store.client.uploadPart(ctx, upload.fileID, partNumber, file, n, sum)
+		cleanupTempFile(file)
+		if err != nil {
+			return written, err
+		}
+		partNumber++
+		uploaded = total
+		written += n
+	}
+
+	// 未完成分片中的数据在上次写入时已计入偏移量
+	written -= incompleteSize
+	if written < 0 {
+		written = 0
+	}
+	upload.info.Offset = offset + written
+
+	if !upload.completed && !upload.info.SizeIsDeferred && upload.info.Offset >= upload.info.Size {
+		if err = upload.complete(ctx); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// takeIncompletePart 读取未完成分片并删除该文件, 不存在时返回nil
+func (upload *sB2Upload) takeIncompletePart(ctx context.Context) (io.ReadCloser, int64, error) {
+	part, err := upload.store.client.getFile(ctx, upload.store.partName(upload.info.ID))
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	resp, err := upload.store.client.download(ctx, part.FileName, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	file, err := os.CreateTemp(upload.store.TemporaryDirectory, "b2-part-")
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(file, resp.Body)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = upload.store.client.deleteFileVersion(ctx, part.FileName, part.FileID)
+	}
+	if err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	return &sTempFile{file}, n, nil
+}
+
+// bufferPart 读取至多一个分片大小的数据到临时文件, 同时计算SHA1
+func (upload *sB2Upload) bufferPart(src io.Reader) (*os.File, int64, string, error) {
+	file, err := os.CreateTemp(upload.store.TemporaryDirectory, "b2-part-")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	partSize := upload.store.PreferredPartSize
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	hasher := sha1.New()
+	n, err := io.CopyN(io.MultiWriter(file, hasher), src, partSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		cleanupTempFile(file)
+		return nil, 0, "", err
+	}
+	if n == 0 {
+		cleanupTempFile(file)
+		return nil, 0, "", nil
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		cleanupTempFile(file)
+		return nil, 0, "", err
+	}
+	return file, n, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// complete 合并所有分片, 完成大文件上传
+func (upload *sB2Upload) complete(ctx context.Context) error {
+	parts, err := upload.store.client.listParts(ctx, upload.fileID)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		// 没有分片的大文件无法完成, 直接上传空文件
+		sum := sha1.Sum(nil)
+		return upload.uploadDirect(ctx, bytes.NewReader(nil), 0, hex.EncodeToString(sum[:]))
+	}
+
+	sha1s := make([]string, 0, len(parts))
+	for _, part := range parts {
+		sha1s = append(sha1s, part.ContentSha1)
+	}
+	if err = upload.store.client.finishLargeFile(ctx, upload.fileID, sha1s); err != nil {
+		return fmt.Errorf("failed to finish large file: %w", err)
+	}
+	upload.completed = true
+	upload.info.Offset = upload.info.Size
+	return upload.writeInfo(ctx)
+}
+
+// uploadDirect 取消大文件, 将全部数据作为普通文件上传
+func (upload *sB2Upload) uploadDirect(ctx context.Context, body io.Reader, size int64, sum string) error {
+	if err := upload.store.client.cancelLargeFile(ctx, upload.fileID); err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	if err := upload.store.client.uploadFile(ctx, upload.store.binName(upload.info.ID), upload.info.MetaData["filetype"],
+		body, size, sum); err != nil {
+		return err
+	}
+	upload.completed = true
+	upload.info.Offset = upload.info.Size
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sB2Upload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	var size int64
+	for i, partialUpload := range uploads {
+		_partialUpload := partialUpload.(*sB2Upload)
+		if !_partialUpload.completed {
+			return fmt.Errorf("partial upload %s is not completed", _partialUpload.info.ID)
+		}
+		if _partialUpload.info.Size < MinPartSize && i < len(uploads)-1 {
+			return fmt.Errorf("partial upload %s is smaller than %d bytes", _partialUpload.info.ID, MinPartSize)
+		}
+
+		// 服务端复制, 数据不经过本机
+		file, err := upload.store.client.getFile(ctx, upload.store.binName(_partialUpload.info.ID))
+		if err != nil {
+			return err
+		}
+		if err = upload.store.client.copyPart(ctx, file.FileID, upload.fileID, i+1); err != nil {
+			return fmt.Errorf("failed to copy partial upload %s: %w", _partialUpload.info.ID, err)
+		}
+		size += _partialUpload.info.Size
+	}
+
+	upload.info.Size = size
+	if err := upload.complete(ctx); err != nil {
+		return err
+	}
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (upload *sB2Upload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	file, err := upload.store.client.getFile(ctx, upload.store.binName(upload.info.ID))
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	// B2不提供ETag, 文件ID随每个版本变化
+	w.Header().Set("ETag", strconv.Quote(file.FileID))
+
+	// Range/If-Range等条件由http.ServeContent统一处理
+	rs := &sRangeReadSeeker{ctx: ctx, upload: upload, size: file.ContentLength}
+	defer rs.Close()
+	http.ServeContent(w, r, "", time.UnixMilli(file.UploadTimestamp), rs)
+	return nil
+}
+
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sB2Upload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.readInfo(ctx); err != nil {
+		return err
+	}
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sB2Upload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if !upload.completed {
+		if err := upload.store.client.cancelLargeFile(ctx, upload.fileID); err != nil && !errors.Is(err, errNotFound) {
+			return err
+		}
+	}
+
+	// 删除数据, 未完成分片与info文件的所有版本
+	files, err := upload.store.client.listFileVersions(ctx, upload.store.binName(upload.info.ID))
+	if err != nil {
+		return err
+	}
+	names := map[string]struct{}{
+		upload.store.binName(upload.info.ID):  {},
+		upload.store.infoName(upload.info.ID): {},
+		upload.store.partName(upload.info.ID): {},
+	}
+	for _, file := range files {
+		if _, ok := names[file.FileName]; !ok {
+			continue
+		}
+		if err = upload.store.client.deleteFileVersion(ctx, file.FileName, file.FileID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sTempFile 关闭时删除临时文件
+type sTempFile struct {
+	*os.File
+}
+
+func (f *sTempFile) Close() error {
+	cleanupTempFile(f.File)
+	return nil
+}
+
+func cleanupTempFile(file *os.File) {
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+}
+
+// sRangeReadSeeker 基于range读取实现io.ReadSeeker, 供http.ServeContent使用
+type sRangeReadSeeker struct {
+	ctx    context.Context
+	upload *sB2Upload
+	size   int64
+	pos    int64
+	reader io.ReadCloser
+}
+
+func (rs *sRangeReadSeeker) Read(p []byte) (int, error) {
+	if rs.pos >= rs.size {
+		return 0, io.EOF
+	}
+	if rs.reader == nil {
+		header := make(http.Header)
+		header.Set("Range", fmt.Sprintf("bytes=%d-", rs.pos))
+		resp, err := rs.upload.store.client.download(rs.ctx, rs.upload.store.binName(rs.upload.info.ID), header)
+		if err != nil {
+			return 0, err
+		}
+		rs.reader = resp.Body
+	}
+	n, err := rs.reader.Read(p)
+	rs.pos += int64(n)
+	return n, err
+}
+
+func (rs *sRangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = rs.pos + offset
+	case io.SeekEnd:
+		pos = rs.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position: %d", pos)
+	}
+	if pos != rs.pos {
+		rs.Close()
+		rs.pos = pos
+	}
+	return pos, nil
+}
+
+func (rs *sRangeReadSeeker) Close() {
+	if rs.reader != nil {
+		_ = rs.reader.Close()
+		rs.reader = nil
+	}
+}
@@ -0,0 +1,368 @@
+//go:build ceph
+
+package ceph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// maxWriteSize 单次写入RADOS的最大字节数, 需小于osd_max_write_size
+const maxWriteSize = 8 * 1024 * 1024
+
+// SCephStore writes uploads directly into a Ceph RADOS pool via librados.
+// The data of an upload is striped over objects named "<id>.<stripe>" of
+// StripeSize bytes each, the upload info (including the offset) is kept in
+// a "<id>.info" object.
+//
+// The store requires cgo and librados, it is only built with the "ceph"
+// build tag.
+type SCephStore struct {
+	// ObjectPrefix is prepended to every object name.
+	ObjectPrefix string
+	// StripeSize is the size of the objects the data is striped over.
+	StripeSize int64
+
+	ioctx  *rados.IOContext
+	locker locker.ILocker
+}
+
+func New(ioctx *rados.IOContext, locker locker.ILocker) (*SCephStore, error) {
+	return &SCephStore{
+		StripeSize: 64 * 1024 * 1024,
+		ioctx:      ioctx,
+		locker:     locker,
+	}, nil
+}
+
+func (store *SCephStore) infoOid(id string) string {
+	return store.ObjectPrefix + id + ".info"
+}
+
+func (store *SCephStore) stripeOid(id string, index int64) string {
+	return fmt.Sprintf("%s%s.%08d", store.ObjectPrefix, id, index)
+}
+
+func (store *SCephStore) newLock(id string) (locker.ILock, error) {
+	return store.locker.NewLock("ceph:" + store.ioctx.GetPoolName() + ":" + strings.ReplaceAll(store.ObjectPrefix+id, "/", ":"))
+}
+
+func (store *SCephStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	info.Storage = map[string]string{
+		"Type":   "ceph",
+		"Pool":   store.ioctx.GetPoolName(),
+		"Prefix": store.ObjectPrefix + info.ID,
+	}
+
+	upload := &sCephUpload{
+		info:  info,
+		store: store,
+	}
+	binLock, err := store.newLock(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer upload.binLock.Unlock()
+
+	if err = upload.writeInfo(); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SCephStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	upload := &sCephUpload{
+		info:  common.FileInfo{ID: id},
+		store: store,
+	}
+	binLock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if _, err = upload.GetInfo(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SCephStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(ctx, expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SCephStore) cleanup(ctx context.Context, expiredBefore time.Duration) {
+	lock, err := store.locker.NewLock("ceph:" + store.ioctx.GetPoolName() + ":cleanup")
+	if err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	if err = lock.Lock(ctx); err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
+	var oids []string
+	err = store.ioctx.ListObjects(func(oid string) {
+		if strings.HasPrefix(oid, store.ObjectPrefix) && strings.HasSuffix(oid, ".info") {
+			oids = append(oids, oid)
+		}
+	})
+	if err != nil {
+		fmt.Printf("failed to list expired uploads: %v\n", err)
+		return
+	}
+	expiredTime := time.Now().Add(-expiredBefore)
+	for _, oid := range oids {
+		stat, err := store.ioctx.Stat(oid)
+		if err != nil || stat.ModTime.After(expiredTime) {
+			continue
+		}
+		upload, err := store.GetUpload(ctx, strings.TrimSuffix(strings.TrimPrefix(oid, store.ObjectPrefix), ".info"))
+		if err != nil {
+			fmt.Printf("failed to get expired upload: %v\n", err)
+			continue
+		}
+		if err = upload.Terminate(ctx); err != nil {
+			fmt.Printf("failed to remove expired upload: %v\n", err)
+		}
+	}
+}
+
+type sCephUpload struct {
+	binLock locker.ILock
+	info    common.FileInfo
+	store   *SCephStore
+}
+
+func (upload *sCephUpload) writeInfo() error {
+	data, err := json.Marshal(upload.info)
+	if err != nil {
+		return err
+	}
+	return upload.store.ioctx.WriteFull(upload.store.infoOid(upload.info.ID), data)
+}
+
+func (upload *sCephUpload) readInfo() error {
+	oid := upload.store.infoOid(upload.info.ID)
+	stat, err := upload.store.ioctx.Stat(oid)
+	if err != nil {
+		if errors.Is(err, rados.ErrNotFound) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	data := make([]byte, stat.Size)
+	n, err := upload.store.ioctx.Read(oid, data, 0)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data[:n], &upload.info)
+}
+
+func (upload *sCephUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	if err := upload.readInfo(); err != nil {
+		return common.FileInfo{}, err
+	}
+	return upload.info, nil
+}
+
+func (upload *sCephUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	return io.NopCloser(&sStripeReadSeeker{upload: upload, size: upload.info.Offset}), nil
+}
+
+func (upload *sCephUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	n, err := upload.write(offset, src)
+	upload.info.Offset = offset + n
+	if werr := upload.writeInfo(); err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// write 将数据按条带写入对象, 每个条带写满后更新一次偏移量
+func (upload *sCephUpload) write(offset int64, src io.Reader) (int64, error) {
+	stripeSize := upload.store.StripeSize
+	buf := make([]byte, min(stripeSize, maxWriteSize))
+	var written int64
+	for {
+		pos := offset + written
+		index, off := pos/stripeSize, pos%stripeSize
+		size := min(int64(len(buf)), stripeSize-off)
+		n, err := io.ReadFull(src, buf[:size])
+		if n > 0 {
+			if werr := upload.store.ioctx.Write(upload.store.stripeOid(upload.info.ID, index), buf[:n], uint64(off)); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+			if (pos+int64(n))%stripeSize == 0 {
+				upload.info.Offset = offset + written
+				if werr := upload.writeInfo(); werr != nil {
+					return written, werr
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+func (upload *sCephUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	var size int64
+	for _, partialUpload := range uploads {
+		_partialUpload := partialUpload.(*sCephUpload)
+		n, err := upload.write(size, &sStripeReadSeeker{upload: _partialUpload, size: _partialUpload.info.Offset})
+		if err != nil {
+			return err
+		}
+		size += n
+		if err = _partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+
+	upload.info.Size = size
+	upload.info.Offset = size
+	return upload.writeInfo()
+}
+
+func (upload *sCephUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	stat, err := upload.store.ioctx.Stat(upload.store.infoOid(upload.info.ID))
+	if err != nil {
+		return err
+	}
+	http.ServeContent(w, r, "", stat.ModTime, &sStripeReadSeeker{upload: upload, size: upload.info.Offset})
+	return nil
+}
+
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sCephUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.readInfo(); err != nil {
+		return err
+	}
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo()
+}
+
+func (upload *sCephUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	stripes := (upload.info.Offset + upload.store.StripeSize - 1) / upload.store.StripeSize
+	for index := int64(0); index < stripes; index++ {
+		err := upload.store.ioctx.Delete(upload.store.stripeOid(upload.info.ID, index))
+		if err != nil && !errors.Is(err, rados.ErrNotFound) {
+			return err
+		}
+	}
+	err := upload.store.ioctx.Delete(upload.store.infoOid(upload.info.ID))
+	if err != nil && !errors.Is(err, rados.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// sStripeReadSeeker 将条带对象组合为连续的io.ReadSeeker
+type sStripeReadSeeker struct {
+	upload *sCephUpload
+	size   int64
+	pos    int64
+}
+
+func (rs *sStripeReadSeeker) Read(p []byte) (int, error) {
+	if rs.pos >= rs.size {
+		return 0, io.EOF
+	}
+	stripeSize := rs.upload.store.StripeSize
+	index, off := rs.pos/stripeSize, rs.pos%stripeSize
+	size := min(int64(len(p)), stripeSize-off, rs.size-rs.pos)
+	n, err := rs.upload.store.ioctx.Read(rs.upload.store.stripeOid(rs.upload.info.ID, index), p[:size], uint64(off))
+	rs.pos += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if n == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+func (rs *sStripeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = rs.pos + offset
+	case io.SeekEnd:
+		pos = rs.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position: %d", pos)
+	}
+	rs.pos = pos
+	return pos, nil
+}
@@ -0,0 +1,63 @@
+package compressed
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	AlgorithmNone = "none"
+	AlgorithmZstd = "zstd"
+	AlgorithmGzip = "gzip"
+)
+
+func validAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case AlgorithmNone, AlgorithmZstd, AlgorithmGzip:
+		return true
+	}
+	return false
+}
+
+func newCompressWriter(algorithm string, dst io.Writer) (io.WriteCloser, error) {
+	switch algorithm {
+	case AlgorithmZstd:
+		return zstd.NewWriter(dst)
+	case AlgorithmGzip:
+		return gzip.NewWriter(dst), nil
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm %s", algorithm)
+}
+
+func newDecompressReader(algorithm string, src io.ReadCloser) (io.ReadCloser, error) {
+	switch algorithm {
+	case AlgorithmZstd:
+		decoder, err := zstd.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		return &sDecompressReader{Reader: decoder, close: decoder.Close, src: src}, nil
+	case AlgorithmGzip:
+		reader, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		return &sDecompressReader{Reader: reader, close: func() { _ = reader.Close() }, src: src}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm %s", algorithm)
+}
+
+// sDecompressReader 关闭时同时释放解压器与底层读取器
+type sDecompressReader struct {
+	io.Reader
+	close func()
+	src   io.Closer
+}
+
+func (r *sDecompressReader) Close() error {
+	r.close()
+	return r.src.Close()
+}
@@ -0,0 +1,558 @@
+package compressed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+const (
+	// MetaCompression is the upload metadata key clients can set to choose
+	// the compression algorithm of a single upload, "none" disables it.
+	MetaCompression = "compression"
+
+	metaAlgorithm = "compression.algorithm"
+	metaSize      = "compression.size"
+
+	rawSuffix = ".raw"
+)
+
+// SCompressedStore wraps any IStorage and compresses the upload data at rest.
+//
+// Compressed data cannot be appended to at arbitrary offsets, so uploads in
+// progress are staged uncompressed in a "<id>.raw" upload of the underlying
+// storage. Once all data has arrived it is compressed into the "<id>" upload
+// and the staging upload is removed. Uploads with deferred length stay
+// uncompressed until their length is known.
+type SCompressedStore struct {
+	// Algorithm is used for uploads which do not choose one via the
+	// "compression" metadata, AlgorithmNone disables compression by default.
+	Algorithm string
+	// TemporaryDirectory is used to buffer the compressed data before
+	// writing it to the underlying storage. The system's temporary directory
+	// is used if empty.
+	TemporaryDirectory string
+
+	inner  storage.IStorage
+	locker locker.ILocker
+}
+
+func New(inner storage.IStorage, locker locker.ILocker) (*SCompressedStore, error) {
+	if inner == nil {
+		return nil, fmt.Errorf("storage is required")
+	}
+	return &SCompressedStore{
+		Algorithm: AlgorithmZstd,
+		inner:     inner,
+		locker:    locker,
+	}, nil
+}
+
+func (store *SCompressedStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if strings.HasSuffix(info.ID, rawSuffix) {
+		return nil, fmt.Errorf("invalid upload id %s", info.ID)
+	}
+	// 压缩参数只能由本存储设置
+	info.MetaData = storage.WithoutMetaDataPrefix(info.MetaData, "compression.")
+	algorithm := store.Algorithm
+	if value, ok := info.MetaData[MetaCompression]; ok {
+		algorithm = strings.ToLower(strings.TrimSpace(value))
+	}
+	if !validAlgorithm(algorithm) {
+		return nil, fmt.Errorf("unsupported compression algorithm %s", algorithm)
+	}
+	if info.IsFinal {
+		// 分片可能使用不同的压缩方式, 合并时按原始数据写入, 需提前确定长度
+		info.Size = 0
+		for _, id := range info.PartialIDs {
+			partialUpload, err := store.GetUpload(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			partialInfo, err := partialUpload.GetInfo(ctx)
+			if err != nil {
+				return nil, err
+			}
+			info.Size += partialInfo.Size
+		}
+	}
+
+	if algorithm == AlgorithmNone {
+		inner, err := store.inner.NewUpload(ctx, info)
+		if err != nil {
+			return nil, err
+		}
+		return &sPlainUpload{IUpload: inner}, nil
+	}
+
+	rawInfo := info
+	rawInfo.ID = info.ID + rawSuffix
+	rawInfo.MetaData = make(map[string]string, len(info.MetaData)+1)
+	for k, v := range info.MetaData {
+		rawInfo.MetaData[k] = v
+	}
+	rawInfo.MetaData[metaAlgorithm] = algorithm
+	raw, err := store.inner.NewUpload(ctx, rawInfo)
+	if err != nil {
+		return nil, err
+	}
+	upload, err := store.newUpload(info.ID, algorithm, raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	// 空文件创建后即已完成
+	if err = upload.finishIfComplete(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SCompressedStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	if strings.HasSuffix(id, rawSuffix) {
+		return nil, fmt.Errorf("upload not found")
+	}
+	inner, err := store.inner.GetUpload(ctx, id)
+	if err == nil {
+		var info common.FileInfo
+		info, err = inner.GetInfo(ctx)
+		if err != nil {
+			return nil, err
+		}
+		algorithm := info.MetaData[metaAlgorithm]
+		if algorithm == "" {
+			return &sPlainUpload{IUpload: inner}, nil
+		}
+		if info.Offset >= info.Size {
+			return store.newUpload(id, algorithm, nil, inner)
+		}
+		// 压缩数据未写完, 由暂存数据重新压缩
+	} else if !strings.Contains(err.Error(), "not found") {
+		return nil, err
+	}
+
+	raw, err := store.inner.GetUpload(ctx, id+rawSuffix)
+	if err != nil {
+		return nil, err
+	}
+	info, err := raw.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	upload, err := store.newUpload(id, info.MetaData[metaAlgorithm], raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = upload.lockedFinishIfComplete(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// ListUploads lists the uploads of the inner store, an upload still staged
+// in "<id>.raw" is listed as "<id>".
+func (store *SCompressedStore) ListUploads(ctx context.Context) ([]string, error) {
+	ids, err := storage.ListUploads(ctx, store.inner)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(ids))
+	uploadIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		id = strings.TrimSuffix(id, rawSuffix)
+		if !seen[id] {
+			seen[id] = true
+			uploadIDs = append(uploadIDs, id)
+		}
+	}
+	return uploadIDs, nil
+}
+
+func (store *SCompressedStore) CanListUploads() bool {
+	return storage.CanListUploads(store.inner)
+}
+
+func (store *SCompressedStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	store.inner.Cleanup(ctx, expiredBefore)
+}
+
+func (store *SCompressedStore) newUpload(id, algorithm string, raw, inner storage.IUpload) (*sCompressedUpload, error) {
+	if !validAlgorithm(algorithm) || algorithm == AlgorithmNone {
+		return nil, fmt.Errorf("unsupported compression algorithm %s of upload %s", algorithm, id)
+	}
+	binLock, err := store.locker.NewLock("compressed:" + id)
+	if err != nil {
+		return nil, err
+	}
+	return &sCompressedUpload{
+		binLock:   binLock,
+		id:        id,
+		algorithm: algorithm,
+		raw:       raw,
+		inner:     inner,
+		store:     store,
+	}, nil
+}
+
+// concatUploads 将各分片的原始数据依次写入upload, 分片可来自不同的压缩方式
+func concatUploads(ctx context.Context, upload storage.IUpload, uploads []storage.IUpload) error {
+	var readers []io.Reader
+	for _, partialUpload := range uploads {
+		reader, err := partialUpload.GetReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = reader.Close()
+		}()
+		readers = append(readers, reader)
+	}
+	if _, err := upload.WriteChunk(ctx, 0, io.MultiReader(readers...)); err != nil {
+		return err
+	}
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sPlainUpload 未压缩的上传, 除合并外直接使用底层存储
+type sPlainUpload struct {
+	storage.IUpload
+}
+
+func (upload *sPlainUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	partialUploads := make([]storage.IUpload, 0, len(uploads))
+	for _, partialUpload := range uploads {
+		plain, ok := partialUpload.(*sPlainUpload)
+		if !ok {
+			return concatUploads(ctx, upload.IUpload, uploads)
+		}
+		partialUploads = append(partialUploads, plain.IUpload)
+	}
+	return upload.IUpload.ConcatUploads(ctx, partialUploads)
+}
+
+func (upload *sPlainUpload) DeclareLength(ctx context.Context, length int64) error {
+	return storage.DeclareLength(ctx, upload.IUpload, length)
+}
+
+type sCompressedUpload struct {
+	binLock   locker.ILock
+	id        string
+	algorithm string
+	// raw 暂存中的未压缩数据, 压缩完成后为nil
+	raw storage.IUpload
+	// inner 压缩后的数据, 压缩完成前为nil
+	inner storage.IUpload
+	store *SCompressedStore
+}
+
+func (upload *sCompressedUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	var (
+		info common.FileInfo
+		err  error
+	)
+	if upload.inner != nil {
+		info, err = upload.inner.GetInfo(ctx)
+		if err != nil {
+			return common.FileInfo{}, err
+		}
+		info.Size, err = strconv.ParseInt(info.MetaData[metaSize], 10, 64)
+		if err != nil {
+			return common.FileInfo{}, fmt.Errorf("invalid size of compressed upload %s: %w", upload.id, err)
+		}
+		info.Offset = info.Size
+	} else {
+		info, err = upload.raw.GetInfo(ctx)
+		if err != nil {
+			return common.FileInfo{}, err
+		}
+		info.ID = upload.id
+	}
+
+	metadata := make(map[string]string, len(info.MetaData))
+	for k, v := range info.MetaData {
+		if !strings.HasPrefix(k, "compression.") {
+			metadata[k] = v
+		}
+	}
+	info.MetaData = metadata
+	return info, nil
+}
+
+func (upload *sCompressedUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	if upload.inner == nil {
+		return upload.raw.GetReader(ctx)
+	}
+	reader, err := upload.inner.GetReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := newDecompressReader(upload.algorithm, reader)
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+	return decompressed, nil
+}
+
+func (upload *sCompressedUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	if upload.inner != nil {
+		return 0, storage.ErrUploadCompleted
+	}
+	n, err := upload.raw.WriteChunk(ctx, offset, src)
+	if err != nil {
+		return n, err
+	}
+	return n, upload.finishIfComplete(ctx)
+}
+
+func (upload *sCompressedUpload) lockedFinishIfComplete(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+	return upload.finishIfComplete(ctx)
+}
+
+// finishIfComplete 数据全部到达后压缩写入底层存储并删除暂存数据
+func (upload *sCompressedUpload) finishIfComplete(ctx context.Context) error {
+	if upload.raw == nil {
+		return nil
+	}
+	rawInfo, err := upload.raw.GetInfo(ctx)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			// 已由其他请求完成压缩
+			return upload.reload(ctx)
+		}
+		return err
+	}
+	if rawInfo.SizeIsDeferred || rawInfo.Offset < rawInfo.Size {
+		return nil
+	}
+
+	file, err := upload.compress(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanupTempFile(file)
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// 清理上次中断时留下的压缩数据
+	if stale, err := upload.store.inner.GetUpload(ctx, upload.id); err == nil {
+		if err = stale.Terminate(ctx); err != nil {
+			return err
+		}
+	} else if !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+
+	info := rawInfo
+	info.ID = upload.id
+	info.Size = size
+	info.Offset = 0
+	info.MetaData = make(map[string]string, len(rawInfo.MetaData)+1)
+	for k, v := range rawInfo.MetaData {
+		info.MetaData[k] = v
+	}
+	info.MetaData[metaSize] = strconv.FormatInt(rawInfo.Size, 10)
+	inner, err := upload.store.inner.NewUpload(ctx, info)
+	if err != nil {
+		return err
+	}
+	if _, err = inner.WriteChunk(ctx, 0, file); err != nil {
+		return err
+	}
+
+	if err = upload.raw.Terminate(ctx); err != nil {
+		return err
+	}
+	upload.raw = nil
+	upload.inner = inner
+	return nil
+}
+
+// compress 将暂存数据压缩到临时文件, 返回时文件位于末尾
+func (upload *sCompressedUpload) compress(ctx context.Context) (*os.File, error) {
+	reader, err := upload.raw.GetReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	file, err := os.CreateTemp(upload.store.TemporaryDirectory, "compressed-")
+	if err != nil {
+		return nil, err
+	}
+	writer, err := newCompressWriter(upload.algorithm, file)
+	if err != nil {
+		cleanupTempFile(file)
+		return nil, err
+	}
+	if _, err = io.Copy(writer, reader); err != nil {
+		_ = writer.Close()
+		cleanupTempFile(file)
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		cleanupTempFile(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+func (upload *sCompressedUpload) reload(ctx context.Context) error {
+	inner, err := upload.store.inner.GetUpload(ctx, upload.id)
+	if err != nil {
+		return err
+	}
+	upload.raw = nil
+	upload.inner = inner
+	return nil
+}
+
+func (upload *sCompressedUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	return concatUploads(ctx, upload, uploads)
+}
+
+func (upload *sCompressedUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if upload.inner == nil {
+		return upload.raw.ServeContent(ctx, w, r)
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	rs := &sDecompressReadSeeker{ctx: ctx, upload: upload, size: info.Size}
+	defer rs.Close()
+	http.ServeContent(w, r, "", info.CreateTime, rs)
+	return nil
+}
+
+// DeclareLength declares the size of the uncompressed data, it is compressed
+// by the WriteChunk completing it.
+func (upload *sCompressedUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if upload.inner != nil {
+		return storage.ErrUploadCompleted
+	}
+	return storage.DeclareLength(ctx, upload.raw, length)
+}
+
+func (upload *sCompressedUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if upload.raw != nil {
+		if err := upload.raw.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	if upload.inner != nil {
+		return upload.inner.Terminate(ctx)
+	}
+	return nil
+}
+
+func cleanupTempFile(file *os.File) {
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+}
+
+// sDecompressReadSeeker 为http.ServeContent提供io.ReadSeeker, 压缩数据只能顺序读取,
+// 向前跳转时丢弃中间数据, 向后跳转时重新读取
+type sDecompressReadSeeker struct {
+	ctx       context.Context
+	upload    *sCompressedUpload
+	size      int64
+	pos       int64
+	reader    io.ReadCloser
+	readerPos int64
+}
+
+func (rs *sDecompressReadSeeker) Read(p []byte) (int, error) {
+	if rs.pos >= rs.size {
+		return 0, io.EOF
+	}
+	if rs.reader == nil || rs.readerPos > rs.pos {
+		rs.Close()
+		reader, err := rs.upload.GetReader(rs.ctx)
+		if err != nil {
+			return 0, err
+		}
+		rs.reader = reader
+		rs.readerPos = 0
+	}
+	if rs.readerPos < rs.pos {
+		n, err := io.CopyN(io.Discard, rs.reader, rs.pos-rs.readerPos)
+		rs.readerPos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := rs.reader.Read(p)
+	rs.pos += int64(n)
+	rs.readerPos += int64(n)
+	return n, err
+}
+
+func (rs *sDecompressReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = rs.pos + offset
+	case io.SeekEnd:
+		pos = rs.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position: %d", pos)
+	}
+	rs.pos = pos
+	return pos, nil
+}
+
+func (rs *sDecompressReadSeeker) Close() {
+	if rs.reader != nil {
+		_ = rs.reader.Close()
+		rs.reader = nil
+	}
+}
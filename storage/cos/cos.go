@@ -0,0 +1,668 @@
+package cos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tencentyun/cos-go-sdk-v5"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+const (
+	// MinPartSize COS要求除最后一个分片外每个分片至少1MB
+	MinPartSize = 1024 * 1024
+	// MaxPartNumber COS单个multipart upload最多10000个分片
+	MaxPartNumber = 10000
+)
+
+// SCOSStore stores uploads in a Tencent Cloud COS bucket. Every upload is
+// backed by a multipart upload; tus chunks are buffered on local disk until
+// they are large enough to become a part. Data which is too small to be
+// uploaded as a part is kept in a separate "<id>.part" object until the next
+// chunk arrives.
+//
+// The upload info is kept next to the data in a "<id>.info" object, so no
+// database is required. Downloads are redirected to a presigned URL.
+type SCOSStore struct {
+	// ObjectPrefix is prepended to every object key, e.g. "uploads/".
+	ObjectPrefix string
+	// PreferredPartSize is the size of the parts uploaded to COS. It must be
+	// at least MinPartSize.
+	PreferredPartSize int64
+	// TemporaryDirectory is used to buffer parts before uploading them.
+	// The system's temporary directory is used if empty.
+	TemporaryDirectory string
+	// PresignExpiry is how long the presigned download URLs are valid.
+	PresignExpiry time.Duration
+
+	client *cos.Client
+	locker locker.ILocker
+}
+
+// New creates a new store. The client must be created with a bucket URL and
+// an authorizing transport, i.e. *cos.AuthorizationTransport.
+func New(client *cos.Client, locker locker.ILocker) (*SCOSStore, error) {
+	if client.BaseURL == nil || client.BaseURL.BucketURL == nil {
+		return nil, fmt.Errorf("bucket url is required")
+	}
+	return &SCOSStore{
+		PreferredPartSize: 50 * 1024 * 1024,
+		PresignExpiry:     15 * time.Minute,
+		client:            client,
+		locker:            locker,
+	}, nil
+}
+
+func (store *SCOSStore) keyWithPrefix(key string) string {
+	return path.Join(store.ObjectPrefix, key)
+}
+
+func (store *SCOSStore) binKey(id string) string {
+	return store.keyWithPrefix(id)
+}
+
+func (store *SCOSStore) infoKey(id string) string {
+	return store.keyWithPrefix(id + ".info")
+}
+
+func (store *SCOSStore) partKey(id string) string {
+	return store.keyWithPrefix(id + ".part")
+}
+
+func (store *SCOSStore) bucketHost() string {
+	return store.client.BaseURL.BucketURL.Host
+}
+
+func (store *SCOSStore) newLock(id string) (locker.ILock, error) {
+	return store.locker.NewLock("cos:" + store.bucketHost() + ":" + strings.ReplaceAll(store.binKey(id), "/", ":"))
+}
+
+func (store *SCOSStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	info.Storage = map[string]string{
+		"Type":   "cos",
+		"Bucket": store.bucketHost(),
+		"Key":    store.binKey(info.ID),
+	}
+
+	upload := &sCOSUpload{
+		info:  info,
+		store: store,
+	}
+	binLock, err := store.newLock(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer upload.binLock.Unlock()
+
+	header := &cos.ObjectPutHeaderOptions{
+		XCosMetaXXX: &http.Header{},
+	}
+	for key, value := range info.MetaData {
+		// COS元数据只允许ASCII, 此处只保留可安全传递的值
+		if isASCII(value) {
+			header.XCosMetaXXX.Set("x-cos-meta-"+key, value)
+		}
+	}
+	if filetype, ok := info.MetaData["filetype"]; ok {
+		header.ContentType = filetype
+	}
+
+	res, _, err := store.client.Object.InitiateMultipartUpload(ctx, store.binKey(info.ID), &cos.InitiateMultipartUploadOptions{
+		ObjectPutHeaderOptions: header,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	upload.multipartID = res.UploadID
+
+	if err = upload.writeInfo(ctx); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (store *SCOSStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	upload := &sCOSUpload{
+		info:  common.FileInfo{ID: id},
+		store: store,
+	}
+	binLock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if _, err = upload.GetInfo(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SCOSStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(ctx, expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SCOSStore) cleanup(ctx context.Context, expiredBefore time.Duration) {
+	lock, err := store.locker.NewLock("cos:" + store.bucketHost() + ":cleanup")
+	if err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	if err = lock.Lock(ctx); err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
+	expiredTime := time.Now().Add(-expiredBefore)
+	opt := &cos.BucketGetOptions{
+		Prefix:  store.ObjectPrefix,
+		MaxKeys: 1000,
+	}
+	for {
+		res, _, err := store.client.Bucket.Get(ctx, opt)
+		if err != nil {
+			fmt.Printf("failed to list expired uploads: %v\n", err)
+			return
+		}
+		for _, object := range res.Contents {
+			if !strings.HasSuffix(object.Key, ".info") {
+				continue
+			}
+			lastModified, err := time.Parse(time.RFC3339, object.LastModified)
+			if err != nil || lastModified.After(expiredTime) {
+				continue
+			}
+			id := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(object.Key, store.ObjectPrefix), "/"), ".info")
+			upload, err := store.GetUpload(ctx, id)
+			if err != nil {
+				fmt.Printf("failed to get expired upload: %v\n", err)
+				continue
+			}
+			if err = upload.Terminate(ctx); err != nil {
+				fmt.Printf("failed to remove expired upload: %v\n", err)
+			}
+		}
+		if !res.IsTruncated {
+			return
+		}
+		opt.Marker = res.NextMarker
+	}
+}
+
+// cosInfo is the content of the "<id>.info" object.
+type cosInfo struct {
+	common.FileInfo
+	MultipartID string `json:"multipartID,omitempty"`
+}
+
+type sCOSUpload struct {
+	binLock     locker.ILock
+	info        common.FileInfo
+	multipartID string
+	store       *SCOSStore
+}
+
+func (upload *sCOSUpload) writeInfo(ctx context.Context) error {
+	data, err := json.Marshal(cosInfo{
+		FileInfo:    upload.info,
+		MultipartID: upload.multipartID,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = upload.store.client.Object.Put(ctx, upload.store.infoKey(upload.info.ID), bytes.NewReader(data), &cos.ObjectPutOptions{
+		ObjectPutHeaderOptions: &cos.ObjectPutHeaderOptions{
+			ContentType:   "application/json",
+			ContentLength: int64(len(data)),
+		},
+	})
+	return err
+}
+
+func (upload *sCOSUpload) readInfo(ctx context.Context) error {
+	res, err := upload.store.client.Object.Get(ctx, upload.store.infoKey(upload.info.ID), nil)
+	if err != nil {
+		if cos.IsNotFoundError(err) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	var info cosInfo
+	if err = json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return err
+	}
+	upload.info = info.FileInfo
+	upload.multipartID = info.MultipartID
+	return nil
+}
+
+// readOffset 根据已上传的分片和未完成分片计算偏移量
+func (upload *sCOSUpload) readOffset(ctx context.Context) error {
+	if upload.multipartID == "" {
+		// multipart upload已完成
+		upload.info.Offset = upload.info.Size
+		return nil
+	}
+
+	parts, err := upload.listParts(ctx)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	for _, part := range parts {
+		offset += part.Size
+	}
+
+	partSize, err := upload.incompletePartSize(ctx)
+	if err != nil {
+		return err
+	}
+	upload.info.Offset = offset + partSize
+	return nil
+}
+
+func (upload *sCOSUpload) listParts(ctx context.Context) ([]cos.Object, error) {
+	var (
+		parts []cos.Object
+		opt   = &cos.ObjectListPartsOptions{MaxParts: "1000"}
+	)
+	for {
+		res, _, err := upload.store.client.Object.ListParts(ctx, upload.store.binKey(upload.info.ID), upload.multipartID, opt)
+		if err != nil {
+			if cos.IsNotFoundError(err) {
+				return nil, fmt.Errorf("upload not found")
+			}
+			return nil, err
+		}
+		parts = append(parts, res.Parts...)
+		if !res.IsTruncated {
+			return parts, nil
+		}
+		opt.PartNumberMarker = res.NextPartNumberMarker
+	}
+}
+
+func (upload *sCOSUpload) incompletePartSize(ctx context.Context) (int64, error) {
+	res, err := upload.store.client.Object.Head(ctx, upload.store.partKey(upload.info.ID), nil)
+	if err != nil {
+		if cos.IsNotFoundError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return res.ContentLength, nil
+}
+
+// takeIncompletePart 下载未完成分片到临时文件并删除该对象, 不存在时返回nil
+func (upload *sCOSUpload) takeIncompletePart(ctx context.Context) (*os.File, int64, error) {
+	res, err := upload.store.client.Object.Get(ctx, upload.store.partKey(upload.info.ID), nil)
+	if err != nil {
+		if cos.IsNotFoundError(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	file, err := os.CreateTemp(upload.store.TemporaryDirectory, "cos-part-")
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(file, res.Body)
+	if err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	if _, err = upload.store.client.Object.Delete(ctx, upload.store.partKey(upload.info.ID)); err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	return file, n, nil
+}
+
+func (upload *sCOSUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	if err := upload.readInfo(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	if err := upload.readOffset(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	return upload.info, nil
+}
+
+func (upload *sCOSUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	res, err := upload.store.client.Object.Get(ctx, upload.store.binKey(upload.info.ID), nil)
+	if err != nil {
+		if cos.IsNotFoundError(err) {
+			return nil, fmt.Errorf("upload not found")
+		}
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (upload *sCOSUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	if upload.multipartID == "" {
+		return 0, storage.ErrUploadCompleted
+	}
+
+	parts, err := upload.listParts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var uploaded int64
+	for _, part := range parts {
+		uploaded += part.Size
+	}
+	partNumber := len(parts) + 1
+
+	// 上次遗留的未完成分片需要与本次数据合并后再上传
+	incomplete, incompleteSize, err := upload.takeIncompletePart(ctx)
+	if err != nil {
+		return 0, err
+	}
+	reader := src
+	if incomplete != nil {
+		defer cleanupTempFile(incomplete)
+		reader = io.MultiReader(incomplete, src)
+	}
+
+	var written int64
+	for {
+		file, n, err := upload.bufferPart(reader)
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			break
+		}
+
+		total := uploaded + n
+		isLast := !upload.info.SizeIsDeferred && total >= upload.info.Size
+		if n < MinPartSize && !isLast {
+			// 数据不足一个分片, 暂存为未完成分片
+			err = upload.put(ctx, upload.store.partKey(upload.info.ID), file, n)
+			cleanupTempFile(file)
+			if err != nil {
+				return written, err
+			}
+			written += n
+			break
+		}
+		if partNumber > MaxPartNumber {
+			cleanupTempFile(file)
+			return written, fmt.Errorf("too many parts for upload %s", upload.info.ID)
+		}
+
+		_, err = upload.store.client.Object.UploadPart(ctx, upload.store.binKey(upload.info.ID), upload.multipartID, partNumber, file,
+			&cos.ObjectUploadPartOptions{ContentLength: n})
+		cleanupTempFile(file)
+		if err != nil {
+			return written, err
+		}
+		partNumber++
+		uploaded = total
+		written += n
+	}
+
+	// 未完成分片中的数据在上次写入时已计入偏移量
+	written -= incompleteSize
+	if written < 0 {
+		written = 0
+	}
+	upload.info.Offset = offset + written
+
+	if !upload.info.SizeIsDeferred && upload.info.Offset >= upload.info.Size {
+		if err = upload.complete(ctx); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// bufferPart 读取至多一个分片大小的数据到临时文件
+func (upload *sCOSUpload) bufferPart(src io.Reader) (*os.File, int64, error) {
+	file, err := os.CreateTemp(upload.store.TemporaryDirectory, "cos-part-")
+	if err != nil {
+		return nil, 0, err
+	}
+	partSize := upload.store.PreferredPartSize
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	n, err := io.CopyN(file, src, partSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	if n == 0 {
+		cleanupTempFile(file)
+		return nil, 0, nil
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	return file, n, nil
+}
+
+func (upload *sCOSUpload) put(ctx context.Context, key string, body io.Reader, size int64) error {
+	_, err := upload.store.client.Object.Put(ctx, key, body, &cos.ObjectPutOptions{
+		ObjectPutHeaderOptions: &cos.ObjectPutHeaderOptions{
+			ContentLength: size,
+		},
+	})
+	return err
+}
+
+// complete 合并所有分片, 完成multipart upload
+func (upload *sCOSUpload) complete(ctx context.Context) error {
+	parts, err := upload.listParts(ctx)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		// 空文件无法通过multipart upload完成, 直接写入空对象
+		if err = upload.put(ctx, upload.store.binKey(upload.info.ID), bytes.NewReader(nil), 0); err != nil {
+			return err
+		}
+		if err = upload.abort(ctx); err != nil {
+			return err
+		}
+	} else {
+		completed := make([]cos.Object, 0, len(parts))
+		for _, part := range parts {
+			completed = append(completed, cos.Object{
+				PartNumber: part.PartNumber,
+				ETag:       part.ETag,
+			})
+		}
+		if _, _, err = upload.store.client.Object.CompleteMultipartUpload(ctx, upload.store.binKey(upload.info.ID), upload.multipartID,
+			&cos.CompleteMultipartUploadOptions{Parts: completed}); err != nil {
+			return fmt.Errorf("failed to complete multipart upload: %w", err)
+		}
+	}
+
+	upload.multipartID = ""
+	upload.info.Offset = upload.info.Size
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sCOSUpload) abort(ctx context.Context) error {
+	_, err := upload.store.client.Object.AbortMultipartUpload(ctx, upload.store.binKey(upload.info.ID), upload.multipartID)
+	if err != nil && !cos.IsNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+func (upload *sCOSUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	var size int64
+	for i, partialUpload := range uploads {
+		_partialUpload := partialUpload.(*sCOSUpload)
+		if _partialUpload.multipartID != "" {
+			return fmt.Errorf("partial upload %s is not completed", _partialUpload.info.ID)
+		}
+		if _partialUpload.info.Size < MinPartSize && i < len(uploads)-1 {
+			return fmt.Errorf("partial upload %s is smaller than %d bytes", _partialUpload.info.ID, MinPartSize)
+		}
+
+		// 服务端复制, 数据不经过本机
+		sourceURL := upload.store.bucketHost() + "/" + upload.store.binKey(_partialUpload.info.ID)
+		_, _, err := upload.store.client.Object.CopyPart(ctx, upload.store.binKey(upload.info.ID), upload.multipartID, i+1, sourceURL, nil)
+		if err != nil {
+			return fmt.Errorf("failed to copy partial upload %s: %w", _partialUpload.info.ID, err)
+		}
+		size += _partialUpload.info.Size
+	}
+
+	upload.info.Size = size
+	if err := upload.complete(ctx); err != nil {
+		return err
+	}
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeContent 重定向到预签名的下载地址, 数据不经过本机
+func (upload *sCOSUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, err := upload.store.client.Object.GetPresignedURL2(ctx, r.Method, upload.store.binKey(upload.info.ID), upload.store.PresignExpiry, nil)
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return nil
+}
+
+func (upload *sCOSUpload) PresignDownload(ctx context.Context, expires time.Duration) (string, error) {
+	u, err := upload.store.client.Object.GetPresignedURL2(ctx, http.MethodGet, upload.store.binKey(upload.info.ID), expires, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sCOSUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.readInfo(ctx); err != nil {
+		return err
+	}
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sCOSUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if upload.multipartID != "" {
+		if err := upload.abort(ctx); err != nil {
+			return err
+		}
+	}
+
+	res, _, err := upload.store.client.Object.DeleteMulti(ctx, &cos.ObjectDeleteMultiOptions{
+		Quiet: true,
+		Objects: []cos.Object{
+			{Key: upload.store.binKey(upload.info.ID)},
+			{Key: upload.store.partKey(upload.info.ID)},
+			{Key: upload.store.infoKey(upload.info.ID)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range res.Errors {
+		if e.Code != "NoSuchKey" {
+			return fmt.Errorf("failed to delete %s: %s", e.Key, e.Message)
+		}
+	}
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+func cleanupTempFile(file *os.File) {
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+}
@@ -0,0 +1,636 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+const (
+	metaBlob    = "dedup.blob"
+	metaSize    = "dedup.size"
+	metaVersion = "dedup.version"
+
+	blobPrefix = "sha256-"
+	stubPrefix = "dedup-"
+	refsSuffix = ".refs"
+	// refsSlots 引用记录交替写入的位置数量
+	refsSlots = 2
+)
+
+// SDedupStore wraps any IStorage and stores identical content only once.
+//
+// Once an upload is complete its SHA-256 hash is computed and the data is
+// moved into a "sha256-<hash>" blob of the underlying storage, unless such a
+// blob already exists. The upload itself is replaced by an empty
+// "dedup-<id>" upload pointing to the blob. The IDs of the uploads
+// referencing a blob are kept in a "sha256-<hash>.refs" upload, the blob is
+// removed once the last of them is terminated or expires. Partial uploads
+// are not deduplicated.
+type SDedupStore struct {
+	inner  storage.IStorage
+	locker locker.ILocker
+}
+
+func New(inner storage.IStorage, locker locker.ILocker) (*SDedupStore, error) {
+	if inner == nil {
+		return nil, fmt.Errorf("storage is required")
+	}
+	return &SDedupStore{
+		inner:  inner,
+		locker: locker,
+	}, nil
+}
+
+func (store *SDedupStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if strings.HasPrefix(info.ID, blobPrefix) || strings.HasPrefix(info.ID, stubPrefix) {
+		return nil, fmt.Errorf("invalid upload id %s", info.ID)
+	}
+	// 客户端设置的dedup.blob可指向他人的内容
+	info.MetaData = storage.WithoutMetaDataPrefix(info.MetaData, "dedup.")
+	if info.IsFinal {
+		// 分片可能已被去重, 合并时按原始数据写入, 需提前确定长度
+		info.Size = 0
+		for _, id := range info.PartialIDs {
+			partialUpload, err := store.GetUpload(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			partialInfo, err := partialUpload.GetInfo(ctx)
+			if err != nil {
+				return nil, err
+			}
+			info.Size += partialInfo.Size
+		}
+	}
+
+	inner, err := store.inner.NewUpload(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	return store.wrap(info.ID, inner)
+}
+
+func (store *SDedupStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	if strings.HasPrefix(id, blobPrefix) || strings.HasPrefix(id, stubPrefix) {
+		return nil, fmt.Errorf("upload not found")
+	}
+	// 去重后的上传由stub代替, 原上传可能因删除失败而残留
+	inner, err := store.inner.GetUpload(ctx, stubPrefix+id)
+	if err != nil {
+		if !strings.Contains(err.Error(), "not found") {
+			return nil, err
+		}
+		if inner, err = store.inner.GetUpload(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return store.wrap(id, inner)
+}
+
+// ListUploads lists the uploads of the inner store without blobs and
+// reference records, a deduplicated upload is listed by its own ID.
+func (store *SDedupStore) ListUploads(ctx context.Context) ([]string, error) {
+	ids, err := storage.ListUploads(ctx, store.inner)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(ids))
+	uploadIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if strings.HasPrefix(id, blobPrefix) {
+			continue
+		}
+		id = strings.TrimPrefix(id, stubPrefix)
+		if !seen[id] {
+			seen[id] = true
+			uploadIDs = append(uploadIDs, id)
+		}
+	}
+	return uploadIDs, nil
+}
+
+func (store *SDedupStore) CanListUploads() bool {
+	return storage.CanListUploads(store.inner)
+}
+
+// Cleanup periodically removes uploads created more than expiredBefore ago,
+// releasing the blobs they reference. Blobs and reference records are never
+// expired themselves, so the Cleanup of the inner store isn't used and it
+// has to implement storage.IUploadLister instead, otherwise uploads don't
+// expire.
+func (store *SDedupStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	if !storage.CanListUploads(store.inner) {
+		fmt.Printf("storage can't list uploads, expired uploads are not removed\n")
+		return
+	}
+	lister := store.inner.(storage.IUploadLister)
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(ctx, lister, expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SDedupStore) cleanup(ctx context.Context, lister storage.IUploadLister, expiredBefore time.Duration) {
+	lock, err := store.locker.NewLock("dedup:cleanup")
+	if err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	if err = lock.Lock(ctx); err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+	ids, err := lister.ListUploads(ctx)
+	if err != nil {
+		fmt.Printf("failed to get expired uploads: %v\n", err)
+		return
+	}
+
+	expiredTime := time.Now().Add(-expiredBefore)
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		// blob和引用记录随引用它们的上传删除
+		if strings.HasPrefix(id, blobPrefix) {
+			continue
+		}
+		id = strings.TrimPrefix(id, stubPrefix)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		upload, err := store.GetUpload(ctx, id)
+		if err != nil {
+			if !strings.Contains(err.Error(), "not found") {
+				fmt.Printf("failed to get upload %s: %v\n", id, err)
+			}
+			continue
+		}
+		info, err := upload.GetInfo(ctx)
+		if err != nil {
+			fmt.Printf("failed to get upload %s: %v\n", id, err)
+			continue
+		}
+		if !info.CreateTime.Before(expiredTime) {
+			continue
+		}
+		if err = upload.Terminate(ctx); err != nil {
+			fmt.Printf("failed to remove expired upload: %v\n", err)
+		}
+	}
+}
+
+func (store *SDedupStore) wrap(id string, inner storage.IUpload) (*sDedupUpload, error) {
+	binLock, err := store.locker.NewLock("dedup:" + id)
+	if err != nil {
+		return nil, err
+	}
+	return &sDedupUpload{
+		binLock: binLock,
+		id:      id,
+		inner:   inner,
+		store:   store,
+	}, nil
+}
+
+// lockBlob 同一内容的引用计数需串行修改
+func (store *SDedupStore) lockBlob(ctx context.Context, blobID string) (locker.ILock, error) {
+	lock, err := store.locker.NewLock("dedup:" + blobID)
+	if err != nil {
+		return nil, err
+	}
+	if err = lock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// sRefs 引用blob的上传ID. 记录交替写入refsSlots个位置, 先写入新记录再删除旧记录,
+// 以版本最大的记录为准
+type sRefs struct {
+	ids     []string
+	version int64
+	// records 各位置现存的记录, current为最新记录的位置, 没有记录时为-1
+	records [refsSlots]storage.IUpload
+	current int
+}
+
+func refsID(blobID string, slot int) string {
+	if slot == 0 {
+		return blobID + refsSuffix
+	}
+	return blobID + refsSuffix + "." + strconv.Itoa(slot)
+}
+
+// readRefs 读取blob的引用记录
+func (store *SDedupStore) readRefs(ctx context.Context, blobID string) (*sRefs, error) {
+	refs := &sRefs{current: -1}
+	for slot := range refs.records {
+		record, err := store.inner.GetUpload(ctx, refsID(blobID, slot))
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				continue
+			}
+			return nil, err
+		}
+		info, err := record.GetInfo(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// 写入中断的记录不完整
+		if info.Offset < info.Size {
+			refs.records[slot] = record
+			continue
+		}
+		version, _ := strconv.ParseInt(info.MetaData[metaVersion], 10, 64)
+		refs.records[slot] = record
+		if refs.current < 0 || version > refs.version {
+			refs.current = slot
+			refs.version = version
+		}
+	}
+	if refs.current < 0 {
+		return refs, nil
+	}
+	reader, err := refs.records[refs.current].GetReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	refs.ids = strings.Fields(string(data))
+	return refs, nil
+}
+
+// writeRefs 底层存储不支持覆盖写入, 在另一位置创建新记录后再删除旧记录
+func (store *SDedupStore) writeRefs(ctx context.Context, blobID string, refs *sRefs, ids []string) error {
+	next := -1
+	if len(ids) > 0 {
+		next = (refs.current + 1) % refsSlots
+		// 上次写入中断或删除失败留下的过时记录
+		if stale := refs.records[next]; stale != nil {
+			if err := stale.Terminate(ctx); err != nil {
+				return err
+			}
+		}
+		data := []byte(strings.Join(ids, "\n"))
+		record, err := store.inner.NewUpload(ctx, common.FileInfo{
+			ID:   refsID(blobID, next),
+			Size: int64(len(data)),
+			MetaData: map[string]string{
+				metaVersion: strconv.FormatInt(refs.version+1, 10),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = record.WriteChunk(ctx, 0, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	for slot, record := range refs.records {
+		if record == nil || slot == next {
+			continue
+		}
+		if err := record.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sDedupUpload struct {
+	binLock locker.ILock
+	id      string
+	inner   storage.IUpload
+	store   *SDedupStore
+}
+
+// blob 返回已去重上传所指向的blob, 未去重时返回nil
+func (upload *sDedupUpload) blob(ctx context.Context) (storage.IUpload, common.FileInfo, error) {
+	info, err := upload.inner.GetInfo(ctx)
+	if err != nil {
+		return nil, common.FileInfo{}, err
+	}
+	blobID := info.MetaData[metaBlob]
+	if blobID == "" {
+		return nil, info, nil
+	}
+	blob, err := upload.store.inner.GetUpload(ctx, blobID)
+	if err != nil {
+		return nil, common.FileInfo{}, fmt.Errorf("failed to get content of upload %s: %w", upload.id, err)
+	}
+	return blob, info, nil
+}
+
+func (upload *sDedupUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	info, err := upload.inner.GetInfo(ctx)
+	if err != nil {
+		return common.FileInfo{}, err
+	}
+	if info.MetaData[metaBlob] == "" {
+		return info, nil
+	}
+
+	info.Size, err = strconv.ParseInt(info.MetaData[metaSize], 10, 64)
+	if err != nil {
+		return common.FileInfo{}, fmt.Errorf("invalid size of upload %s: %w", upload.id, err)
+	}
+	info.ID = upload.id
+	info.Offset = info.Size
+	// 数据位于共享的blob中, 存储位置取自blob
+	if blob, err := upload.store.inner.GetUpload(ctx, info.MetaData[metaBlob]); err == nil {
+		if blobInfo, err := blob.GetInfo(ctx); err == nil {
+			info.Storage = blobInfo.Storage
+		}
+	}
+	metadata := make(map[string]string, len(info.MetaData))
+	for k, v := range info.MetaData {
+		if !strings.HasPrefix(k, "dedup.") {
+			metadata[k] = v
+		}
+	}
+	info.MetaData = metadata
+	return info, nil
+}
+
+func (upload *sDedupUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	blob, _, err := upload.blob(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if blob != nil {
+		return blob.GetReader(ctx)
+	}
+	return upload.inner.GetReader(ctx)
+}
+
+func (upload *sDedupUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	n, err := upload.inner.WriteChunk(ctx, offset, src)
+	if err != nil {
+		return n, err
+	}
+	return n, upload.dedupIfComplete(ctx)
+}
+
+// dedupIfComplete 上传完成后将数据移入blob, 并以指向blob的空上传替换原上传
+func (upload *sDedupUpload) dedupIfComplete(ctx context.Context) error {
+	info, err := upload.inner.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if info.IsPartial || info.SizeIsDeferred || info.Size == 0 || info.Offset < info.Size || info.MetaData[metaBlob] != "" {
+		return nil
+	}
+
+	sum, err := upload.hash(ctx)
+	if err != nil {
+		return err
+	}
+	blobID := blobPrefix + sum
+
+	lock, err := upload.store.lockBlob(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	refs, err := upload.store.readRefs(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	blob, err := upload.store.inner.GetUpload(ctx, blobID)
+	if err != nil && !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	if blob != nil {
+		// 上次复制中断留下的blob不完整
+		blobInfo, err := blob.GetInfo(ctx)
+		if err != nil {
+			return err
+		}
+		if blobInfo.Offset < blobInfo.Size {
+			if err = blob.Terminate(ctx); err != nil {
+				return err
+			}
+			blob = nil
+		}
+	}
+	if blob == nil {
+		if err = upload.copyTo(ctx, blobID, info.Size); err != nil {
+			return err
+		}
+	}
+	if !slices.Contains(refs.ids, upload.id) {
+		if err = upload.store.writeRefs(ctx, blobID, refs, append(refs.ids, upload.id)); err != nil {
+			return err
+		}
+	}
+
+	stubInfo := info
+	stubInfo.ID = stubPrefix + upload.id
+	stubInfo.Size = 0
+	stubInfo.Offset = 0
+	stubInfo.Storage = nil
+	stubInfo.MetaData = make(map[string]string, len(info.MetaData)+2)
+	for k, v := range info.MetaData {
+		stubInfo.MetaData[k] = v
+	}
+	stubInfo.MetaData[metaBlob] = blobID
+	stubInfo.MetaData[metaSize] = strconv.FormatInt(info.Size, 10)
+	stub, err := upload.store.inner.NewUpload(ctx, stubInfo)
+	if err != nil {
+		return err
+	}
+	// stub创建后原上传已不再使用, 删除失败时由Terminate或定时清理删除
+	if err = upload.inner.Terminate(ctx); err != nil {
+		fmt.Printf("failed to remove deduplicated upload %s: %v\n", upload.id, err)
+	}
+	upload.inner = stub
+	return nil
+}
+
+func (upload *sDedupUpload) hash(ctx context.Context) (string, error) {
+	reader, err := upload.inner.GetReader(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	h := sha256.New()
+	if _, err = io.Copy(h, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (upload *sDedupUpload) copyTo(ctx context.Context, blobID string, size int64) error {
+	reader, err := upload.inner.GetReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	blob, err := upload.store.inner.NewUpload(ctx, common.FileInfo{
+		ID:   blobID,
+		Size: size,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := blob.WriteChunk(ctx, 0, reader)
+	if errors.Is(err, storage.ErrUploadCompleted) {
+		// 空文件创建后即已完成
+		err = nil
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("copied %d of %d bytes", n, size)
+	}
+	if err != nil {
+		_ = blob.Terminate(ctx)
+		return err
+	}
+	return nil
+}
+
+func (upload *sDedupUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	var readers []io.Reader
+	for _, partialUpload := range uploads {
+		reader, err := partialUpload.GetReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = reader.Close()
+		}()
+		readers = append(readers, reader)
+	}
+	if _, err := upload.WriteChunk(ctx, 0, io.MultiReader(readers...)); err != nil && !errors.Is(err, storage.ErrUploadCompleted) {
+		return err
+	}
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (upload *sDedupUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	blob, _, err := upload.blob(ctx)
+	if err != nil {
+		return err
+	}
+	if blob != nil {
+		return blob.ServeContent(ctx, w, r)
+	}
+	return upload.inner.ServeContent(ctx, w, r)
+}
+
+func (upload *sDedupUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+	return storage.DeclareLength(ctx, upload.inner, length)
+}
+
+func (upload *sDedupUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	info, err := upload.inner.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if blobID := info.MetaData[metaBlob]; blobID != "" {
+		if err = upload.release(ctx, blobID); err != nil {
+			return err
+		}
+		// 先删除残留的原上传, 否则删除stub后其重新可见
+		if info.ID != upload.id {
+			if raw, err := upload.store.inner.GetUpload(ctx, upload.id); err == nil {
+				if err = raw.Terminate(ctx); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return upload.inner.Terminate(ctx)
+}
+
+// release 移除对blob的引用, 最后一个引用移除后删除blob
+func (upload *sDedupUpload) release(ctx context.Context, blobID string) error {
+	lock, err := upload.store.lockBlob(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	refs, err := upload.store.readRefs(ctx, blobID)
+	if err != nil {
+		return err
+	}
+	// 引用记录丢失时无法确认是否仍被引用, 保留blob
+	if refs.current < 0 {
+		return nil
+	}
+	ids := slices.DeleteFunc(refs.ids, func(id string) bool {
+		return id == upload.id
+	})
+	if err = upload.store.writeRefs(ctx, blobID, refs, ids); err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		return nil
+	}
+	blob, err := upload.store.inner.GetUpload(ctx, blobID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil
+		}
+		return err
+	}
+	return blob.Terminate(ctx)
+}
@@ -0,0 +1,596 @@
+package encrypted
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+const (
+	metaKey         = "encryption.key"
+	metaNonce       = "encryption.nonce"
+	metaSegmentSize = "encryption.segmentSize"
+	metaIndex       = "encryption.index"
+	// metaCustomerKey 标记数据密钥由客户端提供的密钥包装
+	metaCustomerKey = "encryption.customerKey"
+
+	tailSuffix = ".tail"
+)
+
+// SEncryptedStore wraps any IStorage and encrypts the upload data at rest
+// with AES-256-GCM. Every upload gets its own data key which is wrapped by
+// the IKeyProvider and kept in the metadata of the underlying upload.
+//
+// The data is sealed in segments of SegmentSize bytes. Data at the end of a
+// chunk which does not fill a whole segment is kept in a separate
+// "<id>.tail" upload until the next chunk arrives, so the offset of an upload
+// can always be derived from the underlying storage. While the length is
+// deferred the last full segment of a chunk is kept there as well, since it
+// can only be sealed once it is known whether it ends the upload.
+//
+// Clients can provide their own key with storage.WithEncryptionKey, it then
+// wraps the data key instead of the IKeyProvider and is required to read or
+// write the data, the info of the upload stays accessible. Without an
+// IKeyProvider only uploads with a client key are encrypted.
+type SEncryptedStore struct {
+	// SegmentSize is the plaintext size of the segments of new uploads.
+	SegmentSize int64
+
+	inner  storage.IStorage
+	keys   IKeyProvider
+	locker locker.ILocker
+}
+
+// New wraps inner, keys may be nil to encrypt only the uploads with a
+// client key.
+func New(inner storage.IStorage, keys IKeyProvider, locker locker.ILocker) (*SEncryptedStore, error) {
+	if inner == nil {
+		return nil, fmt.Errorf("storage is required")
+	}
+	return &SEncryptedStore{
+		SegmentSize: 64 * 1024,
+		inner:       inner,
+		keys:        keys,
+		locker:      locker,
+	}, nil
+}
+
+func (store *SEncryptedStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if strings.HasSuffix(info.ID, tailSuffix) {
+		return nil, fmt.Errorf("invalid upload id %s", info.ID)
+	}
+	// 加密参数只能由本存储设置
+	info.MetaData = storage.WithoutMetaDataPrefix(info.MetaData, "encryption.")
+	keys := store.keys
+	customerKey, hasCustomerKey := storage.EncryptionKeyFromContext(ctx)
+	if hasCustomerKey {
+		var err error
+		if keys, err = NewStaticKeyProvider(customerKey); err != nil {
+			return nil, err
+		}
+	}
+	if info.IsFinal {
+		// 合并后的明文长度即各分片长度之和
+		info.Size = 0
+		for _, id := range info.PartialIDs {
+			partialUpload, err := store.GetUpload(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			if _, encrypted := partialUpload.(*sEncryptedUpload); encrypted && keys == nil {
+				return nil, fmt.Errorf("%w: partial upload %s is encrypted", storage.ErrEncryptionKeyRequired, id)
+			}
+			partialInfo, err := partialUpload.GetInfo(ctx)
+			if err != nil {
+				return nil, err
+			}
+			info.Size += partialInfo.Size
+		}
+	}
+
+	if keys == nil {
+		// 未配置密钥且客户端未提供密钥的上传不加密
+		return store.inner.NewUpload(ctx, info)
+	}
+
+	key := make([]byte, 32)
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+	wrapped, err := keys.WrapKey(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	stream, err := newStream(key, noncePrefix, store.SegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	innerInfo := info
+	innerInfo.MetaData = make(map[string]string, len(info.MetaData)+3)
+	for k, v := range info.MetaData {
+		innerInfo.MetaData[k] = v
+	}
+	innerInfo.MetaData[metaKey] = base64.StdEncoding.EncodeToString(wrapped)
+	innerInfo.MetaData[metaNonce] = base64.StdEncoding.EncodeToString(noncePrefix)
+	innerInfo.MetaData[metaSegmentSize] = strconv.FormatInt(store.SegmentSize, 10)
+	if hasCustomerKey {
+		innerInfo.MetaData[metaCustomerKey] = "true"
+	}
+	if !info.SizeIsDeferred {
+		innerInfo.Size = stream.cipherSize(info.Size)
+	}
+
+	inner, err := store.inner.NewUpload(ctx, innerInfo)
+	if err != nil {
+		return nil, err
+	}
+	return store.wrap(ctx, inner)
+}
+
+func (store *SEncryptedStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	if strings.HasSuffix(id, tailSuffix) {
+		return nil, fmt.Errorf("upload not found")
+	}
+	inner, err := store.inner.GetUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return store.wrap(ctx, inner)
+}
+
+// ListUploads lists the uploads of the inner store without the tails of
+// incomplete segments.
+func (store *SEncryptedStore) ListUploads(ctx context.Context) ([]string, error) {
+	ids, err := storage.ListUploads(ctx, store.inner)
+	if err != nil {
+		return nil, err
+	}
+	uploadIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !strings.HasSuffix(id, tailSuffix) {
+			uploadIDs = append(uploadIDs, id)
+		}
+	}
+	return uploadIDs, nil
+}
+
+func (store *SEncryptedStore) CanListUploads() bool {
+	return storage.CanListUploads(store.inner)
+}
+
+func (store *SEncryptedStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	store.inner.Cleanup(ctx, expiredBefore)
+}
+
+func (store *SEncryptedStore) wrap(ctx context.Context, inner storage.IUpload) (storage.IUpload, error) {
+	info, err := inner.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := info.MetaData[metaKey]; !ok && store.keys == nil {
+		return inner, nil
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(info.MetaData[metaKey])
+	if err != nil || len(wrapped) == 0 {
+		return nil, fmt.Errorf("upload %s is not encrypted", info.ID)
+	}
+	noncePrefix, err := base64.StdEncoding.DecodeString(info.MetaData[metaNonce])
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce of upload %s: %w", info.ID, err)
+	}
+	segmentSize, err := strconv.ParseInt(info.MetaData[metaSegmentSize], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid segment size of upload %s: %w", info.ID, err)
+	}
+	binLock, err := store.locker.NewLock("encrypted:" + info.ID)
+	if err != nil {
+		return nil, err
+	}
+	upload := &sEncryptedUpload{
+		binLock: binLock,
+		id:      info.ID,
+		inner:   inner,
+		store:   store,
+	}
+
+	keys := store.keys
+	if info.MetaData[metaCustomerKey] != "" {
+		customerKey, ok := storage.EncryptionKeyFromContext(ctx)
+		if ok {
+			keys, err = NewStaticKeyProvider(customerKey)
+		}
+		if !ok || err != nil {
+			// 没有正确的密钥时只能获取上传的信息, 计算长度不需要密钥
+			upload.keyErr = fmt.Errorf("%w: %s", storage.ErrEncryptionKeyRequired, info.ID)
+			upload.stream = &sStream{noncePrefix: noncePrefix, segmentSize: segmentSize}
+			return upload, nil
+		}
+	} else if keys == nil {
+		return nil, fmt.Errorf("no key provider for encrypted upload %s", info.ID)
+	}
+	key, err := keys.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		if info.MetaData[metaCustomerKey] != "" {
+			upload.keyErr = fmt.Errorf("%w: %s", storage.ErrEncryptionKeyMismatch, info.ID)
+			upload.stream = &sStream{noncePrefix: noncePrefix, segmentSize: segmentSize}
+			return upload, nil
+		}
+		return nil, fmt.Errorf("failed to unwrap data key of upload %s: %w", info.ID, err)
+	}
+	if upload.stream, err = newStream(key, noncePrefix, segmentSize); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+type sEncryptedUpload struct {
+	binLock locker.ILock
+	id      string
+	inner   storage.IUpload
+	stream  *sStream
+	store   *SEncryptedStore
+	// keyErr 客户端未提供或提供了错误的密钥, 此时不能读写数据
+	keyErr error
+}
+
+func (upload *sEncryptedUpload) segmentIndex(info common.FileInfo) (int64, error) {
+	size := upload.stream.segmentSize + tagSize
+	if info.Offset%size != 0 {
+		return 0, fmt.Errorf("encrypted upload %s is corrupted", upload.id)
+	}
+	return info.Offset / size, nil
+}
+
+func (upload *sEncryptedUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	info, err := upload.inner.GetInfo(ctx)
+	if err != nil {
+		return common.FileInfo{}, err
+	}
+
+	metadata := make(map[string]string, len(info.MetaData))
+	for k, v := range info.MetaData {
+		if !strings.HasPrefix(k, "encryption.") {
+			metadata[k] = v
+		}
+	}
+	info.MetaData = metadata
+
+	if !info.SizeIsDeferred && info.Offset >= info.Size {
+		info.Size = upload.stream.plainSize(info.Size)
+		info.Offset = info.Size
+		return info, nil
+	}
+	if !info.SizeIsDeferred {
+		info.Size = upload.stream.plainSize(info.Size)
+	}
+	index, err := upload.segmentIndex(info)
+	if err != nil {
+		return common.FileInfo{}, err
+	}
+	_, tailSize, err := upload.getTail(ctx, index)
+	if err != nil {
+		return common.FileInfo{}, err
+	}
+	info.Offset = index*upload.stream.segmentSize + tailSize
+	return info, nil
+}
+
+// getTail 返回属于第index段的尾部数据及其明文长度, 过期的尾部数据长度为0
+func (upload *sEncryptedUpload) getTail(ctx context.Context, index int64) (storage.IUpload, int64, error) {
+	tail, err := upload.store.inner.GetUpload(ctx, upload.id+tailSuffix)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	info, err := tail.GetInfo(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if info.Offset < info.Size || info.Size < nonceSize+tagSize || info.MetaData[metaIndex] != strconv.FormatInt(index, 10) {
+		return tail, 0, nil
+	}
+	return tail, info.Size - nonceSize - tagSize, nil
+}
+
+func (upload *sEncryptedUpload) readTail(ctx context.Context, index int64) (storage.IUpload, []byte, error) {
+	tail, size, err := upload.getTail(ctx, index)
+	if err != nil || size == 0 {
+		return tail, nil, err
+	}
+	reader, err := tail.GetReader(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := upload.stream.openTail(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tail, plaintext, nil
+}
+
+func (upload *sEncryptedUpload) writeTail(ctx context.Context, index int64, plaintext []byte) error {
+	sealed, err := upload.stream.sealTail(plaintext)
+	if err != nil {
+		return err
+	}
+	tail, err := upload.store.inner.NewUpload(ctx, common.FileInfo{
+		ID:   upload.id + tailSuffix,
+		Size: int64(len(sealed)),
+		MetaData: map[string]string{
+			metaIndex: strconv.FormatInt(index, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tail.WriteChunk(ctx, 0, bytes.NewReader(sealed))
+	return err
+}
+
+func (upload *sEncryptedUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	if upload.keyErr != nil {
+		return nil, upload.keyErr
+	}
+	reader, err := upload.inner.GetReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptReader(upload.stream, reader), nil
+}
+
+func (upload *sEncryptedUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if upload.keyErr != nil {
+		return 0, upload.keyErr
+	}
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	info, err := upload.inner.GetInfo(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !info.SizeIsDeferred && info.Offset >= info.Size {
+		return 0, storage.ErrUploadCompleted
+	}
+	index, err := upload.segmentIndex(info)
+	if err != nil {
+		return 0, err
+	}
+	tail, tailData, err := upload.readTail(ctx, index)
+	if err != nil {
+		return 0, err
+	}
+	segmentSize := upload.stream.segmentSize
+	if index*segmentSize+int64(len(tailData)) != offset {
+		return 0, fmt.Errorf("mismatched offset %d, upload has %d bytes", offset, index*segmentSize+int64(len(tailData)))
+	}
+	size := upload.stream.plainSize(info.Size)
+
+	// 上次遗留的尾部数据与本次数据合并后按段加密, 通过管道流式写入底层存储
+	var (
+		reader  = bufio.NewReader(io.MultiReader(bytes.NewReader(tailData), src))
+		pending []byte
+		readErr error
+		done    = make(chan struct{})
+	)
+	pr, pw := io.Pipe()
+	go func() {
+		defer close(done)
+		defer func() {
+			_ = pw.Close()
+		}()
+		buf := make([]byte, segmentSize)
+		for i := index; ; i++ {
+			n, err := io.ReadFull(reader, buf)
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				readErr = err
+			}
+			if n == 0 {
+				return
+			}
+			last := !info.SizeIsDeferred && i*segmentSize+int64(n) >= size
+			if int64(n) < segmentSize && !last {
+				// 不足一段, 作为尾部数据单独保存
+				pending = append([]byte(nil), buf[:n]...)
+				return
+			}
+			// 长度未声明时末尾的整段同样作为尾部数据保存, 声明长度后才能确定是否为最后一段
+			if info.SizeIsDeferred && readErr == nil {
+				if _, err = reader.Peek(1); err != nil {
+					if !errors.Is(err, io.EOF) {
+						readErr = err
+					}
+					pending = append([]byte(nil), buf[:n]...)
+					return
+				}
+			}
+			if _, err = pw.Write(upload.stream.seal(i, last, buf[:n])); err != nil || last || readErr != nil {
+				return
+			}
+		}
+	}()
+	written, err := upload.inner.WriteChunk(ctx, info.Offset, pr)
+	_ = pr.Close()
+	<-done
+
+	newOffset := upload.stream.plainSize(info.Offset + written)
+	if err != nil {
+		return max(newOffset-offset, 0), err
+	}
+
+	// 旧的尾部数据已被合并
+	if tail != nil {
+		if err = tail.Terminate(ctx); err != nil {
+			return max(newOffset-offset, 0), err
+		}
+	}
+	if len(pending) > 0 {
+		if err = upload.writeTail(ctx, (info.Offset+written)/(segmentSize+tagSize), pending); err != nil {
+			return max(newOffset-offset, 0), err
+		}
+		newOffset += int64(len(pending))
+	}
+	return newOffset - offset, readErr
+}
+
+func (upload *sEncryptedUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	// 各分片使用不同的数据密钥, 只能解密后重新加密写入
+	var readers []io.Reader
+	for _, partialUpload := range uploads {
+		reader, err := partialUpload.GetReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = reader.Close()
+		}()
+		readers = append(readers, reader)
+	}
+	if _, err := upload.WriteChunk(ctx, 0, io.MultiReader(readers...)); err != nil {
+		return err
+	}
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (upload *sEncryptedUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if upload.keyErr != nil {
+		return upload.keyErr
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	rs := &sDecryptReadSeeker{ctx: ctx, upload: upload, size: info.Offset}
+	defer rs.Close()
+	http.ServeContent(w, r, "", info.CreateTime, rs)
+	return nil
+}
+
+// DeclareLength declares the size of the ciphertext of length plaintext
+// bytes on the inner upload.
+func (upload *sEncryptedUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+	return storage.DeclareLength(ctx, upload.inner, upload.stream.cipherSize(length))
+}
+
+func (upload *sEncryptedUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	tail, _, err := upload.getTail(ctx, -1)
+	if err != nil {
+		return err
+	}
+	if tail != nil {
+		if err = tail.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return upload.inner.Terminate(ctx)
+}
+
+// sDecryptReadSeeker 为http.ServeContent提供io.ReadSeeker, 底层只能顺序读取,
+// 向前跳转时丢弃中间数据, 向后跳转时重新读取
+type sDecryptReadSeeker struct {
+	ctx       context.Context
+	upload    *sEncryptedUpload
+	size      int64
+	pos       int64
+	reader    io.ReadCloser
+	readerPos int64
+}
+
+func (rs *sDecryptReadSeeker) Read(p []byte) (int, error) {
+	if rs.pos >= rs.size {
+		return 0, io.EOF
+	}
+	if rs.reader == nil || rs.readerPos > rs.pos {
+		rs.Close()
+		reader, err := rs.upload.GetReader(rs.ctx)
+		if err != nil {
+			return 0, err
+		}
+		rs.reader = reader
+		rs.readerPos = 0
+	}
+	if rs.readerPos < rs.pos {
+		n, err := io.CopyN(io.Discard, rs.reader, rs.pos-rs.readerPos)
+		rs.readerPos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := rs.reader.Read(p)
+	rs.pos += int64(n)
+	rs.readerPos += int64(n)
+	return n, err
+}
+
+func (rs *sDecryptReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = rs.pos + offset
+	case io.SeekEnd:
+		pos = rs.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position: %d", pos)
+	}
+	rs.pos = pos
+	return pos, nil
+}
+
+func (rs *sDecryptReadSeeker) Close() {
+	if rs.reader != nil {
+		_ = rs.reader.Close()
+		rs.reader = nil
+	}
+}
@@ -0,0 +1,71 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	memorylocker "github.com/busybox-org/gin-fileuploader/locker/memory"
+	"github.com/busybox-org/gin-fileuploader/storage"
+	"github.com/busybox-org/gin-fileuploader/storage/memory"
+)
+
+// TestDeclareLengthAtSegmentBoundary declares the length of a deferred upload
+// after its data ended exactly at a segment boundary, the last segment must
+// still be sealed as last.
+func TestDeclareLengthAtSegmentBoundary(t *testing.T) {
+	ctx := context.Background()
+	keys, err := NewStaticKeyProvider(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := New(memory.New(), keys, memorylocker.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SegmentSize = 16
+
+	for _, segments := range []int{1, 3} {
+		data := bytes.Repeat([]byte("0123456789abcdef"), segments)
+		upload, err := store.NewUpload(ctx, common.FileInfo{SizeIsDeferred: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := upload.WriteChunk(ctx, 0, bytes.NewReader(data))
+		if err != nil || n != int64(len(data)) {
+			t.Fatalf("WriteChunk() = %d, %v", n, err)
+		}
+		info, err := upload.GetInfo(ctx)
+		if err != nil || info.Offset != int64(len(data)) {
+			t.Fatalf("GetInfo() offset = %d, %v", info.Offset, err)
+		}
+
+		if err = storage.DeclareLength(ctx, upload, int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		if n, err = upload.WriteChunk(ctx, info.Offset, bytes.NewReader(nil)); err != nil || n != 0 {
+			t.Fatalf("WriteChunk() after declaring the length = %d, %v", n, err)
+		}
+		if info, err = upload.GetInfo(ctx); err != nil || info.Offset != info.Size || info.Size != int64(len(data)) {
+			t.Fatalf("GetInfo() = %d/%d, %v", info.Offset, info.Size, err)
+		}
+		if _, err = upload.WriteChunk(ctx, info.Offset, bytes.NewReader(nil)); err != storage.ErrUploadCompleted {
+			t.Fatalf("WriteChunk() on completed upload = %v", err)
+		}
+
+		reader, err := upload.GetReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(reader)
+		_ = reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("GetReader() = %q, want %q", got, data)
+		}
+	}
+}
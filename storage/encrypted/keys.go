@@ -0,0 +1,183 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IKeyProvider wraps and unwraps the data keys of uploads. Every upload is
+// encrypted with its own random data key, only the wrapped key is stored.
+// The providers of the kms package wrap them with a KMS, which keeps the
+// master key out of the process.
+type IKeyProvider interface {
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// SStaticKeyProvider wraps data keys with a local AES-256 master key.
+type SStaticKeyProvider struct {
+	aead cipher.AEAD
+}
+
+// NewStaticKeyProvider creates a key provider from a 32 byte master key.
+func NewStaticKeyProvider(key []byte) (*SStaticKeyProvider, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SStaticKeyProvider{aead: aead}, nil
+}
+
+// NewKeyProviderFromEnv reads a base64 encoded master key from the given
+// environment variable.
+func NewKeyProviderFromEnv(name string) (*SStaticKeyProvider, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key in %s: %w", name, err)
+	}
+	return NewStaticKeyProvider(key)
+}
+
+// NewKeyProviderFromFile reads the master key from a file, either as 32 raw
+// bytes or base64 encoded.
+func NewKeyProviderFromFile(path string) (*SStaticKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return NewStaticKeyProvider(data)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key in %s: %w", path, err)
+	}
+	return NewStaticKeyProvider(key)
+}
+
+func (p *SStaticKeyProvider) WrapKey(_ context.Context, key []byte) ([]byte, error) {
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return p.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (p *SStaticKeyProvider) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < p.aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	nonce, ciphertext := wrapped[:p.aead.NonceSize()], wrapped[p.aead.NonceSize():]
+	return p.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// SKeyRing rotates the key wrapping the data keys: new data keys are
+// wrapped by the first provider, existing ones are unwrapped by the first
+// provider that succeeds. Retired keys, e.g. the previous master key or the
+// static key before moving to a KMS, are kept as later providers until no
+// upload wrapped by them is left.
+type SKeyRing struct {
+	Providers []IKeyProvider
+}
+
+func (ring *SKeyRing) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	if len(ring.Providers) == 0 {
+		return nil, fmt.Errorf("key ring is empty")
+	}
+	return ring.Providers[0].WrapKey(ctx, key)
+}
+
+func (ring *SKeyRing) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var errs []error
+	for _, provider := range ring.Providers {
+		key, err := provider.UnwrapKey(ctx, wrapped)
+		if err == nil {
+			return key, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("no key of the key ring can unwrap the data key: %w", errors.Join(errs...))
+}
+
+// maxCachedKeys 超过后清理过期的数据密钥
+const maxCachedKeys = 10000
+
+// SCachingKeyProvider caches the data keys unwrapped by Provider for TTL,
+// so a KMS isn't called for every request to an upload.
+type SCachingKeyProvider struct {
+	Provider IKeyProvider
+	TTL      time.Duration
+
+	mu   sync.Mutex
+	keys map[string]sCachedKey
+}
+
+type sCachedKey struct {
+	key     []byte
+	expires time.Time
+}
+
+func (p *SCachingKeyProvider) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	wrapped, err := p.Provider.WrapKey(ctx, key)
+	if err == nil {
+		p.store(wrapped, key)
+	}
+	return wrapped, err
+}
+
+func (p *SCachingKeyProvider) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	p.mu.Lock()
+	cached, ok := p.keys[string(wrapped)]
+	p.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return bytes.Clone(cached.key), nil
+	}
+	key, err := p.Provider.UnwrapKey(ctx, wrapped)
+	if err == nil {
+		p.store(wrapped, key)
+	}
+	return key, err
+}
+
+func (p *SCachingKeyProvider) store(wrapped, key []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.keys == nil {
+		p.keys = make(map[string]sCachedKey)
+	}
+	if len(p.keys) >= maxCachedKeys {
+		for k, cached := range p.keys {
+			if !now.Before(cached.expires) {
+				delete(p.keys, k)
+			}
+		}
+	}
+	if len(p.keys) < maxCachedKeys {
+		p.keys[string(wrapped)] = sCachedKey{key: bytes.Clone(key), expires: now.Add(p.TTL)}
+	}
+}
@@ -0,0 +1,121 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// SAWSKeyProvider wraps data keys with a symmetric AWS KMS key using its
+// Encrypt and Decrypt actions. Rotation of the key material by KMS is
+// transparent, wrapped keys name the key they were wrapped with, so after
+// switching to a new KeyID the old one only needs to stay enabled.
+type SAWSKeyProvider struct {
+	// KeyID is the ID, ARN or alias of the key, e.g. alias/tusx.
+	KeyID string
+	// Endpoint overrides https://kms.<region>.amazonaws.com, e.g. for a VPC
+	// endpoint.
+	Endpoint string
+
+	region      string
+	credentials aws.CredentialsProvider
+	client      aws.HTTPClient
+	signer      *v4.Signer
+}
+
+// NewAWSKeyProvider creates a key provider for keyID using the region and
+// credentials of cfg, e.g. loaded by config.LoadDefaultConfig.
+func NewAWSKeyProvider(cfg aws.Config, keyID string) (*SAWSKeyProvider, error) {
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("aws region is required for kms")
+	}
+	if cfg.Credentials == nil {
+		return nil, fmt.Errorf("aws credentials are required for kms")
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &SAWSKeyProvider{
+		KeyID:       keyID,
+		region:      cfg.Region,
+		credentials: cfg.Credentials,
+		client:      client,
+		signer:      v4.NewSigner(),
+	}, nil
+}
+
+func (p *SAWSKeyProvider) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	var out struct {
+		CiphertextBlob []byte
+	}
+	if err := p.call(ctx, "Encrypt", map[string]any{"KeyId": p.KeyID, "Plaintext": key}, &out); err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
+
+func (p *SAWSKeyProvider) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte
+	}
+	// 密文中包含密钥ID, 不指定KeyId以便解密轮换前的密钥包装的数据密钥
+	if err := p.call(ctx, "Decrypt", map[string]any{"CiphertextBlob": wrapped}, &out); err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// call 调用KMS的JSON接口, []byte字段按base64编码与KMS一致
+func (p *SAWSKeyProvider) call(ctx context.Context, action string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + p.region + ".amazonaws.com/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+
+	credentials, err := p.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve aws credentials: %w", err)
+	}
+	hash := sha256.Sum256(body)
+	if err = p.signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(hash[:]), "kms", p.region, time.Now()); err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(data, &kmsErr)
+		return fmt.Errorf("aws kms %s failed with status %d: %s %s", action, resp.StatusCode, kmsErr.Type, kmsErr.Message)
+	}
+	return json.Unmarshal(data, out)
+}
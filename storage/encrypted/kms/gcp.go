@@ -0,0 +1,55 @@
+package kms
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	cloudkms "google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// SGCPKeyProvider wraps data keys with a symmetric Cloud KMS key. Keys are
+// wrapped with the primary version of the key and unwrapped with the
+// version they were wrapped with, so rotating the key in Cloud KMS needs no
+// changes as long as older versions stay enabled.
+type SGCPKeyProvider struct {
+	// KeyName is the resource name of the key, i.e.
+	// projects/*/locations/*/keyRings/*/cryptoKeys/*.
+	KeyName string
+
+	keys *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
+}
+
+// NewGCPKeyProvider creates a key provider for keyName, authenticated by
+// the application default credentials unless opts say otherwise.
+func NewGCPKeyProvider(ctx context.Context, keyName string, opts ...option.ClientOption) (*SGCPKeyProvider, error) {
+	service, err := cloudkms.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cloud kms client: %w", err)
+	}
+	return &SGCPKeyProvider{
+		KeyName: keyName,
+		keys:    service.Projects.Locations.KeyRings.CryptoKeys,
+	}, nil
+}
+
+func (p *SGCPKeyProvider) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	resp, err := p.keys.Encrypt(p.KeyName, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(key),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("cloud kms encrypt failed: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Ciphertext)
+}
+
+func (p *SGCPKeyProvider) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	resp, err := p.keys.Decrypt(p.KeyName, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(wrapped),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("cloud kms decrypt failed: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
@@ -0,0 +1,98 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SVaultKeyProvider wraps data keys with a key of the Vault transit secrets
+// engine. Wrapped keys carry the version of the transit key, so it can be
+// rotated in Vault while older versions remain allowed for decryption by
+// its min_decryption_version.
+type SVaultKeyProvider struct {
+	// Address is the URL of Vault, e.g. https://vault:8200.
+	Address string
+	// Token authenticates with Vault, it needs the update capability on
+	// the encrypt and decrypt paths of the key.
+	Token string
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string
+	// Mount is the path the transit engine is mounted at, transit if empty.
+	Mount string
+	// KeyName is the name of the transit key.
+	KeyName string
+	Client  *http.Client
+}
+
+func (p *SVaultKeyProvider) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := p.call(ctx, "encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}, &out); err != nil {
+		return nil, err
+	}
+	return []byte(out.Ciphertext), nil
+}
+
+func (p *SVaultKeyProvider) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	if !bytes.HasPrefix(wrapped, []byte("vault:")) {
+		return nil, fmt.Errorf("data key is not wrapped by vault")
+	}
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := p.call(ctx, "decrypt", map[string]string{"ciphertext": string(wrapped)}, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+func (p *SVaultKeyProvider) call(ctx context.Context, operation string, in map[string]string, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	mount := strings.Trim(p.Mount, "/")
+	if mount == "" {
+		mount = "transit"
+	}
+	endpoint := strings.TrimSuffix(p.Address, "/") + "/v1/" + mount + "/" + operation + "/" + url.PathEscape(p.KeyName)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", p.Token)
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	_ = json.Unmarshal(data, &result)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault transit %s failed with status %d: %s", operation, resp.StatusCode, strings.Join(result.Errors, ", "))
+	}
+	return json.Unmarshal(result.Data, out)
+}
@@ -0,0 +1,177 @@
+package encrypted
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	tagSize         = 16
+	nonceSize       = 12
+	noncePrefixSize = 7
+)
+
+var tailAAD = []byte("tail")
+
+// sStream implements the segmented AES-256-GCM encryption of an upload. The
+// data is split into segments of segmentSize bytes which are sealed on their
+// own; the nonce of a segment consists of a random per upload prefix, the
+// segment index and a flag marking the last segment, so segments can neither
+// be reordered nor truncated unnoticed.
+type sStream struct {
+	aead        cipher.AEAD
+	noncePrefix []byte
+	segmentSize int64
+}
+
+func newStream(key, noncePrefix []byte, segmentSize int64) (*sStream, error) {
+	if len(noncePrefix) != noncePrefixSize {
+		return nil, fmt.Errorf("invalid nonce prefix")
+	}
+	if segmentSize <= 0 {
+		return nil, fmt.Errorf("invalid segment size %d", segmentSize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sStream{
+		aead:        aead,
+		noncePrefix: noncePrefix,
+		segmentSize: segmentSize,
+	}, nil
+}
+
+func (s *sStream) nonce(index int64, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, s.noncePrefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], uint32(index))
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+func (s *sStream) seal(index int64, last bool, plaintext []byte) []byte {
+	return s.aead.Seal(nil, s.nonce(index, last), plaintext, nil)
+}
+
+func (s *sStream) open(index int64, last bool, ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.aead.Open(nil, s.nonce(index, last), ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt segment %d: %w", index, err)
+	}
+	return plaintext, nil
+}
+
+// sealTail 未满一段的尾部数据使用随机nonce加密, 避免与正式分段的nonce重复
+func (s *sStream) sealTail(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, tailAAD), nil
+}
+
+func (s *sStream) openTail(data []byte) ([]byte, error) {
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("tail too short")
+	}
+	plaintext, err := s.aead.Open(nil, data[:nonceSize], data[nonceSize:], tailAAD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt tail: %w", err)
+	}
+	return plaintext, nil
+}
+
+// cipherSize 计算明文长度对应的密文长度
+func (s *sStream) cipherSize(size int64) int64 {
+	segments := (size + s.segmentSize - 1) / s.segmentSize
+	return size + segments*tagSize
+}
+
+// plainSize 计算密文长度对应的明文长度
+func (s *sStream) plainSize(size int64) int64 {
+	segments := (size + s.segmentSize + tagSize - 1) / (s.segmentSize + tagSize)
+	return size - segments*tagSize
+}
+
+// sDecryptReader 逐段解密密文流
+type sDecryptReader struct {
+	stream  *sStream
+	src     *bufio.Reader
+	closer  io.Closer
+	index   int64
+	segment []byte
+	buf     []byte
+	err     error
+}
+
+func newDecryptReader(stream *sStream, src io.ReadCloser) *sDecryptReader {
+	return &sDecryptReader{
+		stream:  stream,
+		src:     bufio.NewReader(src),
+		closer:  src,
+		segment: make([]byte, stream.segmentSize+tagSize),
+	}
+}
+
+func (r *sDecryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *sDecryptReader) next() error {
+	n, err := io.ReadFull(r.src, r.segment)
+	var last bool
+	switch {
+	case errors.Is(err, io.EOF):
+		if r.index == 0 {
+			// 空文件没有任何分段
+			return io.EOF
+		}
+		return fmt.Errorf("encrypted stream is truncated")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err = r.src.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plaintext, err := r.stream.open(r.index, last, r.segment[:n])
+	if err != nil {
+		return err
+	}
+	r.index++
+	r.buf = plaintext
+	if last {
+		return io.EOF
+	}
+	return nil
+}
+
+func (r *sDecryptReader) Close() error {
+	return r.closer.Close()
+}
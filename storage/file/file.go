@@ -2,7 +2,6 @@ package file
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -13,13 +12,12 @@ import (
 	"sync"
 	"time"
 
-	"gorm.io/datatypes"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 
 	"github.com/busybox-org/gin-fileuploader/common"
 	"github.com/busybox-org/gin-fileuploader/locker"
 	"github.com/busybox-org/gin-fileuploader/storage"
+	"github.com/busybox-org/gin-fileuploader/storage/metadata"
 )
 
 var (
@@ -32,90 +30,149 @@ var (
 	}
 )
 
-// FileUploadChunks GORM模型定义
-type FileUploadChunks struct {
-	ID           uint           `gorm:"primarykey" json:"id"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
-	FileID       string         `gorm:"primaryKey;uniqueIndex;size:255;comment:文件ID" json:"file_id"`
-	FileSize     int64          `gorm:"not null;comment:文件大小" json:"file_size"`
-	OffsetSize   int64          `gorm:"not null;default:0;comment:偏移量" json:"offset_size"`
-	IsPartial    bool           `gorm:"default:false;comment:是否为分片" json:"is_partial"`
-	MetadataInfo datatypes.JSON `gorm:"type:json;comment:元数据" json:"metadata_info"`
-	PartialIDs   datatypes.JSON `gorm:"type:json;comment:分片ID" json:"partial_ids"`
-}
-
-// TableName 指定表名
-func (FileUploadChunks) TableName() string {
-	return "file_upload_chunks"
-}
+// FileUploadChunks is kept for code referring to the model of the file store,
+// the metadata is now persisted by metadata.SGormMetaStore.
+type FileUploadChunks = metadata.FileUploadChunks
 
 type SFileStore struct {
-	Dir    string
-	db     *gorm.DB
+	Dir string
+	// ShardLevels is the number of directory levels the uploads are spread
+	// over, each level is named after the next two characters of the upload
+	// ID, e.g. with 2 levels "abcd1234" is stored as "ab/cd/abcd1234". 0
+	// keeps all uploads directly in Dir. Uploads in the flat layout are still
+	// found after enabling it, MigrateLayout moves them into place.
+	ShardLevels int
+	// Durable enables a mode for network file systems like NFS: chunks are
+	// written at explicit offsets instead of appending, every chunk is
+	// fsynced before its offset is committed and writers hold a fcntl lock
+	// on the file, which NFS, unlike flock, propagates to other clients.
+	Durable bool
+	// FlushBytes and FlushInterval batch the offset updates of the upload
+	// info: the offset is persisted once FlushBytes have been written or
+	// FlushInterval has passed since the first unpersisted chunk, and when
+	// the upload is complete. With both 0 it is persisted after every chunk.
+	// The size of the data file is authoritative, a lagging offset, e.g.
+	// after a crash, is corrected when the upload is loaded again.
+	FlushBytes    int64
+	FlushInterval time.Duration
+
+	meta   storage.IMetaStore
 	locker locker.ILocker
+
+	offsetMu sync.Mutex
+	// pendingOffsets 偏移量尚未持久化的上传
+	pendingOffsets map[string]*sPendingOffset
 }
 
+// New creates a file store keeping the upload info in the given database.
 func New(dir string, db *gorm.DB, locker locker.ILocker) (*SFileStore, error) {
+	meta, err := metadata.NewGorm(db)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithMetaStore(dir, meta, locker), nil
+}
+
+// NewWithMetaStore creates a file store keeping the upload info in meta.
+func NewWithMetaStore(dir string, meta storage.IMetaStore, locker locker.ILocker) *SFileStore {
 	_ = os.MkdirAll(dir, defaultDirectoryPerm)
 
-	store := &SFileStore{
-		Dir:    dir,
-		db:     db,
-		locker: locker,
+	return &SFileStore{
+		Dir:            dir,
+		meta:           meta,
+		locker:         locker,
+		pendingOffsets: make(map[string]*sPendingOffset),
 	}
+}
 
-	// 配置GORM
-	if err := store.configureGORM(); err != nil {
-		return nil, fmt.Errorf("failed to configure GORM: %w", err)
+func (store *SFileStore) binPath(id string) string {
+	// ID过短或前缀中含有目录分隔符时无法分片, 仍使用平铺布局
+	if store.ShardLevels <= 0 || len(id) < store.ShardLevels*2 || strings.Contains(id[:store.ShardLevels*2], "/") {
+		return store.flatPath(id)
+	}
+	elems := []string{store.Dir}
+	for i := 0; i < store.ShardLevels; i++ {
+		elems = append(elems, id[i*2:i*2+2])
 	}
+	return filepath.Join(append(elems, id)...)
+}
+
+func (store *SFileStore) flatPath(id string) string {
+	return filepath.Join(store.Dir, id)
+}
 
-	// 自动迁移
-	if err := store.autoMigrate(); err != nil {
-		return nil, fmt.Errorf("failed to migrate database: %w", err)
+// resolvePath 返回上传数据的实际路径, 尚未迁移的上传仍位于平铺布局中
+func (store *SFileStore) resolvePath(id string) string {
+	path, flatPath := store.binPath(id), store.flatPath(id)
+	if path == flatPath {
+		return path
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if _, err := os.Stat(flatPath); err == nil {
+		return flatPath
 	}
+	return path
+}
 
-	return store, nil
+func (store *SFileStore) newLock(id string) (locker.ILock, error) {
+	return store.locker.NewLock(strings.ReplaceAll(strings.TrimSpace(store.binPath(id)), "/", ":"))
 }
 
-// 配置GORM
-func (store *SFileStore) configureGORM() error {
-	if store.db.Dialector.Name() == "sqlite" {
-		// SQLite特殊配置
-		optimizations := []string{
-			"PRAGMA mode=rwc;",
-			"PRAGMA busy_timeout = 60000;",
-			"PRAGMA journal_mode = WAL;",
-			"PRAGMA synchronous = NORMAL;",
-			"PRAGMA cache = shared;",
-			"PRAGMA cache_spill = ON;",
-			"PRAGMA cache_size = -131072;",
-			"PRAGMA foreign_keys = ON;",
-			"PRAGMA temp_store = MEMORY;",
-			"PRAGMA mmap_size = 536870912;",
-			"PRAGMA wal_autocheckpoint = 1000;",
-			"PRAGMA locking_mode = NORMAL;",
-			"PRAGMA read_uncommitted = ON;",
-			"PRAGMA journal_size_limit=104857600;",
+// MigrateLayout moves the uploads still stored in the flat layout into the
+// sharded layout configured by ShardLevels and returns the number of moved
+// uploads. It is safe to run while the store is serving requests.
+func (store *SFileStore) MigrateLayout(ctx context.Context) (int, error) {
+	uploadIDs, err := store.ListUploads(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var migrated int
+	for _, uploadID := range uploadIDs {
+		ok, err := store.migrateUpload(ctx, uploadID)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to migrate upload %s: %w", uploadID, err)
 		}
-
-		for _, sqlStr := range optimizations {
-			if err := store.db.Exec(sqlStr).Error; err != nil {
-				fmt.Printf("Warning: failed to execute %s: %v\n", sqlStr, err)
-			}
+		if ok {
+			migrated++
 		}
-
 	}
-
-	return nil
+	return migrated, nil
 }
 
-func (store *SFileStore) autoMigrate() error {
-	return store.db.AutoMigrate(&FileUploadChunks{})
-}
+func (store *SFileStore) migrateUpload(ctx context.Context, id string) (bool, error) {
+	path, flatPath := store.binPath(id), store.flatPath(id)
+	if path == flatPath {
+		return false, nil
+	}
+	binLock, err := store.newLock(id)
+	if err != nil {
+		return false, err
+	}
+	if err = binLock.Lock(ctx); err != nil {
+		return false, err
+	}
+	defer binLock.Unlock()
 
-func (store *SFileStore) binPath(id string) string {
-	return filepath.Join(store.Dir, id)
+	stat, err := os.Stat(flatPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	// 平铺布局中带有"/"的ID对应的是目录, 不属于上传数据
+	if stat.IsDir() {
+		return false, nil
+	}
+	if err = os.MkdirAll(filepath.Dir(path), defaultDirectoryPerm); err != nil {
+		return false, err
+	}
+	if err = os.Rename(flatPath, path); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (store *SFileStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
@@ -128,8 +185,9 @@ func (store *SFileStore) NewUpload(ctx context.Context, info common.FileInfo) (s
 		binPath: store.binPath(info.ID),
 		store:   store,
 	}
+	upload.info.Storage = upload.location()
 
-	binLock, err := store.locker.NewLock(strings.ReplaceAll(strings.TrimSpace(upload.binPath), "/", ":"))
+	binLock, err := store.newLock(info.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -144,7 +202,7 @@ func (store *SFileStore) NewUpload(ctx context.Context, info common.FileInfo) (s
 		return nil, err
 	}
 
-	if err = upload.writeInfo(ctx); err != nil {
+	if err = store.meta.Create(ctx, upload.info); err != nil {
 		return nil, err
 	}
 
@@ -153,11 +211,11 @@ func (store *SFileStore) NewUpload(ctx context.Context, info common.FileInfo) (s
 
 func (store *SFileStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
 	upload := &sFileUpload{
-		binPath: store.binPath(id),
+		binPath: store.resolvePath(id),
 		store:   store,
 	}
 
-	binLock, err := store.locker.NewLock(strings.ReplaceAll(strings.TrimSpace(upload.binPath), "/", ":"))
+	binLock, err := store.newLock(id)
 	if err != nil {
 		return nil, err
 	}
@@ -171,8 +229,10 @@ func (store *SFileStore) GetUpload(ctx context.Context, id string) (storage.IUpl
 	if err != nil {
 		return nil, err
 	}
+	stored := upload.info.Offset
 	upload.info.Offset = stat.Size()
-	if upload.info.Offset != upload.info.Offset {
+	// 批量写入的偏移量尚未持久化时不视为不一致, 读取的信息可能已过期时不修正
+	if stored != upload.info.Offset && !store.offsetPending(id) && !storage.StaleReadsAllowed(ctx) {
 		if err = upload.updateOffset(ctx); err != nil {
 			return nil, err
 		}
@@ -208,31 +268,28 @@ func (store *SFileStore) cleanup(ctx context.Context, expiredBefore time.Duratio
 		return
 	}
 	defer lock.Unlock()
-	var (
-		expiredTime = time.Now().Add(-expiredBefore)
-		uploadIDs   []string
-	)
-
-	result := store.db.WithContext(ctx).
-		Model(&FileUploadChunks{}).
-		Select("file_id").
-		Where("created_at < ?", expiredTime).
-		Find(&uploadIDs)
-	if result.Error != nil {
-		fmt.Printf("failed to get expired uploads: %v\n", result.Error)
+	uploadIDs, err := store.meta.List(ctx, time.Now().Add(-expiredBefore))
+	if err != nil {
+		fmt.Printf("failed to get expired uploads: %v\n", err)
 		return
 	}
 
 	for _, uploadID := range uploadIDs {
-		err = os.RemoveAll(store.binPath(uploadID))
+		err = os.RemoveAll(store.resolvePath(uploadID))
 		if err != nil && !errors.Is(err, os.ErrNotExist) {
 			fmt.Printf("failed to remove expired upload: %v\n", err)
 			continue
 		}
-		store.db.WithContext(ctx).Where("file_id = ?", uploadID).Delete(&FileUploadChunks{})
+		if err = store.meta.Delete(ctx, uploadID); err != nil {
+			fmt.Printf("failed to remove expired upload: %v\n", err)
+		}
 	}
 }
 
+func (store *SFileStore) ListUploads(ctx context.Context) ([]string, error) {
+	return store.meta.List(ctx, time.Time{})
+}
+
 type sFileUpload struct {
 	binLock locker.ILock
 	info    common.FileInfo
@@ -241,85 +298,25 @@ type sFileUpload struct {
 }
 
 func (upload *sFileUpload) writeInfo(ctx context.Context) error {
-	var (
-		metadata   []byte
-		partialIDs []byte
-	)
-
-	if len(upload.info.PartialIDs) > 0 {
-		var err error
-		metadata, err = json.Marshal(upload.info.MetaData)
-		if err != nil {
-			return err
-		}
-	}
-	if len(upload.info.PartialIDs) > 0 {
-		var err error
-		partialIDs, err = json.Marshal(upload.info.PartialIDs)
-		if err != nil {
-			return err
-		}
-	}
-	info := &FileUploadChunks{
-		FileID:       upload.info.ID,
-		FileSize:     upload.info.Size,
-		OffsetSize:   upload.info.Offset,
-		IsPartial:    upload.info.IsPartial,
-		MetadataInfo: datatypes.JSON(metadata),
-		PartialIDs:   datatypes.JSON(partialIDs),
-	}
-	var doUpdates = []string{
-		"file_size",
-		"offset_size",
-		"is_partial",
-	}
-	if metadata != nil {
-		doUpdates = append(doUpdates, "metadata_info")
-	}
-	if partialIDs != nil {
-		doUpdates = append(doUpdates, "partial_ids")
-	}
-
-	result := upload.store.db.WithContext(ctx).
-		Clauses(clause.OnConflict{
-			Columns:   []clause.Column{{Name: "file_id"}},
-			DoUpdates: clause.AssignmentColumns(doUpdates),
-		}).Create(info)
-	return result.Error
+	return upload.store.meta.Update(ctx, upload.info)
 }
 
 func (upload *sFileUpload) readInfo(ctx context.Context, id string) error {
-	var info FileUploadChunks
-	result := upload.store.db.WithContext(ctx).Where("file_id = ?", id).First(&info)
-
-	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return fmt.Errorf("upload not found")
-		}
-		return result.Error
-	}
-	upload.info.ID = info.FileID
-	upload.info.Size = info.FileSize
-	upload.info.Offset = info.OffsetSize
-	upload.info.IsPartial = info.IsPartial
-
-	if len(info.MetadataInfo) > 0 {
-		if err := json.Unmarshal(info.MetadataInfo, &upload.info.MetaData); err != nil {
-			return err
-		}
-	}
-	if len(info.PartialIDs) > 0 {
-		if err := json.Unmarshal(info.PartialIDs, &upload.info.PartialIDs); err != nil {
-			return err
-		}
+	info, err := upload.store.meta.Get(ctx, id)
+	if err != nil {
+		return err
 	}
+	upload.info = info
 	return nil
 }
 
 func (upload *sFileUpload) updateOffset(ctx context.Context) error {
-	return upload.store.db.WithContext(ctx).Model(&FileUploadChunks{}).
-		Where("file_id = ?", upload.info.ID).
-		Update("offset_size", upload.info.Offset).Error
+	return upload.store.meta.Update(ctx, upload.info)
+}
+
+// refreshPath 上传可能已被MigrateLayout移动到分片目录中
+func (upload *sFileUpload) refreshPath() {
+	upload.binPath = upload.store.resolvePath(upload.info.ID)
 }
 
 func (upload *sFileUpload) createFile(path string, content []byte) error {
@@ -335,22 +332,62 @@ func (upload *sFileUpload) createFile(path string, content []byte) error {
 			return err
 		}
 	}
-	return file.Close()
+	if upload.store.Durable {
+		if err = file.Sync(); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if upload.store.Durable {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// syncDir 新建文件后同步目录项, 否则故障切换后文件可能不存在
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	return dir.Sync()
 }
 
 func (upload *sFileUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
 	if err := upload.readInfo(ctx, upload.info.ID); err != nil {
 		return common.FileInfo{}, err
 	}
+	upload.refreshPath()
 	stat, err := os.Stat(upload.binPath)
 	if err != nil {
 		return common.FileInfo{}, fmt.Errorf("upload not found")
 	}
 	upload.info.Offset = stat.Size()
+	// 分片布局迁移后路径会变化, 因此每次按实际路径返回
+	upload.info.Storage = upload.location()
 	return upload.info, nil
 }
 
+// location 返回数据文件的绝对路径, 钩子可以在上传完成后直接读取
+func (upload *sFileUpload) location() map[string]string {
+	path, err := filepath.Abs(upload.binPath)
+	if err != nil {
+		path = upload.binPath
+	}
+	return map[string]string{
+		"Type": "file",
+		"Path": path,
+	}
+}
+
 func (upload *sFileUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	upload.refreshPath()
 	return os.Open(upload.binPath)
 }
 
@@ -359,6 +396,10 @@ func (upload *sFileUpload) WriteChunk(ctx context.Context, offset int64, src io.
 		return 0, err
 	}
 	defer upload.binLock.Unlock()
+	upload.refreshPath()
+	if upload.store.Durable {
+		return upload.writeChunkDurable(ctx, offset, src)
+	}
 
 	file, err := os.OpenFile(upload.binPath, os.O_WRONLY|os.O_APPEND, defaultFilePerm)
 	if err != nil {
@@ -381,7 +422,46 @@ func (upload *sFileUpload) WriteChunk(ctx context.Context, offset int64, src io.
 	}
 
 	upload.info.Offset += n
-	return n, upload.writeInfo(ctx)
+	return n, upload.commitOffset(ctx, n)
+}
+
+// writeChunkDurable 按偏移量写入, 不依赖NFS客户端模拟的O_APPEND, 提交偏移量前fsync
+func (upload *sFileUpload) writeChunkDurable(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	file, err := os.OpenFile(upload.binPath, os.O_WRONLY, defaultFilePerm)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if err = lockFile(file); err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = unlockFile(file)
+	}()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if stat.Size() != offset {
+		return 0, fmt.Errorf("mismatched offset %d, upload has %d bytes", offset, stat.Size())
+	}
+
+	buffer := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buffer)
+
+	n, err := io.CopyBuffer(io.NewOffsetWriter(file, offset), src, buffer)
+	// 即使读取中断, 已写入的数据也需落盘
+	if serr := file.Sync(); err == nil {
+		err = serr
+	}
+	upload.info.Offset = offset + n
+	if err != nil {
+		return n, err
+	}
+	return n, upload.commitOffset(ctx, n)
 }
 
 func (upload *sFileUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) (err error) {
@@ -389,8 +469,13 @@ func (upload *sFileUpload) ConcatUploads(ctx context.Context, uploads []storage.
 		return err
 	}
 	defer upload.binLock.Unlock()
+	upload.refreshPath()
 
-	file, err := os.OpenFile(upload.binPath, os.O_WRONLY|os.O_APPEND, defaultFilePerm)
+	flag := os.O_WRONLY | os.O_APPEND
+	if upload.store.Durable {
+		flag = os.O_WRONLY
+	}
+	file, err := os.OpenFile(upload.binPath, flag, defaultFilePerm)
 	if err != nil {
 		return err
 	}
@@ -400,12 +485,26 @@ func (upload *sFileUpload) ConcatUploads(ctx context.Context, uploads []storage.
 			err = cerr
 		}
 	}()
+	if upload.store.Durable {
+		if err = lockFile(file); err != nil {
+			return err
+		}
+		defer func() {
+			_ = unlockFile(file)
+		}()
+	}
 
 	for _, partialUpload := range uploads {
 		_partialUpload := partialUpload.(*sFileUpload)
 		if err = _partialUpload.appendTo(ctx, file); err != nil {
 			return err
 		}
+		// 删除分片前确保合并的数据已落盘
+		if upload.store.Durable {
+			if err = file.Sync(); err != nil {
+				return err
+			}
+		}
 		if err = _partialUpload.Terminate(ctx); err != nil {
 			return err
 		}
@@ -427,6 +526,7 @@ func (upload *sFileUpload) appendTo(ctx context.Context, file *os.File) error {
 		return err
 	}
 	defer upload.binLock.Unlock()
+	upload.refreshPath()
 
 	src, err := os.Open(upload.binPath)
 	if err != nil {
@@ -447,22 +547,64 @@ func (upload *sFileUpload) ServeContent(ctx context.Context, w http.ResponseWrit
 		return err
 	}
 	defer upload.binLock.Unlock()
-	http.ServeFile(w, r, upload.binPath)
+	upload.refreshPath()
+	// ServeFile会处理目录和index.html, 这里只需按范围读取文件
+	file, err := os.Open(upload.binPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	http.ServeContent(w, r, "", stat.ModTime(), file)
 	return nil
 }
 
-func (upload *sFileUpload) Terminate(ctx context.Context) error {
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sFileUpload) DeclareLength(ctx context.Context, length int64) error {
 	if err := upload.binLock.Lock(ctx); err != nil {
 		return err
 	}
 	defer upload.binLock.Unlock()
+	upload.refreshPath()
 
-	err := upload.store.db.WithContext(ctx).Where("file_id = ?", upload.info.ID).Delete(&FileUploadChunks{}).Error
+	if err := upload.readInfo(ctx, upload.info.ID); err != nil {
+		return err
+	}
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	// 元数据中的偏移量可能尚未刷新, 以文件大小为准
+	stat, err := os.Stat(upload.binPath)
 	if err != nil {
 		return err
 	}
+	upload.info.Offset = stat.Size()
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sFileUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+	upload.refreshPath()
+
+	if err := upload.store.meta.Delete(ctx, upload.info.ID); err != nil {
+		return err
+	}
+	upload.store.dropPendingOffset(upload.info.ID)
 
-	err = os.RemoveAll(upload.binPath)
+	err := os.RemoveAll(upload.binPath)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
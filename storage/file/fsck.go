@@ -0,0 +1,210 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// FsckOrphanedFile is a file in the upload dir without metadata.
+	FsckOrphanedFile = "orphaned file"
+	// FsckMissingBlob is an upload whose data file is missing.
+	FsckMissingBlob = "missing blob"
+	// FsckOffsetMismatch is an upload whose stored offset differs from the
+	// size of its data file.
+	FsckOffsetMismatch = "offset mismatch"
+)
+
+// orphanGracePeriod 新建上传时先创建文件再写入元数据, 较新的文件可能属于进行中的创建
+const orphanGracePeriod = time.Minute
+
+// SFsckProblem is an inconsistency between the metadata and the upload dir.
+type SFsckProblem struct {
+	Kind     string
+	ID       string
+	Path     string
+	Detail   string
+	Repaired bool
+}
+
+// Fsck cross-checks the metadata against the files in the upload dir and
+// returns the problems found. With repair, orphaned files are removed,
+// uploads with a missing blob are deleted from the metadata and the stored
+// offset is set to the size of the data file, which is truncated first if
+// it exceeds the declared upload size. Entries starting with "." in the
+// upload dir, like the SQLite database, are not checked.
+func (store *SFileStore) Fsck(ctx context.Context, repair bool) ([]SFsckProblem, error) {
+	started := time.Now()
+	uploadIDs, err := store.meta.List(ctx, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []SFsckProblem
+	known := make(map[string]bool, len(uploadIDs))
+	for _, uploadID := range uploadIDs {
+		known[store.resolvePath(uploadID)] = true
+		problem, err := store.checkUpload(ctx, uploadID, repair)
+		if err != nil {
+			return problems, err
+		}
+		if problem != nil {
+			problems = append(problems, *problem)
+		}
+	}
+
+	err = filepath.WalkDir(store.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == store.Dir {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || known[path] {
+			return nil
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if stat.ModTime().After(started.Add(-orphanGracePeriod)) {
+			return nil
+		}
+		problem, err := store.checkOrphan(ctx, path, repair)
+		if err != nil {
+			return err
+		}
+		if problem != nil {
+			problems = append(problems, *problem)
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// checkUpload 在上传锁内检查单个上传, 检查期间上传可能已被删除
+func (store *SFileStore) checkUpload(ctx context.Context, id string, repair bool) (*SFsckProblem, error) {
+	lock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = lock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	info, err := store.meta.Get(ctx, id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	path := store.resolvePath(id)
+	stat, err := os.Stat(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		problem := &SFsckProblem{Kind: FsckMissingBlob, ID: id, Path: path}
+		if repair {
+			if err = store.meta.Delete(ctx, id); err != nil {
+				return nil, err
+			}
+			problem.Repaired = true
+		}
+		return problem, nil
+	}
+	if stat.IsDir() {
+		problem := &SFsckProblem{Kind: FsckMissingBlob, ID: id, Path: path, Detail: "path is a directory"}
+		if repair {
+			if err = store.meta.Delete(ctx, id); err != nil {
+				return nil, err
+			}
+			problem.Repaired = true
+		}
+		return problem, nil
+	}
+
+	size := stat.Size()
+	oversized := !info.SizeIsDeferred && size > info.Size
+	if size == info.Offset && !oversized {
+		return nil, nil
+	}
+	problem := &SFsckProblem{
+		Kind:   FsckOffsetMismatch,
+		ID:     id,
+		Path:   path,
+		Detail: fmt.Sprintf("stored offset %d, file size %d", info.Offset, size),
+	}
+	if oversized {
+		problem.Detail += fmt.Sprintf(", declared size %d", info.Size)
+	}
+	if repair {
+		if oversized {
+			if err = os.Truncate(path, info.Size); err != nil {
+				return nil, err
+			}
+			size = info.Size
+		}
+		info.Offset = size
+		if err = store.meta.Update(ctx, info); err != nil {
+			return nil, err
+		}
+		problem.Repaired = true
+	}
+	return problem, nil
+}
+
+// checkOrphan 删除前在上传锁内确认文件仍没有对应的元数据
+func (store *SFileStore) checkOrphan(ctx context.Context, path string, repair bool) (*SFsckProblem, error) {
+	id := store.pathID(path)
+	problem := &SFsckProblem{Kind: FsckOrphanedFile, ID: id, Path: path}
+	if !repair {
+		return problem, nil
+	}
+
+	lock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = lock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	if _, err = store.meta.Get(ctx, id); err == nil {
+		return nil, nil
+	} else if !strings.Contains(err.Error(), "not found") {
+		return nil, err
+	}
+	if err = os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	problem.Repaired = true
+	return problem, nil
+}
+
+// pathID 根据路径推断上传ID, 分片布局中为文件名, 平铺布局中为相对路径
+func (store *SFileStore) pathID(path string) string {
+	if id := filepath.Base(path); store.binPath(id) == path {
+		return id
+	}
+	rel, err := filepath.Rel(store.Dir, path)
+	if err != nil {
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,157 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// sPendingOffset 自上次持久化后写入的数据
+type sPendingOffset struct {
+	bytes int64
+	since time.Time
+}
+
+func (store *SFileStore) batchOffsets() bool {
+	return store.FlushBytes > 0 || store.FlushInterval > 0
+}
+
+func (store *SFileStore) offsetPending(id string) bool {
+	store.offsetMu.Lock()
+	defer store.offsetMu.Unlock()
+	_, ok := store.pendingOffsets[id]
+	return ok
+}
+
+func (store *SFileStore) dropPendingOffset(id string) {
+	store.offsetMu.Lock()
+	defer store.offsetMu.Unlock()
+	delete(store.pendingOffsets, id)
+}
+
+// commitOffset 写入n字节后按刷新策略持久化偏移量, 上传完成时总是持久化
+func (upload *sFileUpload) commitOffset(ctx context.Context, n int64) error {
+	store := upload.store
+	complete := !upload.info.SizeIsDeferred && upload.info.Offset >= upload.info.Size
+	if store.batchOffsets() && !complete {
+		store.offsetMu.Lock()
+		pending, ok := store.pendingOffsets[upload.info.ID]
+		if !ok {
+			pending = &sPendingOffset{since: time.Now()}
+			store.pendingOffsets[upload.info.ID] = pending
+		}
+		pending.bytes += n
+		due := (store.FlushBytes > 0 && pending.bytes >= store.FlushBytes) ||
+			(store.FlushInterval > 0 && time.Since(pending.since) >= store.FlushInterval)
+		store.offsetMu.Unlock()
+		if !due {
+			return nil
+		}
+	}
+	if err := upload.writeInfo(ctx); err != nil {
+		return err
+	}
+	store.dropPendingOffset(upload.info.ID)
+	return nil
+}
+
+// FlushOffsetsPeriodically persists the offsets pending for longer than
+// FlushInterval in the background until ctx is done, so the upload info of
+// idle uploads doesn't lag behind. It does nothing without FlushInterval.
+func (store *SFileStore) FlushOffsetsPeriodically(ctx context.Context) {
+	if store.FlushInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(store.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := store.flushOffsets(ctx, store.FlushInterval); err != nil {
+					fmt.Printf("failed to flush upload offsets: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// FlushOffsets persists all pending offsets, it should be called on shutdown
+// after the last chunk has been written.
+func (store *SFileStore) FlushOffsets(ctx context.Context) error {
+	return store.flushOffsets(ctx, 0)
+}
+
+func (store *SFileStore) flushOffsets(ctx context.Context, age time.Duration) error {
+	store.offsetMu.Lock()
+	var uploadIDs []string
+	for id, pending := range store.pendingOffsets {
+		if time.Since(pending.since) >= age {
+			uploadIDs = append(uploadIDs, id)
+		}
+	}
+	store.offsetMu.Unlock()
+
+	var errs []error
+	for _, uploadID := range uploadIDs {
+		if err := store.flushOffset(ctx, uploadID); err != nil {
+			errs = append(errs, fmt.Errorf("upload %s: %w", uploadID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flushOffset 以文件大小为准写入偏移量. 元数据存储支持单独更新偏移量时不获取上传锁,
+// 以免中断正在进行的写入
+func (store *SFileStore) flushOffset(ctx context.Context, id string) error {
+	store.dropPendingOffset(id)
+	if updater, ok := store.meta.(storage.IOffsetUpdater); ok {
+		size, err := store.fileSize(id)
+		if err != nil || size < 0 {
+			return err
+		}
+		return updater.UpdateOffset(ctx, id, size)
+	}
+
+	// 否则需持有上传锁, 以免覆盖并发修改的大小等信息
+	lock, err := store.newLock(id)
+	if err != nil {
+		return err
+	}
+	if err = lock.Lock(ctx); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	info, err := store.meta.Get(ctx, id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil
+		}
+		return err
+	}
+	size, err := store.fileSize(id)
+	if err != nil || size < 0 || info.Offset == size {
+		return err
+	}
+	info.Offset = size
+	return store.meta.Update(ctx, info)
+}
+
+// fileSize 返回上传数据的大小, 文件不存在时返回-1
+func (store *SFileStore) fileSize(id string) (int64, error) {
+	stat, err := os.Stat(store.resolvePath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return -1, nil
+		}
+		return 0, err
+	}
+	return stat.Size(), nil
+}
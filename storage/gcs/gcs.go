@@ -0,0 +1,563 @@
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// maxComposeSources GCS单次compose最多32个源对象
+const maxComposeSources = 32
+
+// SGCSStore stores uploads in a Google Cloud Storage bucket. Every tus chunk
+// is written as its own object ("<id>_<n>") and all chunks are composed into
+// the final object once the upload is complete, so interrupted uploads can be
+// resumed from any server instance.
+//
+// The upload info is kept in a "<id>.info" object, no database is required.
+type SGCSStore struct {
+	Bucket string
+	// ObjectPrefix is prepended to every object key, e.g. "uploads/".
+	ObjectPrefix string
+
+	client *gcs.Client
+	locker locker.ILocker
+}
+
+// New creates a new store. The client is typically created with
+// gcs.NewClient, which reads credentials via Application Default Credentials.
+func New(bucket string, client *gcs.Client, locker locker.ILocker) (*SGCSStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	return &SGCSStore{
+		Bucket: bucket,
+		client: client,
+		locker: locker,
+	}, nil
+}
+
+func (store *SGCSStore) object(key string) *gcs.ObjectHandle {
+	return store.client.Bucket(store.Bucket).Object(path.Join(store.ObjectPrefix, key))
+}
+
+func (store *SGCSStore) binObject(id string) *gcs.ObjectHandle {
+	return store.object(id)
+}
+
+func (store *SGCSStore) infoObject(id string) *gcs.ObjectHandle {
+	return store.object(id + ".info")
+}
+
+func (store *SGCSStore) chunkPrefix(id string) string {
+	return path.Join(store.ObjectPrefix, id) + "_"
+}
+
+func (store *SGCSStore) newLock(id string) (locker.ILock, error) {
+	return store.locker.NewLock("gcs:" + store.Bucket + ":" + strings.ReplaceAll(path.Join(store.ObjectPrefix, id), "/", ":"))
+}
+
+func (store *SGCSStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	info.Storage = map[string]string{
+		"Type":   "gcs",
+		"Bucket": store.Bucket,
+		"Key":    path.Join(store.ObjectPrefix, info.ID),
+	}
+
+	upload := &sGCSUpload{
+		info:  info,
+		store: store,
+	}
+	binLock, err := store.newLock(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer upload.binLock.Unlock()
+
+	if err = upload.writeInfo(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SGCSStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	upload := &sGCSUpload{
+		info:  common.FileInfo{ID: id},
+		store: store,
+	}
+	binLock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.readInfo(ctx); err != nil {
+		return nil, err
+	}
+	if err = upload.readOffset(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SGCSStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(ctx, expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SGCSStore) cleanup(ctx context.Context, expiredBefore time.Duration) {
+	lock, err := store.locker.NewLock("gcs:" + store.Bucket + ":cleanup")
+	if err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	if err = lock.Lock(ctx); err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
+	expiredTime := time.Now().Add(-expiredBefore)
+	it := store.client.Bucket(store.Bucket).Objects(ctx, &gcs.Query{Prefix: store.ObjectPrefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("failed to list expired uploads: %v\n", err)
+			return
+		}
+		if !strings.HasSuffix(attrs.Name, ".info") || attrs.Created.After(expiredTime) {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(attrs.Name, store.ObjectPrefix), "/"), ".info")
+		upload, err := store.GetUpload(ctx, id)
+		if err != nil {
+			fmt.Printf("failed to get expired upload: %v\n", err)
+			continue
+		}
+		if err = upload.Terminate(ctx); err != nil {
+			fmt.Printf("failed to remove expired upload: %v\n", err)
+		}
+	}
+}
+
+func (store *SGCSStore) ListUploads(ctx context.Context) ([]string, error) {
+	var ids []string
+	it := store.client.Bucket(store.Bucket).Objects(ctx, &gcs.Query{Prefix: store.ObjectPrefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return ids, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(attrs.Name, ".info") {
+			ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(attrs.Name, store.ObjectPrefix), "/"), ".info"))
+		}
+	}
+}
+
+type sGCSUpload struct {
+	binLock locker.ILock
+	info    common.FileInfo
+	store   *SGCSStore
+}
+
+func (upload *sGCSUpload) writeInfo(ctx context.Context) error {
+	data, err := json.Marshal(upload.info)
+	if err != nil {
+		return err
+	}
+	w := upload.store.infoObject(upload.info.ID).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err = w.Write(data); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (upload *sGCSUpload) readInfo(ctx context.Context) error {
+	r, err := upload.store.infoObject(upload.info.ID).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return json.NewDecoder(r).Decode(&upload.info)
+}
+
+// readOffset 偏移量为所有分块对象大小之和, 已完成的上传直接取最终对象大小
+func (upload *sGCSUpload) readOffset(ctx context.Context) error {
+	chunks, err := upload.listChunks(ctx)
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		attrs, err := upload.store.binObject(upload.info.ID).Attrs(ctx)
+		if err == nil {
+			upload.info.Offset = attrs.Size
+			return nil
+		}
+		if !errors.Is(err, gcs.ErrObjectNotExist) {
+			return err
+		}
+	}
+
+	var offset int64
+	for _, chunk := range chunks {
+		offset += chunk.size
+	}
+	upload.info.Offset = offset
+	return nil
+}
+
+type gcsChunk struct {
+	name  string
+	index int
+	size  int64
+}
+
+// listChunks 按序号返回所有分块对象
+func (upload *sGCSUpload) listChunks(ctx context.Context) ([]gcsChunk, error) {
+	prefix := upload.store.chunkPrefix(upload.info.ID)
+	it := upload.store.client.Bucket(upload.store.Bucket).Objects(ctx, &gcs.Query{Prefix: prefix})
+
+	var chunks []gcsChunk
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(attrs.Name, prefix))
+		if err != nil {
+			// 不是本上传的分块, 例如ID为本ID前缀的其他上传
+			continue
+		}
+		chunks = append(chunks, gcsChunk{name: attrs.Name, index: index, size: attrs.Size})
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].index < chunks[j].index
+	})
+	return chunks, nil
+}
+
+func (upload *sGCSUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	if err := upload.readInfo(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	if err := upload.readOffset(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	return upload.info, nil
+}
+
+func (upload *sGCSUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	r, err := upload.store.binObject(upload.info.ID).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return nil, fmt.Errorf("upload not found")
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+func (upload *sGCSUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	// 已合并的上传再写入分块会在complete时覆盖最终对象
+	if err := upload.readOffset(ctx); err != nil {
+		return 0, err
+	}
+	if !upload.info.SizeIsDeferred && upload.info.Offset >= upload.info.Size {
+		return 0, storage.ErrUploadCompleted
+	}
+
+	chunks, err := upload.listChunks(ctx)
+	if err != nil {
+		return 0, err
+	}
+	index := 0
+	if len(chunks) > 0 {
+		index = chunks[len(chunks)-1].index + 1
+	}
+
+	name := upload.store.chunkPrefix(upload.info.ID) + strconv.Itoa(index)
+	// 取消wctx后Close会丢弃写入, 不会留下不完整的分块
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := upload.store.client.Bucket(upload.store.Bucket).Object(name).NewWriter(wctx)
+	n, err := io.Copy(w, src)
+	if err != nil {
+		cancel()
+		_ = w.Close()
+		return 0, err
+	}
+	if err = w.Close(); err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		// 空分块没有意义, 删除以免影响compose
+		_ = upload.store.client.Bucket(upload.store.Bucket).Object(name).Delete(ctx)
+	}
+
+	upload.info.Offset = offset + n
+	if !upload.info.SizeIsDeferred && upload.info.Offset >= upload.info.Size {
+		if err = upload.complete(ctx); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// complete 将所有分块合并为最终对象并删除分块
+func (upload *sGCSUpload) complete(ctx context.Context) error {
+	chunks, err := upload.listChunks(ctx)
+	if err != nil {
+		return err
+	}
+	srcs := make([]*gcs.ObjectHandle, 0, len(chunks))
+	for _, chunk := range chunks {
+		srcs = append(srcs, upload.store.client.Bucket(upload.store.Bucket).Object(chunk.name))
+	}
+	if err = upload.compose(ctx, srcs); err != nil {
+		return err
+	}
+	for _, src := range srcs {
+		if err = src.Delete(ctx); err != nil && !errors.Is(err, gcs.ErrObjectNotExist) {
+			return err
+		}
+	}
+	return upload.writeInfo(ctx)
+}
+
+// compose 分批合并源对象, 每批最多32个, 后续批次以已合并的对象作为第一个源
+func (upload *sGCSUpload) compose(ctx context.Context, srcs []*gcs.ObjectHandle) error {
+	dst := upload.store.binObject(upload.info.ID)
+	if len(srcs) == 0 {
+		// 空文件
+		w := dst.NewWriter(ctx)
+		return w.Close()
+	}
+
+	first := true
+	for len(srcs) > 0 {
+		limit := maxComposeSources
+		var batch []*gcs.ObjectHandle
+		if !first {
+			batch = append(batch, dst)
+			limit--
+		}
+		if len(srcs) < limit {
+			limit = len(srcs)
+		}
+		batch = append(batch, srcs[:limit]...)
+		srcs = srcs[limit:]
+
+		composer := dst.ComposerFrom(batch...)
+		if filetype, ok := upload.info.MetaData["filetype"]; ok && first {
+			composer.ContentType = filetype
+		}
+		if _, err := composer.Run(ctx); err != nil {
+			return fmt.Errorf("failed to compose upload %s: %w", upload.info.ID, err)
+		}
+		first = false
+	}
+	return nil
+}
+
+func (upload *sGCSUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	var size int64
+	srcs := make([]*gcs.ObjectHandle, 0, len(uploads))
+	for _, partialUpload := range uploads {
+		_partialUpload := partialUpload.(*sGCSUpload)
+		srcs = append(srcs, upload.store.binObject(_partialUpload.info.ID))
+		size += _partialUpload.info.Size
+	}
+	if err := upload.compose(ctx, srcs); err != nil {
+		return err
+	}
+
+	upload.info.Size = size
+	upload.info.Offset = size
+	if err := upload.writeInfo(ctx); err != nil {
+		return err
+	}
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (upload *sGCSUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	obj := upload.store.binObject(upload.info.ID)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	w.Header().Set("ETag", strconv.Quote(attrs.Etag))
+
+	rs := &sRangeReadSeeker{ctx: ctx, obj: obj, size: attrs.Size}
+	defer rs.Close()
+	http.ServeContent(w, r, "", attrs.Updated, rs)
+	return nil
+}
+
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sGCSUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.readInfo(ctx); err != nil {
+		return err
+	}
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sGCSUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	chunks, err := upload.listChunks(ctx)
+	if err != nil {
+		return err
+	}
+	objects := []*gcs.ObjectHandle{
+		upload.store.binObject(upload.info.ID),
+		upload.store.infoObject(upload.info.ID),
+	}
+	for _, chunk := range chunks {
+		objects = append(objects, upload.store.client.Bucket(upload.store.Bucket).Object(chunk.name))
+	}
+	for _, obj := range objects {
+		if err = obj.Delete(ctx); err != nil && !errors.Is(err, gcs.ErrObjectNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sRangeReadSeeker 基于range读取实现io.ReadSeeker, 供http.ServeContent使用
+type sRangeReadSeeker struct {
+	ctx    context.Context
+	obj    *gcs.ObjectHandle
+	size   int64
+	pos    int64
+	reader *gcs.Reader
+}
+
+func (rs *sRangeReadSeeker) Read(p []byte) (int, error) {
+	if rs.pos >= rs.size {
+		return 0, io.EOF
+	}
+	if rs.reader == nil {
+		reader, err := rs.obj.NewRangeReader(rs.ctx, rs.pos, -1)
+		if err != nil {
+			return 0, err
+		}
+		rs.reader = reader
+	}
+	n, err := rs.reader.Read(p)
+	rs.pos += int64(n)
+	return n, err
+}
+
+func (rs *sRangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = rs.pos + offset
+	case io.SeekEnd:
+		pos = rs.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position: %d", pos)
+	}
+	if pos != rs.pos {
+		rs.Close()
+		rs.pos = pos
+	}
+	return pos, nil
+}
+
+func (rs *sRangeReadSeeker) Close() {
+	if rs.reader != nil {
+		_ = rs.reader.Close()
+		rs.reader = nil
+	}
+}
@@ -0,0 +1,366 @@
+package hdfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/colinmarc/hdfs/v2"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// SHDFSStore appends uploads to files in HDFS as the chunks arrive. The
+// offset of an upload is derived from the length of the HDFS file, the upload
+// info is kept in a "<id>.info" file next to it.
+//
+// The HDFS path of an upload is exposed via FileInfo.Storage, so hooks can
+// pick up the data once the upload is finished.
+type SHDFSStore struct {
+	// Dir is the HDFS directory uploads are written to.
+	Dir string
+
+	client *hdfs.Client
+	locker locker.ILocker
+}
+
+func New(dir string, client *hdfs.Client, locker locker.ILocker) (*SHDFSStore, error) {
+	if err := client.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create hdfs directory %s: %w", dir, err)
+	}
+	return &SHDFSStore{
+		Dir:    dir,
+		client: client,
+		locker: locker,
+	}, nil
+}
+
+func (store *SHDFSStore) binPath(id string) string {
+	return path.Join(store.Dir, id)
+}
+
+func (store *SHDFSStore) infoPath(id string) string {
+	return path.Join(store.Dir, id+".info")
+}
+
+func (store *SHDFSStore) newLock(id string) (locker.ILock, error) {
+	return store.locker.NewLock("hdfs:" + strings.ReplaceAll(store.binPath(id), "/", ":"))
+}
+
+func (store *SHDFSStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	info.Storage = map[string]string{
+		"Type": "hdfs",
+		"Path": store.binPath(info.ID),
+	}
+
+	upload := &sHDFSUpload{
+		info:    info,
+		binPath: store.binPath(info.ID),
+		store:   store,
+	}
+	binLock, err := store.newLock(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer upload.binLock.Unlock()
+
+	file, err := store.client.Create(upload.binPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = closeWriter(file); err != nil {
+		return nil, err
+	}
+
+	if err = upload.writeInfo(); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SHDFSStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	upload := &sHDFSUpload{
+		info:    common.FileInfo{ID: id},
+		binPath: store.binPath(id),
+		store:   store,
+	}
+	binLock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if _, err = upload.GetInfo(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SHDFSStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(ctx, expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SHDFSStore) cleanup(ctx context.Context, expiredBefore time.Duration) {
+	lock, err := store.locker.NewLock("hdfs:" + strings.ReplaceAll(store.Dir, "/", ":") + ":cleanup")
+	if err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	if err = lock.Lock(ctx); err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
+	entries, err := store.client.ReadDir(store.Dir)
+	if err != nil {
+		fmt.Printf("failed to list expired uploads: %v\n", err)
+		return
+	}
+	expiredTime := time.Now().Add(-expiredBefore)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".info") || entry.ModTime().After(expiredTime) {
+			continue
+		}
+		upload, err := store.GetUpload(ctx, strings.TrimSuffix(entry.Name(), ".info"))
+		if err != nil {
+			fmt.Printf("failed to get expired upload: %v\n", err)
+			continue
+		}
+		if err = upload.Terminate(ctx); err != nil {
+			fmt.Printf("failed to remove expired upload: %v\n", err)
+		}
+	}
+}
+
+type sHDFSUpload struct {
+	binLock locker.ILock
+	info    common.FileInfo
+	binPath string
+	store   *SHDFSStore
+}
+
+// writeInfo HDFS文件不能覆盖写, 先写入临时文件再重命名
+func (upload *sHDFSUpload) writeInfo() error {
+	data, err := json.Marshal(upload.info)
+	if err != nil {
+		return err
+	}
+	infoPath := upload.store.infoPath(upload.info.ID)
+	tmpPath := infoPath + ".tmp"
+	if err = upload.store.client.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	file, err := upload.store.client.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = closeWriter(file); err != nil {
+		return err
+	}
+	return upload.store.client.Rename(tmpPath, infoPath)
+}
+
+func (upload *sHDFSUpload) readInfo() error {
+	file, err := upload.store.client.Open(upload.store.infoPath(upload.info.ID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return json.NewDecoder(file).Decode(&upload.info)
+}
+
+func (upload *sHDFSUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	if err := upload.readInfo(); err != nil {
+		return common.FileInfo{}, err
+	}
+	// 偏移量以HDFS文件长度为准
+	stat, err := upload.store.client.Stat(upload.binPath)
+	if err != nil {
+		return common.FileInfo{}, fmt.Errorf("upload not found")
+	}
+	upload.info.Offset = stat.Size()
+	return upload.info, nil
+}
+
+func (upload *sHDFSUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	return upload.store.client.Open(upload.binPath)
+}
+
+func (upload *sHDFSUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	// HDFS只支持追加写入
+	stat, err := upload.store.client.Stat(upload.binPath)
+	if err != nil {
+		return 0, err
+	}
+	if !upload.info.SizeIsDeferred && stat.Size() >= upload.info.Size {
+		return 0, storage.ErrUploadCompleted
+	}
+	if stat.Size() != offset {
+		return 0, fmt.Errorf("mismatched offset %d, hdfs file has %d bytes", offset, stat.Size())
+	}
+
+	file, err := upload.store.client.Append(upload.binPath)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(file, src)
+	if cerr := closeWriter(file); err == nil {
+		err = cerr
+	}
+	upload.info.Offset = offset + n
+	return n, err
+}
+
+func (upload *sHDFSUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) (err error) {
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	file, err := upload.store.client.Append(upload.binPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := closeWriter(file)
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	var size int64
+	for _, partialUpload := range uploads {
+		_partialUpload := partialUpload.(*sHDFSUpload)
+		n, err := _partialUpload.appendTo(ctx, file)
+		if err != nil {
+			return err
+		}
+		size += n
+		if err = _partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+
+	upload.info.Size = size
+	upload.info.Offset = size
+	return upload.writeInfo()
+}
+
+func (upload *sHDFSUpload) appendTo(ctx context.Context, dst io.Writer) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	src, err := upload.store.client.Open(upload.binPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	return io.Copy(dst, src)
+}
+
+func (upload *sHDFSUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	file, err := upload.store.client.Open(upload.binPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	http.ServeContent(w, r, "", file.Stat().ModTime(), file)
+	return nil
+}
+
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sHDFSUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.readInfo(); err != nil {
+		return err
+	}
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo()
+}
+
+func (upload *sHDFSUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	for _, p := range []string{upload.store.infoPath(upload.info.ID), upload.binPath} {
+		if err := upload.store.client.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeWriter 关闭文件, namenode仍在复制最后一个块时需要重试
+func closeWriter(file *hdfs.FileWriter) error {
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = file.Close(); !errors.Is(err, hdfs.ErrReplicating) {
+			return err
+		}
+		time.Sleep(time.Duration(i+1) * 100 * time.Millisecond)
+	}
+	return err
+}
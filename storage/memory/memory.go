@@ -0,0 +1,195 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// SMemoryStore keeps uploads in memory. It has no disk or database
+// dependencies and is meant for tests and demos; all data is lost when the
+// process exits.
+type SMemoryStore struct {
+	uploads map[string]*sMemoryUpload
+	mutex   sync.RWMutex
+}
+
+// New creates a new in-memory store.
+func New() *SMemoryStore {
+	return &SMemoryStore{
+		uploads: make(map[string]*sMemoryUpload),
+	}
+}
+
+func (store *SMemoryStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	info.Storage = map[string]string{
+		"Type": "memory",
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.uploads[info.ID]; ok {
+		return nil, fmt.Errorf("upload %s already exists", info.ID)
+	}
+	upload := &sMemoryUpload{
+		info:    info,
+		modTime: info.CreateTime,
+		store:   store,
+	}
+	store.uploads[info.ID] = upload
+	return upload, nil
+}
+
+func (store *SMemoryStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	upload, ok := store.uploads[id]
+	if !ok {
+		return nil, fmt.Errorf("upload not found")
+	}
+	return upload, nil
+}
+
+func (store *SMemoryStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SMemoryStore) cleanup(expiredBefore time.Duration) {
+	expiredTime := time.Now().Add(-expiredBefore)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for id, upload := range store.uploads {
+		upload.mutex.RLock()
+		expired := upload.modTime.Before(expiredTime)
+		upload.mutex.RUnlock()
+		if expired {
+			delete(store.uploads, id)
+		}
+	}
+}
+
+func (store *SMemoryStore) ListUploads(ctx context.Context) ([]string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	ids := make([]string, 0, len(store.uploads))
+	for id := range store.uploads {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+type sMemoryUpload struct {
+	info    common.FileInfo
+	data    []byte
+	modTime time.Time
+	mutex   sync.RWMutex
+	store   *SMemoryStore
+}
+
+func (upload *sMemoryUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	upload.mutex.RLock()
+	defer upload.mutex.RUnlock()
+	return upload.info, nil
+}
+
+func (upload *sMemoryUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(upload.bytes())), nil
+}
+
+// bytes 返回当前数据的只读视图, 之后的写入只会追加, 不会修改已返回的部分
+func (upload *sMemoryUpload) bytes() []byte {
+	upload.mutex.RLock()
+	defer upload.mutex.RUnlock()
+	return upload.data[:len(upload.data):len(upload.data)]
+}
+
+func (upload *sMemoryUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	data, err := io.ReadAll(src)
+
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+	if !upload.info.SizeIsDeferred && int64(len(upload.data)) >= upload.info.Size {
+		return 0, storage.ErrUploadCompleted
+	}
+	if offset != int64(len(upload.data)) {
+		return 0, fmt.Errorf("mismatched offset %d, upload has %d bytes", offset, len(upload.data))
+	}
+	upload.data = append(upload.data, data...)
+	upload.info.Offset = int64(len(upload.data))
+	upload.modTime = time.Now()
+	return int64(len(data)), err
+}
+
+func (upload *sMemoryUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	// 直接追加各分片的数据, 不再额外复制一份
+	upload.mutex.Lock()
+	for _, partialUpload := range uploads {
+		_partialUpload := partialUpload.(*sMemoryUpload)
+		_partialUpload.mutex.RLock()
+		upload.data = append(upload.data, _partialUpload.data...)
+		_partialUpload.mutex.RUnlock()
+	}
+	upload.info.Size = int64(len(upload.data))
+	upload.info.Offset = upload.info.Size
+	upload.modTime = time.Now()
+	upload.mutex.Unlock()
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (upload *sMemoryUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	upload.mutex.RLock()
+	modTime := upload.modTime
+	upload.mutex.RUnlock()
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(upload.bytes()))
+	return nil
+}
+
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sMemoryUpload) DeclareLength(ctx context.Context, length int64) error {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return nil
+}
+
+func (upload *sMemoryUpload) Terminate(ctx context.Context) error {
+	upload.store.mutex.Lock()
+	defer upload.store.mutex.Unlock()
+	delete(upload.store.uploads, upload.info.ID)
+	return nil
+}
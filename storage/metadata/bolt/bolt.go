@@ -0,0 +1,187 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+var (
+	uploadsBucket = []byte("uploads")
+	// createdBucket 按创建时间索引上传, 键为8字节大端序时间戳加上传ID
+	createdBucket = []byte("created")
+)
+
+// SBoltMetaStore keeps the upload info in an embedded BoltDB file, which is
+// durable and pure Go like SQLite but has a single writer without lock
+// contention between connections. The file is locked by the process, so it
+// suits single node deployments only.
+type SBoltMetaStore struct {
+	db *bbolt.DB
+}
+
+// New opens or creates the BoltDB file at path.
+func New(path string) (*SBoltMetaStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path, os.FileMode(0600), &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{uploadsBucket, createdBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &SBoltMetaStore{
+		db: db,
+	}, nil
+}
+
+// Close closes the database file.
+func (store *SBoltMetaStore) Close() error {
+	return store.db.Close()
+}
+
+func createdKey(createTime time.Time, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(createTime.UnixNano()))
+	return append(key, id...)
+}
+
+func (store *SBoltMetaStore) Create(_ context.Context, info common.FileInfo) error {
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bbolt.Tx) error {
+		uploads, created := tx.Bucket(uploadsBucket), tx.Bucket(createdBucket)
+		// 覆盖已有记录时移除旧的索引
+		if old := uploads.Get([]byte(info.ID)); old != nil {
+			var oldInfo common.FileInfo
+			if err := json.Unmarshal(old, &oldInfo); err == nil {
+				if err = created.Delete(createdKey(oldInfo.CreateTime, oldInfo.ID)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := uploads.Put([]byte(info.ID), data); err != nil {
+			return err
+		}
+		return created.Put(createdKey(info.CreateTime, info.ID), nil)
+	})
+}
+
+func (store *SBoltMetaStore) Get(_ context.Context, id string) (common.FileInfo, error) {
+	var info common.FileInfo
+	err := store.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(uploadsBucket).Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("upload not found")
+		}
+		return json.Unmarshal(data, &info)
+	})
+	return info, err
+}
+
+func (store *SBoltMetaStore) Update(_ context.Context, info common.FileInfo) error {
+	return store.db.Update(func(tx *bbolt.Tx) error {
+		uploads := tx.Bucket(uploadsBucket)
+		old := uploads.Get([]byte(info.ID))
+		if old == nil {
+			return fmt.Errorf("upload not found")
+		}
+		// 创建时间只在Create时写入, 与索引保持一致
+		var oldInfo common.FileInfo
+		if err := json.Unmarshal(old, &oldInfo); err != nil {
+			return err
+		}
+		info.CreateTime = oldInfo.CreateTime
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		return uploads.Put([]byte(info.ID), data)
+	})
+}
+
+// UpdateOffset raises the offset of the upload with id, see
+// storage.IOffsetUpdater.
+func (store *SBoltMetaStore) UpdateOffset(_ context.Context, id string, offset int64) error {
+	return store.db.Update(func(tx *bbolt.Tx) error {
+		uploads := tx.Bucket(uploadsBucket)
+		data := uploads.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var info common.FileInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return err
+		}
+		if info.Offset >= offset {
+			return nil
+		}
+		info.Offset = offset
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		return uploads.Put([]byte(id), data)
+	})
+}
+
+func (store *SBoltMetaStore) List(_ context.Context, createdBefore time.Time) ([]string, error) {
+	var ids []string
+	err := store.db.View(func(tx *bbolt.Tx) error {
+		var end []byte
+		if !createdBefore.IsZero() {
+			end = createdKey(createdBefore, "")
+		}
+		cursor := tx.Bucket(createdBucket).Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			if end != nil && bytes.Compare(key, end) >= 0 {
+				break
+			}
+			ids = append(ids, string(key[8:]))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (store *SBoltMetaStore) Delete(_ context.Context, id string) error {
+	return store.db.Update(func(tx *bbolt.Tx) error {
+		uploads := tx.Bucket(uploadsBucket)
+		data := uploads.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var info common.FileInfo
+		if err := json.Unmarshal(data, &info); err == nil {
+			if err = tx.Bucket(createdBucket).Delete(createdKey(info.CreateTime, id)); err != nil {
+				return err
+			}
+		}
+		return uploads.Delete([]byte(id))
+	})
+}
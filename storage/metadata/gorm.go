@@ -0,0 +1,265 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// FileUploadChunks GORM模型定义, 表结构由migrations维护, 修改字段时需追加迁移
+type FileUploadChunks struct {
+	ID             uint           `gorm:"primarykey" json:"id"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	FileID         string         `gorm:"primaryKey;uniqueIndex;size:255;comment:文件ID" json:"file_id"`
+	FileSize       int64          `gorm:"not null;comment:文件大小" json:"file_size"`
+	SizeIsDeferred bool           `gorm:"default:false;comment:是否延迟声明大小" json:"size_is_deferred"`
+	OffsetSize     int64          `gorm:"not null;default:0;comment:偏移量" json:"offset_size"`
+	IsPartial      bool           `gorm:"default:false;comment:是否为分片" json:"is_partial"`
+	IsFinal        bool           `gorm:"default:false;comment:是否为合并后的文件" json:"is_final"`
+	MetadataInfo   datatypes.JSON `gorm:"type:json;comment:元数据" json:"metadata_info"`
+	PartialIDs     datatypes.JSON `gorm:"type:json;comment:分片ID" json:"partial_ids"`
+	StorageInfo    datatypes.JSON `gorm:"type:json;comment:存储后端信息" json:"storage_info"`
+}
+
+// TableName 指定表名
+func (FileUploadChunks) TableName() string {
+	return "file_upload_chunks"
+}
+
+// SGormMetaStore keeps the upload info in a SQL database using gorm, it can
+// be shared by multiple instances when the database is a server. SQLite only
+// allows a single writer, writes to it are therefore queued in the store
+// instead of competing for the database lock.
+type SGormMetaStore struct {
+	db *gorm.DB
+	// replica 只读副本, 为空时读取主库
+	replica *gorm.DB
+	// writeMu 串行化SQLite的写入
+	writeMu      sync.Mutex
+	serialWrites bool
+}
+
+func NewGorm(db *gorm.DB) (*SGormMetaStore, error) {
+	return NewGormWithReplica(db, nil)
+}
+
+// NewGormWithReplica creates a store which sends the queries of Get and List
+// to the read replica if their context allows it (see
+// storage.WithStaleReads), all other queries and writes go to the primary
+// db. Replication lag can make these reads return an outdated record, e.g.
+// an older offset of an upload.
+func NewGormWithReplica(db, replica *gorm.DB) (*SGormMetaStore, error) {
+	if replica != nil && replica.Dialector.Name() != db.Dialector.Name() {
+		return nil, fmt.Errorf("replica uses %s while the primary database uses %s", replica.Dialector.Name(), db.Dialector.Name())
+	}
+	store := &SGormMetaStore{
+		db:           db,
+		replica:      replica,
+		serialWrites: db.Dialector.Name() == "sqlite",
+	}
+
+	// 配置GORM
+	if err := store.configureGORM(); err != nil {
+		return nil, fmt.Errorf("failed to configure GORM: %w", err)
+	}
+
+	// 执行版本化的迁移
+	if err := store.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return store, nil
+}
+
+// 配置GORM
+func (store *SGormMetaStore) configureGORM() error {
+	if store.db.Dialector.Name() == "sqlite" {
+		// SQLite特殊配置, journal_mode和busy_timeout需对每个连接生效, 通过DSN设置
+		optimizations := []string{
+			"PRAGMA mode=rwc;",
+			"PRAGMA synchronous = NORMAL;",
+			"PRAGMA cache = shared;",
+			"PRAGMA cache_spill = ON;",
+			"PRAGMA cache_size = -131072;",
+			"PRAGMA foreign_keys = ON;",
+			"PRAGMA temp_store = MEMORY;",
+			"PRAGMA mmap_size = 536870912;",
+			"PRAGMA wal_autocheckpoint = 1000;",
+			"PRAGMA locking_mode = NORMAL;",
+			"PRAGMA read_uncommitted = ON;",
+			"PRAGMA journal_size_limit=104857600;",
+		}
+
+		for _, sqlStr := range optimizations {
+			if err := store.db.Exec(sqlStr).Error; err != nil {
+				fmt.Printf("Warning: failed to execute %s: %v\n", sqlStr, err)
+			}
+		}
+
+	}
+
+	return nil
+}
+
+// reader 返回查询使用的连接, 只有允许读取过期数据的请求使用只读副本
+func (store *SGormMetaStore) reader(ctx context.Context) *gorm.DB {
+	if store.replica != nil && storage.StaleReadsAllowed(ctx) {
+		return store.replica
+	}
+	return store.db
+}
+
+// write 执行写操作, SQLite的写入依次排队执行
+func (store *SGormMetaStore) write(fn func() error) error {
+	if store.serialWrites {
+		store.writeMu.Lock()
+		defer store.writeMu.Unlock()
+	}
+	return fn()
+}
+
+// Create stores the info of a new upload, an existing record with the same
+// ID is overwritten.
+func (store *SGormMetaStore) Create(ctx context.Context, info common.FileInfo) error {
+	record, err := toRecord(info)
+	if err != nil {
+		return err
+	}
+	return store.write(func() error {
+		return store.db.WithContext(ctx).
+			Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "file_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{
+					"file_size",
+					"size_is_deferred",
+					"offset_size",
+					"is_partial",
+					"is_final",
+					"metadata_info",
+					"partial_ids",
+					"storage_info",
+				}),
+			}).Create(record).Error
+	})
+}
+
+func (store *SGormMetaStore) Get(ctx context.Context, id string) (common.FileInfo, error) {
+	var record FileUploadChunks
+	result := store.reader(ctx).WithContext(ctx).Where("file_id = ?", id).First(&record)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return common.FileInfo{}, fmt.Errorf("upload not found")
+		}
+		return common.FileInfo{}, result.Error
+	}
+	return fromRecord(record)
+}
+
+func (store *SGormMetaStore) Update(ctx context.Context, info common.FileInfo) error {
+	record, err := toRecord(info)
+	if err != nil {
+		return err
+	}
+	return store.write(func() error {
+		return store.db.WithContext(ctx).Model(&FileUploadChunks{}).
+			Where("file_id = ?", info.ID).
+			Select("file_size", "size_is_deferred", "offset_size", "is_partial", "is_final", "metadata_info", "partial_ids", "storage_info").
+			Updates(record).Error
+	})
+}
+
+// UpdateOffset raises the offset of the upload with id, see
+// storage.IOffsetUpdater.
+func (store *SGormMetaStore) UpdateOffset(ctx context.Context, id string, offset int64) error {
+	return store.write(func() error {
+		return store.db.WithContext(ctx).Model(&FileUploadChunks{}).
+			Where("file_id = ? AND offset_size < ?", id, offset).
+			Update("offset_size", offset).Error
+	})
+}
+
+func (store *SGormMetaStore) List(ctx context.Context, createdBefore time.Time) ([]string, error) {
+	var uploadIDs []string
+	query := store.reader(ctx).WithContext(ctx).
+		Model(&FileUploadChunks{}).
+		Select("file_id")
+	if !createdBefore.IsZero() {
+		query = query.Where("created_at < ?", createdBefore)
+	}
+	result := query.Find(&uploadIDs)
+	return uploadIDs, result.Error
+}
+
+func (store *SGormMetaStore) Delete(ctx context.Context, id string) error {
+	return store.write(func() error {
+		return store.db.WithContext(ctx).Where("file_id = ?", id).Delete(&FileUploadChunks{}).Error
+	})
+}
+
+func toRecord(info common.FileInfo) (*FileUploadChunks, error) {
+	record := &FileUploadChunks{
+		CreatedAt:      info.CreateTime,
+		FileID:         info.ID,
+		FileSize:       info.Size,
+		SizeIsDeferred: info.SizeIsDeferred,
+		OffsetSize:     info.Offset,
+		IsPartial:      info.IsPartial,
+		IsFinal:        info.IsFinal,
+	}
+	var err error
+	if len(info.MetaData) > 0 {
+		if record.MetadataInfo, err = json.Marshal(info.MetaData); err != nil {
+			return nil, err
+		}
+	}
+	if len(info.PartialIDs) > 0 {
+		if record.PartialIDs, err = json.Marshal(info.PartialIDs); err != nil {
+			return nil, err
+		}
+	}
+	if len(info.Storage) > 0 {
+		if record.StorageInfo, err = json.Marshal(info.Storage); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+func fromRecord(record FileUploadChunks) (common.FileInfo, error) {
+	info := common.FileInfo{
+		ID:             record.FileID,
+		Size:           record.FileSize,
+		SizeIsDeferred: record.SizeIsDeferred,
+		Offset:         record.OffsetSize,
+		IsPartial:      record.IsPartial,
+		IsFinal:        record.IsFinal,
+		CreateTime:     record.CreatedAt,
+	}
+	if len(record.MetadataInfo) > 0 {
+		if err := json.Unmarshal(record.MetadataInfo, &info.MetaData); err != nil {
+			return common.FileInfo{}, err
+		}
+	}
+	if len(record.PartialIDs) > 0 {
+		if err := json.Unmarshal(record.PartialIDs, &info.PartialIDs); err != nil {
+			return common.FileInfo{}, err
+		}
+	}
+	if len(record.StorageInfo) > 0 {
+		if err := json.Unmarshal(record.StorageInfo, &info.Storage); err != nil {
+			return common.FileInfo{}, err
+		}
+	}
+	return info, nil
+}
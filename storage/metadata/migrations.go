@@ -0,0 +1,113 @@
+package metadata
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// schemaMigration records an applied migration of the metadata schema.
+type schemaMigration struct {
+	Version   int    `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"size:255"`
+	AppliedAt time.Time
+}
+
+// TableName 指定表名
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+// migrations 按版本排列, 已发布的迁移不可修改, 只能追加新版本.
+// 每个迁移使用当时的模型快照, 不受FileUploadChunks后续变化的影响
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create file_upload_chunks",
+		up: func(tx *gorm.DB) error {
+			type fileUploadChunks struct {
+				ID           uint `gorm:"primarykey"`
+				CreatedAt    time.Time
+				UpdatedAt    time.Time
+				FileID       string         `gorm:"primaryKey;uniqueIndex;size:255;comment:文件ID"`
+				FileSize     int64          `gorm:"not null;comment:文件大小"`
+				OffsetSize   int64          `gorm:"not null;default:0;comment:偏移量"`
+				IsPartial    bool           `gorm:"default:false;comment:是否为分片"`
+				MetadataInfo datatypes.JSON `gorm:"type:json;comment:元数据"`
+				PartialIDs   datatypes.JSON `gorm:"type:json;comment:分片ID"`
+			}
+			// 引入版本管理前由AutoMigrate创建的表直接沿用
+			if tx.Migrator().HasTable("file_upload_chunks") {
+				return nil
+			}
+			return tx.Table("file_upload_chunks").Migrator().CreateTable(&fileUploadChunks{})
+		},
+	},
+	{
+		version: 2,
+		name:    "add size_is_deferred, is_final and storage_info",
+		up: func(tx *gorm.DB) error {
+			type fileUploadChunks struct {
+				SizeIsDeferred bool           `gorm:"default:false;comment:是否延迟声明大小"`
+				IsFinal        bool           `gorm:"default:false;comment:是否为合并后的文件"`
+				StorageInfo    datatypes.JSON `gorm:"type:json;comment:存储后端信息"`
+			}
+			migrator := tx.Table("file_upload_chunks").Migrator()
+			for _, column := range []string{"SizeIsDeferred", "IsFinal", "StorageInfo"} {
+				if migrator.HasColumn(&fileUploadChunks{}, column) {
+					continue
+				}
+				if err := migrator.AddColumn(&fileUploadChunks{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// SchemaVersion is the version of the metadata schema this build expects.
+var SchemaVersion = migrations[len(migrations)-1].version
+
+// migrate 依次执行未应用的迁移, 数据库版本高于当前程序时拒绝启动, 避免降级后静默写坏数据
+func (store *SGormMetaStore) migrate() error {
+	if err := store.db.AutoMigrate(&schemaMigration{}); err != nil {
+		return err
+	}
+	var current int
+	if err := store.db.Model(&schemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&current).Error; err != nil {
+		return err
+	}
+	if current > SchemaVersion {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d, refusing to downgrade", current, SchemaVersion)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err := store.db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			// 多个实例同时启动时, 主键冲突使后执行的实例失败而不是重复迁移
+			return tx.Create(&schemaMigration{
+				Version:   m.version,
+				Name:      m.name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+)
+
+// updateScript 仅更新已存在的上传, 避免并发删除后被重新创建
+var updateScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], unpack(ARGV))
+return 1
+`)
+
+// updateOffsetScript 仅在偏移量增大时更新
+var updateOffsetScript = redis.NewScript(`
+local offset = redis.call('HGET', KEYS[1], 'offset')
+if offset and tonumber(offset) < tonumber(ARGV[1]) then
+	redis.call('HSET', KEYS[1], 'offset', ARGV[1])
+end
+return 0
+`)
+
+// SRedisMetaStore keeps the upload info in Redis, every upload is a hash
+// keyed by its ID and a sorted set indexes the uploads by creation time for
+// expiry scans. No SQL database is required and HEAD/PATCH requests only
+// cost a single round trip.
+type SRedisMetaStore struct {
+	// Prefix is prepended to all keys.
+	Prefix string
+
+	client redis.UniversalClient
+}
+
+// New connects to the Redis server at the given URI, e.g.
+// redis://localhost:6379/0.
+func New(uri string) (*SRedisMetaStore, error) {
+	options, err := redis.ParseURL(uri)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err = client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+	return NewFromClient(client), nil
+}
+
+// NewFromClient creates a metadata store using an existing Redis client.
+func NewFromClient(client redis.UniversalClient) *SRedisMetaStore {
+	return &SRedisMetaStore{
+		Prefix: "tusd:meta:",
+		client: client,
+	}
+}
+
+func (store *SRedisMetaStore) infoKey(id string) string {
+	return store.Prefix + "upload:" + id
+}
+
+func (store *SRedisMetaStore) createdKey() string {
+	return store.Prefix + "created"
+}
+
+func (store *SRedisMetaStore) Create(ctx context.Context, info common.FileInfo) error {
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	fields, err := toFields(info)
+	if err != nil {
+		return err
+	}
+	key := store.infoKey(info.ID)
+	_, err = store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, fields)
+		pipe.ZAdd(ctx, store.createdKey(), redis.Z{
+			Score:  float64(info.CreateTime.Unix()),
+			Member: info.ID,
+		})
+		return nil
+	})
+	return err
+}
+
+func (store *SRedisMetaStore) Get(ctx context.Context, id string) (common.FileInfo, error) {
+	fields, err := store.client.HGetAll(ctx, store.infoKey(id)).Result()
+	if err != nil {
+		return common.FileInfo{}, err
+	}
+	if len(fields) == 0 {
+		return common.FileInfo{}, fmt.Errorf("upload not found")
+	}
+	return fromFields(id, fields)
+}
+
+func (store *SRedisMetaStore) Update(ctx context.Context, info common.FileInfo) error {
+	fields, err := toFields(info)
+	if err != nil {
+		return err
+	}
+	// 创建时间只在Create时写入
+	delete(fields, "created")
+	args := make([]interface{}, 0, len(fields)*2)
+	for field, value := range fields {
+		args = append(args, field, value)
+	}
+	updated, err := updateScript.Run(ctx, store.client, []string{store.infoKey(info.ID)}, args...).Int()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("upload not found")
+	}
+	return nil
+}
+
+// UpdateOffset raises the offset of the upload with id, see
+// storage.IOffsetUpdater.
+func (store *SRedisMetaStore) UpdateOffset(ctx context.Context, id string, offset int64) error {
+	return updateOffsetScript.Run(ctx, store.client, []string{store.infoKey(id)}, offset).Err()
+}
+
+func (store *SRedisMetaStore) List(ctx context.Context, createdBefore time.Time) ([]string, error) {
+	maxScore := "+inf"
+	if !createdBefore.IsZero() {
+		maxScore = "(" + strconv.FormatInt(createdBefore.Unix(), 10)
+	}
+	return store.client.ZRangeByScore(ctx, store.createdKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: maxScore,
+	}).Result()
+}
+
+func (store *SRedisMetaStore) Delete(ctx context.Context, id string) error {
+	_, err := store.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, store.infoKey(id))
+		pipe.ZRem(ctx, store.createdKey(), id)
+		return nil
+	})
+	return err
+}
+
+func toFields(info common.FileInfo) (map[string]interface{}, error) {
+	fields := map[string]interface{}{
+		"size":             info.Size,
+		"size_is_deferred": strconv.FormatBool(info.SizeIsDeferred),
+		"offset":           info.Offset,
+		"is_partial":       strconv.FormatBool(info.IsPartial),
+		"is_final":         strconv.FormatBool(info.IsFinal),
+		"created":          info.CreateTime.UnixNano(),
+	}
+	for field, value := range map[string]interface{}{
+		"metadata":    info.MetaData,
+		"partial_ids": info.PartialIDs,
+		"storage":     info.Storage,
+	} {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		fields[field] = string(data)
+	}
+	return fields, nil
+}
+
+func fromFields(id string, fields map[string]string) (common.FileInfo, error) {
+	info := common.FileInfo{
+		ID:             id,
+		SizeIsDeferred: fields["size_is_deferred"] == "true",
+		IsPartial:      fields["is_partial"] == "true",
+		IsFinal:        fields["is_final"] == "true",
+	}
+	var err error
+	if info.Size, err = strconv.ParseInt(fields["size"], 10, 64); err != nil {
+		return common.FileInfo{}, fmt.Errorf("invalid size of upload %s: %w", id, err)
+	}
+	if info.Offset, err = strconv.ParseInt(fields["offset"], 10, 64); err != nil {
+		return common.FileInfo{}, fmt.Errorf("invalid offset of upload %s: %w", id, err)
+	}
+	if created, err := strconv.ParseInt(fields["created"], 10, 64); err == nil {
+		info.CreateTime = time.Unix(0, created)
+	}
+	for field, value := range map[string]interface{}{
+		"metadata":    &info.MetaData,
+		"partial_ids": &info.PartialIDs,
+		"storage":     &info.Storage,
+	} {
+		if data := fields[field]; data != "" {
+			if err = json.Unmarshal([]byte(data), value); err != nil {
+				return common.FileInfo{}, fmt.Errorf("invalid %s of upload %s: %w", field, id, err)
+			}
+		}
+	}
+	return info, nil
+}
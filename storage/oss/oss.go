@@ -0,0 +1,707 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+const (
+	// MinPartSize OSS要求除最后一个分片外每个分片至少100KB
+	MinPartSize = 100 * 1024
+	// MaxPartNumber OSS单个multipart upload最多10000个分片
+	MaxPartNumber = 10000
+)
+
+// SOSSStore stores uploads in an Alibaba Cloud OSS bucket. Every upload is
+// backed by a multipart upload; tus chunks are buffered on local disk until
+// they are large enough to become a part. Data which is too small to be
+// uploaded as a part is kept in a separate "<id>.part" object until the next
+// chunk arrives.
+//
+// The upload info is kept next to the data in a "<id>.info" object, so no
+// database is required.
+type SOSSStore struct {
+	// ObjectPrefix is prepended to every object key, e.g. "uploads/".
+	ObjectPrefix string
+	// PreferredPartSize is the size of the parts uploaded to OSS. It must be
+	// at least MinPartSize.
+	PreferredPartSize int64
+	// TemporaryDirectory is used to buffer parts before uploading them.
+	// The system's temporary directory is used if empty.
+	TemporaryDirectory string
+
+	bucket *oss.Bucket
+	locker locker.ILocker
+}
+
+func New(bucket *oss.Bucket, locker locker.ILocker) (*SOSSStore, error) {
+	if bucket == nil {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	return &SOSSStore{
+		PreferredPartSize: 50 * 1024 * 1024,
+		bucket:            bucket,
+		locker:            locker,
+	}, nil
+}
+
+func (store *SOSSStore) keyWithPrefix(key string) string {
+	return path.Join(store.ObjectPrefix, key)
+}
+
+func (store *SOSSStore) binKey(id string) string {
+	return store.keyWithPrefix(id)
+}
+
+func (store *SOSSStore) infoKey(id string) string {
+	return store.keyWithPrefix(id + ".info")
+}
+
+func (store *SOSSStore) partKey(id string) string {
+	return store.keyWithPrefix(id + ".part")
+}
+
+func (store *SOSSStore) newLock(id string) (locker.ILock, error) {
+	return store.locker.NewLock("oss:" + store.bucket.BucketName + ":" + strings.ReplaceAll(store.binKey(id), "/", ":"))
+}
+
+func (store *SOSSStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	info.Storage = map[string]string{
+		"Type":   "oss",
+		"Bucket": store.bucket.BucketName,
+		"Key":    store.binKey(info.ID),
+	}
+
+	upload := &sOSSUpload{
+		info:  info,
+		store: store,
+	}
+	binLock, err := store.newLock(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer upload.binLock.Unlock()
+
+	options := []oss.Option{oss.WithContext(ctx)}
+	for key, value := range info.MetaData {
+		// OSS元数据只允许ASCII, 此处只保留可安全传递的值
+		if isASCII(value) {
+			options = append(options, oss.Meta(key, value))
+		}
+	}
+	if filetype, ok := info.MetaData["filetype"]; ok {
+		options = append(options, oss.ContentType(filetype))
+	}
+
+	imur, err := store.bucket.InitiateMultipartUpload(store.binKey(info.ID), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	upload.multipartID = imur.UploadID
+
+	if err = upload.writeInfo(ctx); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (store *SOSSStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	upload := &sOSSUpload{
+		info:  common.FileInfo{ID: id},
+		store: store,
+	}
+	binLock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if _, err = upload.GetInfo(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SOSSStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(ctx, expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SOSSStore) cleanup(ctx context.Context, expiredBefore time.Duration) {
+	lock, err := store.locker.NewLock("oss:" + store.bucket.BucketName + ":cleanup")
+	if err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	if err = lock.Lock(ctx); err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
+	expiredTime := time.Now().Add(-expiredBefore)
+	options := []oss.Option{oss.WithContext(ctx), oss.Prefix(store.ObjectPrefix)}
+	for {
+		res, err := store.bucket.ListObjectsV2(options...)
+		if err != nil {
+			fmt.Printf("failed to list expired uploads: %v\n", err)
+			return
+		}
+		for _, object := range res.Objects {
+			if !strings.HasSuffix(object.Key, ".info") || object.LastModified.After(expiredTime) {
+				continue
+			}
+			id := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(object.Key, store.ObjectPrefix), "/"), ".info")
+			upload, err := store.GetUpload(ctx, id)
+			if err != nil {
+				fmt.Printf("failed to get expired upload: %v\n", err)
+				continue
+			}
+			if err = upload.Terminate(ctx); err != nil {
+				fmt.Printf("failed to remove expired upload: %v\n", err)
+			}
+		}
+		if !res.IsTruncated {
+			return
+		}
+		options = append(options, oss.ContinuationToken(res.NextContinuationToken))
+	}
+}
+
+// ossInfo is the content of the "<id>.info" object.
+type ossInfo struct {
+	common.FileInfo
+	MultipartID string `json:"multipartID,omitempty"`
+}
+
+type sOSSUpload struct {
+	binLock     locker.ILock
+	info        common.FileInfo
+	multipartID string
+	store       *SOSSStore
+}
+
+func (upload *sOSSUpload) imur() oss.InitiateMultipartUploadResult {
+	return oss.InitiateMultipartUploadResult{
+		Bucket:   upload.store.bucket.BucketName,
+		Key:      upload.store.binKey(upload.info.ID),
+		UploadID: upload.multipartID,
+	}
+}
+
+func (upload *sOSSUpload) writeInfo(ctx context.Context) error {
+	data, err := json.Marshal(ossInfo{
+		FileInfo:    upload.info,
+		MultipartID: upload.multipartID,
+	})
+	if err != nil {
+		return err
+	}
+	return upload.store.bucket.PutObject(upload.store.infoKey(upload.info.ID), bytes.NewReader(data),
+		oss.WithContext(ctx), oss.ContentType("application/json"))
+}
+
+func (upload *sOSSUpload) readInfo(ctx context.Context) error {
+	body, err := upload.store.bucket.GetObject(upload.store.infoKey(upload.info.ID), oss.WithContext(ctx))
+	if err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+
+	var info ossInfo
+	if err = json.NewDecoder(body).Decode(&info); err != nil {
+		return err
+	}
+	upload.info = info.FileInfo
+	upload.multipartID = info.MultipartID
+	return nil
+}
+
+// readOffset 根据已上传的分片和未完成分片计算偏移量
+func (upload *sOSSUpload) readOffset(ctx context.Context) error {
+	if upload.multipartID == "" {
+		// multipart upload已完成
+		upload.info.Offset = upload.info.Size
+		return nil
+	}
+
+	parts, err := upload.listParts(ctx)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	for _, part := range parts {
+		offset += int64(part.Size)
+	}
+
+	partSize, err := upload.incompletePartSize(ctx)
+	if err != nil {
+		return err
+	}
+	upload.info.Offset = offset + partSize
+	return nil
+}
+
+func (upload *sOSSUpload) listParts(ctx context.Context) ([]oss.UploadedPart, error) {
+	var (
+		parts  []oss.UploadedPart
+		marker int
+	)
+	for {
+		res, err := upload.store.bucket.ListUploadedParts(upload.imur(), oss.WithContext(ctx), oss.PartNumberMarker(marker))
+		if err != nil {
+			if isNotFound(err) {
+				return nil, fmt.Errorf("upload not found")
+			}
+			return nil, err
+		}
+		parts = append(parts, res.UploadedParts...)
+		if !res.IsTruncated {
+			return parts, nil
+		}
+		if marker, err = strconv.Atoi(res.NextPartNumberMarker); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (upload *sOSSUpload) incompletePartSize(ctx context.Context) (int64, error) {
+	header, err := upload.store.bucket.GetObjectMeta(upload.store.partKey(upload.info.ID), oss.WithContext(ctx))
+	if err != nil {
+		if isNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+}
+
+// takeIncompletePart 下载未完成分片到临时文件并删除该对象, 不存在时返回nil
+func (upload *sOSSUpload) takeIncompletePart(ctx context.Context) (*os.File, int64, error) {
+	body, err := upload.store.bucket.GetObject(upload.store.partKey(upload.info.ID), oss.WithContext(ctx))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+
+	file, err := os.CreateTemp(upload.store.TemporaryDirectory, "oss-part-")
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(file, body)
+	if err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	if err = upload.store.bucket.DeleteObject(upload.store.partKey(upload.info.ID), oss.WithContext(ctx)); err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	return file, n, nil
+}
+
+func (upload *sOSSUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	if err := upload.readInfo(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	if err := upload.readOffset(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	return upload.info, nil
+}
+
+func (upload *sOSSUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	body, err := upload.store.bucket.GetObject(upload.store.binKey(upload.info.ID), oss.WithContext(ctx))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, fmt.Errorf("upload not found")
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+func (upload *sOSSUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	if upload.multipartID == "" {
+		return 0, storage.ErrUploadCompleted
+	}
+
+	parts, err := upload.listParts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var uploaded int64
+	for _, part := range parts {
+		uploaded += int64(part.Size)
+	}
+	partNumber := len(parts) + 1
+
+	// 上次遗留的未完成分片需要与本次数据合并后再上传
+	incomplete, incompleteSize, err := upload.takeIncompletePart(ctx)
+	if err != nil {
+		return 0, err
+	}
+	reader := src
+	if incomplete != nil {
+		defer cleanupTempFile(incomplete)
+		reader = io.MultiReader(incomplete, src)
+	}
+
+	var written int64
+	for {
+		file, n, err := upload.bufferPart(reader)
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			break
+		}
+
+		total := uploaded + n
+		isLast := !upload.info.SizeIsDeferred && total >= upload.info.Size
+		if n < MinPartSize && !isLast {
+			// 数据不足一个分片, 暂存为未完成分片
+			err = upload.store.bucket.PutObject(upload.store.partKey(upload.info.ID), file, oss.WithContext(ctx))
+			cleanupTempFile(file)
+			if err != nil {
+				return written, err
+			}
+			written += n
+			break
+		}
+		if partNumber > MaxPartNumber {
+			cleanupTempFile(file)
+			return written, fmt.Errorf("too many parts for upload %s", upload.info.ID)
+		}
+
+		_, err = upload.store.bucket.UploadPart(upload.imur(), file, n, partNumber, oss.WithContext(ctx))
+		cleanupTempFile(file)
+		if err != nil {
+			return written, err
+		}
+		partNumber++
+		uploaded = total
+		written += n
+	}
+
+	// 未完成分片中的数据在上次写入时已计入偏移量
+	written -= incompleteSize
+	if written < 0 {
+		written = 0
+	}
+	upload.info.Offset = offset + written
+
+	if !upload.info.SizeIsDeferred && upload.info.Offset >= upload.info.Size {
+		if err = upload.complete(ctx); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// bufferPart 读取至多一个分片大小的数据到临时文件
+func (upload *sOSSUpload) bufferPart(src io.Reader) (*os.File, int64, error) {
+	file, err := os.CreateTemp(upload.store.TemporaryDirectory, "oss-part-")
+	if err != nil {
+		return nil, 0, err
+	}
+	partSize := upload.store.PreferredPartSize
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	n, err := io.CopyN(file, src, partSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	if n == 0 {
+		cleanupTempFile(file)
+		return nil, 0, nil
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	return file, n, nil
+}
+
+// complete 合并所有分片, 完成multipart upload
+func (upload *sOSSUpload) complete(ctx context.Context) error {
+	parts, err := upload.listParts(ctx)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		// 空文件无法通过multipart upload完成, 直接写入空对象
+		if err = upload.store.bucket.PutObject(upload.store.binKey(upload.info.ID), bytes.NewReader(nil), oss.WithContext(ctx)); err != nil {
+			return err
+		}
+		if err = upload.abort(ctx); err != nil {
+			return err
+		}
+	} else {
+		completed := make([]oss.UploadPart, 0, len(parts))
+		for _, part := range parts {
+			completed = append(completed, oss.UploadPart{
+				PartNumber: part.PartNumber,
+				ETag:       part.ETag,
+			})
+		}
+		if _, err = upload.store.bucket.CompleteMultipartUpload(upload.imur(), completed, oss.WithContext(ctx)); err != nil {
+			return fmt.Errorf("failed to complete multipart upload: %w", err)
+		}
+	}
+
+	upload.multipartID = ""
+	upload.info.Offset = upload.info.Size
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sOSSUpload) abort(ctx context.Context) error {
+	err := upload.store.bucket.AbortMultipartUpload(upload.imur(), oss.WithContext(ctx))
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (upload *sOSSUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	var size int64
+	for i, partialUpload := range uploads {
+		_partialUpload := partialUpload.(*sOSSUpload)
+		if _partialUpload.multipartID != "" {
+			return fmt.Errorf("partial upload %s is not completed", _partialUpload.info.ID)
+		}
+		if _partialUpload.info.Size < MinPartSize && i < len(uploads)-1 {
+			return fmt.Errorf("partial upload %s is smaller than %d bytes", _partialUpload.info.ID, MinPartSize)
+		}
+
+		// 服务端复制, 数据不经过本机
+		_, err := upload.store.bucket.UploadPartCopy(upload.imur(), upload.store.bucket.BucketName,
+			upload.store.binKey(_partialUpload.info.ID), 0, _partialUpload.info.Size, i+1, oss.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to copy partial upload %s: %w", _partialUpload.info.ID, err)
+		}
+		size += _partialUpload.info.Size
+	}
+
+	upload.info.Size = size
+	if err := upload.complete(ctx); err != nil {
+		return err
+	}
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (upload *sOSSUpload) PresignDownload(ctx context.Context, expires time.Duration) (string, error) {
+	return upload.store.bucket.SignURL(upload.store.binKey(upload.info.ID), oss.HTTPGet, int64(expires/time.Second))
+}
+
+func (upload *sOSSUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	key := upload.store.binKey(upload.info.ID)
+	header, err := upload.store.bucket.GetObjectDetailedMeta(key, oss.WithContext(ctx))
+	if err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return err
+	}
+	modTime, _ := http.ParseTime(header.Get("Last-Modified"))
+	if etag := header.Get("ETag"); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	rs := &sRangeReadSeeker{ctx: ctx, bucket: upload.store.bucket, key: key, size: size}
+	defer rs.Close()
+	http.ServeContent(w, r, "", modTime, rs)
+	return nil
+}
+
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sOSSUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.readInfo(ctx); err != nil {
+		return err
+	}
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sOSSUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if upload.multipartID != "" {
+		if err := upload.abort(ctx); err != nil {
+			return err
+		}
+	}
+
+	// OSS批量删除时不存在的对象不会报错
+	_, err := upload.store.bucket.DeleteObjects([]string{
+		upload.store.binKey(upload.info.ID),
+		upload.store.partKey(upload.info.ID),
+		upload.store.infoKey(upload.info.ID),
+	}, oss.WithContext(ctx), oss.DeleteObjectsQuiet(true))
+	return err
+}
+
+// sRangeReadSeeker 基于range读取实现io.ReadSeeker, 供http.ServeContent使用
+type sRangeReadSeeker struct {
+	ctx    context.Context
+	bucket *oss.Bucket
+	key    string
+	size   int64
+	pos    int64
+	reader io.ReadCloser
+}
+
+func (rs *sRangeReadSeeker) Read(p []byte) (int, error) {
+	if rs.pos >= rs.size {
+		return 0, io.EOF
+	}
+	if rs.reader == nil {
+		reader, err := rs.bucket.GetObject(rs.key, oss.WithContext(rs.ctx), oss.Range(rs.pos, rs.size-1))
+		if err != nil {
+			return 0, err
+		}
+		rs.reader = reader
+	}
+	n, err := rs.reader.Read(p)
+	rs.pos += int64(n)
+	return n, err
+}
+
+func (rs *sRangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = rs.pos + offset
+	case io.SeekEnd:
+		pos = rs.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position: %d", pos)
+	}
+	if pos != rs.pos {
+		rs.Close()
+		rs.pos = pos
+	}
+	return pos, nil
+}
+
+func (rs *sRangeReadSeeker) Close() {
+	if rs.reader != nil {
+		_ = rs.reader.Close()
+		rs.reader = nil
+	}
+}
+
+func isNotFound(err error) bool {
+	var serviceErr oss.ServiceError
+	if !errors.As(err, &serviceErr) {
+		return false
+	}
+	return serviceErr.StatusCode == http.StatusNotFound ||
+		serviceErr.Code == "NoSuchKey" || serviceErr.Code == "NoSuchUpload"
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+func cleanupTempFile(file *os.File) {
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+}
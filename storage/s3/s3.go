@@ -0,0 +1,998 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+const (
+	// MinPartSize S3要求除最后一个分片外每个分片至少5MB
+	MinPartSize = 5 * 1024 * 1024
+	// MaxPartNumber S3单个multipart upload最多10000个分片
+	MaxPartNumber = 10000
+)
+
+// IS3API is the subset of the S3 client used by the store. It is satisfied
+// by *s3.Client and allows replacing the client in tests.
+type IS3API interface {
+	PutObject(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, input *s3.HeadObjectInput, opts ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	DeleteObjects(ctx context.Context, input *s3.DeleteObjectsInput, opts ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, opts ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	CreateMultipartUpload(ctx context.Context, input *s3.CreateMultipartUploadInput, opts ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, input *s3.UploadPartInput, opts ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	UploadPartCopy(ctx context.Context, input *s3.UploadPartCopyInput, opts ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	ListParts(ctx context.Context, input *s3.ListPartsInput, opts ...func(*s3.Options)) (*s3.ListPartsOutput, error)
+	CompleteMultipartUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput, opts ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, input *s3.AbortMultipartUploadInput, opts ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// IS3PresignAPI is the subset of the S3 presign client used by the store. It
+// is satisfied by *s3.PresignClient.
+type IS3PresignAPI interface {
+	PresignUploadPart(ctx context.Context, input *s3.UploadPartInput, opts ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+	PresignGetObject(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+}
+
+// SS3Store stores uploads in an S3 bucket. Every upload is backed by a
+// multipart upload; tus chunks are buffered on local disk until they are large
+// enough to become an S3 part. Data which is too small to be uploaded as a
+// part is kept in a separate "<id>.part" object until the next chunk arrives.
+//
+// The upload info is kept next to the data in a "<id>.info" object, so no
+// database is required, unless MetaStore is set. The bucket and key of the
+// object are exposed via FileInfo.Storage.
+type SS3Store struct {
+	Bucket string
+	// ObjectPrefix is prepended to every object key, e.g. "uploads/".
+	ObjectPrefix string
+	// PreferredPartSize is the size of the parts uploaded to S3. It must be
+	// at least MinPartSize.
+	PreferredPartSize int64
+	// TemporaryDirectory is used to buffer parts before uploading them.
+	// The system's temporary directory is used if empty.
+	TemporaryDirectory string
+	// Presigner enables uploading parts directly to S3 via presigned URLs,
+	// see storage.IPresignedUpload. Parts uploaded this way must be at least
+	// MinPartSize bytes, except for the last one. Once the remaining data of
+	// an upload fits into one part, the URL only accepts exactly the
+	// remaining bytes. It also presigns download URLs, see
+	// storage.IPresignedDownload.
+	Presigner IS3PresignAPI
+	// MetaStore keeps the upload info, e.g. in a database, instead of the
+	// "<id>.info" objects, which saves requests to S3 and allows listing the
+	// uploads without scanning the bucket.
+	MetaStore storage.IMetaStore
+
+	client IS3API
+	locker locker.ILocker
+}
+
+func New(bucket string, client IS3API, locker locker.ILocker) (*SS3Store, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	return &SS3Store{
+		Bucket:            bucket,
+		PreferredPartSize: 50 * 1024 * 1024,
+		client:            client,
+		locker:            locker,
+	}, nil
+}
+
+func (store *SS3Store) keyWithPrefix(key string) *string {
+	return aws.String(path.Join(store.ObjectPrefix, key))
+}
+
+func (store *SS3Store) binKey(id string) *string {
+	return store.keyWithPrefix(id)
+}
+
+func (store *SS3Store) infoKey(id string) *string {
+	return store.keyWithPrefix(id + ".info")
+}
+
+func (store *SS3Store) partKey(id string) *string {
+	return store.keyWithPrefix(id + ".part")
+}
+
+func (store *SS3Store) newLock(id string) (locker.ILock, error) {
+	return store.locker.NewLock("s3:" + store.Bucket + ":" + strings.ReplaceAll(*store.binKey(id), "/", ":"))
+}
+
+func (store *SS3Store) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	info.Storage = map[string]string{
+		"Type":   "s3",
+		"Bucket": store.Bucket,
+		"Key":    *store.binKey(info.ID),
+	}
+
+	upload := &sS3Upload{
+		info:  info,
+		store: store,
+	}
+	binLock, err := store.newLock(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer upload.binLock.Unlock()
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(store.Bucket),
+		Key:      store.binKey(info.ID),
+		Metadata: make(map[string]string, len(info.MetaData)),
+	}
+	for key, value := range info.MetaData {
+		// S3元数据只允许ASCII, 此处只保留可安全传递的值
+		if isASCII(value) {
+			input.Metadata[key] = value
+		}
+	}
+	if filetype, ok := info.MetaData["filetype"]; ok {
+		input.ContentType = aws.String(filetype)
+	}
+
+	res, err := store.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	upload.multipartID = aws.ToString(res.UploadId)
+
+	if store.MetaStore != nil {
+		err = store.MetaStore.Create(ctx, upload.metaInfo())
+	} else {
+		err = upload.writeInfo(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (store *SS3Store) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	upload := &sS3Upload{
+		info:  common.FileInfo{ID: id},
+		store: store,
+	}
+	binLock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.readInfo(ctx); err != nil {
+		return nil, err
+	}
+	if err = upload.readOffset(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SS3Store) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(ctx, expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SS3Store) cleanup(ctx context.Context, expiredBefore time.Duration) {
+	lock, err := store.locker.NewLock("s3:" + store.Bucket + ":cleanup")
+	if err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	if err = lock.Lock(ctx); err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
+	expiredTime := time.Now().Add(-expiredBefore)
+	if store.MetaStore != nil {
+		ids, err := store.MetaStore.List(ctx, expiredTime)
+		if err != nil {
+			fmt.Printf("failed to list expired uploads: %v\n", err)
+			return
+		}
+		for _, id := range ids {
+			store.terminateExpired(ctx, id)
+		}
+		return
+	}
+	paginator := s3.NewListObjectsV2Paginator(store.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(store.Bucket),
+		Prefix: aws.String(store.ObjectPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			fmt.Printf("failed to list expired uploads: %v\n", err)
+			return
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if !strings.HasSuffix(key, ".info") || aws.ToTime(object.LastModified).After(expiredTime) {
+				continue
+			}
+			store.terminateExpired(ctx, strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(key, store.ObjectPrefix), "/"), ".info"))
+		}
+	}
+}
+
+func (store *SS3Store) terminateExpired(ctx context.Context, id string) {
+	upload, err := store.GetUpload(ctx, id)
+	if err != nil {
+		fmt.Printf("failed to get expired upload: %v\n", err)
+		return
+	}
+	if err = upload.Terminate(ctx); err != nil {
+		fmt.Printf("failed to remove expired upload: %v\n", err)
+	}
+}
+
+func (store *SS3Store) ListUploads(ctx context.Context) ([]string, error) {
+	if store.MetaStore != nil {
+		return store.MetaStore.List(ctx, time.Time{})
+	}
+	var ids []string
+	paginator := s3.NewListObjectsV2Paginator(store.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(store.Bucket),
+		Prefix: aws.String(store.ObjectPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if strings.HasSuffix(key, ".info") {
+				ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(key, store.ObjectPrefix), "/"), ".info"))
+			}
+		}
+	}
+	return ids, nil
+}
+
+// s3Info is the content of the "<id>.info" object.
+type s3Info struct {
+	common.FileInfo
+	MultipartID string `json:"multipartID,omitempty"`
+}
+
+type sS3Upload struct {
+	binLock     locker.ILock
+	info        common.FileInfo
+	multipartID string
+	store       *SS3Store
+}
+
+// metaMultipartID 使用MetaStore时multipart upload的ID保存在Storage中
+const metaMultipartID = "s3.multipartID"
+
+// metaInfo 返回保存到MetaStore的上传信息
+func (upload *sS3Upload) metaInfo() common.FileInfo {
+	info := upload.info
+	info.Storage = make(map[string]string, len(upload.info.Storage)+1)
+	for key, value := range upload.info.Storage {
+		info.Storage[key] = value
+	}
+	if upload.multipartID != "" {
+		info.Storage[metaMultipartID] = upload.multipartID
+	}
+	return info
+}
+
+func (upload *sS3Upload) writeInfo(ctx context.Context) error {
+	if upload.store.MetaStore != nil {
+		return upload.store.MetaStore.Update(ctx, upload.metaInfo())
+	}
+	data, err := json.Marshal(s3Info{
+		FileInfo:    upload.info,
+		MultipartID: upload.multipartID,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = upload.store.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(upload.store.Bucket),
+		Key:           upload.store.infoKey(upload.info.ID),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+		ContentType:   aws.String("application/json"),
+	})
+	return err
+}
+
+func (upload *sS3Upload) readInfo(ctx context.Context) error {
+	if upload.store.MetaStore != nil {
+		info, err := upload.store.MetaStore.Get(ctx, upload.info.ID)
+		if err != nil {
+			return err
+		}
+		upload.multipartID = info.Storage[metaMultipartID]
+		delete(info.Storage, metaMultipartID)
+		upload.info = info
+		return nil
+	}
+	res, err := upload.store.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(upload.store.Bucket),
+		Key:    upload.store.infoKey(upload.info.ID),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	var info s3Info
+	if err = json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return err
+	}
+	upload.info = info.FileInfo
+	upload.multipartID = info.MultipartID
+	return nil
+}
+
+// readOffset 根据已上传的分片和未完成分片计算偏移量
+func (upload *sS3Upload) readOffset(ctx context.Context) error {
+	if upload.multipartID == "" {
+		// multipart upload已完成
+		upload.info.Offset = upload.info.Size
+		return nil
+	}
+
+	parts, err := upload.listParts(ctx)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	for _, part := range parts {
+		offset += aws.ToInt64(part.Size)
+	}
+
+	partSize, err := upload.incompletePartSize(ctx)
+	if err != nil {
+		return err
+	}
+	upload.info.Offset = offset + partSize
+	return nil
+}
+
+func (upload *sS3Upload) listParts(ctx context.Context) ([]types.Part, error) {
+	var (
+		parts  []types.Part
+		marker *string
+	)
+	for {
+		res, err := upload.store.client.ListParts(ctx, &s3.ListPartsInput{
+			Bucket:           aws.String(upload.store.Bucket),
+			Key:              upload.store.binKey(upload.info.ID),
+			UploadId:         aws.String(upload.multipartID),
+			PartNumberMarker: marker,
+		})
+		if err != nil {
+			if isNotFound(err) {
+				return nil, fmt.Errorf("upload not found")
+			}
+			return nil, err
+		}
+		parts = append(parts, res.Parts...)
+		if !aws.ToBool(res.IsTruncated) {
+			return parts, nil
+		}
+		marker = res.NextPartNumberMarker
+	}
+}
+
+func (upload *sS3Upload) incompletePartSize(ctx context.Context) (int64, error) {
+	res, err := upload.store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(upload.store.Bucket),
+		Key:    upload.store.partKey(upload.info.ID),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return aws.ToInt64(res.ContentLength), nil
+}
+
+// takeIncompletePart 下载未完成分片到临时文件, 不存在时返回nil.
+// 对象在其数据写入新的分片或被新的未完成分片覆盖后才删除
+func (upload *sS3Upload) takeIncompletePart(ctx context.Context) (*os.File, int64, error) {
+	res, err := upload.store.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(upload.store.Bucket),
+		Key:    upload.store.partKey(upload.info.ID),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	file, err := os.CreateTemp(upload.store.TemporaryDirectory, "s3-part-")
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(file, res.Body)
+	if err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	return file, n, nil
+}
+
+// deleteIncompletePart 删除已合并到分片中的未完成分片对象
+func (upload *sS3Upload) deleteIncompletePart(ctx context.Context) error {
+	_, err := upload.store.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(upload.store.Bucket),
+		Delete: &types.Delete{
+			Objects: []types.ObjectIdentifier{{Key: upload.store.partKey(upload.info.ID)}},
+			Quiet:   aws.Bool(true),
+		},
+	})
+	return err
+}
+
+func (upload *sS3Upload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	if err := upload.readInfo(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	if err := upload.readOffset(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	return upload.info, nil
+}
+
+func (upload *sS3Upload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	res, err := upload.store.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(upload.store.Bucket),
+		Key:    upload.store.binKey(upload.info.ID),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, fmt.Errorf("upload not found")
+		}
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (upload *sS3Upload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	if upload.multipartID == "" {
+		return 0, storage.ErrUploadCompleted
+	}
+
+	parts, err := upload.listParts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var uploaded int64
+	for _, part := range parts {
+		uploaded += aws.ToInt64(part.Size)
+	}
+	partNumber := int32(len(parts)) + 1
+
+	// 上次遗留的未完成分片需要与本次数据合并后再上传
+	incomplete, incompleteSize, err := upload.takeIncompletePart(ctx)
+	if err != nil {
+		return 0, err
+	}
+	reader := src
+	if incomplete != nil {
+		defer cleanupTempFile(incomplete)
+		reader = io.MultiReader(incomplete, src)
+	}
+
+	var written int64
+	var merged bool
+	// 未完成分片中的数据在上次写入时已计入偏移量, 只返回从src读取的字节数
+	fromSrc := func() int64 {
+		return max(written-incompleteSize, 0)
+	}
+	for {
+		file, n, err := upload.bufferPart(reader)
+		if err != nil {
+			return fromSrc(), err
+		}
+		if n == 0 {
+			break
+		}
+
+		total := uploaded + n
+		isLast := !upload.info.SizeIsDeferred && total >= upload.info.Size
+		if n < MinPartSize && !isLast {
+			// 数据不足一个分片, 暂存为未完成分片
+			err = upload.putIncompletePart(ctx, file, n)
+			cleanupTempFile(file)
+			if err != nil {
+				return fromSrc(), err
+			}
+			written += n
+			break
+		}
+		if partNumber > MaxPartNumber {
+			cleanupTempFile(file)
+			return fromSrc(), fmt.Errorf("too many parts for upload %s", upload.info.ID)
+		}
+
+		err = upload.uploadPart(ctx, partNumber, file, n)
+		cleanupTempFile(file)
+		if err != nil {
+			return fromSrc(), err
+		}
+		// 未完成分片的数据已包含在第一个上传的分片中
+		if incomplete != nil && !merged {
+			if err = upload.deleteIncompletePart(ctx); err != nil {
+				return fromSrc(), err
+			}
+			merged = true
+		}
+		partNumber++
+		uploaded = total
+		written += n
+	}
+
+	written = fromSrc()
+	upload.info.Offset = offset + written
+
+	if !upload.info.SizeIsDeferred && upload.info.Offset >= upload.info.Size {
+		if err = upload.complete(ctx); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// bufferPart 读取至多一个分片大小的数据到临时文件
+func (upload *sS3Upload) bufferPart(src io.Reader) (*os.File, int64, error) {
+	file, err := os.CreateTemp(upload.store.TemporaryDirectory, "s3-part-")
+	if err != nil {
+		return nil, 0, err
+	}
+	partSize := upload.store.PreferredPartSize
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	n, err := io.CopyN(file, src, partSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	if n == 0 {
+		cleanupTempFile(file)
+		return nil, 0, nil
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		cleanupTempFile(file)
+		return nil, 0, err
+	}
+	return file, n, nil
+}
+
+func (upload *sS3Upload) uploadPart(ctx context.Context, partNumber int32, file *os.File, size int64) error {
+	_, err := upload.store.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(upload.store.Bucket),
+		Key:           upload.store.binKey(upload.info.ID),
+		UploadId:      aws.String(upload.multipartID),
+		PartNumber:    aws.Int32(partNumber),
+		Body:          file,
+		ContentLength: aws.Int64(size),
+	})
+	return err
+}
+
+func (upload *sS3Upload) putIncompletePart(ctx context.Context, file *os.File, size int64) error {
+	_, err := upload.store.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(upload.store.Bucket),
+		Key:           upload.store.partKey(upload.info.ID),
+		Body:          file,
+		ContentLength: aws.Int64(size),
+	})
+	return err
+}
+
+// complete 合并所有分片, 完成multipart upload
+func (upload *sS3Upload) complete(ctx context.Context) error {
+	parts, err := upload.listParts(ctx)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		// 空文件无法通过multipart upload完成, 直接写入空对象
+		if _, err = upload.store.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(upload.store.Bucket),
+			Key:           upload.store.binKey(upload.info.ID),
+			Body:          bytes.NewReader(nil),
+			ContentLength: aws.Int64(0),
+		}); err != nil {
+			return err
+		}
+		if err = upload.abort(ctx); err != nil {
+			return err
+		}
+	} else {
+		completed := make([]types.CompletedPart, 0, len(parts))
+		for _, part := range parts {
+			completed = append(completed, types.CompletedPart{
+				ETag:       part.ETag,
+				PartNumber: part.PartNumber,
+			})
+		}
+		if _, err = upload.store.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:   aws.String(upload.store.Bucket),
+			Key:      upload.store.binKey(upload.info.ID),
+			UploadId: aws.String(upload.multipartID),
+			MultipartUpload: &types.CompletedMultipartUpload{
+				Parts: completed,
+			},
+		}); err != nil {
+			return fmt.Errorf("failed to complete multipart upload: %w", err)
+		}
+	}
+
+	upload.multipartID = ""
+	upload.info.Offset = upload.info.Size
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sS3Upload) abort(ctx context.Context) error {
+	_, err := upload.store.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(upload.store.Bucket),
+		Key:      upload.store.binKey(upload.info.ID),
+		UploadId: aws.String(upload.multipartID),
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (upload *sS3Upload) PresignNextPart(ctx context.Context, expires time.Duration) (string, error) {
+	if upload.store.Presigner == nil {
+		return "", fmt.Errorf("presigned parts are not enabled")
+	}
+	if upload.multipartID == "" {
+		return "", storage.ErrUploadCompleted
+	}
+
+	parts, err := upload.listParts(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) >= MaxPartNumber {
+		return "", fmt.Errorf("too many parts for upload %s", upload.info.ID)
+	}
+	// 未完成分片的数据须先通过PATCH写入, 否则预签名的分片会排在其之前
+	incompleteSize, err := upload.incompletePartSize(ctx)
+	if err != nil {
+		return "", err
+	}
+	if incompleteSize > 0 {
+		return "", fmt.Errorf("upload %s has an incomplete part of %d bytes", upload.info.ID, incompleteSize)
+	}
+
+	input := &s3.UploadPartInput{
+		Bucket:     aws.String(upload.store.Bucket),
+		Key:        upload.store.binKey(upload.info.ID),
+		UploadId:   aws.String(upload.multipartID),
+		PartNumber: aws.Int32(int32(len(parts)) + 1),
+	}
+	if !upload.info.SizeIsDeferred {
+		var offset int64
+		for _, part := range parts {
+			offset += aws.ToInt64(part.Size)
+		}
+		remaining := upload.info.Size - offset
+		if remaining <= 0 {
+			return "", storage.ErrUploadCompleted
+		}
+		// 剩余数据不超过一个分片时即为最后一个分片, 签名其长度使客户端不能写入更多数据
+		if remaining <= max(upload.store.PreferredPartSize, MinPartSize) {
+			input.ContentLength = aws.Int64(remaining)
+		}
+	}
+	req, err := upload.store.Presigner.PresignUploadPart(ctx, input, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign part: %w", err)
+	}
+	return req.URL, nil
+}
+
+func (upload *sS3Upload) PresignDownload(ctx context.Context, expires time.Duration) (string, error) {
+	if upload.store.Presigner == nil {
+		return "", fmt.Errorf("presigner is not configured")
+	}
+	req, err := upload.store.Presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(upload.store.Bucket),
+		Key:    upload.store.binKey(upload.info.ID),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign download: %w", err)
+	}
+	return req.URL, nil
+}
+
+func (upload *sS3Upload) SyncPresignedParts(ctx context.Context) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.readOffset(ctx); err != nil {
+		return 0, err
+	}
+	if upload.multipartID != "" && !upload.info.SizeIsDeferred && upload.info.Offset > upload.info.Size {
+		return upload.info.Offset, fmt.Errorf("parts of upload %s exceed its size: %d > %d", upload.info.ID, upload.info.Offset, upload.info.Size)
+	}
+	if upload.multipartID != "" && !upload.info.SizeIsDeferred && upload.info.Offset >= upload.info.Size {
+		if err := upload.complete(ctx); err != nil {
+			return upload.info.Offset, err
+		}
+	}
+	return upload.info.Offset, nil
+}
+
+func (upload *sS3Upload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	var size int64
+	for i, partialUpload := range uploads {
+		_partialUpload := partialUpload.(*sS3Upload)
+		if _partialUpload.multipartID != "" {
+			return fmt.Errorf("partial upload %s is not completed", _partialUpload.info.ID)
+		}
+		if _partialUpload.info.Size < MinPartSize && i < len(uploads)-1 {
+			return fmt.Errorf("partial upload %s is smaller than %d bytes", _partialUpload.info.ID, MinPartSize)
+		}
+
+		// 服务端复制, 数据不经过本机
+		_, err := upload.store.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:     aws.String(upload.store.Bucket),
+			Key:        upload.store.binKey(upload.info.ID),
+			UploadId:   aws.String(upload.multipartID),
+			PartNumber: aws.Int32(int32(i + 1)),
+			CopySource: aws.String(upload.store.Bucket + "/" + aws.ToString(upload.store.binKey(_partialUpload.info.ID))),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy partial upload %s: %w", _partialUpload.info.ID, err)
+		}
+		size += _partialUpload.info.Size
+	}
+
+	upload.info.Size = size
+	if err := upload.complete(ctx); err != nil {
+		return err
+	}
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (upload *sS3Upload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	res, err := upload.store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(upload.store.Bucket),
+		Key:    upload.store.binKey(upload.info.ID),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	if res.ETag != nil {
+		w.Header().Set("ETag", *res.ETag)
+	}
+
+	// Range/If-Range等条件由http.ServeContent统一处理
+	rs := &sRangeReadSeeker{ctx: ctx, upload: upload, etag: res.ETag, size: aws.ToInt64(res.ContentLength)}
+	defer rs.Close()
+	http.ServeContent(w, r, "", aws.ToTime(res.LastModified), rs)
+	return nil
+}
+
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sS3Upload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.readInfo(ctx); err != nil {
+		return err
+	}
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sS3Upload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if upload.multipartID != "" {
+		if err := upload.abort(ctx); err != nil {
+			return err
+		}
+	}
+
+	res, err := upload.store.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(upload.store.Bucket),
+		Delete: &types.Delete{
+			Objects: []types.ObjectIdentifier{
+				{Key: upload.store.binKey(upload.info.ID)},
+				{Key: upload.store.partKey(upload.info.ID)},
+				{Key: upload.store.infoKey(upload.info.ID)},
+			},
+			Quiet: aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range res.Errors {
+		if aws.ToString(e.Code) != "NoSuchKey" {
+			return fmt.Errorf("failed to delete %s: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+	if upload.store.MetaStore != nil {
+		return upload.store.MetaStore.Delete(ctx, upload.info.ID)
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var (
+		noSuchKey    *types.NoSuchKey
+		notFound     *types.NotFound
+		noSuchUpload *types.NoSuchUpload
+	)
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound) || errors.As(err, &noSuchUpload)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+func cleanupTempFile(file *os.File) {
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+}
+
+// sRangeReadSeeker 基于range读取实现io.ReadSeeker, 供http.ServeContent使用
+type sRangeReadSeeker struct {
+	ctx    context.Context
+	upload *sS3Upload
+	// etag 读取期间对象被替换时中止, 避免拼接不同版本的数据
+	etag   *string
+	size   int64
+	pos    int64
+	reader io.ReadCloser
+}
+
+func (rs *sRangeReadSeeker) Read(p []byte) (int, error) {
+	if rs.pos >= rs.size {
+		return 0, io.EOF
+	}
+	if rs.reader == nil {
+		res, err := rs.upload.store.client.GetObject(rs.ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(rs.upload.store.Bucket),
+			Key:     rs.upload.store.binKey(rs.upload.info.ID),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-", rs.pos)),
+			IfMatch: rs.etag,
+		})
+		if err != nil {
+			return 0, err
+		}
+		rs.reader = res.Body
+	}
+	n, err := rs.reader.Read(p)
+	rs.pos += int64(n)
+	return n, err
+}
+
+func (rs *sRangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = rs.pos + offset
+	case io.SeekEnd:
+		pos = rs.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position: %d", pos)
+	}
+	if pos != rs.pos {
+		rs.Close()
+		rs.pos = pos
+	}
+	return pos, nil
+}
+
+func (rs *sRangeReadSeeker) Close() {
+	if rs.reader != nil {
+		_ = rs.reader.Close()
+		rs.reader = nil
+	}
+}
@@ -0,0 +1,349 @@
+package sftp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// SSFTPStore streams uploads to a remote SFTP server as they arrive. The
+// offset of an upload is derived from the size of the remote file, the
+// upload info is kept in a "<id>.info" file next to it.
+type SSFTPStore struct {
+	// Dir is the remote directory uploads are written to.
+	Dir string
+
+	client *sftp.Client
+	locker locker.ILocker
+}
+
+func New(dir string, client *sftp.Client, locker locker.ILocker) (*SSFTPStore, error) {
+	if err := client.MkdirAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to create remote directory %s: %w", dir, err)
+	}
+	return &SSFTPStore{
+		Dir:    dir,
+		client: client,
+		locker: locker,
+	}, nil
+}
+
+func (store *SSFTPStore) binPath(id string) string {
+	return path.Join(store.Dir, id)
+}
+
+func (store *SSFTPStore) infoPath(id string) string {
+	return path.Join(store.Dir, id+".info")
+}
+
+func (store *SSFTPStore) newLock(id string) (locker.ILock, error) {
+	return store.locker.NewLock("sftp:" + strings.ReplaceAll(store.binPath(id), "/", ":"))
+}
+
+func (store *SSFTPStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	info.Storage = map[string]string{
+		"Type": "sftp",
+		"Path": store.binPath(info.ID),
+	}
+
+	upload := &sSFTPUpload{
+		info:    info,
+		binPath: store.binPath(info.ID),
+		store:   store,
+	}
+	binLock, err := store.newLock(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer upload.binLock.Unlock()
+
+	if err = store.client.MkdirAll(path.Dir(upload.binPath)); err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s: %w", upload.binPath, err)
+	}
+	file, err := store.client.OpenFile(upload.binPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+
+	if err = upload.writeInfo(); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SSFTPStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	upload := &sSFTPUpload{
+		info:    common.FileInfo{ID: id},
+		binPath: store.binPath(id),
+		store:   store,
+	}
+	binLock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if _, err = upload.GetInfo(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SSFTPStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(ctx, expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SSFTPStore) cleanup(ctx context.Context, expiredBefore time.Duration) {
+	lock, err := store.locker.NewLock("sftp:" + strings.ReplaceAll(store.Dir, "/", ":") + ":cleanup")
+	if err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	if err = lock.Lock(ctx); err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
+	entries, err := store.client.ReadDir(store.Dir)
+	if err != nil {
+		fmt.Printf("failed to list expired uploads: %v\n", err)
+		return
+	}
+	expiredTime := time.Now().Add(-expiredBefore)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".info") || entry.ModTime().After(expiredTime) {
+			continue
+		}
+		upload, err := store.GetUpload(ctx, strings.TrimSuffix(entry.Name(), ".info"))
+		if err != nil {
+			fmt.Printf("failed to get expired upload: %v\n", err)
+			continue
+		}
+		if err = upload.Terminate(ctx); err != nil {
+			fmt.Printf("failed to remove expired upload: %v\n", err)
+		}
+	}
+}
+
+type sSFTPUpload struct {
+	binLock locker.ILock
+	info    common.FileInfo
+	binPath string
+	store   *SSFTPStore
+}
+
+func (upload *sSFTPUpload) writeInfo() error {
+	data, err := json.Marshal(upload.info)
+	if err != nil {
+		return err
+	}
+	file, err := upload.store.client.OpenFile(upload.store.infoPath(upload.info.ID), os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (upload *sSFTPUpload) readInfo() error {
+	file, err := upload.store.client.Open(upload.store.infoPath(upload.info.ID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return json.NewDecoder(file).Decode(&upload.info)
+}
+
+func (upload *sSFTPUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	if err := upload.readInfo(); err != nil {
+		return common.FileInfo{}, err
+	}
+	// 偏移量以远程文件大小为准
+	stat, err := upload.store.client.Stat(upload.binPath)
+	if err != nil {
+		return common.FileInfo{}, fmt.Errorf("upload not found")
+	}
+	upload.info.Offset = stat.Size()
+	return upload.info, nil
+}
+
+func (upload *sSFTPUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	return upload.store.client.Open(upload.binPath)
+}
+
+func (upload *sSFTPUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	file, err := upload.store.client.OpenFile(upload.binPath, os.O_WRONLY)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !upload.info.SizeIsDeferred && stat.Size() >= upload.info.Size {
+		return 0, storage.ErrUploadCompleted
+	}
+
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(file, src)
+	upload.info.Offset = offset + n
+	return n, err
+}
+
+func (upload *sSFTPUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) (err error) {
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	file, err := upload.store.client.OpenFile(upload.binPath, os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := file.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	var size int64
+	for _, partialUpload := range uploads {
+		_partialUpload := partialUpload.(*sSFTPUpload)
+		n, err := _partialUpload.appendTo(ctx, file)
+		if err != nil {
+			return err
+		}
+		size += n
+		if err = _partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+
+	upload.info.Size = size
+	upload.info.Offset = size
+	return upload.writeInfo()
+}
+
+func (upload *sSFTPUpload) appendTo(ctx context.Context, dst io.Writer) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	src, err := upload.store.client.Open(upload.binPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	return io.Copy(dst, src)
+}
+
+func (upload *sSFTPUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	file, err := upload.store.client.Open(upload.binPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	http.ServeContent(w, r, "", stat.ModTime(), file)
+	return nil
+}
+
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sSFTPUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.readInfo(); err != nil {
+		return err
+	}
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo()
+}
+
+func (upload *sSFTPUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	for _, p := range []string{upload.store.infoPath(upload.info.ID), upload.binPath} {
+		if err := upload.store.client.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,13 +2,53 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/busybox-org/gin-fileuploader/common"
 )
 
+// ErrLengthNotDeclarable is returned by DeclareLength for uploads which
+// don't support declaring their length after creation.
+var ErrLengthNotDeclarable = errors.New("store does not support declaring the upload length")
+
+// ReservedMetaDataPrefixes are the prefixes of the metadata keys wrapping
+// stores keep their state in, e.g. the key of an encrypted upload. Clients
+// must not set such keys, the stores drop them from new uploads.
+var ReservedMetaDataPrefixes = []string{"dedup.", "encryption.", "compression."}
+
+// WithoutMetaDataPrefix returns a copy of metadata without the keys starting
+// with prefix.
+func WithoutMetaDataPrefix(metadata map[string]string, prefix string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	filtered := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if !strings.HasPrefix(k, prefix) {
+			filtered[k] = v
+		}
+	}
+	return filtered
+}
+
+// ErrUploadCompleted is returned when writing to an upload which has
+// already received all its data.
+var ErrUploadCompleted = errors.New("upload already completed")
+
+var (
+	// ErrEncryptionKeyRequired is returned when the data of an upload
+	// encrypted with a client's key is accessed without it, see
+	// WithEncryptionKey.
+	ErrEncryptionKeyRequired = errors.New("encryption key required")
+	// ErrEncryptionKeyMismatch is returned when the data of an upload is
+	// accessed with another key than it was encrypted with.
+	ErrEncryptionKeyMismatch = errors.New("encryption key does not match")
+)
+
 type IStorage interface {
 	NewUpload(ctx context.Context, info common.FileInfo) (upload IUpload, err error)
 	GetUpload(ctx context.Context, id string) (upload IUpload, err error)
@@ -23,3 +63,128 @@ type IUpload interface {
 	ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error
 	Terminate(ctx context.Context) error
 }
+
+// IUploadLister is implemented by stores which can enumerate the IDs of
+// all their uploads, e.g. to migrate them to another store.
+type IUploadLister interface {
+	ListUploads(ctx context.Context) ([]string, error)
+}
+
+// IListingChecker is implemented by wrapping stores, which implement
+// IUploadLister whether or not the stores they wrap can list their uploads.
+type IListingChecker interface {
+	CanListUploads() bool
+}
+
+// ErrListingUnsupported is returned by ListUploads for stores which can't
+// list their uploads.
+var ErrListingUnsupported = errors.New("store can't list uploads")
+
+// CanListUploads reports whether the uploads of store can be listed.
+func CanListUploads(store IStorage) bool {
+	if checker, ok := store.(IListingChecker); ok {
+		return checker.CanListUploads()
+	}
+	_, ok := store.(IUploadLister)
+	return ok
+}
+
+// ListUploads returns the IDs of the uploads of store, wrapping stores use it
+// to list the uploads of the stores they wrap.
+func ListUploads(ctx context.Context, store IStorage) ([]string, error) {
+	if !CanListUploads(store) {
+		return nil, ErrListingUnsupported
+	}
+	return store.(IUploadLister).ListUploads(ctx)
+}
+
+// IMetaStore persists the info of uploads independently of their data, so a
+// backend can keep it in a database shared by all instances or next to the
+// data. Get returns an error containing "not found" for unknown uploads.
+type IMetaStore interface {
+	Create(ctx context.Context, info common.FileInfo) error
+	Get(ctx context.Context, id string) (common.FileInfo, error)
+	Update(ctx context.Context, info common.FileInfo) error
+	// List returns the IDs of the uploads created before createdBefore, or
+	// of all uploads if it is zero.
+	List(ctx context.Context, createdBefore time.Time) ([]string, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// IOffsetUpdater is implemented by metadata stores which can persist the
+// offset of an upload without rewriting the rest of its info, so it can be
+// done without holding the lock of the upload.
+type IOffsetUpdater interface {
+	// UpdateOffset sets the offset of the upload with id unless the stored
+	// offset is already larger.
+	UpdateOffset(ctx context.Context, id string, offset int64) error
+}
+
+// IPresignedUpload is implemented by uploads whose data can be sent by the
+// client directly to the storage backend using presigned URLs, so the server
+// only has to drive the protocol state.
+type IPresignedUpload interface {
+	// PresignNextPart returns a presigned URL the client can PUT the next
+	// part of the upload to.
+	PresignNextPart(ctx context.Context, expires time.Duration) (string, error)
+	// SyncPresignedParts updates the offset from the parts uploaded via
+	// presigned URLs and finishes the upload once all data has arrived.
+	SyncPresignedParts(ctx context.Context) (offset int64, err error)
+}
+
+// IPresignedDownload is implemented by uploads which can be downloaded
+// directly from the storage backend using presigned URLs.
+type IPresignedDownload interface {
+	// PresignDownload returns a presigned URL to GET the data of the upload.
+	PresignDownload(ctx context.Context, expires time.Duration) (string, error)
+}
+
+// ILengthDeclarableUpload is implemented by uploads whose size can be set
+// after they have been created with a deferred length. The store finishes
+// the upload on the next WriteChunk once all data has arrived, which may be
+// called without data if the declared length equals the current offset.
+type ILengthDeclarableUpload interface {
+	DeclareLength(ctx context.Context, length int64) error
+}
+
+// DeclareLength sets the size of an upload created with a deferred length,
+// wrapping stores use it to pass the declaration on to the inner upload.
+func DeclareLength(ctx context.Context, upload IUpload, length int64) error {
+	declarable, ok := upload.(ILengthDeclarableUpload)
+	if !ok {
+		return ErrLengthNotDeclarable
+	}
+	return declarable.DeclareLength(ctx, length)
+}
+
+type staleReadsKey struct{}
+
+// WithStaleReads returns a copy of ctx for requests which only read uploads,
+// e.g. HEAD and GET requests or listings. Metadata stores may answer them
+// from a read replica lagging behind the primary database, all other reads
+// go to the primary so they see the latest writes.
+func WithStaleReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, staleReadsKey{}, true)
+}
+
+// StaleReadsAllowed reports whether ctx was returned by WithStaleReads.
+func StaleReadsAllowed(ctx context.Context) bool {
+	allowed, _ := ctx.Value(staleReadsKey{}).(bool)
+	return allowed
+}
+
+type encryptionKeyKey struct{}
+
+// WithEncryptionKey returns a copy of ctx carrying the encryption key
+// provided by the client for an upload. Stores supporting client keys
+// encrypt new uploads with it and require it to access their data, the key
+// is never persisted.
+func WithEncryptionKey(ctx context.Context, key []byte) context.Context {
+	return context.WithValue(ctx, encryptionKeyKey{}, key)
+}
+
+// EncryptionKeyFromContext returns the key set by WithEncryptionKey.
+func EncryptionKeyFromContext(ctx context.Context) ([]byte, bool) {
+	key, ok := ctx.Value(encryptionKeyKey{}).([]byte)
+	return key, ok
+}
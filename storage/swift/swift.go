@@ -0,0 +1,453 @@
+package swift
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncw/swift/v2"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// SSwiftStore stores uploads in OpenStack Swift using Dynamic Large Objects.
+// Every tus chunk becomes a segment below "<id>.segments/" and the manifest
+// object "<id>" is written once the upload is complete.
+//
+// The upload info is kept in a "<id>.info" object, no database is required.
+type SSwiftStore struct {
+	Container string
+	// ObjectPrefix is prepended to every object name, e.g. "uploads/".
+	ObjectPrefix string
+
+	conn   *swift.Connection
+	locker locker.ILocker
+}
+
+// New creates a new store. The connection must already be authenticated.
+func New(container string, conn *swift.Connection, locker locker.ILocker) (*SSwiftStore, error) {
+	if container == "" {
+		return nil, fmt.Errorf("container is required")
+	}
+	return &SSwiftStore{
+		Container: container,
+		conn:      conn,
+		locker:    locker,
+	}, nil
+}
+
+func (store *SSwiftStore) binName(id string) string {
+	return path.Join(store.ObjectPrefix, id)
+}
+
+func (store *SSwiftStore) infoName(id string) string {
+	return path.Join(store.ObjectPrefix, id+".info")
+}
+
+func (store *SSwiftStore) segmentPrefix(id string) string {
+	return path.Join(store.ObjectPrefix, id+".segments") + "/"
+}
+
+// segmentName 段名补零, DLO按对象名字典序拼接
+func (store *SSwiftStore) segmentName(id string, index int) string {
+	return store.segmentPrefix(id) + fmt.Sprintf("%08d", index)
+}
+
+func (store *SSwiftStore) newLock(id string) (locker.ILock, error) {
+	return store.locker.NewLock("swift:" + store.Container + ":" + strings.ReplaceAll(store.binName(id), "/", ":"))
+}
+
+func (store *SSwiftStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.CreateTime.IsZero() {
+		info.CreateTime = time.Now()
+	}
+	info.Storage = map[string]string{
+		"Type":      "swift",
+		"Container": store.Container,
+		"Object":    store.binName(info.ID),
+	}
+
+	upload := &sSwiftUpload{
+		info:  info,
+		store: store,
+	}
+	binLock, err := store.newLock(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if err = upload.binLock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer upload.binLock.Unlock()
+
+	if err = upload.writeInfo(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SSwiftStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	upload := &sSwiftUpload{
+		info:  common.FileInfo{ID: id},
+		store: store,
+	}
+	binLock, err := store.newLock(id)
+	if err != nil {
+		return nil, err
+	}
+	upload.binLock = binLock
+
+	if _, err = upload.GetInfo(ctx); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (store *SSwiftStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	go func() {
+		// 定时清理
+		ticker := time.NewTicker(30 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				store.cleanup(ctx, expiredBefore)
+			}
+		}
+	}()
+}
+
+func (store *SSwiftStore) cleanup(ctx context.Context, expiredBefore time.Duration) {
+	lock, err := store.locker.NewLock("swift:" + store.Container + ":cleanup")
+	if err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	if err = lock.Lock(ctx); err != nil {
+		fmt.Printf("failed to get cleanup lock: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
+	objects, err := store.conn.ObjectsAll(ctx, store.Container, &swift.ObjectsOpts{Prefix: store.ObjectPrefix})
+	if err != nil {
+		fmt.Printf("failed to list expired uploads: %v\n", err)
+		return
+	}
+	expiredTime := time.Now().Add(-expiredBefore)
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Name, ".info") || object.LastModified.After(expiredTime) {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(object.Name, store.ObjectPrefix), "/"), ".info")
+		upload, err := store.GetUpload(ctx, id)
+		if err != nil {
+			fmt.Printf("failed to get expired upload: %v\n", err)
+			continue
+		}
+		if err = upload.Terminate(ctx); err != nil {
+			fmt.Printf("failed to remove expired upload: %v\n", err)
+		}
+	}
+}
+
+type sSwiftUpload struct {
+	binLock locker.ILock
+	info    common.FileInfo
+	store   *SSwiftStore
+}
+
+func (upload *sSwiftUpload) writeInfo(ctx context.Context) error {
+	data, err := json.Marshal(upload.info)
+	if err != nil {
+		return err
+	}
+	return upload.store.conn.ObjectPutBytes(ctx, upload.store.Container, upload.store.infoName(upload.info.ID), data, "application/json")
+}
+
+func (upload *sSwiftUpload) readInfo(ctx context.Context) error {
+	data, err := upload.store.conn.ObjectGetBytes(ctx, upload.store.Container, upload.store.infoName(upload.info.ID))
+	if err != nil {
+		if errors.Is(err, swift.ObjectNotFound) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	return json.Unmarshal(data, &upload.info)
+}
+
+// listSegments 按名称顺序返回所有段
+func (upload *sSwiftUpload) listSegments(ctx context.Context) ([]swift.Object, error) {
+	// Swift按名称排序返回, 段名已补零
+	return upload.store.conn.ObjectsAll(ctx, upload.store.Container, &swift.ObjectsOpts{
+		Prefix: upload.store.segmentPrefix(upload.info.ID),
+	})
+}
+
+func (upload *sSwiftUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	if err := upload.readInfo(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	segments, err := upload.listSegments(ctx)
+	if err != nil {
+		return common.FileInfo{}, err
+	}
+	var offset int64
+	for _, segment := range segments {
+		offset += segment.Bytes
+	}
+	upload.info.Offset = offset
+	return upload.info, nil
+}
+
+func (upload *sSwiftUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	file, _, err := upload.store.conn.ObjectOpen(ctx, upload.store.Container, upload.store.binName(upload.info.ID), false, nil)
+	if err != nil {
+		if errors.Is(err, swift.ObjectNotFound) {
+			return nil, fmt.Errorf("upload not found")
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func (upload *sSwiftUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer upload.binLock.Unlock()
+
+	segments, err := upload.listSegments(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// 偏移量以段为准, 清单已写入的上传不再追加段
+	var current int64
+	for _, segment := range segments {
+		current += segment.Bytes
+	}
+	if !upload.info.SizeIsDeferred && current >= upload.info.Size {
+		return 0, storage.ErrUploadCompleted
+	}
+
+	counter := &sCountingReader{Reader: src}
+	name := upload.store.segmentName(upload.info.ID, len(segments))
+	if _, err = upload.store.conn.ObjectPut(ctx, upload.store.Container, name, counter, false, "", "application/octet-stream", nil); err != nil {
+		return 0, fmt.Errorf("failed to write segment: %w", err)
+	}
+	if counter.n == 0 {
+		// 空段没有意义
+		_ = upload.store.conn.ObjectDelete(ctx, upload.store.Container, name)
+	}
+
+	upload.info.Offset = offset + counter.n
+	if !upload.info.SizeIsDeferred && upload.info.Offset >= upload.info.Size {
+		if err = upload.writeManifest(ctx); err != nil {
+			return counter.n, err
+		}
+	}
+	return counter.n, nil
+}
+
+// writeManifest 写入DLO清单对象, 读取时由Swift按序拼接所有段
+func (upload *sSwiftUpload) writeManifest(ctx context.Context) error {
+	contentType := "application/octet-stream"
+	if filetype, ok := upload.info.MetaData["filetype"]; ok {
+		contentType = filetype
+	}
+	_, err := upload.store.conn.ObjectPut(ctx, upload.store.Container, upload.store.binName(upload.info.ID), bytes.NewReader(nil), false, "", contentType, swift.Headers{
+		"X-Object-Manifest": upload.store.Container + "/" + upload.store.segmentPrefix(upload.info.ID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+func (upload *sSwiftUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	// DLO的段不能是DLO, 因此将各部分上传的段服务端复制为本上传的段
+	var (
+		index int
+		size  int64
+	)
+	for _, partialUpload := range uploads {
+		_partialUpload := partialUpload.(*sSwiftUpload)
+		segments, err := _partialUpload.listSegments(ctx)
+		if err != nil {
+			return err
+		}
+		for _, segment := range segments {
+			_, err = upload.store.conn.ObjectCopy(ctx, upload.store.Container, segment.Name, upload.store.Container, upload.store.segmentName(upload.info.ID, index), nil)
+			if err != nil {
+				return fmt.Errorf("failed to copy segment %s: %w", segment.Name, err)
+			}
+			index++
+			size += segment.Bytes
+		}
+	}
+
+	upload.info.Size = size
+	upload.info.Offset = size
+	if err := upload.writeManifest(ctx); err != nil {
+		return err
+	}
+	if err := upload.writeInfo(ctx); err != nil {
+		return err
+	}
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (upload *sSwiftUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	object, headers, err := upload.store.conn.Object(ctx, upload.store.Container, upload.store.binName(upload.info.ID))
+	if err != nil {
+		if errors.Is(err, swift.ObjectNotFound) {
+			return fmt.Errorf("upload not found")
+		}
+		return err
+	}
+	if etag := headers["Etag"]; etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	rs := &sRangeReadSeeker{ctx: ctx, store: upload.store, name: object.Name, size: object.Bytes}
+	defer rs.Close()
+	http.ServeContent(w, r, "", object.LastModified, rs)
+	return nil
+}
+
+// DeclareLength sets the size of an upload created with a deferred length.
+func (upload *sSwiftUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.readInfo(ctx); err != nil {
+		return err
+	}
+	if !upload.info.SizeIsDeferred {
+		return fmt.Errorf("upload length already declared")
+	}
+	upload.info.Size = length
+	upload.info.SizeIsDeferred = false
+	return upload.writeInfo(ctx)
+}
+
+func (upload *sSwiftUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	segments, err := upload.listSegments(ctx)
+	if err != nil {
+		return err
+	}
+	names := []string{upload.store.binName(upload.info.ID), upload.store.infoName(upload.info.ID)}
+	for _, segment := range segments {
+		names = append(names, segment.Name)
+	}
+	for _, name := range names {
+		if err = upload.store.conn.ObjectDelete(ctx, upload.store.Container, name); err != nil && !errors.Is(err, swift.ObjectNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sCountingReader 统计实际写入段的字节数
+type sCountingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *sCountingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// sRangeReadSeeker 基于range读取实现io.ReadSeeker, 供http.ServeContent使用
+type sRangeReadSeeker struct {
+	ctx    context.Context
+	store  *SSwiftStore
+	name   string
+	size   int64
+	pos    int64
+	reader io.ReadCloser
+}
+
+func (rs *sRangeReadSeeker) Read(p []byte) (int, error) {
+	if rs.pos >= rs.size {
+		return 0, io.EOF
+	}
+	if rs.reader == nil {
+		file, _, err := rs.store.conn.ObjectOpen(rs.ctx, rs.store.Container, rs.name, false, swift.Headers{
+			"Range": "bytes=" + strconv.FormatInt(rs.pos, 10) + "-",
+		})
+		if err != nil {
+			return 0, err
+		}
+		rs.reader = file
+	}
+	n, err := rs.reader.Read(p)
+	rs.pos += int64(n)
+	return n, err
+}
+
+func (rs *sRangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = rs.pos + offset
+	case io.SeekEnd:
+		pos = rs.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position: %d", pos)
+	}
+	if pos != rs.pos {
+		rs.Close()
+		rs.pos = pos
+	}
+	return pos, nil
+}
+
+func (rs *sRangeReadSeeker) Close() {
+	if rs.reader != nil {
+		_ = rs.reader.Close()
+		rs.reader = nil
+	}
+}
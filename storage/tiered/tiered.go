@@ -0,0 +1,387 @@
+package tiered
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/busybox-org/gin-fileuploader/common"
+	"github.com/busybox-org/gin-fileuploader/locker"
+	"github.com/busybox-org/gin-fileuploader/storage"
+)
+
+// STieredStore combines a fast hot storage (e.g. the local file store) with
+// a cheap cold storage (e.g. S3). Uploads are created and written in the hot
+// tier; once an upload is complete it is migrated to the cold tier in the
+// background and removed from the hot tier. Reads are served by whichever
+// tier currently holds the upload, the hot tier is looked up first.
+type STieredStore struct {
+	// MigrationConcurrency limits the number of concurrent migrations.
+	MigrationConcurrency int
+
+	hot       storage.IStorage
+	cold      storage.IStorage
+	locker    locker.ILocker
+	migrating sync.Map
+	semaphore chan struct{}
+	once      sync.Once
+}
+
+func New(hot, cold storage.IStorage, locker locker.ILocker) (*STieredStore, error) {
+	if hot == nil || cold == nil {
+		return nil, fmt.Errorf("hot and cold storage are required")
+	}
+	return &STieredStore{
+		MigrationConcurrency: 4,
+		hot:                  hot,
+		cold:                 cold,
+		locker:               locker,
+	}, nil
+}
+
+func (store *STieredStore) NewUpload(ctx context.Context, info common.FileInfo) (storage.IUpload, error) {
+	if info.ID == "" {
+		info.ID = common.Uid()
+	}
+	if info.IsFinal {
+		// 分片可能已迁移到冷存储, 合并时按原始数据写入, 需提前确定长度
+		info.Size = 0
+		for _, id := range info.PartialIDs {
+			partialUpload, err := store.GetUpload(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			partialInfo, err := partialUpload.GetInfo(ctx)
+			if err != nil {
+				return nil, err
+			}
+			info.Size += partialInfo.Size
+		}
+	}
+
+	upload, err := store.hot.NewUpload(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	tieredUpload, err := store.wrap(info.ID, upload, false)
+	if err != nil {
+		return nil, err
+	}
+	// 空文件创建后即已完成
+	if err = tieredUpload.migrateIfComplete(ctx); err != nil {
+		return nil, err
+	}
+	return tieredUpload, nil
+}
+
+func (store *STieredStore) GetUpload(ctx context.Context, id string) (storage.IUpload, error) {
+	upload, err := store.hot.GetUpload(ctx, id)
+	if err == nil {
+		tieredUpload, err := store.wrap(id, upload, false)
+		if err != nil {
+			return nil, err
+		}
+		// 重启前未完成的迁移在访问时继续
+		if err = tieredUpload.migrateIfComplete(ctx); err != nil {
+			return nil, err
+		}
+		return tieredUpload, nil
+	}
+	if !strings.Contains(err.Error(), "not found") {
+		return nil, err
+	}
+
+	upload, err = store.cold.GetUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return store.wrap(id, upload, true)
+}
+
+// ListUploads lists the uploads of both tiers, uploads being migrated are
+// listed once.
+func (store *STieredStore) ListUploads(ctx context.Context) ([]string, error) {
+	var uploadIDs []string
+	seen := make(map[string]bool)
+	for _, tier := range []storage.IStorage{store.hot, store.cold} {
+		ids, err := storage.ListUploads(ctx, tier)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				uploadIDs = append(uploadIDs, id)
+			}
+		}
+	}
+	return uploadIDs, nil
+}
+
+func (store *STieredStore) CanListUploads() bool {
+	return storage.CanListUploads(store.hot) && storage.CanListUploads(store.cold)
+}
+
+func (store *STieredStore) Cleanup(ctx context.Context, expiredBefore time.Duration) {
+	store.hot.Cleanup(ctx, expiredBefore)
+	store.cold.Cleanup(ctx, expiredBefore)
+}
+
+func (store *STieredStore) wrap(id string, upload storage.IUpload, cold bool) (*sTieredUpload, error) {
+	binLock, err := store.locker.NewLock("tiered:" + id)
+	if err != nil {
+		return nil, err
+	}
+	return &sTieredUpload{
+		IUpload: upload,
+		binLock: binLock,
+		id:      id,
+		cold:    cold,
+		store:   store,
+	}, nil
+}
+
+// scheduleMigration 在后台将已完成的上传迁移到冷存储, 同一上传只会迁移一次
+func (store *STieredStore) scheduleMigration(id string) {
+	if _, loaded := store.migrating.LoadOrStore(id, struct{}{}); loaded {
+		return
+	}
+	store.once.Do(func() {
+		store.semaphore = make(chan struct{}, max(store.MigrationConcurrency, 1))
+	})
+	go func() {
+		defer store.migrating.Delete(id)
+		store.semaphore <- struct{}{}
+		defer func() {
+			<-store.semaphore
+		}()
+		if err := store.migrate(context.Background(), id); err != nil {
+			fmt.Printf("failed to migrate upload %s to cold storage: %v\n", id, err)
+		}
+	}()
+}
+
+func (store *STieredStore) migrate(ctx context.Context, id string) error {
+	lock, err := store.locker.NewLock("tiered:" + id)
+	if err != nil {
+		return err
+	}
+	if err = lock.Lock(ctx); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	hotUpload, err := store.hot.GetUpload(ctx, id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			// 已被删除或已由其他实例迁移
+			return nil
+		}
+		return err
+	}
+	info, err := hotUpload.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	// 清理上次中断时留下的冷存储数据
+	if stale, err := store.cold.GetUpload(ctx, id); err == nil {
+		if err = stale.Terminate(ctx); err != nil {
+			return err
+		}
+	} else if !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+
+	coldInfo := info
+	coldInfo.Offset = 0
+	coldInfo.Storage = nil
+	coldUpload, err := store.cold.NewUpload(ctx, coldInfo)
+	if err != nil {
+		return err
+	}
+	reader, err := hotUpload.GetReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	n, err := coldUpload.WriteChunk(ctx, 0, reader)
+	if err != nil && !errors.Is(err, storage.ErrUploadCompleted) {
+		return err
+	}
+	if n != info.Size {
+		return fmt.Errorf("migrated %d of %d bytes", n, info.Size)
+	}
+	return hotUpload.Terminate(ctx)
+}
+
+type sTieredUpload struct {
+	storage.IUpload
+	binLock locker.ILock
+	id      string
+	cold    bool
+	store   *STieredStore
+}
+
+func (upload *sTieredUpload) migrateIfComplete(ctx context.Context) error {
+	if upload.cold {
+		return nil
+	}
+	info, err := upload.IUpload.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if !info.SizeIsDeferred && info.Offset >= info.Size {
+		upload.store.scheduleMigration(upload.id)
+	}
+	return nil
+}
+
+// resolve 上传可能已在后台迁移到冷存储, 读取前重新确认所在的层
+func (upload *sTieredUpload) resolve(ctx context.Context) error {
+	if upload.cold {
+		return nil
+	}
+	_, err := upload.store.hot.GetUpload(ctx, upload.id)
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	coldUpload, err := upload.store.cold.GetUpload(ctx, upload.id)
+	if err != nil {
+		return err
+	}
+	upload.IUpload = coldUpload
+	upload.cold = true
+	return nil
+}
+
+func (upload *sTieredUpload) GetInfo(ctx context.Context) (common.FileInfo, error) {
+	if err := upload.resolve(ctx); err != nil {
+		return common.FileInfo{}, err
+	}
+	return upload.IUpload.GetInfo(ctx)
+}
+
+func (upload *sTieredUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	if err := upload.resolve(ctx); err != nil {
+		return nil, err
+	}
+	return upload.IUpload.GetReader(ctx)
+}
+
+func (upload *sTieredUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if err := upload.resolve(ctx); err != nil {
+		return err
+	}
+	return upload.IUpload.ServeContent(ctx, w, r)
+}
+
+func (upload *sTieredUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return 0, err
+	}
+	n, err := upload.IUpload.WriteChunk(ctx, offset, src)
+	upload.binLock.Unlock()
+	if err != nil {
+		return n, err
+	}
+	return n, upload.migrateIfComplete(ctx)
+}
+
+func (upload *sTieredUpload) ConcatUploads(ctx context.Context, uploads []storage.IUpload) error {
+	partialUploads := make([]storage.IUpload, 0, len(uploads))
+	for _, partialUpload := range uploads {
+		tieredUpload := partialUpload.(*sTieredUpload)
+		if tieredUpload.cold {
+			partialUploads = nil
+			break
+		}
+		partialUploads = append(partialUploads, tieredUpload.IUpload)
+	}
+
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	var err error
+	if partialUploads != nil {
+		err = upload.IUpload.ConcatUploads(ctx, partialUploads)
+	} else {
+		// 部分分片已在冷存储中, 只能读取后写入
+		err = upload.concatFromReaders(ctx, uploads)
+	}
+	upload.binLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return upload.migrateIfComplete(ctx)
+}
+
+func (upload *sTieredUpload) concatFromReaders(ctx context.Context, uploads []storage.IUpload) error {
+	var readers []io.Reader
+	for _, partialUpload := range uploads {
+		reader, err := partialUpload.GetReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = reader.Close()
+		}()
+		readers = append(readers, reader)
+	}
+	if _, err := upload.IUpload.WriteChunk(ctx, 0, io.MultiReader(readers...)); err != nil && !errors.Is(err, storage.ErrUploadCompleted) {
+		return err
+	}
+
+	for _, partialUpload := range uploads {
+		if err := partialUpload.Terminate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeclareLength declares the length on the hot tier, the upload is migrated
+// by the WriteChunk completing it.
+func (upload *sTieredUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := upload.resolve(ctx); err != nil {
+		return err
+	}
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+	return storage.DeclareLength(ctx, upload.IUpload, length)
+}
+
+func (upload *sTieredUpload) Terminate(ctx context.Context) error {
+	if err := upload.binLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer upload.binLock.Unlock()
+
+	if err := upload.resolve(ctx); err != nil {
+		return err
+	}
+	if err := upload.IUpload.Terminate(ctx); err != nil {
+		return err
+	}
+	if upload.cold {
+		return nil
+	}
+	// 迁移可能已写入部分冷存储数据
+	coldUpload, err := upload.store.cold.GetUpload(ctx, upload.id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil
+		}
+		return err
+	}
+	return coldUpload.Terminate(ctx)
+}